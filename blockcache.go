@@ -0,0 +1,90 @@
+package brimcrypt
+
+import "container/list"
+
+// blockCache is a least recently used cache of decrypted blocks keyed by
+// block number, bounded by a count of blocks, a count of bytes, or both.
+type blockCache struct {
+	maxBlocks int
+	maxBytes  int64
+	bytes     int64
+	lru       *list.List
+	entries   map[int64]*list.Element
+	hits      int64
+	misses    int64
+}
+
+type blockCacheEntry struct {
+	blockNumber int64
+	plain       []byte
+}
+
+// newBlockCache returns a blockCache holding at most maxBlocks blocks and
+// maxBytes bytes of plaintext; 0 means no limit for that measure. If both are
+// 0, nil is returned and no caching is done.
+func newBlockCache(maxBlocks int, maxBytes int64) *blockCache {
+	if maxBlocks <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	return &blockCache{
+		maxBlocks: maxBlocks,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		entries:   map[int64]*list.Element{},
+	}
+}
+
+// get returns a copy of the cached plaintext for the block, or nil if it isn't
+// cached.
+func (c *blockCache) get(blockNumber int64) []byte {
+	e := c.entries[blockNumber]
+	if e == nil {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return append([]byte(nil), e.Value.(*blockCacheEntry).plain...)
+}
+
+// put stores a copy of the plaintext for the block, replacing any existing
+// entry and evicting the least recently used entries to stay within bounds.
+func (c *blockCache) put(blockNumber int64, plain []byte) {
+	if c.maxBytes > 0 && int64(len(plain)) > c.maxBytes {
+		c.remove(blockNumber)
+		return
+	}
+	if e := c.entries[blockNumber]; e != nil {
+		entry := e.Value.(*blockCacheEntry)
+		c.bytes += int64(len(plain) - len(entry.plain))
+		entry.plain = append(entry.plain[:0], plain...)
+		c.lru.MoveToFront(e)
+	} else {
+		c.entries[blockNumber] = c.lru.PushFront(&blockCacheEntry{
+			blockNumber: blockNumber,
+			plain:       append([]byte(nil), plain...),
+		})
+		c.bytes += int64(len(plain))
+	}
+	for (c.maxBlocks > 0 && c.lru.Len() > c.maxBlocks) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back().Value.(*blockCacheEntry).blockNumber)
+	}
+}
+
+func (c *blockCache) remove(blockNumber int64) {
+	e := c.entries[blockNumber]
+	if e == nil {
+		return
+	}
+	c.bytes -= int64(len(e.Value.(*blockCacheEntry).plain))
+	c.lru.Remove(e)
+	delete(c.entries, blockNumber)
+}
+
+// clear drops every entry, such as when the underlying file is closed and
+// could change before it is next opened.
+func (c *blockCache) clear() {
+	c.lru.Init()
+	c.entries = map[int64]*list.Element{}
+	c.bytes = 0
+}
@@ -0,0 +1,62 @@
+package brimcrypt
+
+import "testing"
+
+func TestBlockCacheBlocks(t *testing.T) {
+	if newBlockCache(0, 0) != nil {
+		t.Fatal("expected no cache without limits")
+	}
+	c := newBlockCache(2, 0)
+	c.put(1, []byte("one"))
+	c.put(2, []byte("two"))
+	if string(c.get(1)) != "one" {
+		t.Fatal("expected block 1")
+	}
+	c.put(3, []byte("three"))
+	if c.get(2) != nil {
+		t.Error("expected block 2 to be evicted as least recently used")
+	}
+	if string(c.get(1)) != "one" || string(c.get(3)) != "three" {
+		t.Error("expected blocks 1 and 3")
+	}
+	c.put(1, []byte("uno"))
+	if string(c.get(1)) != "uno" {
+		t.Error("expected block 1 to be updated")
+	}
+	plain := c.get(1)
+	plain[0] = 'X'
+	if string(c.get(1)) != "uno" {
+		t.Error("get should return a copy")
+	}
+	if c.hits != 6 || c.misses != 1 {
+		t.Errorf("hits %d misses %d", c.hits, c.misses)
+	}
+	c.clear()
+	if c.get(1) != nil || c.bytes != 0 {
+		t.Error("expected clear to drop everything")
+	}
+}
+
+func TestBlockCacheBytes(t *testing.T) {
+	c := newBlockCache(0, 10)
+	c.put(1, []byte("1234"))
+	c.put(2, []byte("5678"))
+	c.put(3, []byte("90"))
+	if c.bytes != 10 || c.lru.Len() != 3 {
+		t.Fatalf("bytes %d len %d", c.bytes, c.lru.Len())
+	}
+	c.put(4, []byte("abcd"))
+	if c.get(1) != nil {
+		t.Error("expected block 1 to be evicted")
+	}
+	if c.bytes != 10 {
+		t.Errorf("bytes %d != 10", c.bytes)
+	}
+	c.put(5, []byte("this is too big"))
+	if c.get(5) != nil {
+		t.Error("expected oversized block to not be cached")
+	}
+	if c.bytes != 10 {
+		t.Errorf("bytes %d != 10", c.bytes)
+	}
+}
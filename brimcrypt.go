@@ -1,40 +1,221 @@
 // Package brimcrypt contains crypto-related code including an encrypted disk
 // file implementation of io.Reader, Writer, Seeker, and Closer. The encryption
-// used is AES-256 with each block signed using SHA-256.
+// used is AES-256 with each block signed using SHA-256, or optionally SHA-512,
+// AES-256 in CTR mode, ChaCha20-Poly1305, or AES-256-GCM-SIV.
 package brimcrypt
 
 import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite identifies how each block of a CryptFile is encrypted and
+// authenticated. The suite is chosen when a file is created and recorded in
+// its header.
+type CipherSuite byte
+
+const (
+	// AES256CBCHMACSHA256 encrypts each block with AES-256 in CBC mode and
+	// signs it with HMAC SHA-256. This is the default suite.
+	AES256CBCHMACSHA256 CipherSuite = 0
+	// ChaCha20Poly1305 encrypts and authenticates each block with
+	// ChaCha20-Poly1305, which is usually faster than AES on platforms without
+	// AES hardware acceleration.
+	ChaCha20Poly1305 CipherSuite = 1
+	// AES256CBCHMACSHA512 is the same as AES256CBCHMACSHA256 but signs each
+	// block with HMAC SHA-512, for a larger security margin at the cost of
+	// 32 more bytes per block.
+	AES256CBCHMACSHA512 CipherSuite = 2
+	// AES256CTRHMACSHA256 encrypts each block with AES-256 in CTR mode,
+	// starting from a random counter stored with the block, and signs it
+	// with HMAC SHA-256. Any part of a block can be decrypted on its own, so
+	// once a block has authenticated, ReadAt only decrypts the bytes asked
+	// for rather than the whole block.
+	AES256CTRHMACSHA256 CipherSuite = 3
+	// AES256GCMSIV encrypts and authenticates each block with
+	// AES-256-GCM-SIV, from RFC 8452, which stays safe if a nonce is ever
+	// repeated, such as from a faulty Rand: a repeat only gives away whether
+	// the two blocks were the same. It's for deployments that can't be sure
+	// of their random numbers, and is slower than the other suites, as
+	// POLYVAL is done without hardware support.
+	AES256GCMSIV CipherSuite = 4
 )
 
-func decrypt0(block []byte, key []byte) ([]byte, error) {
-	if len(block)%aes.BlockSize != 0 {
+func (s CipherSuite) valid() bool {
+	return s == AES256CBCHMACSHA256 || s == ChaCha20Poly1305 || s == AES256CBCHMACSHA512 || s == AES256CTRHMACSHA256 || s == AES256GCMSIV
+}
+
+// overhead returns the number of bytes each encrypted block uses beyond its
+// plaintext.
+func (s CipherSuite) overhead() int64 {
+	if s == ChaCha20Poly1305 {
+		return chacha20poly1305.Overhead + chacha20poly1305.NonceSize
+	}
+	if s == AES256CBCHMACSHA512 {
+		return hmac512Size + aes.BlockSize
+	}
+	if s == AES256GCMSIV {
+		return sivTagSize + sivNonceSize
+	}
+	return hmacSize + aes.BlockSize
+}
+
+// encrypt returns the encrypted block for the plaintext. The additional data,
+// ad, which may be nil, is authenticated along with the block but not stored;
+// the same ad must be given to decrypt.
+func (s CipherSuite) encrypt(plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	return s.encryptTo(nil, rand.Reader, plainBlock, key, ad)
+}
+
+// encryptTo is encrypt but uses dst for the encrypted block if its capacity
+// is at least len(plainBlock) + 2*overhead, rather than allocating one, and
+// reads the IV or nonce from rnd rather than crypto/rand.
+func (s CipherSuite) encryptTo(dst []byte, rnd io.Reader, plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	if s == ChaCha20Poly1305 {
+		return encryptChaCha(dst, rnd, plainBlock, key, ad)
+	}
+	if s == AES256CBCHMACSHA512 {
+		return encryptCBC(sha512.New, hmac512Size, dst, rnd, plainBlock, key, ad)
+	}
+	if s == AES256CTRHMACSHA256 {
+		return encryptCTR(dst, rnd, plainBlock, key, ad)
+	}
+	if s == AES256GCMSIV {
+		return encryptSIV(dst, rnd, plainBlock, key, ad)
+	}
+	return encryptCBC(sha256.New, hmacSize, dst, rnd, plainBlock, key, ad)
+}
+
+func (s CipherSuite) decrypt(block []byte, key []byte, ad []byte) ([]byte, error) {
+	return s.decryptTo(nil, block, key, ad)
+}
+
+// decryptTo is decrypt but puts the plaintext in dst, if its capacity is at
+// least len(block), and leaves block as it is so callers can keep the
+// ciphertext; with a nil dst a new plaintext slice is allocated.
+func (s CipherSuite) decryptTo(dst []byte, block []byte, key []byte, ad []byte) ([]byte, error) {
+	if s == ChaCha20Poly1305 {
+		return decryptChaCha(dst, block, key, ad)
+	}
+	if s == AES256CBCHMACSHA512 {
+		return decryptCBC(sha512.New, hmac512Size, dst, block, key, ad)
+	}
+	if s == AES256CTRHMACSHA256 {
+		return decryptCTR(dst, block, key, ad, 0, len(block)-hmacSize-aes.BlockSize)
+	}
+	if s == AES256GCMSIV {
+		return decryptSIV(dst, block, key, ad)
+	}
+	return decryptCBC(sha256.New, hmacSize, dst, block, key, ad)
+}
+
+// decryptRangeTo is decryptTo but, for suites that can, only decrypts the
+// plaintext from start to end once the whole block has authenticated; the rest
+// of the plaintext returned is left as it was in dst. Other suites decrypt the
+// whole block.
+func (s CipherSuite) decryptRangeTo(dst []byte, block []byte, key []byte, ad []byte, start int, end int) ([]byte, error) {
+	if s == AES256CTRHMACSHA256 {
+		return decryptCTR(dst, block, key, ad, start, end)
+	}
+	return s.decryptTo(dst, block, key, ad)
+}
+
+// sized returns b resliced to length n if it has the capacity, or a new slice
+// otherwise.
+func sized(b []byte, n int) []byte {
+	if cap(b) >= n {
+		return b[:n]
+	}
+	return make([]byte, n)
+}
+
+// verify returns KeyError if the block does not authenticate with the key.
+// For the AES suites this only checks the HMAC, without decrypting.
+func (s CipherSuite) verify(block []byte, key []byte, ad []byte) error {
+	if s == ChaCha20Poly1305 {
+		_, err := decrypt1(block, key, ad)
+		return err
+	}
+	if s == AES256GCMSIV {
+		_, err := decrypt4(block, key, ad)
+		return err
+	}
+	newHash, macSize := sha256.New, hmacSize
+	if s == AES256CBCHMACSHA512 {
+		newHash, macSize = sha512.New, hmac512Size
+	}
+	if s == AES256CTRHMACSHA256 {
+		// CTR blocks needn't be a multiple of the AES block size.
+		ad = ctrAD(ad)
+	} else if len(block)%aes.BlockSize != 0 {
+		return fmt.Errorf("block must be multiple of AES block size %d", aes.BlockSize)
+	}
+	if len(block) < macSize {
+		return fmt.Errorf("block must be at least %d bytes", macSize)
+	}
+	if !validateHMACHash(newHash, block[macSize:], block[:macSize], key, ad) {
+		return KeyError
+	}
+	return nil
+}
+
+func decrypt0(block []byte, key []byte, ad []byte) ([]byte, error) {
+	return decryptCBC(sha256.New, hmacSize, nil, block, key, ad)
+}
+
+func encrypt0(plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	return encryptCBC(sha256.New, hmacSize, nil, rand.Reader, plainBlock, key, ad)
+}
+
+// decrypt2 is the HMAC SHA-512 counterpart of decrypt0.
+func decrypt2(block []byte, key []byte, ad []byte) ([]byte, error) {
+	return decryptCBC(sha512.New, hmac512Size, nil, block, key, ad)
+}
+
+// encrypt2 is the HMAC SHA-512 counterpart of encrypt0.
+func encrypt2(plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	return encryptCBC(sha512.New, hmac512Size, nil, rand.Reader, plainBlock, key, ad)
+}
+
+// decryptCBC decrypts a block laid out as the HMAC of size macSize, then the
+// AES IV, then the AES-256 CBC ciphertext, into dst as with
+// CipherSuite.decryptTo.
+func decryptCBC(newHash func() hash.Hash, macSize int, dst []byte, block []byte, key []byte, ad []byte) ([]byte, error) {
+	if len(block)%aes.BlockSize != 0 || len(block) < macSize+aes.BlockSize {
 		return nil, fmt.Errorf("block must be multiple of AES block size %d", aes.BlockSize)
 	}
-	if !validateHMAC(block[hmacSize:], block[:hmacSize], key) {
+	if !validateHMACHash(newHash, block[macSize:], block[:macSize], key, ad) {
 		return nil, KeyError
 	}
-	iv := block[hmacSize : hmacSize+aes.BlockSize]
-	block = block[hmacSize+aes.BlockSize:]
+	iv := block[macSize : macSize+aes.BlockSize]
+	block = block[macSize+aes.BlockSize:]
 	ciph, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	plainBlock := sized(dst, len(block))
 	mode := cipher.NewCBCDecrypter(ciph, iv)
-	mode.CryptBlocks(block, block)
-	return block, nil
+	mode.CryptBlocks(plainBlock, block)
+	return plainBlock, nil
 }
 
-func encrypt0(plainBlock []byte, key []byte) ([]byte, error) {
+// encryptCBC is the counterpart of decryptCBC, using dst as with
+// CipherSuite.encryptTo.
+func encryptCBC(newHash func() hash.Hash, macSize int, dst []byte, rnd io.Reader, plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
 	if len(plainBlock)%aes.BlockSize != 0 {
 		return nil, fmt.Errorf("plainBlock must be multiple of AES block size %d", aes.BlockSize)
 	}
-	block := make([]byte, hmacSize+aes.BlockSize+len(plainBlock))
-	iv := block[hmacSize : hmacSize+aes.BlockSize]
-	_, err := rand.Read(iv)
+	block := sized(dst, macSize+aes.BlockSize+len(plainBlock))
+	iv := block[macSize : macSize+aes.BlockSize]
+	_, err := io.ReadFull(rnd, iv)
 	if err != nil {
 		return nil, err
 	}
@@ -43,7 +224,131 @@ func encrypt0(plainBlock []byte, key []byte) ([]byte, error) {
 		return nil, err
 	}
 	mode := cipher.NewCBCEncrypter(ciph, iv)
-	mode.CryptBlocks(block[hmacSize+aes.BlockSize:], plainBlock)
-	copy(block[:hmacSize], newHMAC(block[hmacSize:], key))
+	mode.CryptBlocks(block[macSize+aes.BlockSize:], plainBlock)
+	copy(block[:macSize], newHMACHash(newHash, block[macSize:], key, ad))
 	return block, err
 }
+
+// decrypt3 is the AES-256 CTR counterpart of decrypt0.
+func decrypt3(block []byte, key []byte, ad []byte) ([]byte, error) {
+	return decryptCTR(nil, block, key, ad, 0, len(block)-hmacSize-aes.BlockSize)
+}
+
+// encrypt3 is the AES-256 CTR counterpart of encrypt0.
+func encrypt3(plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	return encryptCTR(nil, rand.Reader, plainBlock, key, ad)
+}
+
+// decryptCTR decrypts the plaintext from start to end of a block laid out as
+// the HMAC SHA-256, then the initial AES counter, then the AES-256 CTR
+// ciphertext, into dst as with CipherSuite.decryptRangeTo.
+func decryptCTR(dst []byte, block []byte, key []byte, ad []byte, start int, end int) ([]byte, error) {
+	if len(block) < hmacSize+aes.BlockSize {
+		return nil, fmt.Errorf("block must be at least %d bytes", hmacSize+aes.BlockSize)
+	}
+	if start < 0 || end < start || end > len(block)-hmacSize-aes.BlockSize {
+		return nil, fmt.Errorf("range %d to %d out of bounds", start, end)
+	}
+	if !validateHMACHash(sha256.New, block[hmacSize:], block[:hmacSize], key, ctrAD(ad)) {
+		return nil, KeyError
+	}
+	ciph, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := block[hmacSize+aes.BlockSize:]
+	plainBlock := sized(dst, len(ciphertext))
+	// The counter is moved on to the AES block start falls in.
+	start -= start % aes.BlockSize
+	counter := addCounter(block[hmacSize:hmacSize+aes.BlockSize], uint64(start/aes.BlockSize))
+	cipher.NewCTR(ciph, counter).XORKeyStream(plainBlock[start:end], ciphertext[start:end])
+	return plainBlock, nil
+}
+
+// encryptCTR is the counterpart of decryptCTR, using dst as with
+// CipherSuite.encryptTo.
+func encryptCTR(dst []byte, rnd io.Reader, plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	block := sized(dst, hmacSize+aes.BlockSize+len(plainBlock))
+	counter := block[hmacSize : hmacSize+aes.BlockSize]
+	if _, err := io.ReadFull(rnd, counter); err != nil {
+		return nil, err
+	}
+	ciph, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(ciph, counter).XORKeyStream(block[hmacSize+aes.BlockSize:], plainBlock)
+	copy(block[:hmacSize], newHMACHash(sha256.New, block[hmacSize:], key, ctrAD(ad)))
+	return block, nil
+}
+
+// ctrAD returns the additional data ad as signed for AES256CTRHMACSHA256,
+// which is marked so a block can't pass as an AES256CBCHMACSHA256 one, whose
+// layout is the same.
+func ctrAD(ad []byte) []byte {
+	return append([]byte("CTR "), ad...)
+}
+
+// addCounter returns a copy of the big-endian 128 bit counter plus n.
+func addCounter(counter []byte, n uint64) []byte {
+	sum := append([]byte(nil), counter...)
+	for i := len(sum) - 1; i >= 0 && n > 0; i-- {
+		n += uint64(sum[i])
+		sum[i] = byte(n)
+		n >>= 8
+	}
+	return sum
+}
+
+// decrypt1 is the ChaCha20-Poly1305 counterpart of decrypt0. The block is laid
+// out as the Poly1305 tag, then the nonce, then the ciphertext.
+func decrypt1(block []byte, key []byte, ad []byte) ([]byte, error) {
+	return decryptChaCha(nil, block, key, ad)
+}
+
+// encrypt1 is the ChaCha20-Poly1305 counterpart of encrypt0.
+func encrypt1(plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	return encryptChaCha(nil, rand.Reader, plainBlock, key, ad)
+}
+
+// decryptChaCha is decrypt1 into dst as with CipherSuite.decryptTo; block is
+// never modified.
+func decryptChaCha(dst []byte, block []byte, key []byte, ad []byte) ([]byte, error) {
+	if len(block) < chacha20poly1305.Overhead+chacha20poly1305.NonceSize {
+		return nil, fmt.Errorf("block must be at least %d bytes", chacha20poly1305.Overhead+chacha20poly1305.NonceSize)
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	tag := block[:chacha20poly1305.Overhead]
+	nonce := block[chacha20poly1305.Overhead : chacha20poly1305.Overhead+chacha20poly1305.NonceSize]
+	ciphertext := block[chacha20poly1305.Overhead+chacha20poly1305.NonceSize:]
+	sealed := sized(dst, len(ciphertext)+len(tag))
+	copy(sealed, ciphertext)
+	copy(sealed[len(ciphertext):], tag)
+	plainBlock, err := aead.Open(sealed[:0], nonce, sealed, ad)
+	if err != nil {
+		return nil, KeyError
+	}
+	return plainBlock, nil
+}
+
+// encryptChaCha is encrypt1 using dst as with CipherSuite.encryptTo. The
+// ciphertext is sealed in place after the nonce, with the tag landing past the
+// end of the block, and the tag is then moved to the front.
+func encryptChaCha(dst []byte, rnd io.Reader, plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	const start = chacha20poly1305.Overhead + chacha20poly1305.NonceSize
+	block := sized(dst, start+len(plainBlock)+chacha20poly1305.Overhead)
+	nonce := block[chacha20poly1305.Overhead:start]
+	if _, err = io.ReadFull(rnd, nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(block[start:start], nonce, plainBlock, ad)
+	copy(block[:chacha20poly1305.Overhead], sealed[len(plainBlock):])
+	return block[:start+len(plainBlock)], nil
+}
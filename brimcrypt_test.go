@@ -1,6 +1,12 @@
 package brimcrypt
 
-import "testing"
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+)
 
 func TestCrypt0(t *testing.T) {
 	plain := []byte("Test Message 123")
@@ -8,23 +14,30 @@ func TestCrypt0(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	enc, err := encrypt0(plain, key)
+	enc, err := encrypt0(plain, key, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	dec, err := decrypt0(enc, key)
+	dec, err := decrypt0(enc, key, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if string(dec) != string(plain) {
 		t.Errorf("decryption failed")
 	}
+	dec, err = decrypt0(enc, key, nil)
+	if err != nil {
+		t.Fatalf("decrypting the same block again: %s", err)
+	}
+	if string(dec) != string(plain) {
+		t.Errorf("second decryption failed")
+	}
 
 	key, err = Key("Test Phrase Two", "", "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	dec, err = decrypt0(enc, key)
+	dec, err = decrypt0(enc, key, nil)
 	if err == nil {
 		t.Errorf("expected err when using wrong key")
 	}
@@ -33,14 +46,384 @@ func TestCrypt0(t *testing.T) {
 	}
 
 	plain = []byte("Test Message Not Aligned")
-	enc, err = encrypt0(plain, key)
+	enc, err = encrypt0(plain, key, nil)
 	if err == nil {
 		t.Errorf("expected err with misaligned plainBlock")
 	}
 
 	enc = []byte("Test Message Not Aligned")
-	dec, err = decrypt0(enc, key)
+	dec, err = decrypt0(enc, key, nil)
 	if err == nil {
 		t.Errorf("expected err with misaligned block")
 	}
 }
+
+func TestCrypt1(t *testing.T) {
+	plain := []byte("Test Message 123 Not Aligned")
+	key, err := Key("Test Phrase", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encrypt1(plain, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(enc)) != int64(len(plain))+ChaCha20Poly1305.overhead() {
+		t.Errorf("encrypted length %d != %d", len(enc), int64(len(plain))+ChaCha20Poly1305.overhead())
+	}
+	dec, err := decrypt1(enc, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != string(plain) {
+		t.Errorf("decryption failed")
+	}
+
+	enc[len(enc)-1] ^= 1
+	dec, err = decrypt1(enc, key, nil)
+	if err != KeyError {
+		t.Errorf("expected KeyError with tampered block; got %v", err)
+	}
+	enc[len(enc)-1] ^= 1
+
+	key, err = Key("Test Phrase Two", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err = decrypt1(enc, key, nil)
+	if err != KeyError {
+		t.Errorf("expected KeyError when using wrong key; got %v", err)
+	}
+
+	dec, err = decrypt1([]byte("short"), key, nil)
+	if err == nil {
+		t.Errorf("expected err with short block")
+	}
+}
+
+func benchmarkEncrypt(b *testing.B, suite CipherSuite) {
+	plain := make([]byte, 65536-suite.overhead())
+	key := []byte("0123456789abcdef0123456789abcdef")
+	b.SetBytes(int64(len(plain)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := suite.encrypt(plain, key, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecrypt(b *testing.B, suite CipherSuite) {
+	plain := make([]byte, 65536-suite.overhead())
+	key := []byte("0123456789abcdef0123456789abcdef")
+	enc, err := suite.encrypt(plain, key, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	block := make([]byte, len(enc))
+	b.SetBytes(int64(len(plain)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(block, enc)
+		if _, err := suite.decrypt(block, key, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncrypt0(b *testing.B) {
+	benchmarkEncrypt(b, AES256CBCHMACSHA256)
+}
+
+func BenchmarkEncrypt1(b *testing.B) {
+	benchmarkEncrypt(b, ChaCha20Poly1305)
+}
+
+func BenchmarkDecrypt0(b *testing.B) {
+	benchmarkDecrypt(b, AES256CBCHMACSHA256)
+}
+
+func BenchmarkDecrypt1(b *testing.B) {
+	benchmarkDecrypt(b, ChaCha20Poly1305)
+}
+
+func BenchmarkDecrypt3(b *testing.B) {
+	benchmarkDecrypt(b, AES256CTRHMACSHA256)
+}
+
+func BenchmarkEncrypt4(b *testing.B) {
+	benchmarkEncrypt(b, AES256GCMSIV)
+}
+
+func BenchmarkDecrypt4(b *testing.B) {
+	benchmarkDecrypt(b, AES256GCMSIV)
+}
+
+func TestCrypt2(t *testing.T) {
+	plain := []byte("Test Message 123")
+	key, err := Key("Test Phrase", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encrypt2(plain, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(enc)) != int64(len(plain))+AES256CBCHMACSHA512.overhead() {
+		t.Errorf("encrypted length %d != %d", len(enc), int64(len(plain))+AES256CBCHMACSHA512.overhead())
+	}
+	dec, err := decrypt2(enc, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != string(plain) {
+		t.Errorf("decryption failed")
+	}
+	enc, err = encrypt2(plain, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decrypt0(enc, key, nil); err != KeyError {
+		t.Errorf("expected KeyError decrypting as HMAC SHA-256; got %v", err)
+	}
+	enc[len(enc)-1] ^= 1
+	if _, err = decrypt2(enc, key, nil); err != KeyError {
+		t.Errorf("expected KeyError with altered block; got %v", err)
+	}
+}
+
+func TestCrypt3(t *testing.T) {
+	plain := []byte("Test Message 123 Not Aligned")
+	key, err := Key("Test Phrase", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encrypt3(plain, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(enc)) != int64(len(plain))+AES256CTRHMACSHA256.overhead() {
+		t.Errorf("encrypted length %d != %d", len(enc), int64(len(plain))+AES256CTRHMACSHA256.overhead())
+	}
+	dec, err := decrypt3(enc, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != string(plain) {
+		t.Errorf("decryption failed")
+	}
+	dec, err = decryptCTR(nil, enc, key, nil, 18, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec[18:25]) != string(plain[18:25]) {
+		t.Errorf("range decryption failed")
+	}
+	if _, err = decryptCTR(nil, enc, key, nil, 20, 100); err == nil {
+		t.Errorf("expected err with range past the end")
+	}
+	// The counter carries into the bytes before it.
+	if c := addCounter([]byte{0, 1, 0xff, 0xff}, 2); string(c) != string([]byte{0, 2, 0, 1}) {
+		t.Errorf("addCounter gave %v", c)
+	}
+	enc[len(enc)-1] ^= 1
+	if _, err = decrypt3(enc, key, nil); err != KeyError {
+		t.Errorf("expected KeyError with tampered block; got %v", err)
+	}
+	if err = AES256CTRHMACSHA256.verify(enc, key, nil); err != KeyError {
+		t.Errorf("expected KeyError verifying tampered block; got %v", err)
+	}
+	enc[len(enc)-1] ^= 1
+	if err = AES256CTRHMACSHA256.verify(enc, key, nil); err != nil {
+		t.Errorf("expected block to verify; got %v", err)
+	}
+	// The layout is the same as AES256CBCHMACSHA256 but a block can't pass
+	// for one.
+	enc, err = encrypt3([]byte("Test Message 123"), key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decrypt0(enc, key, nil); err != KeyError {
+		t.Errorf("expected KeyError decrypting as CBC; got %v", err)
+	}
+	key, err = Key("Test Phrase Two", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decrypt3(enc, key, nil); err != KeyError {
+		t.Errorf("expected KeyError when using wrong key; got %v", err)
+	}
+	if _, err = decrypt3([]byte("short"), key, nil); err == nil {
+		t.Errorf("expected err with short block")
+	}
+}
+
+func TestCrypt4(t *testing.T) {
+	plain := []byte("Test Message 123 Not Aligned")
+	key, err := Key("Test Phrase", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encrypt4(plain, key, []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(enc)) != int64(len(plain))+AES256GCMSIV.overhead() {
+		t.Errorf("encrypted length %d != %d", len(enc), int64(len(plain))+AES256GCMSIV.overhead())
+	}
+	dec, err := decrypt4(enc, key, []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != string(plain) {
+		t.Errorf("decryption failed")
+	}
+	if _, err = decrypt4(enc, key, []byte("AD")); err != KeyError {
+		t.Errorf("expected KeyError with different ad; got %v", err)
+	}
+	enc[len(enc)-1] ^= 1
+	if _, err = decrypt4(enc, key, []byte("ad")); err != KeyError {
+		t.Errorf("expected KeyError with tampered block; got %v", err)
+	}
+	if err = AES256GCMSIV.verify(enc, key, []byte("ad")); err != KeyError {
+		t.Errorf("expected KeyError verifying tampered block; got %v", err)
+	}
+	enc[len(enc)-1] ^= 1
+	if err = AES256GCMSIV.verify(enc, key, []byte("ad")); err != nil {
+		t.Errorf("expected block to verify; got %v", err)
+	}
+	key2, err := Key("Test Phrase Two", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decrypt4(enc, key2, []byte("ad")); err != KeyError {
+		t.Errorf("expected KeyError when using wrong key; got %v", err)
+	}
+	if _, err = decrypt4([]byte("short"), key, nil); err == nil {
+		t.Errorf("expected err with short block")
+	}
+}
+
+func TestPolyval(t *testing.T) {
+	// From RFC 8452, Appendix A.
+	h, _ := hex.DecodeString("25629347589242761d31f826ba4b757b")
+	x, _ := hex.DecodeString("4f4f95668c83dfb6401762bb2d01a262d1a24ddd2721d006bbe45f20d3c9f362")
+	hx := polyvalMul(polyvalLoad(h), polyvalXInv128)
+	var s polyvalElement
+	for i := 0; i < len(x); i += 16 {
+		xi := polyvalLoad(x[i:])
+		s = polyvalMul(polyvalElement{lo: s.lo ^ xi.lo, hi: s.hi ^ xi.hi}, hx)
+	}
+	if got := hex.EncodeToString(append(le64(s.lo), le64(s.hi)...)); got != "f7a3b47b846119fae5b7866cf5e5b77e" {
+		t.Errorf("POLYVAL gave %s", got)
+	}
+}
+
+func le64(v uint64) []byte {
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = byte(v >> (8 * uint(i)))
+	}
+	return b
+}
+
+func TestCrypt4Vectors(t *testing.T) {
+	// From RFC 8452, Appendix C.2, where the result is the ciphertext
+	// followed by the tag.
+	for _, v := range []struct {
+		plain, ad, key, nonce, result string
+	}{
+		{"", "", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "07f5f4169bbf55a8400cd47ea6fd400f"},
+		{"0100000000000000", "", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+		{"0200000000000000", "01", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "1de22967237a813291213f267e3b452f02d01ae33e4ec854"},
+		{"020000000000000000000000", "01", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "163d6f9cc1b346cd453a2e4cc1a4a19ae800941ccdc57cc8413c277f"},
+		{"02000000000000000000000000000000", "01", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "c91545823cc24f17dbb0e9e807d5ec17b292d28ff61189e8e49f3875ef91aff7"},
+		{"0200000000000000000000000000000003000000000000000000000000000000", "01", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "07dad364bfc2b9da89116d7bef6daaaf6f255510aa654f920ac81b94e8bad365aea1bad12702e1965604374aab96dbbc"},
+		{"020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000", "01", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "c67a1f0f567a5198aa1fcc8e3f21314336f7f51ca8b1af61feac35a86416fa47fbca3b5f749cdf564527f2314f42fe2503332742b228c647173616cfd44c54eb"},
+		{"02000000000000000000000000000000030000000000000000000000000000000400000000000000000000000000000005000000000000000000000000000000", "01", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "67fd45e126bfb9a79930c43aad2d36967d3f0e4d217c1e551f59727870beefc98cb933a8fce9de887b1e40799988db1fc3f91880ed405b2dd298318858467c895bde0285037c5de81e5b570a049b62a0"},
+		{"02000000", "010000000000000000000000", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "22b3f4cd1835e517741dfddccfa07fa4661b74cf"},
+		{"0300000000000000000000000000000004000000", "010000000000000000000000000000000200", "0100000000000000000000000000000000000000000000000000000000000000", "030000000000000000000000", "43dd0163cdb48f9fe3212bf61b201976067f342bb879ad976d8242acc188ab59cabfe307"},
+	} {
+		plain, _ := hex.DecodeString(v.plain)
+		ad, _ := hex.DecodeString(v.ad)
+		key, _ := hex.DecodeString(v.key)
+		nonce, _ := hex.DecodeString(v.nonce)
+		enc, err := encryptSIV(nil, bytes.NewReader(nonce), plain, key, ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := hex.EncodeToString(append(enc[sivTagSize+sivNonceSize:], enc[:sivTagSize]...))
+		if got != v.result {
+			t.Errorf("%s: got %s != %s", v.plain, got, v.result)
+		}
+		dec, err := decrypt4(enc, key, ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec, plain) {
+			t.Errorf("%s: decryption failed", v.plain)
+		}
+	}
+}
+
+// TestCrypt4NonceReuse shows what a repeated nonce gives away: with GCM, the
+// XOR of two ciphertexts is the XOR of their plaintexts, so knowing one gives
+// the other, while with GCM-SIV only whether the plaintexts were the same is
+// given away.
+func TestCrypt4NonceReuse(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	nonce := make([]byte, sivNonceSize)
+	plain1 := []byte("attack at dawn, from the north..")
+	plain2 := []byte("attack at dusk, from the south..")
+	xor := func(a, b []byte) []byte {
+		out := make([]byte, len(a))
+		for i := range a {
+			out[i] = a[i] ^ b[i]
+		}
+		return out
+	}
+	ciph, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(ciph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm1 := gcm.Seal(nil, nonce, plain1, nil)
+	gcm2 := gcm.Seal(nil, nonce, plain2, nil)
+	if !bytes.Equal(xor(gcm1[:len(plain1)], gcm2[:len(plain2)]), xor(plain1, plain2)) {
+		t.Fatal("expected GCM to leak the XOR of the plaintexts")
+	}
+	siv1, err := encryptSIV(nil, bytes.NewReader(nonce), plain1, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	siv2, err := encryptSIV(nil, bytes.NewReader(nonce), plain2, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct1 := siv1[sivTagSize+sivNonceSize:]
+	ct2 := siv2[sivTagSize+sivNonceSize:]
+	if bytes.Equal(xor(ct1, ct2), xor(plain1, plain2)) {
+		t.Error("GCM-SIV leaked the XOR of the plaintexts")
+	}
+	// Recovering plain2 as GCM would allow gives garbage.
+	if guess := xor(xor(ct1, ct2), plain1); bytes.Equal(guess, plain2) {
+		t.Error("GCM-SIV let plain2 be recovered from plain1")
+	}
+	// The same plaintext under the same nonce gives the same block, which is
+	// all that's given away.
+	siv3, err := encryptSIV(nil, bytes.NewReader(nonce), plain1, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(siv1, siv3) {
+		t.Error("expected the same block for the same plaintext and nonce")
+	}
+	for _, enc := range [][]byte{siv1, siv2} {
+		if _, err = decrypt4(enc, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
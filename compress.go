@@ -0,0 +1,115 @@
+package brimcrypt
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// compressedRaw gives the compressor and decompressor of a compressed
+// CryptFile access to the data stored in its blocks.
+type compressedRaw struct {
+	cf *CryptFile
+}
+
+func (c compressedRaw) Read(b []byte) (int, error) {
+	if c.cf.index >= c.cf.size {
+		return 0, io.EOF
+	}
+	return c.cf.readRaw(b)
+}
+
+func (c compressedRaw) Write(b []byte) (int, error) {
+	return c.cf.writeRaw(b)
+}
+
+func (cf *CryptFile) readCompressed(b []byte) (int, error) {
+	if cf.deflater != nil {
+		return 0, fmt.Errorf("%#v is compressed and must be rewound with Seek before reading what was written", cf.Path)
+	}
+	if cf.inflater == nil {
+		cf.inflater = flate.NewReader(compressedRaw{cf})
+	}
+	n, err := cf.inflater.Read(b)
+	cf.uncompressedIndex += int64(n)
+	return n, err
+}
+
+func (cf *CryptFile) writeCompressed(b []byte) (int, error) {
+	if cf.deflater == nil {
+		if cf.size != 0 || cf.inflater != nil {
+			return 0, fmt.Errorf("%#v is compressed and can only be written sequentially when created", cf.Path)
+		}
+		var err error
+		if cf.deflater, err = flate.NewWriter(compressedRaw{cf}, flate.DefaultCompression); err != nil {
+			return 0, err
+		}
+	}
+	n, err := cf.deflater.Write(b)
+	cf.uncompressedIndex += int64(n)
+	cf.uncompressedSize = cf.uncompressedIndex
+	cf.headerDirty = true
+	return n, err
+}
+
+// writeCompressedAsEmpty is WriteAsEmpty for a compressed file; the empty
+// compressed stream fills out a block of its own.
+func (cf *CryptFile) writeCompressedAsEmpty() error {
+	if cf.uncompressedSize != 0 {
+		return fmt.Errorf("%#v is compressed and already has data written", cf.Path)
+	}
+	if _, err := cf.writeCompressed(nil); err != nil {
+		return err
+	}
+	return cf.finishCompressed()
+}
+
+// finishCompressed flushes the rest of the compressed stream, after which the
+// file can no longer be written to.
+func (cf *CryptFile) finishCompressed() error {
+	err := cf.deflater.Close()
+	cf.deflater = nil
+	cf.headerDirty = true
+	return err
+}
+
+// seekCompressed moves through a compressed file by decompressing and
+// discarding data, rewinding to the start first if seeking backward.
+func (cf *CryptFile) seekCompressed(offset int64, whence int) (int64, error) {
+	var newIndex int64
+	switch whence {
+	case 0:
+		newIndex = offset
+	case 1:
+		newIndex = cf.uncompressedIndex + offset
+	case 2:
+		newIndex = cf.uncompressedSize + offset
+	default:
+		return cf.uncompressedIndex, &SeekError{Path: cf.Path, Offset: offset, Whence: whence, msg: fmt.Sprintf("invalid seek whence %d", whence)}
+	}
+	if newIndex < 0 || newIndex > cf.uncompressedSize {
+		return cf.uncompressedIndex, &SeekError{Path: cf.Path, Offset: offset, Whence: whence, msg: fmt.Sprintf("invalid seek result %d for a compressed file", newIndex)}
+	}
+	if newIndex == cf.uncompressedIndex {
+		return cf.uncompressedIndex, nil
+	}
+	if cf.deflater != nil {
+		if err := cf.finishCompressed(); err != nil {
+			return cf.uncompressedIndex, err
+		}
+	}
+	if newIndex < cf.uncompressedIndex || cf.inflater == nil {
+		if _, err := cf.seekRaw(0, 0); err != nil {
+			return cf.uncompressedIndex, err
+		}
+		cf.inflater = flate.NewReader(compressedRaw{cf})
+		cf.uncompressedIndex = 0
+	}
+	n, err := io.CopyN(ioutil.Discard, cf.inflater, newIndex-cf.uncompressedIndex)
+	cf.uncompressedIndex += n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return cf.uncompressedIndex, err
+}
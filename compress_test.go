@@ -0,0 +1,125 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCryptFileCompress(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := bytes.Repeat([]byte("2006-01-02 15:04:05 INFO something happened\n"), 10000)
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Compress: true})
+	defer cf.Close()
+	if _, err := cf.Write(in[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(cf, bytes.NewReader(in[1000:])); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := cf.Size(); err != nil || size != int64(len(in)) {
+		t.Errorf("Size gave %d %v", size, err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	finfo, err := os.Stat(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Size() > int64(len(in))/10 {
+		t.Errorf("compressed file is %d bytes for %d bytes of input", finfo.Size(), len(in))
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if size, err := cf.Size(); err != nil || size != int64(len(in)) {
+		t.Errorf("Size gave %d %v after reopening", size, err)
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("output does not match input")
+	}
+	if _, err = cf.Write([]byte("more")); err == nil {
+		t.Error("expected an error writing to a compressed file after reading")
+	}
+	if _, err = cf.ReadAt(out[:10], 0); err == nil {
+		t.Error("expected an error from ReadAt on a compressed file")
+	}
+	for _, off := range []int64{100000, 5, 300000} {
+		pos, err := cf.Seek(off, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != off {
+			t.Errorf("Seek gave %d != %d", pos, off)
+		}
+		out = make([]byte, 20)
+		if _, err = io.ReadFull(cf, out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in[off:off+20]) {
+			t.Errorf("read after Seek to %d does not match input", off)
+		}
+	}
+	if _, err = cf.Seek(1, 2); err == nil {
+		t.Error("expected an error seeking past the end of a compressed file")
+	}
+}
+
+func TestCryptFileCompressRewind(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Compress: true})
+	defer cf.Close()
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Read(make([]byte, 1)); err == nil {
+		t.Error("expected an error reading without rewinding")
+	}
+	if _, err := cf.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "Hello World!" {
+		t.Errorf("output %#v does not match input", string(out))
+	}
+	if _, err = cf.Write([]byte("more")); err == nil {
+		t.Error("expected an error writing after rewinding")
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tmp = path.Join(tmpdir, "empty")
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Compress: true})
+	defer cf.Close()
+	if err = cf.WriteAsEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err = ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Errorf("expected no output, got %#v", string(out))
+	}
+}
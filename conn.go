@@ -0,0 +1,209 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// An encrypted connection starts with each side sending the magic
+// "CRYPTCONN0" and a random 16 byte nonce of its own, in plaintext. After
+// that each side sends frames of a uint32 of the length of an encrypted block
+// followed by the block, as from encrypt0. Each decrypted block starts with a
+// uint32 of how many of the following bytes are data, the rest being zero
+// padding to the AES block size. Each block is authenticated along with the
+// sender's nonce, the receiver's nonce, and the number of frames the sender
+// sent before it, so frames can't be reordered, dropped without the next one
+// failing, replayed from another connection, or reflected back to their
+// sender.
+const (
+	connMagic     = "CRYPTCONN0"
+	connNonceSize = 16
+	connLenSize   = 4
+	// connMaxData is the most data sent in a single frame.
+	connMaxData = 16 * 1024
+	// connMaxFrame is the largest encrypted block a frame may have.
+	connMaxFrame = hmacSize + aes.BlockSize + (connLenSize+connMaxData+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize
+)
+
+type encryptedConn struct {
+	net.Conn
+	key           []byte
+	handshakeOnce sync.Once
+	handshakeErr  error
+	nonce         []byte
+	peerNonce     []byte
+	readLock      sync.Mutex
+	readSeq       uint64
+	frame         []byte
+	plain         []byte
+	readErr       error
+	writeLock     sync.Mutex
+	writeSeq      uint64
+	plainFrame    []byte
+	writeErr      error
+}
+
+// NewEncryptedConn returns a net.Conn that encrypts everything written to it,
+// in authenticated frames, to conn, and decrypts and authenticates what is
+// read from conn, which must have a NewEncryptedConn with the same key on the
+// other end. A frame that fails authentication gives KeyError. A frame only
+// partly read or written leaves the two ends out of step, so any error,
+// including a timeout from a deadline, is returned by every later Read, or
+// Write, as the case may be. The key is pre-shared, so this is a
+// lightweight channel rather than a replacement for TLS: there is no forward
+// secrecy, and the sizes and timing of writes show on the wire. The first
+// Read or Write exchanges nonces with the other end, so both ends need to
+// be read from or written to for either to get going. Close closes conn.
+func NewEncryptedConn(conn net.Conn, key []byte) net.Conn {
+	return &encryptedConn{Conn: conn, key: key}
+}
+
+// handshake sends this end's nonce while reading the other end's, so it
+// doesn't matter which end reads or writes first, even over a synchronous
+// connection such as net.Pipe.
+func (ec *encryptedConn) handshake() error {
+	ec.handshakeOnce.Do(func() {
+		nonce := make([]byte, connNonceSize)
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			ec.handshakeErr = err
+			return
+		}
+		sent := make(chan error, 1)
+		go func() {
+			_, err := ec.Conn.Write(append([]byte(connMagic), nonce...))
+			sent <- err
+		}()
+		hello := make([]byte, len(connMagic)+connNonceSize)
+		_, err := io.ReadFull(ec.Conn, hello)
+		if err == nil {
+			// The send is only waited for once the other end has been
+			// heard from, as it may never read.
+			err = <-sent
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			ec.handshakeErr = err
+			return
+		}
+		if string(hello[:len(connMagic)]) != connMagic {
+			ec.handshakeErr = fmt.Errorf("not %s data", connMagic)
+			return
+		}
+		if bytes.Equal(hello[len(connMagic):], nonce) {
+			ec.handshakeErr = fmt.Errorf("%s nonce reflected back", connMagic)
+			return
+		}
+		ec.nonce = nonce
+		ec.peerNonce = hello[len(connMagic):]
+	})
+	return ec.handshakeErr
+}
+
+// connAD returns the additional data for the frame seq sent from the end
+// with the nonce from to the end with the nonce to.
+func connAD(from []byte, to []byte, seq uint64) []byte {
+	ad := make([]byte, 2*connNonceSize+8)
+	copy(ad, from)
+	copy(ad[connNonceSize:], to)
+	binary.BigEndian.PutUint64(ad[2*connNonceSize:], seq)
+	return ad
+}
+
+func (ec *encryptedConn) Read(b []byte) (int, error) {
+	if err := ec.handshake(); err != nil {
+		return 0, err
+	}
+	ec.readLock.Lock()
+	defer ec.readLock.Unlock()
+	for len(ec.plain) == 0 {
+		if ec.readErr != nil {
+			return 0, ec.readErr
+		}
+		ec.readErr = ec.next()
+	}
+	n := copy(b, ec.plain)
+	ec.plain = ec.plain[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next frame.
+func (ec *encryptedConn) next() error {
+	var length [connLenSize]byte
+	if _, err := io.ReadFull(ec.Conn, length[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > connMaxFrame {
+		return fmt.Errorf("invalid %s frame length %d", connMagic, size)
+	}
+	ec.frame = sized(ec.frame, int(size))
+	if _, err := io.ReadFull(ec.Conn, ec.frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	dec, err := decrypt0(ec.frame, ec.key, connAD(ec.peerNonce, ec.nonce, ec.readSeq))
+	if err != nil {
+		return err
+	}
+	ec.readSeq++
+	if len(dec) < connLenSize {
+		return fmt.Errorf("invalid %s frame length %d", connMagic, size)
+	}
+	n := binary.BigEndian.Uint32(dec)
+	if int64(n) > int64(len(dec)-connLenSize) {
+		return fmt.Errorf("invalid %s frame data length %d", connMagic, n)
+	}
+	ec.plain = dec[connLenSize : connLenSize+n]
+	return nil
+}
+
+func (ec *encryptedConn) Write(b []byte) (int, error) {
+	if err := ec.handshake(); err != nil {
+		return 0, err
+	}
+	ec.writeLock.Lock()
+	defer ec.writeLock.Unlock()
+	if ec.writeErr != nil {
+		return 0, ec.writeErr
+	}
+	n := 0
+	for len(b) > 0 {
+		data := b
+		if len(data) > connMaxData {
+			data = data[:connMaxData]
+		}
+		size := (connLenSize + len(data) + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize
+		ec.plainFrame = sized(ec.plainFrame, size)
+		binary.BigEndian.PutUint32(ec.plainFrame, uint32(len(data)))
+		copy(ec.plainFrame[connLenSize:], data)
+		for i := connLenSize + len(data); i < size; i++ {
+			ec.plainFrame[i] = 0
+		}
+		enc, err := encrypt0(ec.plainFrame, ec.key, connAD(ec.nonce, ec.peerNonce, ec.writeSeq))
+		if err != nil {
+			ec.writeErr = err
+			return n, err
+		}
+		frame := make([]byte, connLenSize, connLenSize+len(enc))
+		binary.BigEndian.PutUint32(frame, uint32(len(enc)))
+		frame = append(frame, enc...)
+		if _, err = ec.Conn.Write(frame); err != nil {
+			ec.writeErr = err
+			return n, err
+		}
+		ec.writeSeq++
+		n += len(data)
+		b = b[len(data):]
+	}
+	return n, nil
+}
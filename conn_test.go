@@ -0,0 +1,111 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// tamperConn flips a bit in the nth byte written through it.
+type tamperConn struct {
+	net.Conn
+	n int
+}
+
+func (tc *tamperConn) Write(b []byte) (int, error) {
+	if tc.n >= 0 && tc.n < len(b) {
+		b = append([]byte(nil), b...)
+		b[tc.n] ^= 1
+	}
+	tc.n -= len(b)
+	return tc.Conn.Write(b)
+}
+
+func TestEncryptedConn(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 3*connMaxData+1000)
+	for i := range in {
+		in[i] = byte(i * 3)
+	}
+	c1, c2 := net.Pipe()
+	a := NewEncryptedConn(c1, key)
+	b := NewEncryptedConn(c2, key)
+	defer a.Close()
+	defer b.Close()
+	// Each end writes a multi-frame message while the other reads it in
+	// small pieces that straddle the frame boundaries.
+	errs := make(chan error, 2)
+	for _, conn := range []net.Conn{a, b} {
+		go func(conn net.Conn) {
+			_, err := conn.Write(in)
+			errs <- err
+		}(conn)
+	}
+	for _, conn := range []net.Conn{a, b} {
+		var out []byte
+		buf := make([]byte, 999)
+		for len(out) < len(in) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, buf[:n]...)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatal("output does not match input")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The other end sees the Close as the end of the stream.
+	a.Close()
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected io.EOF after the other end closed; got %v", err)
+	}
+}
+
+func TestEncryptedConnAuthFailure(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, tt := range []struct {
+		name   string
+		key    []byte
+		tamper int
+	}{
+		{"wrong key", []byte("0123456789abcdef0123456789abcdeX"), -1},
+		// The hello is the magic and nonce, then comes the frame length
+		// and the block, so this is within the second frame's block.
+		{"tampered", key, len(connMagic) + connNonceSize + connLenSize + 80 + connLenSize + 50},
+	} {
+		c1, c2 := net.Pipe()
+		a := NewEncryptedConn(&tamperConn{Conn: c1, n: tt.tamper}, key)
+		b := NewEncryptedConn(c2, tt.key)
+		go func() {
+			a.Write(make([]byte, 20))
+			a.Write(make([]byte, 20))
+			a.Read(make([]byte, 1))
+		}()
+		buf := make([]byte, 100)
+		var err error
+		for n := 0; err == nil; n++ {
+			_, err = b.Read(buf)
+			if err == nil && tt.tamper < 0 {
+				t.Fatalf("%s: read with the wrong key", tt.name)
+			}
+			if n > 2 {
+				t.Fatalf("%s: read more frames than were sent", tt.name)
+			}
+		}
+		if err != KeyError {
+			t.Errorf("%s: expected KeyError; got %v", tt.name, err)
+		}
+		if _, err = b.Read(buf); err != KeyError {
+			t.Errorf("%s: expected KeyError again; got %v", tt.name, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
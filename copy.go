@@ -0,0 +1,359 @@
+package brimcrypt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// CopyOptions are the options for CopyFileWithOptions,
+// DecryptToFileWithOptions, and EncryptFromFileWithOptions.
+type CopyOptions struct {
+	// Progress, if not nil, is told of the plaintext bytes copied out of the
+	// size of the source, or -1 if that isn't known, such as when encrypting
+	// from a pipe.
+	Progress ProgressFunc
+}
+
+// CopyFile copies the CryptFile at srcPath, using srcKey, to dstPath using
+// dstKey, which may be the same key. The plaintext is streamed across so
+// every block of the copy is freshly encrypted. The copy keeps the cipher
+// suite and compression of the source, and its size, including files written
+// with WriteAsEmpty. It is written to a temporary file next to dstPath and
+// renamed into place once complete, so anything already at dstPath is only
+// replaced by a full copy. The estimatedSize is used to pick the block size
+// for the copy; if 0, the size of the source is used.
+func CopyFile(srcPath string, srcKey []byte, dstPath string, dstKey []byte, estimatedSize int64) error {
+	return CopyFileWithOptions(srcPath, srcKey, dstPath, dstKey, estimatedSize, nil)
+}
+
+// CopyFileWithOptions is CopyFile with opts, which may be nil.
+func CopyFileWithOptions(srcPath string, srcKey []byte, dstPath string, dstKey []byte, estimatedSize int64, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	src := NewCryptFileWithOptions(srcPath, srcKey, 0, &CryptFileOptions{ReadOnly: true})
+	defer src.Close()
+	size, err := src.Size()
+	if err != nil {
+		return err
+	}
+	if estimatedSize == 0 {
+		estimatedSize = size
+	}
+	tmp, err := tempPath(dstPath)
+	if err != nil {
+		return err
+	}
+	dst := NewCryptFileWithOptions(tmp, dstKey, estimatedSize, &CryptFileOptions{Suite: src.suite, Compress: src.compressed})
+	prog := newProgress(opts.Progress, size)
+	if err = copyCryptFile(dst, src, size, prog); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, dstPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+func copyCryptFile(dst *CryptFile, src *CryptFile, size int64, prog *progress) error {
+	// Writing nothing still creates the file, so even a source with no data
+	// blocks at all is copied as such.
+	if _, err := dst.Write(nil); err != nil {
+		return err
+	}
+	if size == 0 {
+		if src.blocks > 0 {
+			return dst.WriteAsEmpty()
+		}
+		return nil
+	}
+	var w io.Writer = dst
+	if prog.fn != nil {
+		w = &progressWriter{w: dst, p: prog}
+	}
+	_, err := io.Copy(w, src)
+	return err
+}
+
+// DecryptToFile writes the plaintext of the CryptFile at cryptPath, using the
+// key given, to a normal file at plainPath, creating any parent directories
+// needed. As with CopyFile, the output is written to a temporary file and
+// renamed into place once complete.
+func DecryptToFile(cryptPath string, key []byte, plainPath string) error {
+	return DecryptToFileWithOptions(cryptPath, key, plainPath, nil)
+}
+
+// DecryptToFileWithOptions is DecryptToFile with opts, which may be nil.
+func DecryptToFileWithOptions(cryptPath string, key []byte, plainPath string, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	cf := NewCryptFileWithOptions(cryptPath, key, 0, &CryptFileOptions{ReadOnly: true})
+	defer cf.Close()
+	size, err := cf.Size()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(plainPath), 0700); err != nil {
+		return err
+	}
+	tmp, err := tempPath(plainPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	prog := newProgress(opts.Progress, size)
+	var w io.Writer = f
+	if prog.fn != nil {
+		w = &progressWriter{w: f, p: prog}
+	}
+	if _, err = io.Copy(w, cf); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, plainPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// EncryptFromFile writes the contents of the normal file at plainPath to a new
+// CryptFile at cryptPath using the key given, creating any parent directories
+// needed. An empty file is written with WriteAsEmpty. The estimatedSize is
+// used to pick the block size; if 0, the size of the plaintext file is used.
+// As with CopyFile, the output is written to a temporary file and renamed
+// into place once complete.
+func EncryptFromFile(plainPath string, key []byte, cryptPath string, estimatedSize int64) error {
+	return EncryptFromFileWithOptions(plainPath, key, cryptPath, estimatedSize, nil)
+}
+
+// EncryptFromFileWithOptions is EncryptFromFile with opts, which may be nil.
+func EncryptFromFileWithOptions(plainPath string, key []byte, cryptPath string, estimatedSize int64, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	f, err := os.Open(plainPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if estimatedSize == 0 {
+		estimatedSize = finfo.Size()
+	}
+	tmp, err := tempPath(cryptPath)
+	if err != nil {
+		return err
+	}
+	total := int64(-1)
+	if finfo.Mode().IsRegular() {
+		total = finfo.Size()
+	}
+	prog := newProgress(opts.Progress, total)
+	var r io.Reader = f
+	if prog.fn != nil {
+		r = &progressReader{r: f, p: prog}
+	}
+	cf := NewCryptFile(tmp, key, estimatedSize)
+	n, err := io.Copy(cf, r)
+	if err == nil && n == 0 {
+		err = cf.WriteAsEmpty()
+	}
+	if err != nil {
+		cf.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = cf.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, cryptPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// FormatOptions are the settings for MigrateInPlace.
+type FormatOptions struct {
+	// Options are for the new file, as for NewCryptFileWithOptions; if nil,
+	// it has the same cipher suite and features as the original, such as
+	// compression, a block map, block keys, a Merkle tree, block versions,
+	// padding, a key commitment, parity, and CRCs. If FileMode is 0, the
+	// original's permissions are kept, and if Phrase is "", the new file
+	// has the original's phrase and, unless KDF is set, key derivation
+	// settings.
+	Options *CryptFileOptions
+	// Phrase, if not "", is used to open the original instead of the key
+	// given, as with CryptFileOptions.Phrase.
+	Phrase string
+	// EstimatedSize is used to pick the block size; if 0, the size of the
+	// original is used.
+	EstimatedSize int64
+	// Backup keeps the original at the path with ".bak" appended, replacing
+	// any file already there.
+	Backup bool
+}
+
+// MigrateInPlace rewrites the CryptFile at the path, using the key given, or
+// target.Phrase, in the format of target, keeping its content and size as
+// CopyFile does. The new file is written to a temporary file next to it,
+// synced to disk, and renamed over the original, so however it is
+// interrupted, the path holds either the original or the whole new file;
+// only a leftover temporary file may need removing. The original is held
+// with an exclusive lock, as with CryptFileOptions.Lock, throughout, except
+// on Windows, which can't rename over an open file, from just before the
+// rename. With target.Backup the original is first linked to the backup
+// path, which needs a file system with hard links. A file with recipients
+// added with AddRecipient can't be migrated, as only the key or phrase given
+// could be carried over.
+func MigrateInPlace(path string, key []byte, target FormatOptions) error {
+	src := NewCryptFileWithOptions(path, key, 0, &CryptFileOptions{Phrase: target.Phrase, Lock: true})
+	defer src.Close()
+	size, err := src.Size()
+	if err != nil {
+		return err
+	}
+	if src.recipients != nil {
+		return fmt.Errorf("%#v has recipients, which can't be migrated", path)
+	}
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var opts CryptFileOptions
+	if target.Options != nil {
+		opts = *target.Options
+	} else {
+		opts = CryptFileOptions{
+			Suite:         src.suite,
+			Compress:      src.compressed,
+			Sparse:        src.sparseFile,
+			BlockKeys:     src.fileKey != nil,
+			Merkle:        src.merkleFile,
+			Versioned:     src.versionedFile,
+			MinVersion:    src.version,
+			Padding:       src.paddedFile,
+			PaddingBucket: src.paddedBucket,
+			KeyCommit:     src.keyCommitFile,
+			CRC:           src.crcFile,
+		}
+		if src.parityFile {
+			opts.ParityShards = int(src.shardParity)
+			opts.DataShards = int(src.shardData)
+		}
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = finfo.Mode().Perm()
+	}
+	if opts.Phrase == "" {
+		opts.Phrase = target.Phrase
+		if opts.KDF == nil {
+			opts.KDF = src.kdf
+		}
+	}
+	estimatedSize := target.EstimatedSize
+	if estimatedSize == 0 {
+		estimatedSize = size
+	}
+	tmp, err := tempPath(path)
+	if err != nil {
+		return err
+	}
+	dst := NewCryptFileWithOptions(tmp, key, estimatedSize, &opts)
+	if err = copyCryptFile(dst, src, size, newProgress(nil, size)); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = dst.Close(); err == nil {
+		err = syncFile(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if target.Backup {
+		if err = linkBackup(path, path+".bak"); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if runtime.GOOS == "windows" {
+		src.Close()
+	}
+	if err = renameFile(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncFile syncs the file at the path to disk.
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// linkBackup makes backupPath another name for the file at the path, by way
+// of a temporary link renamed into place so any earlier backup is only ever
+// replaced whole.
+func linkBackup(path string, backupPath string) error {
+	tmp, err := tempPath(backupPath)
+	if err != nil {
+		return err
+	}
+	if err = os.Link(path, tmp); err != nil {
+		return err
+	}
+	err = renameFile(tmp, backupPath)
+	// If the backup was already a link to the same file, as after an
+	// interrupted migration, the rename does nothing and leaves tmp.
+	os.Remove(tmp)
+	return err
+}
+
+// tempPath returns an unused path in the same directory as pth, for writing a
+// file that will then be renamed to pth.
+func tempPath(pth string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(pth), "."+filepath.Base(pth)+"."+hex.EncodeToString(b)+".tmp"), nil
+}
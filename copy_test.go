@@ -0,0 +1,303 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCopyFile(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("abcdef0123456789abcdef0123456789")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	src := path.Join(tmpdir, "src")
+	cf := NewCryptFileWithOptions(src, key, 0, &CryptFileOptions{Suite: ChaCha20Poly1305})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dst := path.Join(tmpdir, "dst")
+	if err := CopyFile(src, key, dst, newKey, 0); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(dst, newKey, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("copy does not match input")
+	}
+	if cf.suite != ChaCha20Poly1305 {
+		t.Errorf("copy has suite %d rather than the source's", cf.suite)
+	}
+	cf.Close()
+	// A failed copy must leave the destination as it was.
+	if err = CopyFile(src, newKey, dst, key, 0); err != KeyError {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+	cf = NewCryptFile(dst, newKey, 0)
+	if size, err := cf.Size(); err != nil || size != int64(len(in)) {
+		t.Errorf("destination changed by failed copy: %d %v", size, err)
+	}
+	cf.Close()
+	names, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Errorf("expected only src and dst, got %d entries", len(names))
+	}
+}
+
+func TestCopyFileEmpty(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for name, f := range map[string]func(cf *CryptFile) error{
+		"asempty": func(cf *CryptFile) error { return cf.WriteAsEmpty() },
+		"noblocks": func(cf *CryptFile) error {
+			_, err := cf.Write(nil)
+			return err
+		},
+	} {
+		src := path.Join(tmpdir, name)
+		cf := NewCryptFile(src, key, 0)
+		if err := f(cf); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dst := path.Join(tmpdir, name+"copy")
+		if err := CopyFile(src, key, dst, key, 0); err != nil {
+			t.Fatal(err)
+		}
+		srcInfo, err := os.Stat(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dstInfo, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if srcInfo.Size() != dstInfo.Size() {
+			t.Errorf("%s: copy is %d bytes on disk rather than %d", name, dstInfo.Size(), srcInfo.Size())
+		}
+		cf = NewCryptFile(dst, key, 0)
+		if size, err := cf.Size(); err != nil || size != 0 {
+			t.Errorf("%s: copy has size %d %v", name, size, err)
+		}
+		cf.Close()
+	}
+}
+
+func TestEncryptFromFileDecryptToFile(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 100000)
+	for i := range in {
+		in[i] = byte(i * 31)
+	}
+	for name, data := range map[string][]byte{"binary": in, "empty": nil} {
+		plain := path.Join(tmpdir, name, "in")
+		if err := os.MkdirAll(path.Dir(plain), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(plain, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		crypt := path.Join(tmpdir, name, "crypt", "file")
+		if err := EncryptFromFile(plain, key, crypt, 0); err != nil {
+			t.Fatal(err)
+		}
+		cf := NewCryptFile(crypt, key, 0)
+		if size, err := cf.Size(); err != nil || size != int64(len(data)) {
+			t.Errorf("%s: CryptFile has size %d %v", name, size, err)
+		}
+		if cf.blocks == 0 {
+			t.Errorf("%s: expected at least one data block", name)
+		}
+		cf.Close()
+		out := path.Join(tmpdir, name, "out", "file")
+		if err := DecryptToFile(crypt, key, out); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: output does not match input", name)
+		}
+	}
+}
+
+func TestMigrateInPlace(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{FileMode: 0640})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	orig, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Being interrupted before the rename leaves the original as it was,
+	// even once backed up.
+	defer func(f func(string, string) error) { renameFile = f }(renameFile)
+	renameFile = func(oldpath, newpath string) error {
+		if newpath == tmp {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrPermission}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	target := FormatOptions{Options: &CryptFileOptions{Suite: ChaCha20Poly1305, CRC: true}, Backup: true}
+	if err = MigrateInPlace(tmp, key, target); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected the rename to fail; got %v", err)
+	}
+	if raw, err := ioutil.ReadFile(tmp); err != nil || !bytes.Equal(raw, orig) {
+		t.Errorf("expected the original untouched; got %v", err)
+	}
+	names, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0].Name() != "test" || names[1].Name() != "test.bak" {
+		t.Errorf("expected only the file and its backup; got %d entries", len(names))
+	}
+	renameFile = os.Rename
+	if err = MigrateInPlace(tmp, key, target); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("migrated file does not match input")
+	}
+	if cf.suite != ChaCha20Poly1305 || !cf.crcFile {
+		t.Errorf("migrated file has suite %d and CRCs %v", cf.suite, cf.crcFile)
+	}
+	cf.Close()
+	if raw, err := ioutil.ReadFile(tmp + ".bak"); err != nil || !bytes.Equal(raw, orig) {
+		t.Errorf("expected the original as the backup; got %v", err)
+	}
+	if finfo, err := os.Stat(tmp); err != nil || finfo.Mode().Perm() != 0640 {
+		t.Errorf("expected the original's mode 0640; got %v %v", finfo, err)
+	}
+	// A wrong key changes nothing.
+	if err = MigrateInPlace(tmp, []byte("abcdef0123456789abcdef0123456789"), FormatOptions{}); err != KeyError {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+	if names, err = ioutil.ReadDir(tmpdir); err != nil || len(names) != 2 {
+		t.Errorf("expected only the file and its backup; got %d entries, %v", len(names), err)
+	}
+	// Empty files stay empty.
+	empty := path.Join(tmpdir, "empty")
+	cf = NewCryptFile(empty, key, 0)
+	if err = cf.WriteAsEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	if err = MigrateInPlace(empty, key, FormatOptions{Options: &CryptFileOptions{Suite: AES256CBCHMACSHA512}}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := ReadHeader(empty, key); err != nil || info.Size != 0 || info.Suite != AES256CBCHMACSHA512 {
+		t.Errorf("expected an empty AES256CBCHMACSHA512 file; got %+v %v", info, err)
+	}
+	// Without Options, the original's features are carried over.
+	sparse := path.Join(tmpdir, "sparse")
+	cf = NewCryptFileWithOptions(sparse, key, 0, &CryptFileOptions{Suite: ChaCha20Poly1305, Sparse: true, BlockKeys: true})
+	if _, err = cf.Write(append(make([]byte, 100000), in...)); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = MigrateInPlace(sparse, key, FormatOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(sparse, key, 0)
+	out = make([]byte, len(in))
+	if _, err = cf.ReadAt(out, 100000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("migrated sparse file does not match input")
+	}
+	if cf.suite != ChaCha20Poly1305 || !cf.sparseFile || cf.fileKey == nil {
+		t.Errorf("migrated file has suite %d, sparse %v, and block keys %v", cf.suite, cf.sparseFile, cf.fileKey != nil)
+	}
+	cf.Close()
+	// The original is locked while it's migrated.
+	cf = NewCryptFileWithOptions(sparse, key, 0, &CryptFileOptions{Lock: true})
+	if _, err = cf.Size(); err != nil {
+		t.Fatal(err)
+	}
+	if err = MigrateInPlace(sparse, key, FormatOptions{}); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	cf.Close()
+	// Recipients can't be carried over, so such files are refused.
+	cf = NewCryptFile(sparse, key, 0)
+	if err = cf.AddRecipient([]byte("abcdef0123456789abcdef0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	if err = MigrateInPlace(sparse, key, FormatOptions{}); err == nil {
+		t.Error("expected an error for a file with recipients")
+	}
+	// A file keyed by a phrase keeps it, and its key derivation settings.
+	phrase := path.Join(tmpdir, "phrase")
+	params := &PBKDF2Params{Iterations: 1000}
+	cf = NewCryptFileWithOptions(phrase, nil, 0, &CryptFileOptions{Phrase: "Test Phrase", KDF: params})
+	if _, err = cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = MigrateInPlace(phrase, nil, FormatOptions{}); err == nil {
+		t.Error("expected an error without the phrase")
+	}
+	for _, target := range []FormatOptions{{Phrase: "Test Phrase"}, {Options: &CryptFileOptions{Suite: ChaCha20Poly1305}, Phrase: "Test Phrase"}} {
+		if err = MigrateInPlace(phrase, nil, target); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFileWithOptions(phrase, nil, 0, &CryptFileOptions{Phrase: "Test Phrase"})
+		if out, err = ioutil.ReadAll(cf); err != nil || !bytes.Equal(out, in) {
+			t.Errorf("%+v: reading the migrated file gave %v", target, err)
+		}
+		if p, ok := cf.kdf.(*PBKDF2Params); !ok || *p != *params {
+			t.Errorf("%+v: expected the original's key derivation settings; got %#v", target, cf.kdf)
+		}
+		cf.Close()
+	}
+}
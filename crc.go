@@ -0,0 +1,150 @@
+package brimcrypt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A file with CRCs keeps a CRC-32C of each encrypted data block, as it is on
+// disk, in a table of a uint32 per block. The table is written in the slots
+// just after the data blocks, and after any Merkle tree and block versions,
+// whenever the header is, encrypted and authenticated like any other block.
+// The CRCs are only for finding accidental damage cheaply, with Scrub; a block
+// is still only trusted once it authenticates.
+
+// crcTable is the table for CRC-32C, the Castagnoli polynomial, which most
+// CPUs compute in hardware.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockCRC returns the CRC of the encrypted block.
+func blockCRC(enc []byte) uint32 {
+	return crc32.Checksum(enc, crcTable)
+}
+
+// crcSlot returns the slot where the table of CRCs starts.
+func (cf *CryptFile) crcSlot() int64 {
+	slot := cf.versionsSlot()
+	if cf.versionedFile {
+		perBlock := cf.plainBlockSize / 8
+		slot += (cf.blocks + perBlock - 1) / perBlock
+	}
+	return slot
+}
+
+// crcBlocks returns the number of blocks the table of CRCs takes.
+func (cf *CryptFile) crcBlocks() int64 {
+	if !cf.crcFile {
+		return 0
+	}
+	perBlock := cf.plainBlockSize / 4
+	return (cf.blocks + perBlock - 1) / perBlock
+}
+
+// setBlockCRC records the encrypted block just written to the slot.
+func (cf *CryptFile) setBlockCRC(slot int64, enc []byte) {
+	for int64(len(cf.blockCRCs)) <= slot {
+		cf.blockCRCs = append(cf.blockCRCs, 0)
+	}
+	cf.blockCRCs[slot] = blockCRC(enc)
+	cf.headerDirty = true
+}
+
+// loadCRCs reads the table of CRCs for the header last read or written.
+func (cf *CryptFile) loadCRCs() error {
+	crcs := make([]uint32, cf.blocks)
+	perBlock := cf.plainBlockSize / 4
+	enc := make([]byte, cf.blockSize)
+	for i, slot := int64(0), cf.crcSlot(); i < cf.blocks; slot++ {
+		n, err := cf.file.ReadAt(enc, cf.blockSize+slot*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+			return fmt.Errorf("%#v reading CRCs: %w", cf.Path, err)
+		}
+		dec, err := cf.suite.decrypt(enc, cf.blockKey(slot), cf.blockAD(slot))
+		if err != nil {
+			cf.countAuth(err, slot, cf.blockSize+slot*cf.blockSize)
+			return fmt.Errorf("%#v CRCs: %w", cf.Path, err)
+		}
+		for j := int64(0); j < perBlock && i < cf.blocks; j++ {
+			crcs[i] = binary.BigEndian.Uint32(dec[j*4 : j*4+4])
+			i++
+		}
+	}
+	cf.blockCRCs = crcs
+	return nil
+}
+
+// writeCRCs writes the table of CRCs for the header about to be written.
+func (cf *CryptFile) writeCRCs() error {
+	perBlock := int(cf.plainBlockSize / 4)
+	dec := make([]byte, cf.plainBlockSize)
+	crcs := cf.blockCRCs
+	for slot := cf.crcSlot(); len(crcs) > 0; slot++ {
+		for i := range dec {
+			dec[i] = 0
+		}
+		for i := 0; i < perBlock && len(crcs) > 0; i++ {
+			binary.BigEndian.PutUint32(dec[i*4:], crcs[0])
+			crcs = crcs[1:]
+		}
+		enc, err := cf.suite.encryptTo(nil, cf.random(), dec, cf.blockKey(slot), cf.blockAD(slot))
+		if err != nil {
+			cf.fail()
+			return fmt.Errorf("%#v encrypting CRCs: %w", cf.Path, err)
+		}
+		n, err := cf.file.WriteAt(enc, cf.blockSize+slot*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && n != len(enc))) {
+			if err != io.EOF {
+				cf.unknownState = true
+				cf.file.Close()
+				cf.file = nil
+			}
+			return fmt.Errorf("%#v writing CRCs: %w", cf.Path, err)
+		}
+	}
+	return nil
+}
+
+// Scrub checks every data block of a file created with the CRC option
+// against its CRC, which is far cheaper than authenticating it as Verify
+// does, and returns the block numbers of those that don't match and then
+// also fail to authenticate, in order; a file with none gives an empty
+// list. A block too short to read in full counts as failing. Only the table
+// of CRCs and blocks that don't match are decrypted, and the header is
+// authenticated when the file is opened, but nothing else is checked, so
+// this is a routine check for bit rot, not a substitute for Verify against
+// tampering. Any pending writes are flushed first.
+func (cf *CryptFile) Scrub() ([]int64, error) {
+	if err := cf.prepareFlushed(); err != nil {
+		return nil, err
+	}
+	if !cf.crcFile {
+		return nil, fmt.Errorf("%#v has no CRCs", cf.Path)
+	}
+	if cf.blockCRCs == nil {
+		if err := cf.loadCRCs(); err != nil {
+			return nil, err
+		}
+	}
+	bad := []int64{}
+	enc := make([]byte, cf.blockSize)
+	for blockNumber := int64(0); blockNumber < cf.blocks; blockNumber++ {
+		n, err := cf.file.ReadAt(enc, cf.blockSize+blockNumber*cf.blockSize)
+		if err != nil && err != io.EOF {
+			return bad, fmt.Errorf("%#v reading block %d: %w", cf.Path, blockNumber, err)
+		}
+		if int64(n) == cf.blockSize && blockCRC(enc) == cf.blockCRCs[blockNumber] {
+			continue
+		}
+		if int64(n) == cf.blockSize {
+			err = cf.suite.verify(enc, cf.blockKey(blockNumber), cf.blockAD(blockNumber))
+			if err == nil {
+				continue
+			}
+			cf.countAuth(err, blockNumber, cf.blockSize+blockNumber*cf.blockSize)
+		}
+		bad = append(bad, blockNumber)
+	}
+	return bad, nil
+}
@@ -0,0 +1,103 @@
+package brimcrypt
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCryptFileScrub(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("0123456789abcdef0123456789abcdeX")
+	in := make([]byte, 3000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for _, tt := range []struct {
+		name string
+		opts *CryptFileOptions
+	}{
+		{"plain", &CryptFileOptions{CRC: true}},
+		{"chacha", &CryptFileOptions{Suite: ChaCha20Poly1305, CRC: true}},
+		{"everything", &CryptFileOptions{CRC: true, Merkle: true, Versioned: true, Padding: true}},
+	} {
+		tmp := path.Join(tmpdir, tt.name)
+		cf := NewCryptFileWithOptions(tmp, key, 0, tt.opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Rewriting a block, and rekeying, keep the CRCs up to date.
+		cf = NewCryptFile(tmp, key, 0)
+		if _, err := cf.Write([]byte("rewritten")); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Rekey(newKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmp, newKey, 0)
+		bad, err := cf.Scrub()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if bad == nil || len(bad) != 0 {
+			t.Errorf("%s: expected no bad blocks; got %v", tt.name, bad)
+		}
+		if err = cf.Verify(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		blockSize := cf.blockSize
+		cf.Close()
+		// A single flipped bit is caught by the CRC and confirmed by
+		// authenticating the block.
+		f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 1)
+		offset := blockSize + 3*blockSize + 50
+		if _, err = f.ReadAt(b, offset); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0x10
+		if _, err = f.WriteAt(b, offset); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		cf = NewCryptFileWithOptions(tmp, newKey, 0, &CryptFileOptions{ReadOnly: true})
+		if bad, err = cf.Scrub(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(bad, []int64{3}) {
+			t.Errorf("%s: expected block 3 to be bad; got %v", tt.name, bad)
+		}
+		if err = cf.Verify(); !errors.Is(err, KeyError) || !strings.Contains(err.Error(), "block 3:") {
+			t.Errorf("%s: expected KeyError for block 3; got %v", tt.name, err)
+		}
+		cf.Close()
+	}
+	cf := NewCryptFile(path.Join(tmpdir, "none"), key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Scrub(); err == nil {
+		t.Error("expected an error scrubbing a file without CRCs")
+	}
+	cf = NewCryptFileWithOptions(path.Join(tmpdir, "sparse"), key, 0, &CryptFileOptions{CRC: true, Sparse: true})
+	if _, err := cf.Write(in); err == nil || errors.Is(err, KeyError) {
+		t.Errorf("expected an error for a sparse file with CRCs; got %v", err)
+	}
+	cf.Close()
+}
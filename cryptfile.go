@@ -1,21 +1,56 @@
 package brimcrypt
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
 	"crypto/aes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
+	"reflect"
+
+	"github.com/klauspost/reedsolomon"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/time/rate"
 )
 
+// File is the minimal file-like interface that CryptFile satisfies, as does
+// *os.File, for code that wants to work with either.
+type File interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Name() string
+}
+
+var _ File = (*CryptFile)(nil)
+
 type CryptFile struct {
 	Path              string
 	key               []byte
+	phrase            string
 	fallbackBlockSize int64
+	estimatedSize     int64
+	preallocate       bool
+	rand              io.Reader
+	fallbackSuite     CipherSuite
+	fallbackKDF       KDFParams
+	fileMode          os.FileMode
+	dirMode           os.FileMode
+	readOnly          bool
 	unknownState      bool
 	file              *os.File
+	suite             CipherSuite
+	kdf               KDFParams
+	salt              []byte
+	headerASize       int64
 	blockSize         int64
 	size              int64
 	headerDirty       bool
@@ -24,17 +59,436 @@ type CryptFile struct {
 	plainBlockIndex   int64
 	plainBlockDirty   bool
 	index             int64
+	cache             *blockCache
+	encryptWorkers    int
+	encryptQueue      []*encryptJob
+	blocks            int64
+	boundBlocks       bool
+	headerFeatures    uint16
+	compress          bool
+	compressed        bool
+	uncompressedSize  int64
+	uncompressedIndex int64
+	deflater          *flate.Writer
+	inflater          io.ReadCloser
+	sparse            bool
+	sparseFile        bool
+	blockMap          []int64
+	blockMapDirty     bool
+	blockMapSlot      int64
+	freeSlots         []int64
+	nextSlot          int64
+	encBuf            []byte
+	spareBlock        []byte
+	blockKeys         bool
+	fileKey           []byte
+	wideHeader        bool
+	readAhead         bool
+	ahead             *readAheadJob
+	aheadEnc          []byte
+	writeBehind       int
+	metrics           Metrics
+	stats             Stats
+	fresh             bool
+	lock              bool
+	recipients        [][]byte
+	recipient         int
+	merkle            bool
+	merkleFile        bool
+	merkleRoot        []byte
+	merkleLeaves      [][]byte
+	merkleDirty       bool
+	versioned         bool
+	versionedFile     bool
+	version           uint64
+	blockVersions     []uint64
+	minVersion        uint64
+	seenVersion       uint64
+	padding           bool
+	paddingBucket     int64
+	paddedFile        bool
+	paddedBucket      int64
+	progress          ProgressFunc
+	mmap              bool
+	mapped            []byte
+	keyCommit         bool
+	requireKeyCommit  bool
+	keyCommitFile     bool
+	dataShards        int
+	parityShards      int
+	parityFile        bool
+	shardData         int64
+	shardParity       int64
+	parityEnc         reedsolomon.Encoder
+	parityAt          int64
+	parityDirty       map[int64]bool
+	crc               bool
+	crcFile           bool
+	blockCRCs         []uint32
+	onAuthFailure     func(blockNumber int64, offset int64)
+	logger            Logger
+	limiter           *rate.Limiter
 }
 
 // NewCryptFile returns a new CryptFile for the path using the 32 byte
 // encryption key given. The estimated size is used to pick an optimal
-// encrypted block size, but may be 0 if unknown.
-func NewCryptFile(path string, key []byte, estimatedSize int64) *CryptFile {
-	return &CryptFile{
+// encrypted block size, but may be 0 if unknown. Any opts, such as
+// WithBlockSize, are applied in order.
+func NewCryptFile(path string, key []byte, estimatedSize int64, opts ...Option) *CryptFile {
+	cf := &CryptFile{
 		Path:              path,
 		key:               key,
-		fallbackBlockSize: blockSizeForSize(estimatedSize),
+		fallbackBlockSize: blockSizeForSize(estimatedSize, AES256CBCHMACSHA256.overhead()),
+		estimatedSize:     estimatedSize,
+		fileMode:          0600,
+		dirMode:           0700,
+	}
+	for _, opt := range opts {
+		opt(cf)
+	}
+	return cf
+}
+
+// Option is an optional setting for NewCryptFile. The options cover only the
+// few settings most often wanted; CryptFileOptions, with
+// NewCryptFileWithOptions, has them all and is preferred for new code.
+type Option func(*CryptFile)
+
+// WithBlockSize has the file use the encrypted block size given if it has to
+// be created rather than picking one from the estimated size, as with
+// NewCryptFileBlockSize. A block size that isn't valid gives a
+// *BlockSizeError when the file is created.
+func WithBlockSize(blockSize int64) Option {
+	return func(cf *CryptFile) {
+		cf.fallbackBlockSize = blockSize
+	}
+}
+
+// WithReadOnly has the file opened with os.O_RDONLY, such as for files on
+// read-only media, and makes any attempt to modify it an error, as with
+// CryptFileOptions.ReadOnly.
+func WithReadOnly() Option {
+	return func(cf *CryptFile) {
+		cf.readOnly = true
+	}
+}
+
+// WithFileMode sets the permissions given to the file if it has to be
+// created, as with CryptFileOptions.FileMode; 0 leaves the default of 0600.
+func WithFileMode(mode os.FileMode) Option {
+	return func(cf *CryptFile) {
+		if mode != 0 {
+			cf.fileMode = mode
+		}
+	}
+}
+
+// WithRandReader has the file read the salt, file key, IVs or nonces, and
+// padding from rnd instead of crypto/rand.Reader, as with
+// CryptFileOptions.Rand. It is only for making output reproducible in tests;
+// anything else gives up the security of the encryption.
+func WithRandReader(rnd io.Reader) Option {
+	return func(cf *CryptFile) {
+		cf.rand = rnd
+	}
+}
+
+// NewCryptFileBlockSize returns a new CryptFile for the path using the 32
+// byte encryption key given, which will use the encrypted block size given if
+// the file has to be created rather than picking one from an estimated size.
+// The block size must be a multiple of the AES block size and at least
+// minBlockSize (128); it is doubled as needed if the header doesn't fit with
+// the suite and features chosen. Existing files always use the block size
+// recorded in their header.
+func NewCryptFileBlockSize(path string, key []byte, blockSize int64) (*CryptFile, error) {
+	if err := checkBlockSize(blockSize); err != nil {
+		return nil, err
+	}
+	return NewCryptFile(path, key, 0, WithBlockSize(blockSize)), nil
+}
+
+// checkBlockSize returns a *BlockSizeError, without a Path, if the block size
+// can't be used for a new file.
+func checkBlockSize(blockSize int64) *BlockSizeError {
+	if blockSize < minBlockSize {
+		return &BlockSizeError{BlockSize: blockSize, msg: fmt.Sprintf("block size %d isn't at least %d", blockSize, minBlockSize)}
+	}
+	if blockSize%aes.BlockSize != 0 {
+		return &BlockSizeError{BlockSize: blockSize, msg: fmt.Sprintf("block size %d isn't a multiple of the AES block size %d", blockSize, aes.BlockSize)}
+	}
+	return nil
+}
+
+// CryptFileOptions holds the optional settings for NewCryptFileWithOptions.
+// The zero value gives the same behavior as NewCryptFile.
+type CryptFileOptions struct {
+	// Suite is the cipher suite to use if the file has to be created, and is
+	// taken into account when picking a block size from the estimated size. An
+	// existing file always uses the suite recorded in its header.
+	Suite CipherSuite
+	// Phrase, if not "", is used to derive the key instead of the key given
+	// to the constructor. A new file derives it with KDF and a random salt,
+	// both recorded in its header, and always has a file key as with
+	// BlockKeys, so RewrapKey only has to rewrite the header. An existing file
+	// uses whatever its header records, or the same SHA-256 derivation as Key
+	// if it records nothing.
+	Phrase string
+	// KDF is the key derivation used with Phrase when the file is created;
+	// nil means Argon2id with DefaultArgon2Params.
+	KDF KDFParams
+	// FileMode is the permissions given to the file if it has to be created;
+	// 0 means 0600.
+	FileMode os.FileMode
+	// DirMode is the permissions given to any parent directories that have to
+	// be created; 0 means 0700.
+	DirMode os.FileMode
+	// ReadOnly opens the file with os.O_RDONLY, such as for files on
+	// read-only media, and makes any attempt to modify it an error.
+	ReadOnly bool
+	// CacheBlocks and CacheBytes, if either is not 0, enable a least recently
+	// used cache of decrypted blocks, holding at most that many blocks and
+	// bytes of plaintext; 0 means no limit for that measure. This saves
+	// decrypting the same blocks over and over for random access workloads,
+	// such as scattered ReadAt calls.
+	CacheBlocks int
+	CacheBytes  int64
+	// EncryptWorkers, if more than 1, has up to that many filled blocks
+	// encrypted at once in background goroutines while writing continues,
+	// with the encrypted blocks written out in order. This speeds up large
+	// sequential writes on multicore machines; write errors may then be
+	// reported by a later call than the one that caused them, up to Close.
+	EncryptWorkers int
+	// Compress, if the file has to be created, has the plaintext compressed
+	// with DEFLATE before it is split into blocks and encrypted, which is
+	// recorded in the header. A compressed file can only be written
+	// sequentially from when it is created until it is closed or Seek is
+	// used; after that it can only be read. Seek on a compressed file works
+	// by reading forward, and going backward rewinds to the start first, so
+	// it can be slow; ReadAt is not supported.
+	Compress bool
+	// Sparse, if the file has to be created, has any block written as all
+	// zeros recorded as such in a block map rather than stored, with reads
+	// of it giving zeros without touching the disk. This saves space for
+	// files with large runs of zeros, at the cost of the block map, which
+	// is rewritten each time the header is. The map is never written over
+	// the one the header last recorded, so the file may hold two copies of
+	// it, but slots no longer used, by it or a block, are reused.
+	Sparse bool
+	// Preallocate, if the file has to be created and the estimated size
+	// given is not 0, reserves the disk space for that much data up front
+	// where the platform and filesystem support it, currently with fallocate
+	// on Linux, to avoid fragmentation as the file grows. The file's length
+	// isn't changed; only the space is reserved.
+	Preallocate bool
+	// Rand, if not nil, is used instead of crypto/rand.Reader for the salt,
+	// file key, IVs or nonces, and padding, such as to make the output
+	// reproducible in tests; anything else gives up the security of the
+	// encryption. With EncryptWorkers it is read from concurrently.
+	Rand io.Reader
+	// BlockKeys, if the file has to be created, gives it a random file key,
+	// stored in its encrypted header, from which each block's key is derived
+	// with HKDF and the block's place in the file, rather than encrypting
+	// every block under the key given. No single key then encrypts more than
+	// a block, and Rekey and RewrapKey only have to rewrite the header. Files
+	// created with a Phrase always have a file key.
+	BlockKeys bool
+	// ReadAhead, as each block is read in turn by Read or WriteTo, starts
+	// reading and decrypting the next one in a background goroutine so it's
+	// ready when wanted. Only one block is read ahead at a time, and it's
+	// discarded by a Seek or a write.
+	ReadAhead bool
+	// WriteBehind, if more than 0, has up to that many filled blocks both
+	// encrypted and written to the file by background goroutines while
+	// writing continues, rather than written out in order as Write goes as
+	// with EncryptWorkers alone; together, the larger of the two bounds the
+	// blocks in flight. An error writing a block is reported by a later
+	// call, up to Close, which waits for every block to be written.
+	WriteBehind int
+	// Metrics, if not nil, is told of the bytes read and written, blocks
+	// encrypted and decrypted, authentication failures, and block cache hits
+	// and misses.
+	Metrics Metrics
+	// Logger, if not nil, is given diagnostic messages about what goes wrong
+	// and how it is dealt with, such as blocks failing to authenticate or
+	// being repaired, and a file being given up on after an error. Without
+	// one nothing is logged.
+	Logger Logger
+	// Limiter, if not nil, paces the bytes of plaintext read and written, as
+	// with Metrics.ReadBytes and WroteBytes, to its limit in bytes per
+	// second. A Read, ReadAt, or Write waits once the bytes are through, and
+	// WriteTo before each write to the io.Writer, for as long as it takes
+	// the limiter to allow them, in turns of at most its burst; with the
+	// Context methods the wait ends early with an error once ctx is done.
+	// One Limiter may be shared by CryptFiles to cap them all together.
+	Limiter *rate.Limiter
+	// Lock takes an advisory lock on the file for as long as it is open,
+	// shared if ReadOnly and exclusive otherwise, so that another CryptFile
+	// for the same path, in this or another process, can't write it while
+	// it is being read or read it while it is being written. If the lock
+	// can't be had straight away, a *LockError is returned. This uses flock
+	// on Unix and LockFileEx on Windows, and does nothing elsewhere.
+	Lock bool
+	// Merkle, if the file has to be created, keeps a Merkle tree of hashes
+	// of its encrypted blocks, rewritten after the data blocks whenever the
+	// header is, with the root in the encrypted header. MerkleRoot gives the
+	// root as a fingerprint of the whole file, and VerifyRange checks just
+	// the blocks covering a range against it. It can't be used with Sparse.
+	Merkle bool
+	// Versioned, if the file has to be created, records a version number in
+	// its header that goes up each time the header is written, and
+	// authenticates each block along with the version it was last written
+	// under, so a block, or the whole file, rolled back to an older copy can
+	// be detected; see Version. It can't be used with Sparse.
+	Versioned bool
+	// MinVersion, if not 0, has opening a file whose Version is older, or
+	// which isn't versioned at all, give a *RollbackError. A CryptFile also
+	// remembers the newest version it has opened or written and refuses
+	// anything older when it reopens the file, and starts a file it creates
+	// from there.
+	MinVersion uint64
+	// Padding, if the file has to be created, pads it on disk with random
+	// bytes up to the next power of two in length, or with PaddingBucket up
+	// to the next multiple of that many bytes, rounded up to whole blocks, so
+	// its length gives away less about the size of its data. This can as
+	// much as double the space taken. The padding is kept up as the file is
+	// written to later, with or without this option.
+	Padding       bool
+	PaddingBucket int64
+	// Progress, if not nil, is told of the bytes of the file on disk handled
+	// so far by Rekey and Verify, out of all the blocks they'll go through
+	// including the header.
+	Progress ProgressFunc
+	// Mmap, with ReadOnly, maps the encrypted file into memory when it is
+	// opened and decrypts blocks straight from the mapping, saving a ReadAt
+	// call per block for random access to large files. It's unmapped by
+	// Close. Only what the file held when opened is mapped, and anything
+	// past that is read as usual. Mapping is only done on Unix, and on
+	// 32-bit systems only for files under 2GB; elsewhere, or if mapping
+	// fails, reads quietly go through ReadAt. Another process truncating
+	// the file while it's mapped can crash this one with SIGBUS, so this is
+	// only for files nothing else will shorten while they're open.
+	Mmap bool
+	// KeyCommit, if the file has to be created, records in its encrypted
+	// header a commitment to the exact key its blocks are under, the file
+	// key with BlockKeys or recipients, which is checked whenever the file
+	// is opened. The ChaCha20Poly1305 and AES256GCMSIV suites don't commit
+	// to a key themselves, so a header can be crafted to authenticate under
+	// more than one; with KeyCommit, opening such a file with the wrong one
+	// gives a *KeyCommitmentError. This matters most for files shared with
+	// AddRecipient, where a recipient could otherwise be handed a different
+	// file key than the others. The commitment takes 32 bytes of the header
+	// block, leaving room for fewer recipients.
+	KeyCommit bool
+	// RequireKeyCommit refuses to open a file without a key commitment, with
+	// an error matching ErrKeyCommitment, and implies KeyCommit for a file
+	// that has to be created. Whether a file has one is recorded in its
+	// plaintext header, so without this a file crafted to open under more
+	// than one key can simply leave it out.
+	RequireKeyCommit bool
+	// ParityShards, if the file has to be created and it's more than 0,
+	// stores that many Reed-Solomon parity blocks for each group of
+	// DataShards data blocks, or 16 if DataShards is 0, after the data
+	// blocks, rewritten whenever the header is. A block that fails to
+	// authenticate when read, or by Verify, is rebuilt from the rest of its
+	// group and the parity, as long as no more than ParityShards blocks of
+	// the group are bad, and written back unless ReadOnly. This guards
+	// against bit rot, taking ParityShards/DataShards more space, but not
+	// against tampering, as anyone able to alter the file can alter the
+	// parity too. DataShards and ParityShards can't be more than 256
+	// together, and this can't be used with Sparse.
+	ParityShards int
+	DataShards   int
+	// CRC, if the file has to be created, keeps a CRC-32C of each of its
+	// encrypted blocks, rewritten after the data blocks whenever the header
+	// is, so Scrub can look for bit rot far more cheaply than Verify. It
+	// can't be used with Sparse.
+	CRC bool
+	// OnAuthFailure, if not nil, is called with where a block or the header
+	// failed to authenticate, whether tampered with, damaged, or given the
+	// wrong key, before the error is returned, or before the block is
+	// repaired from any parity. The blockNumber counts from 0 for the first
+	// block after the header, as in the errors from Verify, and is -1 for
+	// the header; for a read from a sparse file it's the number of the block
+	// of data rather than where it's stored. The offset is where the block,
+	// or the part of the header that failed, starts in the file on disk. It
+	// is called from whichever goroutine is using the CryptFile.
+	OnAuthFailure func(blockNumber int64, offset int64)
+}
+
+// NewCryptFileWithOptions is the same as NewCryptFile but takes all the
+// settings through opts, which may be nil; it is preferred over the Option
+// functions, which cover only a few of them.
+func NewCryptFileWithOptions(path string, key []byte, estimatedSize int64, opts *CryptFileOptions) *CryptFile {
+	cf := NewCryptFile(path, key, estimatedSize)
+	if opts != nil {
+		cf.fallbackSuite = opts.Suite
+		if opts.Suite.valid() {
+			cf.fallbackBlockSize = blockSizeForSize(estimatedSize, opts.Suite.overhead())
+		}
+		cf.phrase = opts.Phrase
+		cf.fallbackKDF = opts.KDF
+		if opts.FileMode != 0 {
+			cf.fileMode = opts.FileMode
+		}
+		if opts.DirMode != 0 {
+			cf.dirMode = opts.DirMode
+		}
+		cf.readOnly = opts.ReadOnly
+		cf.cache = newBlockCache(opts.CacheBlocks, opts.CacheBytes)
+		cf.encryptWorkers = opts.EncryptWorkers
+		cf.compress = opts.Compress
+		cf.sparse = opts.Sparse
+		cf.preallocate = opts.Preallocate
+		cf.rand = opts.Rand
+		cf.blockKeys = opts.BlockKeys
+		cf.readAhead = opts.ReadAhead
+		cf.writeBehind = opts.WriteBehind
+		cf.metrics = opts.Metrics
+		cf.logger = opts.Logger
+		cf.limiter = opts.Limiter
+		cf.lock = opts.Lock
+		cf.merkle = opts.Merkle
+		cf.versioned = opts.Versioned
+		cf.minVersion = opts.MinVersion
+		cf.padding = opts.Padding
+		cf.paddingBucket = opts.PaddingBucket
+		cf.progress = opts.Progress
+		cf.mmap = opts.Mmap
+		cf.keyCommit = opts.KeyCommit || opts.RequireKeyCommit
+		cf.requireKeyCommit = opts.RequireKeyCommit
+		cf.dataShards = opts.DataShards
+		cf.parityShards = opts.ParityShards
+		cf.crc = opts.CRC
+		cf.onAuthFailure = opts.OnAuthFailure
+	}
+	return cf
+}
+
+// HeaderError indicates the plaintext part of a CryptFile header, such as its
+// block size, has been altered since it was written.
+var HeaderError = fmt.Errorf("header altered")
+
+// OpenForAppend returns a CryptFile for the path, opening it or creating it
+// if need be, positioned at the end of its data so writes append to it. Only
+// the last block, if partially filled, is rewritten along with the header;
+// earlier blocks are left untouched. The estimatedSize and opts, which may be
+// nil, are as for NewCryptFileWithOptions. Compressed files with data already
+// in them can't be appended to.
+func OpenForAppend(path string, key []byte, estimatedSize int64, opts *CryptFileOptions) (*CryptFile, error) {
+	cf := NewCryptFileWithOptions(path, key, estimatedSize, opts)
+	if err := cf.prepareWrite(); err != nil {
+		cf.Close()
+		return nil, err
+	}
+	if cf.compressed && cf.size > 0 {
+		cf.Close()
+		return nil, fmt.Errorf("%#v is compressed and can't be appended to", path)
 	}
+	if _, err := cf.Seek(0, 2); err != nil {
+		cf.Close()
+		return nil, err
+	}
+	return cf, nil
 }
 
 type unusableError string
@@ -43,6 +497,45 @@ func (u unusableError) Error() string {
 	return fmt.Sprintf("%#v is in an unusable state", u)
 }
 
+type readOnlyError string
+
+func (r readOnlyError) Error() string {
+	return fmt.Sprintf("%#v is read-only", r)
+}
+
+// Open opens the existing file, reading and checking its header, if it isn't
+// open already. Otherwise the file is opened by the first call that needs
+// it; Open gives a place to handle errors, such as os.ErrNotExist, up front.
+func (cf *CryptFile) Open() error {
+	return cf.open()
+}
+
+// Create creates the file, which must not already exist, returning an error
+// matching os.ErrExist if it does; Close must then be called before the
+// CryptFile is used again. Otherwise the file is created by the first write
+// when it can't be opened.
+func (cf *CryptFile) Create() error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.readOnly {
+		return readOnlyError(cf.Path)
+	}
+	if cf.file != nil {
+		return fmt.Errorf("%#v is already open", cf.Path)
+	}
+	return cf.create()
+}
+
+// OpenOrCreate opens the file as with Open or, if it doesn't exist, creates
+// it as with Create, which is what the first write does otherwise.
+func (cf *CryptFile) OpenOrCreate() error {
+	if err := cf.open(); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return cf.Create()
+}
+
 // Size returns the size of the decrypted data within the file.
 func (cf *CryptFile) Size() (int64, error) {
 	if cf.unknownState {
@@ -53,11 +546,78 @@ func (cf *CryptFile) Size() (int64, error) {
 			return 0, err
 		}
 	}
+	if cf.compressed {
+		return cf.uncompressedSize, nil
+	}
 	return cf.size, nil
 }
 
-// See io.Reader
+// Name returns the path of the file, the same as the Path field.
+func (cf *CryptFile) Name() string {
+	return cf.Path
+}
+
+// Stat returns the os.FileInfo for the underlying file, but with Size
+// reporting the size of the decrypted data rather than the padded encrypted
+// size on disk.
+func (cf *CryptFile) Stat() (os.FileInfo, error) {
+	if cf.file == nil {
+		if _, err := os.Stat(cf.Path); err != nil {
+			return nil, err
+		}
+	}
+	size, err := cf.Size()
+	if err != nil {
+		return nil, err
+	}
+	finfo, err := cf.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &cryptFileInfo{FileInfo: finfo, size: size}, nil
+}
+
+type cryptFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (c *cryptFileInfo) Size() int64 {
+	return c.size
+}
+
+// Salt returns the random salt generated for the file when it was created,
+// for use with KeyArgon2, KeyScrypt, or KeyPBKDF2. The salt is stored in the
+// plaintext part of the header so it can be read without the key; files
+// created before salts were stored will return a nil salt.
+func (cf *CryptFile) Salt() ([]byte, error) {
+	if cf.unknownState {
+		return nil, unusableError(cf.Path)
+	}
+	if cf.file != nil {
+		return append([]byte(nil), cf.salt...), nil
+	}
+	file, err := os.Open(cf.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ha, err := readHeaderA(file, cf.Path)
+	if err != nil {
+		return nil, err
+	}
+	return ha.salt, nil
+}
+
+// See io.Reader; io.EOF is only returned with no data, on the call after the
+// one that reached the end of the file.
 func (cf *CryptFile) Read(b []byte) (int, error) {
+	return cf.ReadContext(context.Background(), b)
+}
+
+// ReadContext is Read, returning an error once ctx is done while waiting on
+// CryptFileOptions.Limiter; the bytes already read are still counted in n.
+func (cf *CryptFile) ReadContext(ctx context.Context, b []byte) (int, error) {
 	if cf.unknownState {
 		return 0, unusableError(cf.Path)
 	}
@@ -66,12 +626,51 @@ func (cf *CryptFile) Read(b []byte) (int, error) {
 			return 0, err
 		}
 	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var n int
+	var err error
+	if cf.compressed {
+		n, err = cf.readCompressed(b)
+	} else {
+		n, err = cf.readRaw(b)
+	}
+	// Data and io.EOF together are easy for callers to mishandle, so io.EOF
+	// is left for the next call, which will return no data.
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	cf.countRead(int64(n))
+	if err == nil {
+		err = cf.waitLimiter(ctx, n)
+	}
+	return n, err
+}
+
+// readRaw reads the data stored in the blocks, which is compressed data for a
+// compressed file.
+func (cf *CryptFile) readRaw(b []byte) (int, error) {
+	// The last block is padded out with random bytes past the size, which
+	// must never reach the caller, not even in the unused part of b.
+	if cf.index >= cf.size {
+		return 0, io.EOF
+	}
 	if cf.plainBlock == nil {
 		if err := cf.read(); err != nil {
+			// The size says there's more, so the file's been cut short.
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
 			return 0, err
 		}
+		cf.startReadAhead(cf.index/cf.plainBlockSize + 1)
 	}
-	n := copy(b, cf.plainBlock[cf.plainBlockIndex:])
+	end := cf.plainBlockSize
+	if remaining := cf.size - cf.index; cf.plainBlockIndex+remaining < end {
+		end = cf.plainBlockIndex + remaining
+	}
+	n := copy(b, cf.plainBlock[cf.plainBlockIndex:end])
 	cf.plainBlockIndex += int64(n)
 	if cf.plainBlockIndex >= cf.plainBlockSize {
 		if cf.plainBlockDirty {
@@ -79,52 +678,139 @@ func (cf *CryptFile) Read(b []byte) (int, error) {
 				return n, err
 			}
 		}
-		cf.plainBlock = nil
+		cf.releasePlainBlock()
 		cf.plainBlockIndex = 0
 	}
 	cf.index += int64(n)
-	if cf.index > cf.size {
-		n -= int(cf.index - cf.size)
-		cf.index = cf.size
+	return n, nil
+}
+
+// ReadByte implements io.ByteReader, returning io.EOF at the end of the file.
+// Bytes are taken straight from the decrypted block while it lasts, so
+// reading a byte at a time costs little more than reading in bulk.
+func (cf *CryptFile) ReadByte() (byte, error) {
+	if !cf.unknownState && cf.file != nil && !cf.compressed && cf.limiter == nil && cf.plainBlock != nil && cf.index < cf.size && cf.plainBlockIndex+1 < cf.plainBlockSize {
+		c := cf.plainBlock[cf.plainBlockIndex]
+		cf.plainBlockIndex++
+		cf.index++
+		cf.countRead(1)
+		return c, nil
 	}
-	if n <= 0 {
-		return n, io.EOF
+	var b [1]byte
+	if _, err := io.ReadFull(cf, b[:]); err != nil {
+		return 0, err
 	}
-	return n, nil
+	return b[0], nil
 }
 
-// See io.Writer
-func (cf *CryptFile) Write(b []byte) (int, error) {
+// ReadAt implements io.ReaderAt; it neither uses nor changes the position
+// used by Read, Write, and Seek. Any pending write to the current block is
+// included in what is read.
+func (cf *CryptFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := cf.readAt(b, off)
+	cf.countRead(int64(n))
+	if err == nil {
+		err = cf.waitLimiter(context.Background(), n)
+	}
+	return n, err
+}
+
+func (cf *CryptFile) readAt(b []byte, off int64) (int, error) {
 	if cf.unknownState {
 		return 0, unusableError(cf.Path)
 	}
 	if cf.file == nil {
 		if err := cf.open(); err != nil {
-			if !os.IsNotExist(err) {
-				return 0, err
-			}
-			if err := cf.create(); err != nil {
-				return 0, err
-			}
+			return 0, err
 		}
 	}
+	if cf.compressed {
+		return 0, fmt.Errorf("%#v is compressed and does not support ReadAt", cf.Path)
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("%#v invalid read offset %d", cf.Path, off)
+	}
 	n := 0
 	for len(b) > 0 {
-		if cf.plainBlock == nil {
-			if err := cf.read(); err != nil {
+		if off >= cf.size {
+			return n, io.EOF
+		}
+		blockNumber := off / cf.plainBlockSize
+		start := off % cf.plainBlockSize
+		end := cf.plainBlockSize
+		if remaining := cf.size - off; start+remaining < end {
+			end = start + remaining
+		}
+		if start+int64(len(b)) < end {
+			end = start + int64(len(b))
+		}
+		plain := cf.plainBlock
+		spare := false
+		if plain == nil || !cf.plainBlockDirty || blockNumber != cf.index/cf.plainBlockSize {
+			var err error
+			if plain, err = cf.readBlockRange(blockNumber, start, end); err != nil {
 				if err == io.EOF {
-					cf.plainBlock = make([]byte, cf.plainBlockSize)
-					if _, err = rand.Read(cf.plainBlock); err != nil {
-						cf.unknownState = true
-						cf.file.Close()
-						cf.file = nil
-						return 0, err
-					}
-					cf.plainBlockIndex = 0
-					cf.plainBlockDirty = false
-				} else {
-					return 0, err
+					err = io.ErrUnexpectedEOF
 				}
+				return n, err
+			}
+			spare = true
+		}
+		n2 := copy(b, plain[start:end])
+		if spare {
+			cf.spareBlock = plain
+		}
+		n += n2
+		b = b[n2:]
+		off += int64(n2)
+	}
+	return n, nil
+}
+
+// See io.Writer
+//
+// Writing before the end of the file overwrites what was there, as with an
+// os.File; the file's size only grows.
+func (cf *CryptFile) Write(b []byte) (int, error) {
+	return cf.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write, returning an error once ctx is done while waiting on
+// CryptFileOptions.Limiter; the bytes already written are still counted in n.
+func (cf *CryptFile) WriteContext(ctx context.Context, b []byte) (int, error) {
+	if err := cf.prepareWrite(); err != nil {
+		return 0, err
+	}
+	var n int
+	var err error
+	if cf.compressed {
+		n, err = cf.writeCompressed(b)
+	} else {
+		n, err = cf.writeRaw(b)
+	}
+	cf.countWrite(int64(n))
+	if err == nil {
+		err = cf.waitLimiter(ctx, n)
+	}
+	return n, err
+}
+
+// writeRaw writes the data stored in the blocks, which is compressed data for
+// a compressed file.
+func (cf *CryptFile) writeRaw(b []byte) (int, error) {
+	if err := cf.fillGap(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for len(b) > 0 {
+		if cf.plainBlock == nil {
+			if cf.plainBlockIndex == 0 && int64(len(b)) >= cf.plainBlockSize {
+				// The whole block is about to be overwritten, so there's no
+				// need to read it first.
+				cf.plainBlock = cf.newPlainBlock()
+				cf.plainBlockDirty = false
+			} else if err := cf.loadPlainBlock(); err != nil {
+				return 0, err
 			}
 		}
 		n2 := copy(cf.plainBlock[cf.plainBlockIndex:], b)
@@ -135,12 +821,14 @@ func (cf *CryptFile) Write(b []byte) (int, error) {
 				if err := cf.write(); err != nil {
 					return 0, err
 				}
-				cf.plainBlock = nil
+				cf.releasePlainBlock()
 				cf.plainBlockIndex = 0
 				cf.plainBlockDirty = false
 			}
 			cf.index += int64(n2)
-			cf.size = cf.index
+			if cf.index > cf.size {
+				cf.size = cf.index
+			}
 			cf.headerDirty = true
 		}
 		n += n2
@@ -149,24 +837,101 @@ func (cf *CryptFile) Write(b []byte) (int, error) {
 	return n, nil
 }
 
-// WriteAsEmpty will write one encrypted data block but set the size in the
-// header to 0. This makes it so an observer cannot tell the difference between
-// a small single block file and a zero-byte file. Sometimes knowing a file is
-// zero-bytes gives away information, so empty files should always use
-// WriteAsEmpty.
-func (cf *CryptFile) WriteAsEmpty() error {
-	_, err := cf.Write([]byte{0})
-	if err != nil {
-		return err
+// WriteByte implements io.ByteWriter. Like ReadByte, it goes straight to the
+// decrypted block while it lasts.
+func (cf *CryptFile) WriteByte(c byte) error {
+	if !cf.unknownState && cf.file != nil && !cf.readOnly && !cf.compressed && cf.limiter == nil && cf.plainBlock != nil && cf.index <= cf.size && cf.plainBlockIndex+1 < cf.plainBlockSize {
+		cf.plainBlock[cf.plainBlockIndex] = c
+		cf.plainBlockDirty = true
+		cf.plainBlockIndex++
+		cf.index++
+		if cf.index > cf.size {
+			cf.size = cf.index
+		}
+		cf.headerDirty = true
+		cf.countWrite(1)
+		return nil
 	}
-	cf.index = 0
-	cf.size = 0
-	cf.headerDirty = true
-	return nil
+	_, err := cf.Write([]byte{c})
+	return err
 }
 
-// See io.Seeker
-func (cf *CryptFile) Seek(offset int64, whence int) (int64, error) {
+// ReadFrom implements io.ReaderFrom, reading from r straight into the
+// plaintext block buffer rather than through an intermediate buffer as
+// io.Copy would otherwise do with Write.
+func (cf *CryptFile) ReadFrom(r io.Reader) (n int64, err error) {
+	return cf.ReadFromContext(context.Background(), r)
+}
+
+// ReadFromContext is ReadFrom, checking ctx before each read from r and
+// returning ctx.Err() once it is done, or an error if it is done while
+// waiting on CryptFileOptions.Limiter. What was read before then is kept as
+// if written with Write, with the position just after it, so the CryptFile
+// is still usable and nothing is lost that n counts.
+func (cf *CryptFile) ReadFromContext(ctx context.Context, r io.Reader) (n int64, err error) {
+	if err := cf.prepareWrite(); err != nil {
+		return 0, err
+	}
+	if cf.compressed {
+		// Write does the counting.
+		return io.Copy(cryptFileContext{cf: cf, ctx: ctx}, &contextReader{ctx: ctx, r: r})
+	}
+	defer func() { cf.countWrite(n) }()
+	if err := cf.fillGap(); err != nil {
+		return 0, err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if cf.plainBlock == nil {
+			if err := cf.loadPlainBlock(); err != nil {
+				return n, err
+			}
+		}
+		n2, err := r.Read(cf.plainBlock[cf.plainBlockIndex:])
+		if n2 > 0 {
+			cf.plainBlockDirty = true
+			cf.plainBlockIndex += int64(n2)
+			if cf.plainBlockIndex >= cf.plainBlockSize {
+				if err := cf.write(); err != nil {
+					return n, err
+				}
+				cf.releasePlainBlock()
+				cf.plainBlockIndex = 0
+				cf.plainBlockDirty = false
+			}
+			cf.index += int64(n2)
+			if cf.index > cf.size {
+				cf.size = cf.index
+			}
+			cf.headerDirty = true
+			n += int64(n2)
+		}
+		if err := cf.waitLimiter(ctx, n2); err != nil {
+			return n, err
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, writing the plaintext from the current
+// position to the end of the file to w straight from each decrypted block
+// rather than through an intermediate buffer as io.Copy would otherwise do
+// with Read. The position is left at the end of the file.
+func (cf *CryptFile) WriteTo(w io.Writer) (n int64, err error) {
+	return cf.WriteToContext(context.Background(), w)
+}
+
+// WriteToContext is WriteTo, checking ctx before each write to w and returning
+// ctx.Err() once it is done, or an error if it is done while waiting on
+// CryptFileOptions.Limiter, with the position just after what was written.
+func (cf *CryptFile) WriteToContext(ctx context.Context, w io.Writer) (n int64, err error) {
 	if cf.unknownState {
 		return 0, unusableError(cf.Path)
 	}
@@ -175,169 +940,1687 @@ func (cf *CryptFile) Seek(offset int64, whence int) (int64, error) {
 			return 0, err
 		}
 	}
-	var newIndex int64
-	switch whence {
-	case 0:
-		newIndex = offset
-	case 1:
-		newIndex = cf.index + offset
-	case 2:
-		newIndex = cf.size + offset
-	default:
-		return cf.index, fmt.Errorf("%#v invalid seek whence %d", cf.Path, whence)
-	}
-	if newIndex < 0 {
-		return cf.index, fmt.Errorf("%#v invalid seek result %d", cf.Path, newIndex)
+	if cf.compressed {
+		// Read does the counting.
+		return io.Copy(&contextWriter{ctx: ctx, w: w}, cryptFileContext{cf: cf, ctx: ctx})
 	}
-	if newIndex/cf.plainBlockSize != cf.index/cf.plainBlockSize {
-		if cf.plainBlockDirty {
-			if err := cf.write(); err != nil {
-				return cf.index, err
-			}
+	defer func() { cf.countRead(n) }()
+	for cf.index < cf.size {
+		if err := ctx.Err(); err != nil {
+			return n, err
 		}
-		cf.plainBlock = nil
-	}
-	cf.index = newIndex
-	cf.plainBlockIndex = newIndex % cf.plainBlockSize
-	return cf.index, nil
-}
-
-// See io.Closer
-func (cf *CryptFile) Close() error {
-	if !cf.unknownState {
-		if cf.plainBlockDirty {
-			if err := cf.write(); err != nil {
-				return err
+		if cf.plainBlock == nil {
+			if err := cf.read(); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, err
 			}
+			cf.startReadAhead(cf.index/cf.plainBlockSize + 1)
+		}
+		end := cf.plainBlockSize
+		if remaining := cf.size - cf.index; cf.plainBlockIndex+remaining < end {
+			end = cf.plainBlockIndex + remaining
 		}
-		if cf.headerDirty {
-			if err := cf.writeHeader(); err != nil {
-				return err
+		want := int(end - cf.plainBlockIndex)
+		if err := cf.waitLimiter(ctx, want); err != nil {
+			return n, err
+		}
+		n2, err := w.Write(cf.plainBlock[cf.plainBlockIndex:end])
+		if err == nil && n2 < want {
+			err = io.ErrShortWrite
+		}
+		cf.plainBlockIndex += int64(n2)
+		if cf.plainBlockIndex >= cf.plainBlockSize {
+			if cf.plainBlockDirty {
+				if err := cf.write(); err != nil {
+					return n, err
+				}
 			}
+			cf.releasePlainBlock()
+			cf.plainBlockIndex = 0
+		}
+		cf.index += int64(n2)
+		n += int64(n2)
+		if err != nil {
+			return n, err
 		}
 	}
-	if cf.file != nil {
-		cf.file.Close()
-		cf.file = nil
-	}
-	cf.unknownState = false
-	cf.blockSize = 0
-	cf.size = 0
-	cf.headerDirty = false
-	cf.plainBlockSize = 0
-	cf.plainBlock = nil
-	cf.plainBlockIndex = 0
-	cf.plainBlockDirty = false
-	cf.index = 0
-	return nil
+	return n, nil
 }
 
-// aes.BlockSize * 2
-const header0ASize = 32
+// contextReader reads from r until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-// int64
+func (cr *contextReader) Read(b []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(b)
+}
+
+// contextWriter writes to w until ctx is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(b []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(b)
+}
+
+// prepareWrite ensures the file is open for writing, creating it if need be.
+func (cf *CryptFile) prepareWrite() error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.readOnly {
+		return readOnlyError(cf.Path)
+	}
+	return cf.OpenOrCreate()
+}
+
+// loadPlainBlock reads the current block so it can be written to, or starts a
+// new random filled block if the current block is beyond the end of the file.
+func (cf *CryptFile) loadPlainBlock() error {
+	if err := cf.read(); err != nil {
+		if err != io.EOF {
+			return err
+		}
+		cf.plainBlock = cf.newPlainBlock()
+		if _, err = io.ReadFull(cf.random(), cf.plainBlock); err != nil {
+			cf.fail()
+			return err
+		}
+		cf.plainBlockIndex = 0
+		cf.plainBlockDirty = false
+	}
+	return nil
+}
+
+// fillGap writes zeros from the end of the file up to the current position,
+// if Seek has moved past the end, so a write there extends the file as if the
+// gap had been written as zeros.
+func (cf *CryptFile) fillGap() error {
+	if cf.index <= cf.size {
+		return nil
+	}
+	gap := cf.index - cf.size
+	if _, err := cf.seekRaw(cf.size, 0); err != nil {
+		return err
+	}
+	zeros := make([]byte, cf.plainBlockSize)
+	for gap > 0 {
+		b := zeros
+		if gap < int64(len(b)) {
+			b = b[:gap]
+		}
+		n, err := cf.writeRaw(b)
+		gap -= int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteAsEmpty will write one encrypted data block but set the size in the
+// header to 0. This makes it so an observer cannot tell the difference between
+// a small single block file and a zero-byte file. Sometimes knowing a file is
+// zero-bytes gives away information, so empty files should always use
+// WriteAsEmpty.
+func (cf *CryptFile) WriteAsEmpty() error {
+	if err := cf.prepareWrite(); err != nil {
+		return err
+	}
+	if cf.compressed {
+		return cf.writeCompressedAsEmpty()
+	}
+	_, err := cf.Write([]byte{0})
+	if err != nil {
+		return err
+	}
+	cf.index = 0
+	cf.size = 0
+	cf.headerDirty = true
+	return nil
+}
+
+// See io.Seeker
+//
+// Seeking past the end of the file and then writing extends the file, with
+// the gap reading back as zeros.
+func (cf *CryptFile) Seek(offset int64, whence int) (int64, error) {
+	if cf.unknownState {
+		return 0, unusableError(cf.Path)
+	}
+	if cf.file == nil {
+		if err := cf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if cf.compressed {
+		return cf.seekCompressed(offset, whence)
+	}
+	return cf.seekRaw(offset, whence)
+}
+
+// Tell returns the current position, as Seek(0, 1) would, without otherwise
+// touching the file; before the file is opened, that's 0.
+func (cf *CryptFile) Tell() (int64, error) {
+	if cf.unknownState {
+		return 0, unusableError(cf.Path)
+	}
+	if cf.compressed {
+		return cf.uncompressedIndex, nil
+	}
+	return cf.index, nil
+}
+
+// Rewind moves back to the start of the file, as Seek(0, 0) does.
+func (cf *CryptFile) Rewind() error {
+	_, err := cf.Seek(0, 0)
+	return err
+}
+
+func (cf *CryptFile) seekRaw(offset int64, whence int) (int64, error) {
+	var newIndex int64
+	switch whence {
+	case 0:
+		newIndex = offset
+	case 1:
+		newIndex = cf.index + offset
+	case 2:
+		newIndex = cf.size + offset
+	default:
+		return cf.index, &SeekError{Path: cf.Path, Offset: offset, Whence: whence, msg: fmt.Sprintf("invalid seek whence %d", whence)}
+	}
+	if newIndex < 0 {
+		return cf.index, &SeekError{Path: cf.Path, Offset: offset, Whence: whence, msg: fmt.Sprintf("invalid seek result %d", newIndex)}
+	}
+	cf.dropReadAhead()
+	if newIndex/cf.plainBlockSize != cf.index/cf.plainBlockSize {
+		if cf.plainBlockDirty {
+			if err := cf.write(); err != nil {
+				return cf.index, err
+			}
+		}
+		cf.releasePlainBlock()
+	}
+	cf.index = newIndex
+	cf.plainBlockIndex = newIndex % cf.plainBlockSize
+	return cf.index, nil
+}
+
+// Rekey re-encrypts every block of the file, and then its header, with
+// newKey; each block is given a fresh IV as it is rewritten in place. For a
+// file created with the BlockKeys option only the header, which holds the
+// file key, has to be rewritten; if it has recipients added with
+// AddRecipient, only the entry for the CryptFile's own key is changed. If
+// Rekey fails partway through, the CryptFile is left in an unusable state and the
+// file will have a mix of blocks under the old and new keys, with the header
+// still under the old key. Running Rekey again with the same newKey from a
+// CryptFile using the old key will finish the job, as blocks already under
+// newKey are left as they are.
+func (cf *CryptFile) Rekey(newKey []byte) error {
+	return cf.rekey(context.Background(), newKey, "", nil)
+}
+
+// RekeyContext is Rekey, checking ctx before each block and returning
+// ctx.Err() once it is done. Being cancelled is like failing partway through:
+// each block is wholly under one key or the other, the header is still under
+// the old key, and the CryptFile is left unusable; running Rekey again with
+// the same newKey from a new CryptFile will finish the job.
+func (cf *CryptFile) RekeyContext(ctx context.Context, newKey []byte) error {
+	return cf.rekey(ctx, newKey, "", nil)
+}
+
+// RewrapKey changes the key phrase for the file from oldPass to newPass, with
+// the new key derived the same way as the old one, such as with the KDF and
+// salt recorded in the header. A file created with a phrase, or with the
+// BlockKeys option, has its blocks under keys derived from a random file key,
+// which the header holds wrapped under the phrase's key, so only the header
+// has to be rewritten however large the file is. Only a file from before
+// then, with no file key, has every block re-encrypted, as with Rekey, whose
+// notes on failing partway through apply here too. A KeyError is returned if
+// oldPass isn't the file's phrase.
+func (cf *CryptFile) RewrapKey(oldPass, newPass []byte) error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.readOnly {
+		return readOnlyError(cf.Path)
+	}
+	if cf.file == nil {
+		phrase := cf.phrase
+		cf.phrase = string(oldPass)
+		if err := cf.open(); err != nil {
+			cf.phrase = phrase
+			return err
+		}
+	} else {
+		oldKey, err := cf.phraseKey(string(oldPass))
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(oldKey, cf.key) {
+			return KeyError
+		}
+	}
+	newKey, err := cf.phraseKey(string(newPass))
+	if err != nil {
+		return err
+	}
+	return cf.rekey(context.Background(), newKey, string(newPass), cf.kdf)
+}
+
+// phraseKey derives the key for the phrase as the open file's header says to.
+func (cf *CryptFile) phraseKey(phrase string) ([]byte, error) {
+	if cf.kdf == nil {
+		return keyPhrase(phrase), nil
+	}
+	key, err := cf.kdf.deriveKey(phrase, cf.salt)
+	if err != nil {
+		return nil, fmt.Errorf("%#v deriving key: %w", cf.Path, err)
+	}
+	return key, nil
+}
+
+// rekey is RekeyContext, with the phrase, if any, that newKey was derived from
+// with kdf.
+func (cf *CryptFile) rekey(ctx context.Context, newKey []byte, phrase string, kdf KDFParams) error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.readOnly {
+		return readOnlyError(cf.Path)
+	}
+	if cf.file == nil {
+		if err := cf.open(); err != nil {
+			return err
+		}
+	}
+	if cf.plainBlockDirty {
+		if err := cf.write(); err != nil {
+			return err
+		}
+	}
+	cf.plainBlock = nil
+	cf.dropReadAhead()
+	if err := cf.flushQueue(); err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		cf.unknownState = true
+		cf.file.Close()
+		cf.file = nil
+		return err
+	}
+	finfo, err := cf.file.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	blocks := (finfo.Size() - cf.blockSize + cf.blockSize - 1) / cf.blockSize
+	if cf.paddedFile && blocks > cf.endSlot() {
+		blocks = cf.endSlot()
+	}
+	if cf.parityFile && blocks > cf.paritySlot() {
+		blocks = cf.paritySlot()
+	}
+	if cf.fileKey != nil {
+		// The blocks are under keys derived from the file key, which
+		// only the header holds.
+		blocks = 0
+	}
+	if cf.parityFile && blocks > 0 {
+		// The parity is rebuilt from the rekeyed blocks when the header
+		// is written.
+		cf.parityAt = -1
+	}
+	// The Merkle tree's leaves, and the CRCs, are rebuilt as the blocks are
+	// rewritten; the tree and table themselves are rewritten with the
+	// header.
+	var leaves [][]byte
+	if cf.merkleFile && blocks > 0 {
+		leaves = make([][]byte, cf.blocks)
+	}
+	var crcs []uint32
+	if cf.crcFile && blocks > 0 {
+		crcs = make([]uint32, cf.blocks)
+	}
+	prog := newProgress(cf.progress, (blocks+1)*cf.blockSize)
+	enc := make([]byte, cf.blockSize)
+	for blockNumber := int64(0); blockNumber < blocks; blockNumber++ {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		prog.add(cf.blockSize)
+		offset := cf.blockSize + blockNumber*cf.blockSize
+		n, err := cf.file.ReadAt(enc, offset)
+		if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+			return fail(err)
+		}
+		ad := cf.blockAD(blockNumber)
+		dec, err := cf.suite.decrypt(enc, cf.key, ad)
+		if err == KeyError {
+			if _, err2 := cf.suite.decrypt(enc, newKey, ad); err2 == nil {
+				if blockNumber < int64(len(leaves)) {
+					leaves[blockNumber] = merkleLeaf(enc)
+				}
+				if blockNumber < int64(len(crcs)) {
+					crcs[blockNumber] = blockCRC(enc)
+				}
+				continue
+			}
+		}
+		if err != nil {
+			return fail(fmt.Errorf("%#v block %d: %w", cf.Path, blockNumber, err))
+		}
+		enc2, err := cf.suite.encryptTo(nil, cf.random(), dec, newKey, ad)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err = cf.file.WriteAt(enc2, offset); err != nil {
+			return fail(err)
+		}
+		if blockNumber < int64(len(leaves)) {
+			leaves[blockNumber] = merkleLeaf(enc2)
+		}
+		if blockNumber < int64(len(crcs)) {
+			crcs[blockNumber] = blockCRC(enc2)
+		}
+	}
+	if leaves != nil {
+		cf.merkleLeaves = leaves
+		cf.merkleDirty = true
+	}
+	if crcs != nil {
+		cf.blockCRCs = crcs
+	}
+	prog.add(cf.blockSize)
+	if cf.recipients != nil {
+		// Only this CryptFile's own entry is rewrapped; other recipients'
+		// keys still open the file.
+		entry, err := cf.wrapFileKey(newKey)
+		if err != nil {
+			return fail(err)
+		}
+		cf.recipients = append([][]byte(nil), cf.recipients...)
+		cf.recipients[cf.recipient] = entry
+	}
+	cf.key = newKey
+	cf.phrase = phrase
+	cf.kdf = kdf
+	if err = cf.writeHeader(); err != nil {
+		return err
+	}
+	cf.headerDirty = false
+	prog.finish()
+	return nil
+}
+
+// Shred overwrites the whole file in place with random bytes, syncs it to
+// disk, and then removes it, discarding anything not yet written. The key is
+// checked first, so a file the CryptFile couldn't read is left alone; a
+// truncated file is still shredded. This only helps where the filesystem
+// writes over the same disk blocks: SSDs remap writes for wear leveling, and
+// copy-on-write filesystems such as btrfs and ZFS, snapshots, and backups all
+// keep the old data elsewhere, so the encryption remains the real protection.
+func (cf *CryptFile) Shred() error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.readOnly {
+		return readOnlyError(cf.Path)
+	}
+	if cf.file == nil {
+		if err := cf.openFile(true); err != nil {
+			return err
+		}
+	}
+	cf.plainBlockDirty = false
+	cf.headerDirty = false
+	// A block being written behind could otherwise land after the random
+	// bytes.
+	cf.drainQueue()
+	cf.deflater = nil
+	cf.dropReadAhead()
+	fail := func(err error) error {
+		cf.unknownState = true
+		cf.file.Close()
+		cf.file = nil
+		return fmt.Errorf("%#v shredding: %w", cf.Path, err)
+	}
+	finfo, err := cf.file.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	b := make([]byte, cf.blockSize)
+	for offset := int64(0); offset < finfo.Size(); offset += int64(len(b)) {
+		if remaining := finfo.Size() - offset; remaining < int64(len(b)) {
+			b = b[:remaining]
+		}
+		if _, err = io.ReadFull(cf.random(), b); err != nil {
+			return fail(err)
+		}
+		if _, err = cf.file.WriteAt(b, offset); err != nil {
+			return fail(err)
+		}
+	}
+	if err = cf.file.Sync(); err != nil {
+		return fail(err)
+	}
+	cf.Close()
+	return os.Remove(cf.Path)
+}
+
+// Verify checks that the header and every block of the file authenticate
+// with the key, without returning any plaintext; for AES256CBCHMACSHA256
+// files the blocks are not even decrypted. It also checks the file is a whole
+// number of blocks long, and gives a *TruncationError if it has fewer blocks than
+// its header records. Any pending writes are flushed first. The error for a block
+// that fails names its block number, counting from 0 for the first data
+// block after the header. For a file with ParityShards, a block that can be
+// repaired from the parity isn't an error, and the parity itself is checked
+// against the blocks.
+func (cf *CryptFile) Verify() error {
+	return cf.VerifyContext(context.Background())
+}
+
+// VerifyContext is Verify, checking ctx before each block and returning
+// ctx.Err() once it is done. Verify only reads, so the file and the CryptFile
+// are as they were, other than any pending writes having been flushed and any
+// blocks repaired from parity written back.
+func (cf *CryptFile) VerifyContext(ctx context.Context) error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.file == nil {
+		if err := cf.openFile(true); err != nil {
+			return err
+		}
+	}
+	if cf.plainBlockDirty {
+		if err := cf.write(); err != nil {
+			return err
+		}
+		cf.plainBlock = nil
+	}
+	if err := cf.flushQueue(); err != nil {
+		return err
+	}
+	if cf.headerDirty {
+		if err := cf.writeHeader(); err != nil {
+			return err
+		}
+		cf.headerDirty = false
+	}
+	finfo, err := cf.file.Stat()
+	if err != nil {
+		return err
+	}
+	if finfo.Size()%cf.blockSize != 0 {
+		return &LengthError{Path: cf.Path, Length: finfo.Size(), BlockSize: cf.blockSize}
+	}
+	if blocks := finfo.Size()/cf.blockSize - 1; blocks < cf.blocks {
+		return &TruncationError{Path: cf.Path, Blocks: blocks, Expected: cf.blocks}
+	}
+	blocks := finfo.Size()/cf.blockSize - 1
+	if cf.paddedFile && blocks > cf.endSlot() {
+		// The padding is just random bytes.
+		blocks = cf.endSlot()
+	}
+	if cf.parityFile && blocks > cf.paritySlot() {
+		// The parity is checked against the data blocks once they are.
+		blocks = cf.paritySlot()
+	}
+	prog := newProgress(cf.progress, (blocks+1)*cf.blockSize)
+	enc := make([]byte, cf.blockSize)
+	n, err := cf.file.ReadAt(enc[:cf.blockSize-cf.headerASize], cf.headerASize)
+	if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize-cf.headerASize)) {
+		return err
+	}
+	if err = cf.suite.verify(enc[:cf.blockSize-cf.headerASize], cf.headerKey(), cf.blockAD(-1)); err != nil {
+		cf.countAuth(err, -1, cf.headerASize)
+		return fmt.Errorf("%#v header: %w", cf.Path, err)
+	}
+	prog.add(cf.blockSize)
+	for blockNumber := int64(0); blockNumber < blocks; blockNumber++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := cf.file.ReadAt(enc, cf.blockSize+blockNumber*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+			return err
+		}
+		if err = cf.suite.verify(enc, cf.blockKey(blockNumber), cf.blockAD(blockNumber)); err != nil {
+			cf.countAuth(err, blockNumber, cf.blockSize+blockNumber*cf.blockSize)
+			if err != KeyError || cf.repairBlock(blockNumber) == nil {
+				return fmt.Errorf("%#v block %d: %w", cf.Path, blockNumber, err)
+			}
+		}
+		prog.add(cf.blockSize)
+	}
+	if cf.parityFile {
+		if err = cf.verifyParity(); err != nil {
+			return err
+		}
+	}
+	prog.finish()
+	return nil
+}
+
+// ScanFile opens the file at the path with the key and checks every data
+// block authenticates, as Verify does, but carries on past any that don't
+// and returns the block numbers of all of them, in order, counting from 0 for
+// the first data block after the header; a healthy file gives an empty list.
+// Blocks missing from a truncated file are included. For AES256CBCHMACSHA256
+// files only the HMAC is checked, without decrypting. The header still has to
+// authenticate, as it says how many blocks there should be, and anything
+// stored after the data blocks isn't checked. Blocks aren't repaired from any
+// parity, so this is a report of the damage as it is on disk.
+func ScanFile(path string, key []byte) ([]int64, error) {
+	cf := NewCryptFile(path, key, 0, WithReadOnly())
+	defer cf.Close()
+	if err := cf.openFile(true); err != nil {
+		return nil, err
+	}
+	blocks := cf.dataBlocks()
+	bad := []int64{}
+	enc := make([]byte, cf.blockSize)
+	for blockNumber := int64(0); blockNumber < blocks; blockNumber++ {
+		slot, zero, err := cf.lookupSlot(blockNumber)
+		if err != nil {
+			return bad, err
+		}
+		if zero {
+			continue
+		}
+		n, err := cf.file.ReadAt(enc, cf.blockSize+slot*cf.blockSize)
+		if err != nil && err != io.EOF {
+			return bad, fmt.Errorf("%#v reading block %d: %w", path, blockNumber, err)
+		}
+		if int64(n) == cf.blockSize {
+			if err = cf.suite.verify(enc, cf.blockKey(slot), cf.blockAD(slot)); err == nil {
+				continue
+			}
+			if err != KeyError {
+				return bad, fmt.Errorf("%#v block %d: %w", path, blockNumber, err)
+			}
+		}
+		bad = append(bad, blockNumber)
+	}
+	return bad, nil
+}
+
+// dataBlocks returns the number of data blocks, including the all zero blocks
+// of a sparse file that aren't stored.
+func (cf *CryptFile) dataBlocks() int64 {
+	if cf.sparseFile {
+		return int64(len(cf.blockMap))
+	}
+	return cf.blocks
+}
+
+// RewriteBlock encrypts plain afresh as the data block given, counting from 0
+// for the first block after the header, and writes it in place, such as to
+// fix a damaged block from a good copy of its plaintext. The block must
+// already exist and plain must be exactly a block of plaintext, as
+// PlainBlockSize from ReadHeader gives. Other blocks, and the size, are left
+// as they are: for the last block, only what is within the size will ever
+// be read back, and the rest is replaced with random bytes as usual. Any
+// pending writes are flushed first. As with Write, anything the header
+// keeps about the blocks, such as a Merkle tree, is brought up to date when
+// the header is next written, such as by Close. Compressed files are not
+// supported.
+func (cf *CryptFile) RewriteBlock(blockNumber int64, plain []byte) error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.readOnly {
+		return readOnlyError(cf.Path)
+	}
+	if err := cf.open(); err != nil {
+		return err
+	}
+	if cf.compressed {
+		return fmt.Errorf("%#v is compressed and does not support RewriteBlock", cf.Path)
+	}
+	if int64(len(plain)) != cf.plainBlockSize {
+		return fmt.Errorf("%#v block of %d bytes should be %d", cf.Path, len(plain), cf.plainBlockSize)
+	}
+	if blockNumber < 0 || blockNumber >= cf.dataBlocks() {
+		return fmt.Errorf("%#v block %d out of range", cf.Path, blockNumber)
+	}
+	if cf.merkleFile && cf.merkleLeaves == nil {
+		if err := cf.loadMerkleLeaves(); err != nil {
+			return err
+		}
+	}
+	if cf.crcFile && cf.blockCRCs == nil {
+		if err := cf.loadCRCs(); err != nil {
+			return err
+		}
+	}
+	if cf.plainBlockDirty {
+		if err := cf.write(); err != nil {
+			return err
+		}
+	}
+	// The current block is read again if need be, in case it's this one.
+	cf.plainBlock = append(cf.newPlainBlock()[:0], plain...)
+	cf.plainBlockDirty = false
+	if end := cf.size - blockNumber*cf.plainBlockSize; end < cf.plainBlockSize {
+		if _, err := io.ReadFull(cf.random(), cf.plainBlock[end:]); err != nil {
+			cf.plainBlock = nil
+			cf.fail()
+			return err
+		}
+	}
+	err := cf.writePlainBlock(blockNumber)
+	cf.plainBlock = nil
+	if err != nil {
+		return err
+	}
+	return cf.flushQueue()
+}
+
+// RecoverTo writes as much of the plaintext as can be recovered to w,
+// starting from the beginning of the file regardless of the current position.
+// Unlike Read, a block that fails to authenticate, or is missing from a
+// truncated file, doesn't stop the process; its plaintext is replaced by fill
+// bytes and its block number is added to the list returned. The header still
+// has to decrypt, as it holds the size. Compressed files are not supported.
+func (cf *CryptFile) RecoverTo(w io.Writer, fill byte) (int64, []int64, error) {
+	if cf.unknownState {
+		return 0, nil, unusableError(cf.Path)
+	}
+	if cf.file == nil {
+		if err := cf.openFile(true); err != nil {
+			return 0, nil, err
+		}
+	}
+	if cf.compressed {
+		return 0, nil, fmt.Errorf("%#v is compressed and does not support RecoverTo", cf.Path)
+	}
+	if cf.plainBlockDirty {
+		if err := cf.write(); err != nil {
+			return 0, nil, err
+		}
+		cf.plainBlock = nil
+	}
+	if err := cf.flushQueue(); err != nil {
+		return 0, nil, err
+	}
+	var n int64
+	var badBlocks []int64
+	var fillBlock []byte
+	enc := make([]byte, cf.blockSize)
+	for blockNumber := int64(0); n < cf.size; blockNumber++ {
+		var dec []byte
+		slot, zero, err := cf.lookupSlot(blockNumber)
+		if zero {
+			dec = make([]byte, cf.plainBlockSize)
+		} else if err == nil {
+			n2, err := cf.file.ReadAt(enc, cf.blockSize+slot*cf.blockSize)
+			if err != nil && err != io.EOF {
+				return n, badBlocks, err
+			}
+			if int64(n2) == cf.blockSize {
+				dec, err = cf.suite.decrypt(enc, cf.blockKey(slot), cf.blockAD(slot))
+				cf.countDecrypt(err, blockNumber, cf.blockSize+slot*cf.blockSize)
+				if err == KeyError {
+					if repaired := cf.repairBlock(slot); repaired != nil {
+						dec, err = cf.suite.decrypt(repaired, cf.blockKey(slot), cf.blockAD(slot))
+					}
+				}
+				if err != nil && err != KeyError {
+					return n, badBlocks, err
+				}
+			}
+		}
+		if dec == nil {
+			if fillBlock == nil {
+				fillBlock = make([]byte, cf.plainBlockSize)
+				for i := range fillBlock {
+					fillBlock[i] = fill
+				}
+			}
+			dec = fillBlock
+			badBlocks = append(badBlocks, blockNumber)
+		}
+		if remaining := cf.size - n; remaining < int64(len(dec)) {
+			dec = dec[:remaining]
+		}
+		n3, err := w.Write(dec)
+		n += int64(n3)
+		if err == nil && n3 < len(dec) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return n, badBlocks, err
+		}
+	}
+	return n, badBlocks, nil
+}
+
+// See io.Closer
+//
+// A closed CryptFile can be used again rather than having to be recreated;
+// the next call will reopen, or create, the file just as the first call on a
+// new CryptFile would. Even if flushing pending data fails, and that error is
+// returned, the CryptFile is still closed and reset for reuse.
+func (cf *CryptFile) Close() error {
+	var err error
+	if !cf.unknownState {
+		if cf.deflater != nil {
+			err = cf.finishCompressed()
+		}
+		if err == nil && cf.plainBlockDirty {
+			err = cf.write()
+		}
+		if err == nil {
+			err = cf.flushQueue()
+		}
+		if err == nil && cf.headerDirty {
+			err = cf.writeHeader()
+		}
+	}
+	cf.drainQueue()
+	cf.dropReadAhead()
+	if cf.mapped != nil {
+		munmapFile(cf.mapped)
+		cf.mapped = nil
+	}
+	if cf.file != nil {
+		cf.file.Close()
+		cf.file = nil
+	}
+	cf.unknownState = false
+	cf.suite = 0
+	cf.kdf = nil
+	cf.salt = nil
+	cf.headerASize = 0
+	cf.blockSize = 0
+	cf.size = 0
+	cf.headerDirty = false
+	cf.plainBlockSize = 0
+	cf.plainBlock = nil
+	cf.plainBlockIndex = 0
+	cf.plainBlockDirty = false
+	cf.index = 0
+	cf.encryptQueue = nil
+	cf.blocks = 0
+	cf.boundBlocks = false
+	cf.headerFeatures = 0
+	cf.compressed = false
+	cf.uncompressedSize = 0
+	cf.uncompressedIndex = 0
+	cf.deflater = nil
+	cf.inflater = nil
+	cf.sparseFile = false
+	cf.blockMap = nil
+	cf.blockMapDirty = false
+	cf.blockMapSlot = 0
+	cf.freeSlots = nil
+	cf.nextSlot = 0
+	cf.encBuf = nil
+	cf.spareBlock = nil
+	cf.fileKey = nil
+	cf.wideHeader = false
+	cf.recipients = nil
+	cf.recipient = 0
+	cf.merkleFile = false
+	cf.merkleRoot = nil
+	cf.merkleLeaves = nil
+	cf.merkleDirty = false
+	cf.versionedFile = false
+	cf.version = 0
+	cf.blockVersions = nil
+	cf.paddedFile = false
+	cf.paddedBucket = 0
+	cf.keyCommitFile = false
+	cf.parityFile = false
+	cf.shardData = 0
+	cf.shardParity = 0
+	cf.parityEnc = nil
+	cf.parityAt = 0
+	cf.parityDirty = nil
+	cf.crcFile = false
+	cf.blockCRCs = nil
+	cf.aheadEnc = nil
+	cf.fresh = false
+	if cf.cache != nil {
+		cf.cache.clear()
+	}
+	return err
+}
+
+// aes.BlockSize * 2; this plaintext part of the header may be followed by an
+// extension of header[15] * aes.BlockSize bytes.
+const header0ASize = 32
+
+// A CRYPTFILE1 header is the same as a CRYPTFILE0 one except that bytes 16 to
+// 20 are 0 and the block size is instead an int64 in an extra aes.BlockSize
+// of extension after the salt, so it can be more than 32 bits. It's only used
+// for such block sizes, above wideBlockSize, so older code can still read
+// everything else.
+const wideHeaderASize = header0ASize + kdfParamsSize + saltSize + aes.BlockSize
+
+// wideBlockSize is the largest block size written with a CRYPTFILE0 header;
+// tests lower it to try CRYPTFILE1 headers without huge blocks.
+var wideBlockSize int64 = math.MaxUint32
+
+// int64
 const header0BSize = 8
 
+// header[13] bits, followed by header[12] bits shifted up 8
+const (
+	// featureCompressed means the plaintext is DEFLATE compressed before
+	// being split into blocks, and the encrypted header has the uncompressed
+	// size as a second int64 after the size of the compressed data.
+	featureCompressed = 1 << iota
+	// featureBlockCount means the encrypted header has the number of data
+	// blocks the file should have as an int64 after the sizes, so truncation
+	// can be detected.
+	featureBlockCount
+	// featureHeaderAuth means bytes 20 to 32 of the header hold a key check
+	// and an authentication code for the plaintext part of the header, from
+	// headerAuth.
+	featureHeaderAuth
+	// featureBoundBlocks means each block, and the encrypted header as block
+	// -1, is authenticated along with the salt and its block number, from
+	// blockAD, so blocks moved within or between files fail authentication.
+	featureBoundBlocks
+	// featureSparse means all zero blocks aren't stored and the encrypted
+	// header has, after the block count, the slot where the block map
+	// starts and its number of entries, both int64s; see sparse.go.
+	featureSparse
+	// featureBlockKeys means the encrypted header ends with a 32 byte file
+	// key, and each block is encrypted under a key derived from it, from
+	// blockKey, rather than under the key the header is encrypted with.
+	featureBlockKeys
+	// featureRecipients means the plaintext header has a table of the file
+	// key wrapped under each recipient's key, and the header is encrypted
+	// and authenticated under a key derived from the file key; see
+	// recipients.go.
+	featureRecipients
+	// featureMerkle means the encrypted header ends with the root of a
+	// Merkle tree of the data blocks, which is stored after them; see
+	// merkle.go.
+	featureMerkle
+	// featureVersioned means the encrypted header ends with the file's
+	// version, a uint64, and each block is authenticated along with the
+	// version it was last written under; see version.go.
+	featureVersioned
+	// featurePadded means the encrypted header ends with the bucket size the
+	// file is padded to a multiple of, an int64, or 0 for a power of two;
+	// see padding.go.
+	featurePadded
+	// featureKeyCommit means the encrypted header ends with a commitment to
+	// the key the blocks are under, from keyCommitment.
+	featureKeyCommit
+	// featureParity means the encrypted header ends with the number of data
+	// blocks in each group covered by parity and the number of parity
+	// blocks for each group, both uint32s; see parity.go.
+	featureParity
+	// featureCRC means a table of a CRC of each data block is stored after
+	// them; see crc.go.
+	featureCRC
+	// featureBoundFeatures means the encrypted header is authenticated along
+	// with the two feature bytes, from headerAD, so they can't be changed
+	// even by stripping the plaintext header's authentication.
+	featureBoundFeatures
+)
+
+// The size of the random key of a file with featureBlockKeys, and of the keys
+// derived from it.
+const fileKeySize = 32
+
+// The HKDF info for blockKey, followed by the slot.
+const blockKeyInfo = "brimcrypt block key "
+
+// The HMAC message for keyCommitment, followed by the salt.
+const keyCommitInfo = "brimcrypt key commitment "
+
+// The size of the commitment of a file with featureKeyCommit.
+const keyCommitSize = sha256.Size
+
 // header0ASize + hmacSize + aes.BlockSize[iv] + header0BSize, aligned to
 // aes.BlockSize and then aligned to a power of 2
 const minBlockSize = 128
 
-func blockSizeForSize(size int64) int64 {
+// BlockSizeOptions holds the optional settings for BlockSizeForSize. The zero
+// value gives the block sizes NewCryptFile picks.
+type BlockSizeOptions struct {
+	// Suite is the cipher suite whose overhead is allowed for.
+	Suite CipherSuite
+	// MaxBlockSize is the largest block size to consider, rounded down to a
+	// power of 2; 0 means 65536. Larger blocks favor throughput for large
+	// files, smaller ones favor random access.
+	MaxBlockSize int64
+	// WasteThreshold is how much less of the space, as a fraction of size, a
+	// smaller block size has to waste to be picked over a larger one; 0 means
+	// 0.01, or 1%, and a negative value means any improvement at all.
+	WasteThreshold float64
+}
+
+// BlockSizeForSize returns the block size to use for a file of the size given,
+// such as for NewCryptFileBlockSize, with settings from opts, which may be nil.
+func BlockSizeForSize(size int64, opts *BlockSizeOptions) int64 {
+	if opts == nil {
+		opts = &BlockSizeOptions{}
+	}
+	maxBlockSize := int64(65536)
+	if opts.MaxBlockSize > 0 {
+		maxBlockSize = minBlockSize
+		for maxBlockSize <= opts.MaxBlockSize/2 {
+			maxBlockSize *= 2
+		}
+	}
+	threshold := opts.WasteThreshold
+	if threshold == 0 {
+		threshold = 0.01
+	} else if threshold < 0 {
+		threshold = 0
+	}
+	return blockSizeForSizeMax(size, opts.Suite.overhead(), maxBlockSize, threshold)
+}
+
+// blockSizeForSize returns the block size that wastes the least space storing
+// size bytes with the per block overhead given, preferring larger blocks
+// unless a smaller one saves more than 1%.
+func blockSizeForSize(size int64, overhead int64) int64 {
+	return blockSizeForSizeMax(size, overhead, 65536, 0.01)
+}
+
+// blockSizeForSizeMax is blockSizeForSize with the largest block size to
+// consider and the fraction a smaller one must save given.
+func blockSizeForSizeMax(size int64, overhead int64, maxBlockSize int64, threshold float64) int64 {
 	if size <= minBlockSize {
 		return minBlockSize
 	}
-	candidate := int64(65536)
-	usable := candidate - hmacSize - aes.BlockSize
+	candidate := maxBlockSize
+	usable := candidate - overhead
 	best := candidate
 	bestWaste := -1.0
 	for candidate >= minBlockSize {
 		waste := float64(((size+usable-1)/usable+1)*candidate-size) / float64(size)
-		if bestWaste < 0 || bestWaste-waste > 0.01 {
+		if bestWaste < 0 || bestWaste-waste > threshold {
 			best = candidate
 			bestWaste = waste
 		}
-		candidate >>= 1
-		usable = candidate - hmacSize - aes.BlockSize
-	}
-	return best
-}
-
-func (cf *CryptFile) open() error {
-	if cf.unknownState {
-		return unusableError(cf.Path)
+		candidate >>= 1
+		usable = candidate - overhead
+	}
+	return best
+}
+
+// EncryptedSize returns the size on disk of a CryptFile holding plainSize
+// bytes, as created by NewCryptFile with plainSize as the estimated size: the
+// header block, then enough blocks for the plaintext, each with its Overhead,
+// with the last padded out to a whole block. Files written with WriteAsEmpty
+// have one more block than EncryptedSize(0).
+func EncryptedSize(plainSize int64) int64 {
+	blockSize := blockSizeForSize(plainSize, AES256CBCHMACSHA256.overhead())
+	return encryptedSize(plainSize, blockSize, Overhead(blockSize))
+}
+
+func encryptedSize(plainSize int64, blockSize int64, overhead int64) int64 {
+	plainBlockSize := blockSize - overhead
+	return blockSize + (plainSize+plainBlockSize-1)/plainBlockSize*blockSize
+}
+
+// Overhead returns the number of bytes of each encrypted block of blockSize
+// bytes that are not plaintext, for files using the default
+// AES256CBCHMACSHA256 suite; this is the HMAC and IV and is the same for any
+// block size.
+func Overhead(blockSize int64) int64 {
+	return AES256CBCHMACSHA256.overhead()
+}
+
+// headerA is the parsed plaintext part of a CryptFile header, which can be
+// read without the key.
+type headerA struct {
+	raw        []byte
+	suite      CipherSuite
+	features   uint16
+	kdf        KDFParams
+	salt       []byte
+	length     int64
+	blockSize  int64
+	wide       bool
+	recipients [][]byte
+}
+
+// headerBSize returns the minimum size of the plaintext of the encrypted
+// header for the header's features.
+func (ha *headerA) headerBSize() int64 {
+	return headerBSize(ha.features)
+}
+
+// headerBSize returns the minimum size of the plaintext of the encrypted
+// header for the features given.
+func headerBSize(features uint16) int64 {
+	size := int64(header0BSize)
+	if features&featureCompressed != 0 {
+		size += 8
+	}
+	if features&featureBlockCount != 0 {
+		size += 8
+	}
+	if features&featureSparse != 0 {
+		size += 16
+	}
+	if features&featureBlockKeys != 0 {
+		size += fileKeySize
+	}
+	if features&featureMerkle != 0 {
+		size += merkleHashSize
+	}
+	if features&featureVersioned != 0 {
+		size += 8
+	}
+	if features&featurePadded != 0 {
+		size += 8
+	}
+	if features&featureKeyCommit != 0 {
+		size += keyCommitSize
+	}
+	if features&featureParity != 0 {
+		size += 8
+	}
+	return size
+}
+
+func readHeaderA(file *os.File, pth string) (*headerA, error) {
+	header := make([]byte, header0ASize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && (err != io.EOF || (err == io.EOF && n != len(header))) {
+		return nil, fmt.Errorf("%#v reading header: %w", pth, err)
+	}
+	wide := string(header[:11]) == "CRYPTFILE1 "
+	if string(header[:11]) != "CRYPTFILE0 " && !wide {
+		return nil, &NotCryptFileError{Path: pth}
+	}
+	ha := &headerA{
+		suite:     CipherSuite(header[11]),
+		features:  uint16(header[13]) | uint16(header[12])<<8,
+		length:    header0ASize + int64(header[15])*aes.BlockSize,
+		blockSize: int64(binary.BigEndian.Uint32(header[16:20])),
+		wide:      wide,
+	}
+	if ha.length > header0ASize {
+		header = append(header, make([]byte, ha.length-header0ASize)...)
+		n, err = file.ReadAt(header[header0ASize:], header0ASize)
+		if err != nil && (err != io.EOF || (err == io.EOF && n != len(header)-header0ASize)) {
+			return nil, fmt.Errorf("%#v reading header: %w", pth, err)
+		}
+	}
+	if ha.wide {
+		if ha.length < wideHeaderASize {
+			return nil, fmt.Errorf("%#v header too short for its block size", pth)
+		}
+		wideBlockSize := binary.BigEndian.Uint64(header[wideHeaderASize-aes.BlockSize:])
+		if wideBlockSize > math.MaxInt64 {
+			return nil, &BlockSizeError{Path: pth, BlockSize: -1, msg: fmt.Sprintf("block size %d specified is too large", wideBlockSize)}
+		}
+		ha.blockSize = int64(wideBlockSize)
+	}
+	if !ha.suite.valid() {
+		return nil, fmt.Errorf("%#v unknown cipher suite %d", pth, ha.suite)
+	}
+	if ha.blockSize < minBlockSize {
+		return nil, &BlockSizeError{Path: pth, BlockSize: ha.blockSize, msg: fmt.Sprintf("block size %d specified isn't at least %d", ha.blockSize, minBlockSize)}
+	}
+	if ha.blockSize%aes.BlockSize != 0 {
+		return nil, &BlockSizeError{Path: pth, BlockSize: ha.blockSize, msg: fmt.Sprintf("block size %d specified isn't a multiple of the AES block size %d", ha.blockSize, aes.BlockSize)}
+	}
+	if ha.features&^(featureCompressed|featureBlockCount|featureHeaderAuth|featureBoundBlocks|featureSparse|featureBlockKeys|featureRecipients|featureMerkle|featureVersioned|featurePadded|featureKeyCommit|featureParity|featureCRC|featureBoundFeatures) != 0 {
+		return nil, fmt.Errorf("%#v unknown features %#x", pth, ha.features)
+	}
+	if ha.features&featureBoundFeatures != 0 && ha.features&featureBoundBlocks == 0 {
+		return nil, fmt.Errorf("%#v bound features without bound blocks", pth)
+	}
+	if ha.features&featureSparse != 0 && ha.features&featureBlockCount == 0 {
+		return nil, fmt.Errorf("%#v sparse without a block count", pth)
+	}
+	if ha.features&featureBlockKeys != 0 && ha.features&featureBlockCount == 0 {
+		return nil, fmt.Errorf("%#v block keys without a block count", pth)
+	}
+	if ha.features&featureRecipients != 0 && ha.features&(featureBlockKeys|featureHeaderAuth) != featureBlockKeys|featureHeaderAuth {
+		return nil, fmt.Errorf("%#v recipients without block keys", pth)
+	}
+	if ha.features&featureMerkle != 0 && ha.features&(featureBlockCount|featureSparse) != featureBlockCount {
+		return nil, fmt.Errorf("%#v Merkle tree without a block count or with a block map", pth)
+	}
+	if ha.features&featureVersioned != 0 && ha.features&(featureBlockCount|featureBoundBlocks|featureSparse) != featureBlockCount|featureBoundBlocks {
+		return nil, fmt.Errorf("%#v versioned without a block count or bound blocks, or with a block map", pth)
+	}
+	if ha.features&featurePadded != 0 && ha.features&featureBlockCount == 0 {
+		return nil, fmt.Errorf("%#v padded without a block count", pth)
+	}
+	if ha.features&featureKeyCommit != 0 && ha.features&featureBlockCount == 0 {
+		return nil, fmt.Errorf("%#v key commitment without a block count", pth)
+	}
+	if ha.features&featureParity != 0 && ha.features&(featureBlockCount|featureSparse) != featureBlockCount {
+		return nil, fmt.Errorf("%#v parity without a block count or with a block map", pth)
+	}
+	if ha.features&featureCRC != 0 && ha.features&(featureBlockCount|featureSparse) != featureBlockCount {
+		return nil, fmt.Errorf("%#v CRCs without a block count or with a block map", pth)
+	}
+	if ha.blockSize < ha.length+ha.suite.overhead()+ha.headerBSize() {
+		return nil, &BlockSizeError{Path: pth, BlockSize: ha.blockSize, msg: fmt.Sprintf("block size %d specified is too small for a %d byte header", ha.blockSize, ha.length)}
+	}
+	if ha.length >= header0ASize+kdfParamsSize+saltSize {
+		ha.salt = header[header0ASize+kdfParamsSize : header0ASize+kdfParamsSize+saltSize]
+	}
+	ha.raw = header
+	if header[14] != kdfNone {
+		if ha.salt == nil {
+			return nil, fmt.Errorf("%#v header too short for key derivation settings", pth)
+		}
+		if ha.kdf, err = unmarshalKDFParams(header[14], header[header0ASize:header0ASize+kdfParamsSize]); err != nil {
+			return nil, fmt.Errorf("%#v %w", pth, err)
+		}
+	}
+	if ha.features&featureRecipients != 0 {
+		if err = ha.readRecipients(pth); err != nil {
+			return nil, err
+		}
+	}
+	return ha, nil
+}
+
+// IsCryptFile returns true if the file at the path starts with a CryptFile
+// header, which needs no key to tell. A file that exists but doesn't, even if
+// it's too short to, gives false with no error; any other error reading the
+// file is returned.
+func IsCryptFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	magic := make([]byte, 11)
+	if _, err = io.ReadFull(file, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, fmt.Errorf("%#v reading header: %w", path, err)
+	}
+	return string(magic) == "CRYPTFILE0 " || string(magic) == "CRYPTFILE1 ", nil
+}
+
+// HeaderInfo is what ReadHeader finds in a CryptFile header.
+type HeaderInfo struct {
+	// Version is 0 for a CRYPTFILE0 header and 1 for a CRYPTFILE1 header.
+	Version int
+	// Suite is the cipher suite the file is encrypted with.
+	Suite CipherSuite
+	// BlockSize is the size of each encrypted block in the file.
+	BlockSize int64
+	// PlainBlockSize is how much data each block holds once decrypted.
+	PlainBlockSize int64
+	// Size is the size of the decrypted data, as from CryptFile.Size, or -1
+	// if no key was given to ReadHeader.
+	Size int64
+}
+
+// ReadHeader returns what the header of the file at the path records, for
+// diagnostics and tooling. The plaintext part needs no key; with a nil key
+// the Size is left as -1. Otherwise the header is decrypted to find the
+// Size, giving an error if the key doesn't authenticate it. A file shorter
+// than its header records isn't an error here.
+func ReadHeader(path string, key []byte) (*HeaderInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ha, err := readHeaderA(file, path)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	info := &HeaderInfo{
+		Suite:          ha.suite,
+		BlockSize:      ha.blockSize,
+		PlainBlockSize: ha.blockSize - ha.suite.overhead(),
+		Size:           -1,
+	}
+	if ha.wide {
+		info.Version = 1
+	}
+	if key == nil {
+		return info, nil
+	}
+	cf := NewCryptFile(path, key, 0, WithReadOnly())
+	defer cf.Close()
+	if err = cf.openFile(true); err != nil {
+		return nil, err
+	}
+	info.Size = cf.size
+	if cf.compressed {
+		info.Size = cf.uncompressedSize
+	}
+	return info, nil
+}
+
+func (cf *CryptFile) open() error {
+	return cf.openFile(false)
+}
+
+// openFile opens the existing file, returning a *TruncationError if it is shorter
+// than its header records, or a *LengthError if it isn't a whole number of
+// blocks long, unless allowTruncated is set.
+func (cf *CryptFile) openFile(allowTruncated bool) (err error) {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.file != nil {
+		return nil
+	}
+	flag := os.O_RDWR
+	if cf.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(cf.Path, flag, 0600)
+	if err != nil {
+		return err
+	}
+	if cf.lock {
+		if err = cf.lockFile(file, !cf.readOnly); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	ha, err := readHeaderA(file, cf.Path)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if cf.requireKeyCommit && ha.features&featureKeyCommit == 0 {
+		file.Close()
+		return fmt.Errorf("%#v has no key commitment: %w", cf.Path, ErrKeyCommitment)
+	}
+	key := cf.key
+	if ha.kdf != nil {
+		if cf.phrase == "" {
+			file.Close()
+			return fmt.Errorf("%#v requires a key phrase", cf.Path)
+		}
+		if key, err = ha.kdf.deriveKey(cf.phrase, ha.salt); err != nil {
+			file.Close()
+			return fmt.Errorf("%#v deriving key: %w", cf.Path, err)
+		}
+	} else if cf.phrase != "" {
+		key = keyPhrase(cf.phrase)
+	}
+	headerKey := key
+	var recipient int
+	if ha.recipients != nil {
+		var fileKey []byte
+		if fileKey, recipient, err = unwrapFileKey(ha.suite, ha.recipients, key, ha.salt); err != nil {
+			file.Close()
+			cf.countAuth(err, -1, 0)
+			return err
+		}
+		headerKey = blockKey(fileKey, ha.salt, -1)
+	}
+	if ha.features&featureHeaderAuth != 0 {
+		keyCheck, mac := headerAuth(ha.raw, headerKey)
+		if !hmac.Equal(keyCheck, ha.raw[20:24]) {
+			file.Close()
+			cf.countAuth(KeyError, -1, 0)
+			return KeyError
+		}
+		if !hmac.Equal(mac, ha.raw[24:32]) {
+			file.Close()
+			cf.countAuth(HeaderError, -1, 0)
+			return HeaderError
+		}
+	} else if !bytes.Equal(ha.raw[20:32], make([]byte, 12)) || ha.features != 0 {
+		// Files from before headers were authenticated have zeros here, and
+		// predate every feature, so a file claiming any has been stripped
+		// of its authentication.
+		file.Close()
+		return HeaderError
+	}
+	enc := make([]byte, ha.blockSize-ha.length)
+	n, err := file.ReadAt(enc, ha.length)
+	if err != nil && (err != io.EOF || (err == io.EOF && n != len(enc))) {
+		file.Close()
+		return fmt.Errorf("%#v reading header: %w", cf.Path, err)
+	}
+	var ad []byte
+	if ha.features&featureBoundBlocks != 0 {
+		ad = headerAD(ha.salt, ha.features)
+	}
+	dec, err := ha.suite.decrypt(enc, headerKey, ad)
+	if err != nil {
+		file.Close()
+		cf.countAuth(err, -1, ha.length)
+		return err
+	}
+	size := int64(binary.BigEndian.Uint64(dec[:8]))
+	offset := header0BSize
+	cf.compressed = ha.features&featureCompressed != 0
+	if cf.compressed {
+		cf.uncompressedSize = int64(binary.BigEndian.Uint64(dec[offset : offset+8]))
+		offset += 8
+	}
+	finfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("%#v %w", cf.Path, err)
+	}
+	if finfo.Size()%ha.blockSize != 0 && !allowTruncated {
+		file.Close()
+		return &LengthError{Path: cf.Path, Length: finfo.Size(), BlockSize: ha.blockSize}
+	}
+	blocks := (finfo.Size() - ha.blockSize + ha.blockSize - 1) / ha.blockSize
+	if ha.features&featureBlockCount != 0 {
+		recorded := int64(binary.BigEndian.Uint64(dec[offset : offset+8]))
+		if blocks < recorded && !allowTruncated {
+			file.Close()
+			return &TruncationError{Path: cf.Path, Blocks: blocks, Expected: recorded}
+		}
+		blocks = recorded
+		offset += 8
+	} else if plainBlockSize := ha.blockSize - ha.suite.overhead(); !cf.compressed && blocks*plainBlockSize < size && !allowTruncated {
+		// Without a block count, the size still says how many blocks there
+		// must be at least.
+		file.Close()
+		return &TruncationError{Path: cf.Path, Blocks: blocks, Expected: (size + plainBlockSize - 1) / plainBlockSize}
+	}
+	cf.blocks = blocks
+	cf.nextSlot = blocks
+	cf.key = key
+	cf.file = file
+	cf.suite = ha.suite
+	cf.kdf = ha.kdf
+	cf.salt = ha.salt
+	cf.boundBlocks = ha.features&featureBoundBlocks != 0
+	cf.headerFeatures = ha.features
+	cf.wideHeader = ha.wide
+	cf.headerASize = ha.length
+	cf.blockSize = ha.blockSize
+	cf.plainBlockSize = ha.blockSize - ha.suite.overhead()
+	cf.size = size
+	cf.headerDirty = false
+	cf.sparseFile = ha.features&featureSparse != 0
+	var mapEntries int64
+	if cf.sparseFile {
+		cf.blockMapSlot = int64(binary.BigEndian.Uint64(dec[offset : offset+8]))
+		mapEntries = int64(binary.BigEndian.Uint64(dec[offset+8 : offset+16]))
+		offset += 16
+	}
+	if ha.features&featureBlockKeys != 0 {
+		cf.fileKey = append([]byte(nil), dec[offset:offset+fileKeySize]...)
+		offset += fileKeySize
+	}
+	cf.merkleFile = ha.features&featureMerkle != 0
+	if cf.merkleFile {
+		cf.merkleRoot = append([]byte(nil), dec[offset:offset+merkleHashSize]...)
+		offset += merkleHashSize
+	}
+	cf.versionedFile = ha.features&featureVersioned != 0
+	if cf.versionedFile {
+		cf.version = binary.BigEndian.Uint64(dec[offset : offset+8])
+		offset += 8
+	}
+	cf.paddedFile = ha.features&featurePadded != 0
+	if cf.paddedFile {
+		cf.paddedBucket = int64(binary.BigEndian.Uint64(dec[offset : offset+8]))
+		if cf.paddedBucket < 0 {
+			cf.Close()
+			return fmt.Errorf("%#v padding bucket %d out of range", cf.Path, cf.paddedBucket)
+		}
+		offset += 8
+	}
+	cf.recipients = ha.recipients
+	cf.recipient = recipient
+	cf.keyCommitFile = ha.features&featureKeyCommit != 0
+	if cf.keyCommitFile {
+		if !hmac.Equal(dec[offset:offset+keyCommitSize], cf.keyCommitment()) {
+			cf.Close()
+			return &KeyCommitmentError{Path: cf.Path}
+		}
+		offset += keyCommitSize
+	}
+	cf.crcFile = ha.features&featureCRC != 0
+	cf.parityFile = ha.features&featureParity != 0
+	if cf.parityFile {
+		cf.shardData = int64(binary.BigEndian.Uint32(dec[offset : offset+4]))
+		cf.shardParity = int64(binary.BigEndian.Uint32(dec[offset+4 : offset+8]))
+		if cf.shardData < 1 || cf.shardParity < 1 || cf.shardData+cf.shardParity > maxShards {
+			cf.Close()
+			return fmt.Errorf("%#v parity of %d blocks for each %d out of range", cf.Path, cf.shardParity, cf.shardData)
+		}
+		cf.parityAt = cf.paritySlot()
+	}
+	if err = cf.checkVersion(); err != nil {
+		cf.Close()
+		return err
+	}
+	if cf.sparseFile {
+		if err = cf.readBlockMap(cf.blockMapSlot, mapEntries); err != nil {
+			cf.Close()
+			return err
+		}
+		cf.findFreeSlots()
+	}
+	// A truncated file is still opened, but with the table of block
+	// versions lost, its blocks won't authenticate.
+	if cf.versionedFile {
+		if err = cf.readVersions(); err != nil && !allowTruncated {
+			cf.Close()
+			return err
+		}
+	}
+	if cf.mmap && cf.readOnly && finfo.Size() > 0 && int64(int(finfo.Size())) == finfo.Size() {
+		if cf.mapped != nil {
+			munmapFile(cf.mapped)
+		}
+		cf.mapped, _ = mmapFile(file, int(finfo.Size()))
+	}
+	return nil
+}
+
+func (cf *CryptFile) create() error {
+	cf.unknownState = false
+	cf.suite = cf.fallbackSuite
+	if !cf.suite.valid() {
+		cf.unknownState = true
+		return fmt.Errorf("%#v unknown cipher suite %d", cf.Path, cf.suite)
+	}
+	cf.kdf = nil
+	cf.blocks = 0
+	cf.boundBlocks = true
+	cf.compressed = cf.compress
+	cf.sparseFile = cf.sparse
+	cf.merkleFile = cf.merkle
+	if cf.merkleFile && cf.sparseFile {
+		cf.unknownState = true
+		return fmt.Errorf("%#v can't be both sparse and have a Merkle tree", cf.Path)
+	}
+	cf.versionedFile = cf.versioned
+	if cf.versionedFile && cf.sparseFile {
+		cf.unknownState = true
+		return fmt.Errorf("%#v can't be both sparse and versioned", cf.Path)
+	}
+	cf.version = cf.minVersion
+	if cf.seenVersion > cf.version {
+		cf.version = cf.seenVersion
+	}
+	cf.blockVersions = nil
+	cf.paddedFile = cf.padding
+	cf.paddedBucket = cf.paddingBucket
+	if cf.paddedBucket < 0 {
+		cf.unknownState = true
+		return fmt.Errorf("%#v padding bucket %d is negative", cf.Path, cf.paddedBucket)
+	}
+	cf.keyCommitFile = cf.keyCommit
+	cf.parityFile = cf.parityShards > 0
+	cf.shardData = int64(cf.dataShards)
+	if cf.shardData == 0 {
+		cf.shardData = defaultDataShards
+	}
+	cf.shardParity = int64(cf.parityShards)
+	if cf.parityFile {
+		if cf.sparseFile {
+			cf.unknownState = true
+			return fmt.Errorf("%#v can't be both sparse and have parity", cf.Path)
+		}
+		if cf.shardData < 0 || cf.shardData+cf.shardParity > maxShards {
+			cf.unknownState = true
+			return fmt.Errorf("%#v parity of %d blocks for each %d out of range", cf.Path, cf.shardParity, cf.shardData)
+		}
+	}
+	cf.parityEnc = nil
+	cf.parityAt = -1
+	cf.parityDirty = nil
+	cf.crcFile = cf.crc
+	if cf.crcFile && cf.sparseFile {
+		cf.unknownState = true
+		return fmt.Errorf("%#v can't be both sparse and have CRCs", cf.Path)
+	}
+	cf.blockCRCs = []uint32{}
+	cf.merkleRoot = nil
+	cf.merkleLeaves = [][]byte{}
+	cf.merkleDirty = true
+	cf.blockMap = nil
+	cf.blockMapDirty = false
+	cf.blockMapSlot = 0
+	cf.freeSlots = nil
+	cf.nextSlot = 0
+	cf.uncompressedSize = 0
+	cf.uncompressedIndex = 0
+	cf.salt = make([]byte, saltSize)
+	if _, err := io.ReadFull(cf.random(), cf.salt); err != nil {
+		cf.unknownState = true
+		return fmt.Errorf("%#v generating salt: %w", cf.Path, err)
+	}
+	cf.recipients = nil
+	cf.recipient = 0
+	cf.fileKey = nil
+	if cf.blockKeys || cf.phrase != "" {
+		cf.fileKey = make([]byte, fileKeySize)
+		if _, err := io.ReadFull(cf.random(), cf.fileKey); err != nil {
+			cf.unknownState = true
+			return fmt.Errorf("%#v generating file key: %w", cf.Path, err)
+		}
+	}
+	cf.headerASize = header0ASize + kdfParamsSize + saltSize
+	if cf.phrase != "" {
+		cf.kdf = cf.fallbackKDF
+		if cf.kdf == nil {
+			cf.kdf = &DefaultArgon2Params
+		}
+		// Settings the file couldn't be opened with again are refused, as
+		// are any that don't fit in the header as they are.
+		b := make([]byte, kdfParamsSize)
+		cf.kdf.marshal(b)
+		recorded, err := unmarshalKDFParams(cf.kdf.kdfID(), b)
+		if err != nil {
+			cf.unknownState = true
+			return fmt.Errorf("%#v %w", cf.Path, err)
+		}
+		if !reflect.DeepEqual(recorded, cf.kdf) {
+			cf.unknownState = true
+			return fmt.Errorf("%#v key derivation parameters %+v out of range", cf.Path, cf.kdf)
+		}
+		key, err := cf.kdf.deriveKey(cf.phrase, cf.salt)
+		if err != nil {
+			cf.unknownState = true
+			return fmt.Errorf("%#v deriving key: %w", cf.Path, err)
+		}
+		cf.key = key
 	}
-	if cf.file != nil {
-		return nil
+	cf.blockSize = cf.fallbackBlockSize
+	if cf.blockSize == 0 {
+		cf.blockSize = minBlockSize
 	}
-	file, err := os.OpenFile(cf.Path, os.O_RDWR, 0600)
-	if err != nil {
+	if err := checkBlockSize(cf.blockSize); err != nil {
+		cf.unknownState = true
+		err.Path = cf.Path
 		return err
 	}
-	header := make([]byte, header0ASize)
-	n, err := file.ReadAt(header, 0)
-	if err != nil && (err != io.EOF || (err == io.EOF && n != len(header))) {
-		file.Close()
-		return err
+	cf.wideHeader = cf.blockSize > wideBlockSize
+	if cf.wideHeader {
+		cf.headerASize = wideHeaderASize
 	}
-	if string(header[:11]) != "CRYPTFILE0 " {
-		file.Close()
-		return fmt.Errorf("%#v not CRYPTFILE0 data", cf.Path)
+	// The smallest block sizes don't have room for the header with some
+	// suites and features.
+	var features uint16
+	if cf.compressed {
+		features |= featureCompressed
 	}
-	blockSize := int64(binary.BigEndian.Uint32(header[16:20]))
-	if blockSize < minBlockSize {
-		file.Close()
-		return fmt.Errorf("%#v block size %d specified isn't at least %d", cf.Path, blockSize, minBlockSize)
+	if cf.sparseFile {
+		features |= featureBlockCount | featureSparse
 	}
-	if blockSize%aes.BlockSize != 0 {
-		file.Close()
-		return fmt.Errorf("%#v block size %d specified isn't a multiple of the AES block size %d", cf.Path, blockSize, aes.BlockSize)
+	if cf.fileKey != nil {
+		features |= featureBlockCount | featureBlockKeys
 	}
-	enc := make([]byte, blockSize-header0ASize)
-	n, err = file.ReadAt(enc, header0ASize)
-	if err != nil && (err != io.EOF || (err == io.EOF && n != len(enc))) {
-		file.Close()
-		return err
+	if cf.merkleFile {
+		features |= featureBlockCount | featureMerkle
 	}
-	dec, err := decrypt0(enc, cf.key)
-	if err != nil {
-		file.Close()
-		return err
+	if cf.versionedFile {
+		features |= featureBlockCount | featureVersioned
 	}
-	size := int64(binary.BigEndian.Uint64(dec[:8]))
-	cf.file = file
-	cf.blockSize = blockSize
-	cf.plainBlockSize = blockSize - hmacSize - aes.BlockSize
-	cf.size = size
-	cf.headerDirty = false
-	return nil
-}
-
-func (cf *CryptFile) create() error {
-	cf.unknownState = false
-	cf.blockSize = cf.fallbackBlockSize
-	if cf.blockSize == 0 {
-		cf.blockSize = minBlockSize
+	if cf.paddedFile {
+		features |= featureBlockCount | featurePadded
+	}
+	if cf.keyCommitFile {
+		features |= featureBlockCount | featureKeyCommit
+	}
+	if cf.parityFile {
+		features |= featureBlockCount | featureParity
+	}
+	if cf.crcFile {
+		features |= featureBlockCount | featureCRC
+	}
+	for cf.blockSize < cf.headerASize+cf.suite.overhead()+headerBSize(features) {
+		cf.blockSize *= 2
 	}
 	cf.size = 0
 	cf.headerDirty = true
-	cf.plainBlockSize = cf.blockSize - hmacSize - aes.BlockSize
+	cf.plainBlockSize = cf.blockSize - cf.suite.overhead()
 	cf.plainBlock = nil
 	cf.plainBlockIndex = 0
 	cf.plainBlockDirty = false
 	cf.index = 0
 	dir := path.Dir(cf.Path)
 	_, err := os.Stat(dir)
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(dir, 0700)
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(dir, cf.dirMode)
 		if err != nil {
 			return err
 		}
 	}
-	cf.file, err = os.OpenFile(cf.Path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	cf.file, err = os.OpenFile(cf.Path, os.O_CREATE|os.O_EXCL|os.O_RDWR, cf.fileMode)
 	if err != nil {
 		cf.unknownState = true
 		return err
 	}
+	cf.fresh = true
+	if cf.lock {
+		if err = cf.lockFile(cf.file, true); err != nil {
+			cf.fail()
+			return err
+		}
+	}
+	if cf.preallocate && cf.estimatedSize > 0 && !cf.compressed {
+		// This is only an optimization, so failure is no reason not to
+		// carry on.
+		preallocate(cf.file, encryptedSize(cf.estimatedSize, cf.blockSize, cf.suite.overhead()))
+	}
 	return nil
 }
 
@@ -345,18 +2628,7 @@ func (cf *CryptFile) read() error {
 	if cf.unknownState || cf.plainBlockSize == 0 {
 		return unusableError(cf.Path)
 	}
-	enc := make([]byte, cf.blockSize)
-	blockNumber := cf.index / cf.plainBlockSize
-	n, err := cf.file.ReadAt(enc, cf.blockSize+blockNumber*cf.blockSize)
-	if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
-		if err != io.EOF {
-			cf.unknownState = true
-			cf.file.Close()
-			cf.file = nil
-		}
-		return err
-	}
-	dec, err := decrypt0(enc, cf.key)
+	dec, err := cf.readBlock(cf.index / cf.plainBlockSize)
 	if err != nil {
 		return err
 	}
@@ -365,31 +2637,416 @@ func (cf *CryptFile) read() error {
 	return nil
 }
 
+// readBlock returns the decrypted plaintext of the block, from the block cache
+// if it is enabled and holds the block. The returned slice belongs to the
+// caller.
+func (cf *CryptFile) readBlock(blockNumber int64) ([]byte, error) {
+	return cf.readBlockRange(blockNumber, 0, cf.plainBlockSize)
+}
+
+// readBlockRange is readBlock but, with a suite that can, only decrypts the
+// plaintext from start to end; the rest of the block returned is garbage and
+// it isn't cached.
+func (cf *CryptFile) readBlockRange(blockNumber int64, start int64, end int64) ([]byte, error) {
+	if dec := cf.takeReadAhead(blockNumber); dec != nil {
+		if cf.cache != nil {
+			cf.cache.put(blockNumber, dec)
+		}
+		return dec, nil
+	}
+	if cf.cache != nil {
+		dec := cf.cache.get(blockNumber)
+		if cf.metrics != nil {
+			if dec != nil {
+				cf.metrics.CacheHit()
+			} else {
+				cf.metrics.CacheMiss()
+			}
+		}
+		if dec != nil {
+			return dec, nil
+		}
+	}
+	slot, zero, err := cf.lookupSlot(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if zero {
+		return make([]byte, cf.plainBlockSize), nil
+	}
+	if cf.queued(blockNumber) {
+		if err := cf.flushQueue(); err != nil {
+			return nil, err
+		}
+	}
+	// Past the data blocks may be a Merkle tree or block versions, which
+	// aren't data.
+	if slot >= cf.blocks {
+		return nil, io.EOF
+	}
+	var enc []byte
+	offset := cf.blockSize + slot*cf.blockSize
+	if offset+cf.blockSize <= int64(len(cf.mapped)) {
+		// The suites all leave the block as it is, so the read-only
+		// mapping can be decrypted from directly.
+		enc = cf.mapped[offset : offset+cf.blockSize]
+	} else {
+		enc = cf.encScratch()
+		n, err := cf.file.ReadAt(enc, offset)
+		if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+			if err != io.EOF {
+				cf.unknownState = true
+				cf.file.Close()
+				cf.file = nil
+				err = fmt.Errorf("%#v reading block %d: %w", cf.Path, blockNumber, err)
+			}
+			return nil, err
+		}
+	}
+	cf.stats.BlockReads++
+	dec, err := cf.suite.decryptRangeTo(cf.newPlainBlock(), enc, cf.blockKey(slot), cf.blockAD(slot), int(start), int(end))
+	cf.countDecrypt(err, blockNumber, offset)
+	if err == KeyError && cf.parityFile {
+		if enc = cf.repairBlock(slot); enc != nil {
+			dec, err = cf.suite.decryptRangeTo(cf.newPlainBlock(), enc, cf.blockKey(slot), cf.blockAD(slot), int(start), int(end))
+			cf.countDecrypt(err, blockNumber, offset)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cf.cache != nil && start == 0 && end == cf.plainBlockSize {
+		cf.cache.put(blockNumber, dec)
+	}
+	return dec, nil
+}
+
+// write encrypts and writes out the current plaintext block. If
+// encryptWorkers is more than 1 or writeBehind more than 0, the block is
+// instead queued to be encrypted, and with writeBehind written, in the
+// background, and seen to in order by flushQueue; in that case the plaintext
+// block is handed off and must not be modified after.
 func (cf *CryptFile) write() error {
 	if cf.unknownState {
 		return unusableError(cf.Path)
 	}
-	enc, err := encrypt0(cf.plainBlock, cf.key)
+	if cf.merkleFile && cf.merkleLeaves == nil {
+		if err := cf.loadMerkleLeaves(); err != nil {
+			return err
+		}
+	}
+	if cf.crcFile && cf.blockCRCs == nil {
+		if err := cf.loadCRCs(); err != nil {
+			return err
+		}
+	}
+	return cf.writePlainBlock(cf.index / cf.plainBlockSize)
+}
+
+// writePlainBlock is write for the plaintext block given by blockNumber
+// rather than the current one.
+func (cf *CryptFile) writePlainBlock(blockNumber int64) error {
+	cf.dropReadAhead()
+	if cf.cache != nil {
+		cf.cache.put(blockNumber, cf.plainBlock)
+	}
+	if cf.sparseFile && isZero(cf.plainBlock) {
+		cf.setZero(blockNumber)
+		cf.plainBlockDirty = false
+		return nil
+	}
+	slot := cf.slotFor(blockNumber)
+	if cf.versionedFile {
+		cf.setBlockVersion(slot)
+	}
+	if cf.queueing() {
+		if err := cf.queueWrite(blockNumber, slot); err != nil {
+			return err
+		}
+		cf.plainBlockDirty = false
+		return nil
+	}
+	enc, err := cf.suite.encryptTo(cf.encScratch(), cf.random(), cf.plainBlock, cf.blockKey(slot), cf.blockAD(slot))
 	if err != nil {
-		cf.unknownState = true
-		cf.file.Close()
-		cf.file = nil
+		cf.fail()
+		return fmt.Errorf("%#v encrypting block %d: %w", cf.Path, blockNumber, err)
+	}
+	if cf.metrics != nil {
+		cf.metrics.EncryptedBlock()
+	}
+	if err = cf.writeBlock(slot, enc); err != nil {
 		return err
 	}
-	blockNumber := cf.index / cf.plainBlockSize
-	n, err := cf.file.WriteAt(enc, cf.blockSize+blockNumber*cf.blockSize)
+	cf.plainBlockDirty = false
+	return nil
+}
+
+// random returns the source of random bytes for the file.
+func (cf *CryptFile) random() io.Reader {
+	if cf.rand != nil {
+		return cf.rand
+	}
+	return rand.Reader
+}
+
+// encScratch returns the buffer reused for each encrypted block as it is read
+// or, unless queued, written.
+func (cf *CryptFile) encScratch() []byte {
+	if cf.encBuf == nil {
+		cf.encBuf = make([]byte, cf.blockSize, cf.blockSize+2*cf.suite.overhead())
+	}
+	return cf.encBuf
+}
+
+// newPlainBlock returns a plaintext block to fill, reusing the last one
+// released if there is one; its contents are left as they were.
+func (cf *CryptFile) newPlainBlock() []byte {
+	if b := cf.spareBlock; b != nil {
+		cf.spareBlock = nil
+		return b[:cf.plainBlockSize]
+	}
+	return make([]byte, cf.plainBlockSize, cf.blockSize)
+}
+
+// releasePlainBlock drops the current plaintext block, keeping it for
+// newPlainBlock unless it may have been handed off to be encrypted in the
+// background.
+func (cf *CryptFile) releasePlainBlock() {
+	if !cf.queueing() {
+		cf.spareBlock = cf.plainBlock
+	}
+	cf.plainBlock = nil
+}
+
+// blockAD returns the additional data to authenticate along with the block, or
+// nil for files from before blocks were bound to their place. For a versioned
+// file, the data blocks add the version each was last written under and the
+// table of those versions adds the header's version.
+func (cf *CryptFile) blockAD(blockNumber int64) []byte {
+	if !cf.boundBlocks {
+		return nil
+	}
+	if blockNumber == -1 {
+		return headerAD(cf.salt, cf.headerFeatures)
+	}
+	ad := blockAD(cf.salt, blockNumber)
+	if cf.versionedFile && blockNumber >= 0 {
+		if blockNumber < int64(len(cf.blockVersions)) {
+			return versionAD(ad, cf.blockVersions[blockNumber])
+		}
+		if blockNumber >= cf.versionsSlot() {
+			return versionAD(ad, cf.version)
+		}
+	}
+	return ad
+}
+
+// blockKey returns the key to encrypt the block in the slot with, which is
+// derived from the file key if the file has one.
+func (cf *CryptFile) blockKey(slot int64) []byte {
+	if cf.fileKey == nil {
+		return cf.key
+	}
+	return blockKey(cf.fileKey, cf.salt, slot)
+}
+
+// keyCommitment returns the commitment to the key the blocks are under, an
+// HMAC SHA-256 under the key of the salt, which a key other than the one it
+// was made with can't give.
+func (cf *CryptFile) keyCommitment() []byte {
+	key := cf.fileKey
+	if key == nil {
+		key = cf.key
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyCommitInfo))
+	mac.Write(cf.salt)
+	return mac.Sum(nil)
+}
+
+func blockKey(fileKey []byte, salt []byte, slot int64) []byte {
+	info := make([]byte, len(blockKeyInfo)+8)
+	copy(info, blockKeyInfo)
+	binary.BigEndian.PutUint64(info[len(blockKeyInfo):], uint64(slot))
+	key := make([]byte, fileKeySize)
+	// HKDF can only fail by being asked for more than 255 hashes of output.
+	io.ReadFull(hkdf.New(sha256.New, fileKey, salt, info), key)
+	return key
+}
+
+func blockAD(salt []byte, blockNumber int64) []byte {
+	ad := make([]byte, len(salt)+8)
+	copy(ad, salt)
+	binary.BigEndian.PutUint64(ad[len(salt):], uint64(blockNumber))
+	return ad
+}
+
+// headerAD returns the additional data the encrypted header of a file with
+// featureBoundBlocks is authenticated along with: that of block -1, followed
+// by the two feature bytes as in the header if it has featureBoundFeatures.
+func headerAD(salt []byte, features uint16) []byte {
+	ad := blockAD(salt, -1)
+	if features&featureBoundFeatures != 0 {
+		ad = append(ad, byte(features>>8), byte(features))
+	}
+	return ad
+}
+
+// writeBlock writes the encrypted block to the slot given, which is the same
+// as the block number unless the file is sparse.
+func (cf *CryptFile) writeBlock(slot int64, enc []byte) error {
+	n, err := cf.file.WriteAt(enc, cf.blockSize+slot*cf.blockSize)
 	if err != nil && (err != io.EOF || (err == io.EOF && n != len(enc))) {
 		if err != io.EOF {
 			cf.unknownState = true
 			cf.file.Close()
 			cf.file = nil
 		}
-		return err
+		return fmt.Errorf("%#v writing block %d: %w", cf.Path, slot, err)
+	}
+	cf.wroteBlock(slot, enc)
+	return nil
+}
+
+// wroteBlock records that the encrypted block has been written to the slot,
+// which may have extended the file.
+func (cf *CryptFile) wroteBlock(slot int64, enc []byte) {
+	cf.stats.BlockWrites++
+	if cf.merkleFile {
+		cf.setMerkleLeaf(slot, enc)
+	}
+	if cf.crcFile {
+		cf.setBlockCRC(slot, enc)
+	}
+	if cf.parityFile {
+		cf.setParityDirty(slot)
+	}
+	if slot >= cf.blocks {
+		cf.blocks = slot + 1
+		cf.headerDirty = true
+	}
+}
+
+// encryptJob is a plaintext block being encrypted, and with writeBehind
+// written, in the background.
+type encryptJob struct {
+	blockNumber int64
+	slot        int64
+	enc         []byte
+	written     bool
+	err         error
+	done        chan struct{}
+}
+
+// queueing returns true if write queues blocks rather than writing them out
+// itself.
+func (cf *CryptFile) queueing() bool {
+	return cf.encryptWorkers > 1 || cf.writeBehind > 0
+}
+
+// queueWrite starts encrypting the current plaintext block in the background,
+// first writing out the oldest queued blocks if as many as encryptWorkers or
+// writeBehind allow are already in flight.
+func (cf *CryptFile) queueWrite(blockNumber, slot int64) error {
+	limit := cf.encryptWorkers
+	if cf.writeBehind > limit {
+		limit = cf.writeBehind
+	}
+	// Blocks written in the background could land in any order, so an
+	// earlier write of the same block has to be finished first.
+	if cf.writeBehind > 0 && cf.queued(blockNumber) {
+		if err := cf.flushQueue(); err != nil {
+			return err
+		}
+	}
+	for len(cf.encryptQueue) >= limit {
+		if err := cf.writeQueued(); err != nil {
+			return err
+		}
+	}
+	job := &encryptJob{blockNumber: blockNumber, slot: slot, done: make(chan struct{})}
+	plain, suite, rnd, key, ad := cf.plainBlock, cf.suite, cf.random(), cf.blockKey(slot), cf.blockAD(slot)
+	var file *os.File
+	if cf.writeBehind > 0 {
+		file = cf.file
+	}
+	offset := cf.blockSize + slot*cf.blockSize
+	pth := cf.Path
+	go func() {
+		job.enc, job.err = suite.encryptTo(nil, rnd, plain, key, ad)
+		if job.err == nil && file != nil {
+			n, err := file.WriteAt(job.enc, offset)
+			if err == nil && n != len(job.enc) {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				job.err = fmt.Errorf("%#v writing block %d: %w", pth, slot, err)
+			}
+			job.written = true
+		}
+		close(job.done)
+	}()
+	cf.encryptQueue = append(cf.encryptQueue, job)
+	if cf.metrics != nil {
+		cf.metrics.EncryptedBlock()
+	}
+	return nil
+}
+
+// writeQueued waits for the oldest queued block to be encrypted and writes it
+// out, unless it was already written in the background.
+func (cf *CryptFile) writeQueued() error {
+	job := cf.encryptQueue[0]
+	cf.encryptQueue[0] = nil
+	cf.encryptQueue = cf.encryptQueue[1:]
+	<-job.done
+	err := job.err
+	if err == nil {
+		if job.written {
+			cf.wroteBlock(job.slot, job.enc)
+		} else {
+			err = cf.writeBlock(job.slot, job.enc)
+		}
+	}
+	if err != nil {
+		cf.encryptQueue = nil
+		if !cf.unknownState {
+			cf.fail()
+		}
+	}
+	return err
+}
+
+// flushQueue writes out every block queued by write, in order.
+func (cf *CryptFile) flushQueue() error {
+	for len(cf.encryptQueue) > 0 {
+		if err := cf.writeQueued(); err != nil {
+			return err
+		}
 	}
-	cf.plainBlockDirty = false
 	return nil
 }
 
+// drainQueue discards every block queued by write, waiting for any being
+// encrypted or written in the background to finish so none can touch the
+// file afterwards.
+func (cf *CryptFile) drainQueue() {
+	for _, job := range cf.encryptQueue {
+		<-job.done
+	}
+	cf.encryptQueue = nil
+}
+
+// queued returns true if the block is queued to be written by flushQueue.
+func (cf *CryptFile) queued(blockNumber int64) bool {
+	for _, job := range cf.encryptQueue {
+		if job.blockNumber == blockNumber {
+			return true
+		}
+	}
+	return false
+}
+
 func (cf *CryptFile) writeHeader() error {
 	if cf.unknownState {
 		return unusableError(cf.Path)
@@ -397,9 +3054,130 @@ func (cf *CryptFile) writeHeader() error {
 	if cf.file == nil {
 		return nil
 	}
-	header := make([]byte, header0ASize)
-	copy(header, "CRYPTFILE0 ")
-	binary.BigEndian.PutUint32(header[16:20], uint32(cf.blockSize))
+	if err := cf.flushQueue(); err != nil {
+		return err
+	}
+	if cf.sparseFile && cf.blockMapDirty {
+		if err := cf.writeBlockMap(); err != nil {
+			return err
+		}
+	}
+	// The table of CRCs is rewritten even if no block has been, as it may
+	// have to move, or be authenticated along with a new version.
+	if cf.crcFile && cf.blockCRCs == nil {
+		if err := cf.loadCRCs(); err != nil {
+			return err
+		}
+	}
+	if cf.merkleFile && cf.merkleDirty {
+		if err := cf.writeMerkle(); err != nil {
+			return err
+		}
+	}
+	if cf.versionedFile {
+		if err := cf.writeVersions(); err != nil {
+			return err
+		}
+	}
+	if cf.crcFile {
+		if err := cf.writeCRCs(); err != nil {
+			return err
+		}
+	}
+	if cf.parityFile {
+		if err := cf.writeParity(); err != nil {
+			return err
+		}
+	}
+	if cf.paddedFile {
+		if err := cf.writePadding(); err != nil {
+			return err
+		}
+	}
+	header := make([]byte, cf.headerASize)
+	if cf.wideHeader {
+		copy(header, "CRYPTFILE1 ")
+		binary.BigEndian.PutUint64(header[wideHeaderASize-aes.BlockSize:], uint64(cf.blockSize))
+	} else {
+		copy(header, "CRYPTFILE0 ")
+		binary.BigEndian.PutUint32(header[16:20], uint32(cf.blockSize))
+	}
+	header[11] = byte(cf.suite)
+	dec := make([]byte, cf.plainBlockSize-cf.headerASize)
+	binary.BigEndian.PutUint64(dec[:8], uint64(cf.size))
+	offset := header0BSize
+	if cf.compressed {
+		header[13] |= featureCompressed
+		binary.BigEndian.PutUint64(dec[offset:offset+8], uint64(cf.uncompressedSize))
+		offset += 8
+	}
+	// Only the smallest block sizes don't have room for the block count.
+	if offset+8 <= len(dec) {
+		header[13] |= featureBlockCount
+		binary.BigEndian.PutUint64(dec[offset:offset+8], uint64(cf.blocks))
+		offset += 8
+	}
+	if cf.sparseFile {
+		header[13] |= featureSparse
+		binary.BigEndian.PutUint64(dec[offset:offset+8], uint64(cf.blockMapSlot))
+		binary.BigEndian.PutUint64(dec[offset+8:offset+16], uint64(len(cf.blockMap)))
+		offset += 16
+	}
+	if cf.fileKey != nil {
+		header[13] |= featureBlockKeys
+		copy(dec[offset:offset+fileKeySize], cf.fileKey)
+		offset += fileKeySize
+	}
+	if cf.merkleFile {
+		header[13] |= featureMerkle
+		copy(dec[offset:offset+merkleHashSize], cf.merkleRoot)
+		offset += merkleHashSize
+	}
+	if cf.versionedFile {
+		header[12] |= featureVersioned >> 8
+		binary.BigEndian.PutUint64(dec[offset:offset+8], cf.version)
+		offset += 8
+	}
+	if cf.paddedFile {
+		header[12] |= featurePadded >> 8
+		binary.BigEndian.PutUint64(dec[offset:offset+8], uint64(cf.paddedBucket))
+		offset += 8
+	}
+	if cf.keyCommitFile {
+		header[12] |= featureKeyCommit >> 8
+		copy(dec[offset:offset+keyCommitSize], cf.keyCommitment())
+		offset += keyCommitSize
+	}
+	if cf.parityFile {
+		header[12] |= featureParity >> 8
+		binary.BigEndian.PutUint32(dec[offset:offset+4], uint32(cf.shardData))
+		binary.BigEndian.PutUint32(dec[offset+4:offset+8], uint32(cf.shardParity))
+		offset += 8
+	}
+	if cf.crcFile {
+		header[12] |= featureCRC >> 8
+	}
+	if cf.kdf != nil {
+		header[14] = cf.kdf.kdfID()
+		cf.kdf.marshal(header[header0ASize : header0ASize+kdfParamsSize])
+	}
+	if cf.salt != nil {
+		copy(header[header0ASize+kdfParamsSize:], cf.salt)
+	}
+	header[15] = byte((cf.headerASize - header0ASize) / aes.BlockSize)
+	header[13] |= featureHeaderAuth
+	if cf.boundBlocks {
+		header[13] |= featureBoundBlocks
+		header[12] |= featureBoundFeatures >> 8
+	}
+	if cf.recipients != nil {
+		header[13] |= featureRecipients
+		cf.writeRecipients(header)
+	}
+	cf.headerFeatures = uint16(header[13]) | uint16(header[12])<<8
+	keyCheck, mac := headerAuth(header, cf.headerKey())
+	copy(header[20:24], keyCheck)
+	copy(header[24:32], mac)
 	n, err := cf.file.WriteAt(header, 0)
 	if err != nil && (err != io.EOF || (err == io.EOF && n != len(header))) {
 		if err != io.EOF {
@@ -407,32 +3185,63 @@ func (cf *CryptFile) writeHeader() error {
 			cf.file.Close()
 			cf.file = nil
 		}
-		return err
+		return fmt.Errorf("%#v writing header: %w", cf.Path, err)
 	}
-	dec := make([]byte, cf.plainBlockSize-header0ASize)
-	binary.BigEndian.PutUint64(dec[:8], uint64(cf.size))
-	_, err = rand.Read(dec[8:])
+	_, err = io.ReadFull(cf.random(), dec[offset:])
 	if err != nil {
-		cf.unknownState = true
-		cf.file.Close()
-		cf.file = nil
-		return err
+		cf.fail()
+		return fmt.Errorf("%#v generating header padding: %w", cf.Path, err)
 	}
-	enc, err := encrypt0(dec, cf.key)
+	enc, err := cf.suite.encryptTo(nil, cf.random(), dec, cf.headerKey(), cf.blockAD(-1))
 	if err != nil {
-		cf.unknownState = true
-		cf.file.Close()
-		cf.file = nil
-		return err
+		cf.fail()
+		return fmt.Errorf("%#v encrypting header: %w", cf.Path, err)
 	}
-	n, err = cf.file.WriteAt(enc, header0ASize)
+	n, err = cf.file.WriteAt(enc, cf.headerASize)
 	if err != nil && (err != io.EOF || (err == io.EOF && n != len(enc))) {
 		if err != io.EOF {
 			cf.unknownState = true
 			cf.file.Close()
 			cf.file = nil
 		}
-		return err
+		return fmt.Errorf("%#v writing header: %w", cf.Path, err)
+	}
+	cf.stats.HeaderWrites++
+	if cf.sparseFile {
+		cf.findFreeSlots()
+	}
+	cf.fresh = false
+	if cf.version > cf.seenVersion {
+		cf.seenVersion = cf.version
+	}
+	return nil
+}
+
+// lockFile locks the file as for CryptFileOptions.Lock.
+func (cf *CryptFile) lockFile(file *os.File, exclusive bool) error {
+	err := lockFile(file, exclusive)
+	if err == ErrLocked {
+		return &LockError{Path: cf.Path, Exclusive: exclusive}
+	}
+	if err != nil {
+		return fmt.Errorf("%#v locking: %w", cf.Path, err)
 	}
 	return nil
 }
+
+// fail leaves the CryptFile unusable after an error it can't recover from,
+// closing the file. If the file was only just created and has yet to have a
+// header written, it can't be opened, so it is removed so that trying again
+// can create it afresh.
+func (cf *CryptFile) fail() {
+	cf.unknownState = true
+	cf.file.Close()
+	cf.file = nil
+	if cf.fresh {
+		cf.logf("%#v removing the file just created after an error", cf.Path)
+		os.Remove(cf.Path)
+		cf.fresh = false
+	} else {
+		cf.logf("%#v in an unknown state after an error", cf.Path)
+	}
+}
@@ -1,11 +1,28 @@
 package brimcrypt
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"math/rand"
 	"os"
 	"path"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func TestBlockSizeForSize(t *testing.T) {
@@ -30,13 +47,40 @@ func TestBlockSizeForSize(t *testing.T) {
 		{3397889, 8192},
 		{3404193, 65536},
 	} {
-		blockSize := blockSizeForSize(sizes[0])
+		blockSize := blockSizeForSize(sizes[0], AES256CBCHMACSHA256.overhead())
 		if blockSize != sizes[1] {
 			t.Errorf("blockSizeForSize(%d) %d != %d", sizes[0], blockSize, sizes[1])
 		}
 	}
 }
 
+func TestEncryptedSize(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, size := range []int64{0, 1, 80, 81, 1000, 24567, 245678, 1 << 20} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", size))
+		cf := NewCryptFile(tmp, key, size)
+		defer cf.Close()
+		if _, err := cf.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		finfo, err := os.Stat(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if EncryptedSize(size) != finfo.Size() {
+			t.Errorf("EncryptedSize(%d) %d != %d on disk", size, EncryptedSize(size), finfo.Size())
+		}
+	}
+	if Overhead(128) != 48 || Overhead(65536) != 48 {
+		t.Errorf("Overhead %d %d != 48", Overhead(128), Overhead(65536))
+	}
+}
+
 func TestCryptFile(t *testing.T) {
 	tmpdir := EmptyTestDir(t)
 	defer removeTestTree(tmpdir)
@@ -273,3 +317,3863 @@ func TestReadWithoutPreviousOpen(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestBlockSizeForSizeOptions(t *testing.T) {
+	for _, size := range []int64{0, 161, 2456, 24567890, 3339889} {
+		if BlockSizeForSize(size, nil) != blockSizeForSize(size, AES256CBCHMACSHA256.overhead()) {
+			t.Errorf("BlockSizeForSize(%d, nil) %d != %d", size, BlockSizeForSize(size, nil), blockSizeForSize(size, AES256CBCHMACSHA256.overhead()))
+		}
+	}
+	for _, c := range []struct {
+		size int64
+		opts *BlockSizeOptions
+		want int64
+	}{
+		{5 << 30, nil, 65536},
+		{5 << 30, &BlockSizeOptions{MaxBlockSize: 1 << 24}, 1 << 24},
+		{5 << 30, &BlockSizeOptions{MaxBlockSize: 3 << 20}, 2 << 20},
+		{5 << 30, &BlockSizeOptions{MaxBlockSize: 1024}, 1024},
+		{5 << 30, &BlockSizeOptions{MaxBlockSize: 1}, minBlockSize},
+		{24567, &BlockSizeOptions{WasteThreshold: 10}, 65536},
+		{24567, &BlockSizeOptions{WasteThreshold: -1}, 1024},
+	} {
+		if got := BlockSizeForSize(c.size, c.opts); got != c.want {
+			t.Errorf("BlockSizeForSize(%d, %#v) %d != %d", c.size, c.opts, got, c.want)
+		}
+	}
+}
+
+func TestCryptFileChaCha20Poly1305(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Suite: ChaCha20Poly1305})
+	defer cf.Close()
+	in := `
+        Rambling text for the testing of cryptfile with the ChaCha20-Poly1305
+        cipher suite, long enough to span several 128-byte blocks.
+    `
+	if _, err := io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.suite != ChaCha20Poly1305 {
+		t.Errorf("suite %d != %d", cf.suite, ChaCha20Poly1305)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, []byte("0123456789abcdef0123456789abcdeX"), 0)
+	defer cf.Close()
+	if _, err = cf.Size(); err != KeyError {
+		t.Errorf("expected KeyError with wrong key; got %v", err)
+	}
+}
+
+func TestCryptFileAES256GCMSIV(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Suite: AES256GCMSIV})
+	defer cf.Close()
+	in := `
+        Rambling text for the testing of cryptfile with the AES-256-GCM-SIV
+        cipher suite, long enough to span several 128-byte blocks.
+    `
+	if _, err := io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.suite != AES256GCMSIV {
+		t.Errorf("suite %d != %d", cf.suite, AES256GCMSIV)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+	if err = cf.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, []byte("0123456789abcdef0123456789abcdeX"), 0)
+	defer cf.Close()
+	if _, err = cf.Size(); err != KeyError {
+		t.Errorf("expected KeyError with wrong key; got %v", err)
+	}
+}
+
+func TestCryptFileHMACSHA512(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Suite: AES256CBCHMACSHA512})
+	defer cf.Close()
+	in := strings.Repeat("Rambling text for the testing of cryptfile with HMAC SHA-512. ", 20)
+	if _, err := io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.suite != AES256CBCHMACSHA512 {
+		t.Errorf("suite %d != %d", cf.suite, AES256CBCHMACSHA512)
+	}
+	if cf.plainBlockSize != cf.blockSize-hmac512Size-16 {
+		t.Errorf("plain block size %d for block size %d", cf.plainBlockSize, cf.blockSize)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+	blockSize := cf.blockSize
+	cf.Close()
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, blockSize*2+100); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 1
+	if _, err = f.WriteAt(b, blockSize*2+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err = ioutil.ReadAll(cf); err != KeyError {
+		t.Errorf("expected KeyError reading a tampered block; got %v", err)
+	}
+	cf.Close()
+	if err = cf.Verify(); !errors.Is(err, KeyError) || !strings.Contains(err.Error(), "block 1") {
+		t.Errorf("expected KeyError for block 1 from Verify; got %v", err)
+	}
+}
+
+func TestCryptFileAES256CTR(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Suite: AES256CTRHMACSHA256})
+	defer cf.Close()
+	in := strings.Repeat("Rambling text for the testing of cryptfile with AES-256 CTR. ", 20)
+	if _, err := io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.suite != AES256CTRHMACSHA256 {
+		t.Errorf("suite %d != %d", cf.suite, AES256CTRHMACSHA256)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+	// ReadAt only decrypts what it's asked for, at any alignment.
+	for _, r := range [][2]int{{0, 1}, {5, 20}, {17, 80}, {70, 200}, {len(in) - 3, len(in)}} {
+		b := make([]byte, r[1]-r[0])
+		if _, err = cf.ReadAt(b, int64(r[0])); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != in[r[0]:r[1]] {
+			t.Errorf("ReadAt %d to %d gave %#v not %#v", r[0], r[1], string(b), in[r[0]:r[1]])
+		}
+	}
+	blockSize := cf.blockSize
+	cf.Close()
+	// Tampering with a block fails even a ReadAt of other bytes in it.
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, blockSize*2+100); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 1
+	if _, err = f.WriteAt(b, blockSize*2+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	plainBlockSize := blockSize - AES256CTRHMACSHA256.overhead()
+	if _, err = cf.ReadAt(b, plainBlockSize+1); err != KeyError {
+		t.Errorf("expected KeyError with ReadAt of a tampered block; got %v", err)
+	}
+	if _, err = cf.ReadAt(b, 1); err != nil {
+		t.Errorf("expected ReadAt of an untampered block to work; got %v", err)
+	}
+	cf.Close()
+	if err = cf.Verify(); !errors.Is(err, KeyError) || !strings.Contains(err.Error(), "block 1") {
+		t.Errorf("expected KeyError for block 1 from Verify; got %v", err)
+	}
+}
+
+func TestCryptFilePhrase(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	params := &Argon2Params{Time: 1, Memory: 64, Threads: 1}
+	cf := NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Test Phrase", KDF: params})
+	defer cf.Close()
+	in := "Test Message protected by a derived key"
+	if _, err := io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw[14] != kdfArgon2id {
+		t.Errorf("header KDF %d != %d", raw[14], kdfArgon2id)
+	}
+	salt := raw[header0ASize+kdfParamsSize : header0ASize+kdfParamsSize+saltSize]
+	if string(KeyArgon2("Test Phrase", salt, params)) != string(cf.key) {
+		t.Errorf("key was not derived from the stored salt")
+	}
+	cf = NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Test Phrase"})
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Wrong Phrase"})
+	defer cf.Close()
+	if _, err = cf.Size(); err != KeyError {
+		t.Errorf("expected KeyError with wrong phrase; got %v", err)
+	}
+	cf = NewCryptFile(tmp, keyPhrase("Test Phrase"), 0)
+	defer cf.Close()
+	if _, err = cf.Size(); err == nil {
+		t.Errorf("expected error opening without a phrase")
+	}
+	// A file that couldn't be opened again isn't created.
+	huge := path.Join(tmpdir, "huge")
+	cf = NewCryptFileWithOptions(huge, nil, 0, &CryptFileOptions{Phrase: "Test Phrase", KDF: &Argon2Params{Time: 17, Memory: 64, Threads: 1}})
+	if _, err = io.WriteString(cf, in); err == nil {
+		t.Errorf("expected error creating with excessive KDF params")
+	}
+	cf.Close()
+	if _, err = os.Stat(huge); !os.IsNotExist(err) {
+		t.Errorf("expected no file; got %v", err)
+	}
+}
+
+func TestCryptFilePhraseLegacy(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key, err := Key("Test Phrase", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	in := "Test Message"
+	if _, err = io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Test Phrase"})
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+}
+
+func TestCryptFilePhraseScrypt(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Test Phrase", KDF: &ScryptParams{N: 16, R: 1, P: 1}})
+	defer cf.Close()
+	in := "Test Message protected by an scrypt key"
+	if _, err := io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Test Phrase"})
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+	if params, ok := cf.kdf.(*ScryptParams); !ok || *params != (ScryptParams{N: 16, R: 1, P: 1}) {
+		t.Errorf("scrypt params not recovered from header; got %#v", cf.kdf)
+	}
+}
+
+func TestCryptFilePhrasePBKDF2(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Test Phrase", KDF: &PBKDF2Params{Iterations: 1000}})
+	defer cf.Close()
+	in := "Test Message protected by a PBKDF2 key"
+	if _, err := io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Test Phrase"})
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+	key, err := KeyPBKDF2("Test Phrase", cf.salt, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != string(cf.key) {
+		t.Errorf("key was not derived with the stored salt and iterations")
+	}
+	cf.Close()
+	// Too many iterations, or more than the header holds, which would be
+	// recorded as fewer, aren't created.
+	iterations := []int{maxPBKDF2Iterations + 1}
+	if strconv.IntSize == 64 {
+		wrapped := int64(1)<<32 + 1000
+		iterations = append(iterations, int(wrapped))
+	}
+	for _, i := range iterations {
+		huge := path.Join(tmpdir, fmt.Sprintf("huge%d", i))
+		cf = NewCryptFileWithOptions(huge, nil, 0, &CryptFileOptions{Phrase: "Test Phrase", KDF: &PBKDF2Params{Iterations: i}})
+		if _, err = io.WriteString(cf, in); err == nil {
+			t.Errorf("%d: expected error creating with excessive iterations", i)
+		}
+		cf.Close()
+		if _, err = os.Stat(huge); !os.IsNotExist(err) {
+			t.Errorf("%d: expected no file; got %v", i, err)
+		}
+	}
+}
+
+func TestCryptFileSalt(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	var salts [][]byte
+	for _, name := range []string{"one", "two"} {
+		cf := NewCryptFile(path.Join(tmpdir, name), key, 0)
+		if _, err := io.WriteString(cf, "Test Message"); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(path.Join(tmpdir, name), nil, 0)
+		salt, err := cf.Salt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(salt) != saltSize {
+			t.Fatalf("salt length %d != %d", len(salt), saltSize)
+		}
+		salts = append(salts, salt)
+		cf = NewCryptFile(path.Join(tmpdir, name), key, 0)
+		if _, err = cf.Size(); err != nil {
+			t.Fatal(err)
+		}
+		salt2, err := cf.Salt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(salt2) != string(salt) {
+			t.Errorf("salt %x did not survive reopen; got %x", salt, salt2)
+		}
+		cf.Close()
+	}
+	if string(salts[0]) == string(salts[1]) {
+		t.Errorf("two files were given the same salt %x", salts[0])
+	}
+	if _, err := NewCryptFile(path.Join(tmpdir, "missing"), key, 0).Salt(); !os.IsNotExist(err) {
+		t.Errorf("expected IsNotExist err from Salt; got %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	cf := NewCryptFile(tmp, oldKey, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, newKey, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(in) {
+		t.Errorf("output does not match input after Rekey")
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, oldKey, 0)
+	defer cf.Close()
+	if _, err = cf.Size(); err != KeyError {
+		t.Errorf("expected KeyError with old key; got %v", err)
+	}
+}
+
+func TestRekeyResume(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	cf := NewCryptFile(tmp, oldKey, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an interrupted Rekey that only got through the first block.
+	if _, err := cf.Size(); err != nil {
+		t.Fatal(err)
+	}
+	enc := make([]byte, cf.blockSize)
+	if _, err := cf.file.ReadAt(enc, cf.blockSize); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := decrypt0(enc, oldKey, cf.blockAD(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc, err = encrypt0(dec, newKey, cf.blockAD(0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.file.WriteAt(enc, cf.blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(cf); err != KeyError {
+		t.Errorf("expected KeyError reading a half rekeyed file; got %v", err)
+	}
+	if err = cf.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, newKey, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(in) {
+		t.Errorf("output does not match input after resumed Rekey")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, suite := range []CipherSuite{AES256CBCHMACSHA256, ChaCha20Poly1305} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", suite))
+		cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Suite: suite})
+		defer cf.Close()
+		if _, err := cf.Write(make([]byte, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmp, key, 0)
+		if err := cf.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		cf.Close()
+		cf = NewCryptFile(tmp, []byte("0123456789abcdef0123456789abcdeX"), 0)
+		if err := cf.Verify(); err != KeyError {
+			t.Errorf("%d: expected KeyError with the wrong key, got %v", suite, err)
+		}
+		cf.Close()
+		f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.WriteAt([]byte{0xff}, 128*3+100); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		cf = NewCryptFile(tmp, key, 0)
+		err = cf.Verify()
+		if err == nil || !strings.Contains(err.Error(), "block 2:") {
+			t.Errorf("%d: expected an error for block 2, got %v", suite, err)
+		}
+		cf.Close()
+		if err = os.Truncate(tmp, 128*3+100); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmp, key, 0)
+		err = cf.Verify()
+		if err == nil || !strings.Contains(err.Error(), "whole number") {
+			t.Errorf("%d: expected an error for the length, got %v", suite, err)
+		}
+		cf.Close()
+	}
+}
+
+// cancelReader gives zeros forever, cancelling after the first read.
+type cancelReader struct {
+	cancel func()
+}
+
+func (cr *cancelReader) Read(b []byte) (int, error) {
+	cr.cancel()
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// cancelWriter cancels after the first write.
+type cancelWriter struct {
+	cancel func()
+	n      int
+}
+
+func (cw *cancelWriter) Write(b []byte) (int, error) {
+	cw.cancel()
+	cw.n += len(b)
+	return len(b), nil
+}
+
+func TestCryptFileContext(t *testing.T) {
+	defer func(v int64) { progressInterval = v }(progressInterval)
+	progressInterval = 1
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	in := make([]byte, 10000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	// An endless reader can only be stopped by the context.
+	cf := NewCryptFile(path.Join(tmpdir, "endless"), key, 0)
+	defer cf.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	var n int64
+	go func() {
+		var err error
+		n, err = cf.ReadFromContext(ctx, &cancelReader{cancel: cancel})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled; got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ReadFromContext did not return after the context was cancelled")
+	}
+	// What was read before the cancellation is kept.
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := cf.Size(); err != nil {
+		t.Fatal(err)
+	} else if n == 0 || size != n {
+		t.Fatalf("ReadFromContext read %d, size %d", n, size)
+	}
+	cf.Close()
+	cf = NewCryptFile(tmp, key, 0)
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelWriter{cancel: cancel}
+	cf = NewCryptFile(tmp, key, 0)
+	n, err := cf.WriteToContext(ctx, w)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+	if n != int64(w.n) || n >= int64(len(in)) {
+		t.Fatalf("WriteToContext wrote %d of %d, %d counted", w.n, len(in), n)
+	}
+	rest, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, in[n:]) {
+		t.Fatal("reading after WriteToContext was cancelled didn't pick up where it left off")
+	}
+	cf.Close()
+	var calls int
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Progress: func(bytesDone, bytesTotal int64) {
+		if calls++; calls == 3 {
+			cancel()
+		}
+	}})
+	if err = cf.VerifyContext(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("VerifyContext went on for %d progress calls after being cancelled", calls-3)
+	}
+	if err = cf.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err = cf.RekeyContext(ctx, newKey); err != context.Canceled {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("RekeyContext went on for %d progress calls after being cancelled", calls-3)
+	}
+	cf.Close()
+	cf = NewCryptFile(tmp, key, 0)
+	if err = cf.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	cf = NewCryptFile(tmp, newKey, 0)
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Fatal("output does not match input after a cancelled Rekey was finished")
+	}
+}
+
+func TestRecoverTo(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i%250 + 1)
+	}
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, 128*3+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err = ioutil.ReadAll(cf); err != KeyError {
+		t.Errorf("expected KeyError from Read, got %v", err)
+	}
+	var buf bytes.Buffer
+	n, badBlocks, err := cf.RecoverTo(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(in)) || buf.Len() != len(in) {
+		t.Fatalf("RecoverTo gave n %d and %d bytes != %d", n, buf.Len(), len(in))
+	}
+	if len(badBlocks) != 1 || badBlocks[0] != 2 {
+		t.Errorf("expected bad block 2, got %v", badBlocks)
+	}
+	want := append([]byte(nil), in...)
+	for i := 80 * 2; i < 80*3; i++ {
+		want[i] = 0
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Error("recovered output does not match input")
+	}
+	cf.Close()
+	if err = os.Truncate(tmp, 128*5); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	buf.Reset()
+	if _, badBlocks, err = cf.RecoverTo(&buf, '?'); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(badBlocks) != "[2 4 5 6 7 8 9 10 11 12]" {
+		t.Errorf("unexpected bad blocks %v", badBlocks)
+	}
+	if buf.Len() != len(in) || !bytes.Equal(buf.Bytes()[:80*2], in[:80*2]) || buf.Bytes()[len(in)-1] != '?' {
+		t.Error("recovered output from truncated file does not match input")
+	}
+}
+
+func TestScanFile(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i%250 + 1)
+	}
+	for _, tt := range []struct {
+		name string
+		opts *CryptFileOptions
+	}{
+		{"plain", nil},
+		{"chacha", &CryptFileOptions{Suite: ChaCha20Poly1305}},
+	} {
+		tmp := path.Join(tmpdir, tt.name)
+		cf := NewCryptFileWithOptions(tmp, key, 0, tt.opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		bad, err := ScanFile(tmp, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bad == nil || len(bad) != 0 {
+			t.Errorf("%s: expected no bad blocks, got %v", tt.name, bad)
+		}
+		f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, blockNumber := range []int64{2, 7} {
+			if _, err = f.WriteAt([]byte{0xff, 0xff}, 128+blockNumber*128+100); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.Close()
+		if bad, err = ScanFile(tmp, key); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(bad) != "[2 7]" {
+			t.Errorf("%s: expected bad blocks 2 and 7, got %v", tt.name, bad)
+		}
+		if _, err = ScanFile(tmp, []byte("0123456789abcdef0123456789abcdeX")); err != KeyError {
+			t.Errorf("%s: expected KeyError with the wrong key, got %v", tt.name, err)
+		}
+	}
+	// The blocks missing from a truncated file are bad too.
+	tmp := path.Join(tmpdir, "plain")
+	if err := os.Truncate(tmp, 128*10); err != nil {
+		t.Fatal(err)
+	}
+	bad, err := ScanFile(tmp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(bad) != "[2 7 9 10 11 12]" {
+		t.Errorf("unexpected bad blocks from truncated file %v", bad)
+	}
+}
+
+func TestRewriteBlock(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i%250 + 1)
+	}
+	for _, tt := range []struct {
+		name string
+		opts *CryptFileOptions
+	}{
+		{"plain", nil},
+		{"merkle", &CryptFileOptions{Merkle: true, CRC: true}},
+		{"workers", &CryptFileOptions{EncryptWorkers: 2, CacheBlocks: 4}},
+	} {
+		tmp := path.Join(tmpdir, tt.name)
+		cf := NewCryptFileWithOptions(tmp, key, 0, tt.opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		info, err := ReadHeader(tmp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, pbs := info.BlockSize, int(info.PlainBlockSize)
+		blocks := (len(in) + pbs - 1) / pbs
+		f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.WriteAt([]byte{0xff, 0xff}, bs+2*bs+20); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		before, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFileWithOptions(tmp, key, 0, tt.opts)
+		if _, err = ioutil.ReadAll(cf); err != KeyError {
+			t.Errorf("%s: expected KeyError, got %v", tt.name, err)
+		}
+		if err = cf.RewriteBlock(2, in[2*pbs:3*pbs]); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.opts == nil {
+			// Only the block itself has changed on disk.
+			after, err := ioutil.ReadFile(tmp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) != len(before) || !bytes.Equal(after[:bs*3], before[:bs*3]) || !bytes.Equal(after[bs*4:], before[bs*4:]) || bytes.Equal(after[bs*3:bs*4], before[bs*3:bs*4]) {
+				t.Errorf("%s: expected only block 2 to change", tt.name)
+			}
+		}
+		// The last block isn't full of data.
+		last := append([]byte(nil), in[(blocks-1)*pbs:]...)
+		last = append(last, bytes.Repeat([]byte("x"), pbs-len(last))...)
+		if err = cf.RewriteBlock(int64(blocks-1), last); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err = cf.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%s: output does not match input", tt.name)
+		}
+		if err = cf.RewriteBlock(1, in[:pbs-1]); err == nil {
+			t.Errorf("%s: expected an error for a short block", tt.name)
+		}
+		if err = cf.RewriteBlock(int64(blocks), in[:pbs]); err == nil {
+			t.Errorf("%s: expected an error for a block past the end", tt.name)
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.Verify(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		cf.Close()
+	}
+	cf := NewCryptFileWithOptions(path.Join(tmpdir, "plain"), key, 0, &CryptFileOptions{ReadOnly: true})
+	defer cf.Close()
+	if err := cf.RewriteBlock(0, in[:80]); err == nil {
+		t.Error("expected an error rewriting a read-only file")
+	}
+}
+
+func TestCryptFileTruncated(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	if err := os.Truncate(tmp, 128*10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Size(); !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	if _, err := ioutil.ReadAll(cf); !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	if err := cf.Verify(); !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+// writeLegacyFile writes the plaintext to the path as a CRYPTFILE0 file from
+// before any features, which has neither a block count nor an authenticated
+// header.
+func writeLegacyFile(t *testing.T, pth string, key []byte, plain []byte) {
+	const blockSize = 128
+	plainBlockSize := blockSize - AES256CBCHMACSHA256.overhead()
+	header := make([]byte, header0ASize)
+	copy(header, "CRYPTFILE0 ")
+	binary.BigEndian.PutUint32(header[16:20], blockSize)
+	dec := make([]byte, plainBlockSize-header0ASize)
+	binary.BigEndian.PutUint64(dec, uint64(len(plain)))
+	enc, err := AES256CBCHMACSHA256.encryptTo(nil, &testRand{}, dec, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append(header, enc...)
+	for i := int64(0); i < int64(len(plain)); i += plainBlockSize {
+		dec = make([]byte, plainBlockSize)
+		copy(dec, plain[i:])
+		if enc, err = AES256CBCHMACSHA256.encryptTo(nil, &testRand{}, dec, key, nil); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, enc...)
+	}
+	if err = os.MkdirAll(path.Dir(pth), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(pth, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptFileTruncatedLegacy(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	writeLegacyFile(t, tmp, key, in)
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("output does not match input")
+	}
+	cf.Close()
+	// Without a block count, the size still gives the truncation away.
+	finfo, err := os.Stat(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(tmp, finfo.Size()-128); err != nil {
+		t.Fatal(err)
+	}
+	var truncation *TruncationError
+	if _, err = cf.Size(); !errors.As(err, &truncation) || truncation.Blocks != 12 || truncation.Expected != 13 {
+		t.Errorf("expected a TruncationError of 12 blocks out of 13, got %v", err)
+	}
+	if _, err = ioutil.ReadAll(cf); !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	cf.Close()
+	// Nor is a file cut short once opened taken as ending early.
+	writeLegacyFile(t, tmp, key, in)
+	if _, err = cf.Size(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(tmp, finfo.Size()-128); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = ioutil.ReadAll(cf); err != io.ErrUnexpectedEOF || len(out) != 960 {
+		t.Errorf("expected io.ErrUnexpectedEOF after 960 bytes, got %v after %d", err, len(out))
+	}
+}
+
+func TestCryptFileHeaderAltered(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	orig, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range []struct {
+		name   string
+		offset int
+		xor    byte
+	}{
+		{"block size", 18, 0x01},
+		{"features", 13, featureBlockCount},
+		{"authentication code", 30, 0x01},
+		{"salt", 60, 0x01},
+	} {
+		altered := append([]byte(nil), orig...)
+		altered[change.offset] ^= change.xor
+		if err = ioutil.WriteFile(tmp, altered, 0600); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmp, key, 0)
+		if _, err = cf.Size(); err != HeaderError {
+			t.Errorf("%s: expected HeaderError, got %v", change.name, err)
+		}
+		cf.Close()
+	}
+	// Stripping the authentication, and the block count with it, as if the
+	// file were from before either, doesn't get past it, truncated or not.
+	stripped := append([]byte(nil), orig...)
+	stripped[13] &^= featureHeaderAuth | featureBlockCount
+	copy(stripped[20:32], make([]byte, 12))
+	for _, length := range []int{len(stripped), len(stripped) / 2} {
+		if err = ioutil.WriteFile(tmp, stripped[:length], 0600); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmp, key, 0)
+		if _, err = ioutil.ReadAll(cf); err != HeaderError {
+			t.Errorf("stripped to %d bytes: expected HeaderError, got %v", length, err)
+		}
+		cf.Close()
+	}
+	if err = ioutil.WriteFile(tmp, orig, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, []byte("0123456789abcdef0123456789abcdeX"), 0)
+	if _, err = cf.Size(); err != KeyError {
+		t.Errorf("expected KeyError with the wrong key, got %v", err)
+	}
+	cf.Close()
+	cf = NewCryptFile(tmp, key, 0)
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "Hello World!" {
+		t.Errorf("output %#v does not match input", string(out))
+	}
+	cf.Close()
+}
+
+func TestCryptFileBlocksBound(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for _, suite := range []CipherSuite{AES256CBCHMACSHA256, ChaCha20Poly1305} {
+		var tmps []string
+		for _, name := range []string{"a", "b"} {
+			tmp := path.Join(tmpdir, fmt.Sprintf("%s%d", name, suite))
+			cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Suite: suite})
+			if _, err := cf.Write(in); err != nil {
+				t.Fatal(err)
+			}
+			if err := cf.Close(); err != nil {
+				t.Fatal(err)
+			}
+			tmps = append(tmps, tmp)
+		}
+		a, err := ioutil.ReadFile(tmps[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(tmps[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		swapped := append([]byte(nil), a...)
+		copy(swapped[128*2:128*3], a[128*3:128*4])
+		copy(swapped[128*3:128*4], a[128*2:128*3])
+		if err = ioutil.WriteFile(tmps[0], swapped, 0600); err != nil {
+			t.Fatal(err)
+		}
+		cf := NewCryptFile(tmps[0], key, 0)
+		out, err := ioutil.ReadAll(cf)
+		if err != KeyError {
+			t.Errorf("%d: expected KeyError reading swapped blocks, got %v", suite, err)
+		}
+		if !bytes.Equal(out, in[:128-suite.overhead()]) {
+			t.Errorf("%d: expected the block before the swapped blocks to read", suite)
+		}
+		cf.Close()
+		moved := append([]byte(nil), a...)
+		copy(moved[128*2:128*3], b[128*2:128*3])
+		if err = ioutil.WriteFile(tmps[0], moved, 0600); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmps[0], key, 0)
+		if _, err = ioutil.ReadAll(cf); err != KeyError {
+			t.Errorf("%d: expected KeyError reading a block from another file, got %v", suite, err)
+		}
+		cf.Close()
+	}
+}
+
+func TestOpenForAppend(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 2000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	cf, err := OpenForAppend(tmp, key, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf.Close()
+	if _, err = cf.Write(in[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, end := range []int{1555, 1600, 2000} {
+		cf, err = OpenForAppend(tmp, key, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cf.Close()
+		start, _ := cf.Seek(0, 1)
+		if _, err = cf.Write(in[start:end]); err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1000 bytes is 12 full 80 byte blocks and then a partial one.
+	if !bytes.Equal(before[128:128*13], after[128:128*13]) {
+		t.Error("appending rewrote full blocks")
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("output does not match appended input")
+	}
+	cf.Close()
+	if cf, err = OpenForAppend(tmp, key, 0, &CryptFileOptions{ReadOnly: true}); err == nil {
+		cf.Close()
+		t.Error("expected an error appending to a read-only file")
+	}
+}
+
+func TestSeekPastEndWrite(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for i, opts := range []*CryptFileOptions{nil, {Sparse: true}} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", i))
+		cf := NewCryptFileWithOptions(tmp, key, 0, opts)
+		defer cf.Close()
+		if _, err := cf.Write([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cf.Seek(10240, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cf.Write([]byte("d")); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		want := make([]byte, 3+10240+1)
+		copy(want, "abc")
+		want[len(want)-1] = 'd'
+		if size, err := cf.Size(); err != nil || size != int64(len(want)) {
+			t.Fatal(size, err)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, want) {
+			t.Errorf("%d: gap did not read back as zeros", i)
+		}
+		if err = cf.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		cf.Close()
+	}
+}
+
+func TestCryptFileSparse(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1<<20)
+	for i := 0; i < 1000; i++ {
+		in[i] = byte(i)
+		in[len(in)-1000+i] = byte(i)
+	}
+	write := func(pth string, opts *CryptFileOptions) int64 {
+		cf := NewCryptFileWithOptions(pth, key, 0, opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		finfo, err := os.Stat(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return finfo.Size()
+	}
+	tmp := path.Join(tmpdir, "sparse")
+	sparseSize := write(tmp, &CryptFileOptions{Sparse: true})
+	fullSize := write(path.Join(tmpdir, "full"), nil)
+	if sparseSize*10 > fullSize {
+		t.Errorf("sparse file is %d bytes against %d bytes for the full file", sparseSize, fullSize)
+	}
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("output does not match input")
+	}
+	if err = cf.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	copy(in[len(in)/2:], "filling in the gap")
+	if _, err = cf.Seek(int64(len(in)/2), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Write(in[len(in)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out = make([]byte, len(in))
+	if _, err = cf.ReadAt(out, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("output does not match input after filling in the gap")
+	}
+	var buf bytes.Buffer
+	if _, bad, err := cf.RecoverTo(&buf, 0xff); err != nil || len(bad) != 0 {
+		t.Fatal(bad, err)
+	}
+	if !bytes.Equal(buf.Bytes(), in) {
+		t.Error("recovered output does not match input")
+	}
+	newKey := []byte("abcdef0123456789abcdef0123456789")
+	if err = cf.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	cf = NewCryptFile(tmp, newKey, 0)
+	defer cf.Close()
+	if err = cf.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = ioutil.ReadAll(cf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("output does not match input after Rekey")
+	}
+}
+
+func TestCryptFileSparseSessions(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	chunk := make([]byte, 10000)
+	for i := range chunk {
+		chunk[i] = byte(i) | 1
+	}
+	const sessions = 40
+	once := path.Join(tmpdir, "once")
+	cf := NewCryptFileWithOptions(once, key, 0, &CryptFileOptions{Sparse: true})
+	defer cf.Close()
+	for i := 0; i < sessions; i++ {
+		if _, err := cf.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Each session writes a new block map, but the slots of those before
+	// the last are reused rather than left behind.
+	tmp := path.Join(tmpdir, "sessions")
+	for i := 0; i < sessions; i++ {
+		cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Sparse: true})
+		if i > 0 {
+			if _, err := cf.Seek(0, io.SeekEnd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := cf.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, bytes.Repeat(chunk, sessions)) {
+		t.Error("output does not match input")
+	}
+	mapSize := cf.blockMapBlocks() * cf.blockSize
+	cf.Close()
+	onceInfo, err := os.Stat(once)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionsInfo, err := os.Stat(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionsInfo.Size() > onceInfo.Size()+2*mapSize {
+		t.Errorf("%d sessions took %d bytes against %d for one", sessions, sessionsInfo.Size(), onceInfo.Size())
+	}
+}
+
+func TestCryptFilePreallocate(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 100000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	var sizes []int64
+	for i, opts := range []*CryptFileOptions{nil, {Preallocate: true}} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", i))
+		cf := NewCryptFileWithOptions(tmp, key, 1<<20, opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if size, err := cf.Size(); err != nil || size != int64(len(in)) {
+			t.Errorf("%d: size %d != %d; %v", i, size, len(in), err)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%d: output does not match input", i)
+		}
+		if err = cf.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		cf.Close()
+		finfo, err := os.Stat(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, finfo.Size())
+	}
+	if sizes[0] != sizes[1] {
+		t.Errorf("preallocating changed the file length from %d to %d", sizes[0], sizes[1])
+	}
+}
+
+// testRand is a deterministic random source that fails after limit bytes if
+// limit is not 0.
+type testRand struct {
+	n     int
+	limit int
+}
+
+func (r *testRand) Read(b []byte) (int, error) {
+	for i := range b {
+		if r.limit != 0 && r.n >= r.limit {
+			return i, fmt.Errorf("test rand exhausted")
+		}
+		b[i] = byte(r.n * 7)
+		r.n++
+	}
+	return len(b), nil
+}
+
+func TestCryptFileRand(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	var outputs [][]byte
+	var used int
+	for i := 0; i < 2; i++ {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", i))
+		rnd := &testRand{}
+		cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Rand: rnd})
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, out)
+		used = rnd.n
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("same random source gave different files")
+	}
+	// Failing anywhere along the way, from the salt through the IVs and
+	// padding to the header, has to be reported and leave the CryptFile
+	// unusable until closed.
+	for limit := 1; limit < used; limit += 37 {
+		tmp := path.Join(tmpdir, fmt.Sprintf("fail%d", limit))
+		cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Rand: &testRand{limit: limit}})
+		defer cf.Close()
+		_, err := cf.Write(in)
+		if err == nil {
+			err = cf.Close()
+		} else if _, err2 := cf.Write(in); err2 == nil {
+			t.Errorf("expected the CryptFile to be unusable after rand failed after %d bytes", limit)
+		}
+		if err == nil {
+			t.Errorf("expected an error with rand failing after %d bytes", limit)
+		}
+		cf.Close()
+	}
+}
+
+func TestCryptFileBlockKeys(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("abcdef0123456789abcdef0123456789")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for i, opts := range []*CryptFileOptions{
+		{BlockKeys: true},
+		{BlockKeys: true, Sparse: true},
+		{BlockKeys: true, Suite: ChaCha20Poly1305},
+	} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", i))
+		cf := NewCryptFileWithOptions(tmp, key, 0, opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatalf("%d: output does not match input", i)
+		}
+		if cf.fileKey == nil {
+			t.Fatalf("%d: no file key after reopening", i)
+		}
+		key0, key1 := cf.blockKey(0), cf.blockKey(1)
+		if bytes.Equal(key0, key1) || bytes.Equal(key0, key) || bytes.Equal(key0, cf.fileKey) {
+			t.Errorf("%d: block keys are not distinct", i)
+		}
+		enc := make([]byte, cf.blockSize)
+		if _, err = cf.file.ReadAt(enc, cf.blockSize); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cf.suite.decrypt(enc, key, cf.blockAD(0)); err == nil {
+			t.Errorf("%d: first block decrypted with the key given", i)
+		}
+		if _, err = cf.suite.decrypt(enc, key0, cf.blockAD(0)); err != nil {
+			t.Errorf("%d: first block did not decrypt with its block key: %s", i, err)
+		}
+		if err = cf.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		before, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockSize := cf.blockSize
+		if err = cf.Rekey(newKey); err != nil {
+			t.Fatal(err)
+		}
+		cf.Close()
+		after, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before[blockSize:], after[blockSize:]) {
+			t.Errorf("%d: Rekey rewrote more than the header", i)
+		}
+		cf = NewCryptFile(tmp, newKey, 0)
+		defer cf.Close()
+		if out, err = ioutil.ReadAll(cf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%d: output after Rekey does not match input", i)
+		}
+		cf.Close()
+		cf = NewCryptFile(tmp, key, 0)
+		if _, err = cf.Size(); err != KeyError {
+			t.Errorf("%d: expected KeyError with the old key, got %v", i, err)
+		}
+		cf.Close()
+	}
+}
+
+func TestCryptFileShred(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, []byte("abcdef0123456789abcdef0123456789"), 0)
+	if err := cf.Shred(); err != KeyError {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Fatalf("file with the wrong key was not left alone: %s", err)
+	}
+	// Overwriting has to happen in place; a link to the same file shows
+	// what was written.
+	link := path.Join(tmpdir, "link")
+	if err := os.Link(tmp, link); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	if _, err = cf.Write([]byte("unwritten")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Shred(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected the file to be removed, got %v", err)
+	}
+	after, err := ioutil.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("shredding changed the length from %d to %d", len(before), len(after))
+	}
+	for i := 0; i+aes.BlockSize <= len(before); i += aes.BlockSize {
+		if bytes.Equal(before[i:i+aes.BlockSize], after[i:i+aes.BlockSize]) {
+			t.Fatalf("bytes %d to %d were not overwritten", i, i+aes.BlockSize)
+		}
+	}
+	if err = cf.Shred(); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error shredding a missing file, got %v", err)
+	}
+	// Blocks still being written behind are finished before the overwrite,
+	// so none land after it.
+	cf = NewCryptFile(tmp, key, 0)
+	if _, err = cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(link)
+	if err = os.Link(tmp, link); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{WriteBehind: 16})
+	if _, err = cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if len(cf.encryptQueue) == 0 {
+		t.Fatal("expected blocks queued to be written behind")
+	}
+	if err = cf.Shred(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cf.encryptQueue) != 0 {
+		t.Errorf("expected no blocks left queued; got %d", len(cf.encryptQueue))
+	}
+	raw, err := ioutil.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("CRYPTFILE")) {
+		t.Error("expected the header to be overwritten")
+	}
+}
+
+func TestCryptFileWideHeader(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	defer func(n int64) { wideBlockSize = n }(wideBlockSize)
+	wideBlockSize = 256
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for _, blockSize := range []int64{256, 512} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", blockSize))
+		cf, err := NewCryptFileBlockSize(tmp, key, blockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cf.Close()
+		if _, err = cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		magic := "CRYPTFILE0 "
+		if blockSize > wideBlockSize {
+			magic = "CRYPTFILE1 "
+			if !bytes.Equal(raw[16:20], make([]byte, 4)) {
+				t.Errorf("%d: expected a 0 32 bit block size, got %x", blockSize, raw[16:20])
+			}
+		}
+		if string(raw[:11]) != magic {
+			t.Errorf("%d: expected %q, got %q", blockSize, magic, raw[:11])
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%d: output does not match input", blockSize)
+		}
+		if cf.blockSize != blockSize {
+			t.Errorf("%d: reopened with block size %d", blockSize, cf.blockSize)
+		}
+		if err = cf.Verify(); err != nil {
+			t.Error(err)
+		}
+		cf.Close()
+	}
+	// Block sizes past 32 bits are only read here, as reopening would
+	// allocate blocks that large.
+	tmp := path.Join(tmpdir, "test512")
+	raw, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		blockSize uint64
+		ok        bool
+	}{
+		{1 << 33, true},
+		{1<<33 + 1, false},
+		{1 << 63, false},
+	} {
+		binary.BigEndian.PutUint64(raw[wideHeaderASize-aes.BlockSize:], c.blockSize)
+		if err = ioutil.WriteFile(tmp, raw, 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ha, err := readHeaderA(f, tmp)
+		f.Close()
+		if !c.ok {
+			if !errors.Is(err, ErrBadBlockSize) {
+				t.Errorf("%d: expected ErrBadBlockSize, got %v", c.blockSize, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ha.blockSize != int64(c.blockSize) {
+			t.Errorf("expected block size %d, got %d", c.blockSize, ha.blockSize)
+		}
+	}
+}
+
+func TestCryptFileReadAhead(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for _, opts := range []*CryptFileOptions{
+		{ReadAhead: true},
+		{ReadAhead: true, Sparse: true},
+		{ReadAhead: true, CacheBlocks: 4},
+		{ReadAhead: true, EncryptWorkers: 4},
+	} {
+		tmp := path.Join(tmpdir, "test")
+		os.Remove(tmp)
+		cf := NewCryptFileWithOptions(tmp, key, 0, opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatalf("%+v: output does not match input", opts)
+		}
+		// Reading the first block starts reading the second, which then
+		// has to be dropped when written to or when Seek moves elsewhere.
+		plainBlockSize := int(cf.plainBlockSize)
+		if _, err = cf.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(cf, make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if cf.ahead == nil {
+			t.Fatalf("%+v: nothing read ahead", opts)
+		}
+		if _, err = cf.Seek(int64(plainBlockSize+5), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cf.Write([]byte("changed")); err != nil {
+			t.Fatal(err)
+		}
+		copy(in[plainBlockSize+5:], "changed")
+		if _, err = cf.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(cf, make([]byte, plainBlockSize)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cf.Seek(int64(2*plainBlockSize), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cf.Write([]byte("again")); err != nil {
+			t.Fatal(err)
+		}
+		copy(in[2*plainBlockSize:], "again")
+		if _, err = cf.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if out, err = ioutil.ReadAll(cf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%+v: output does not match after writes", opts)
+		}
+		cf.Close()
+	}
+}
+
+func TestCryptFileWriteBehind(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 100000)
+	for i := range in {
+		in[i] = byte(i * 7)
+	}
+	for _, opts := range []*CryptFileOptions{
+		{WriteBehind: 4},
+		{WriteBehind: 1, EncryptWorkers: 4},
+		{WriteBehind: 8, Sparse: true},
+	} {
+		tmp := path.Join(tmpdir, "test")
+		os.Remove(tmp)
+		cf := NewCryptFileWithOptions(tmp, key, 0, opts)
+		defer cf.Close()
+		for i := 0; i < len(in); i += 333 {
+			end := i + 333
+			if end > len(in) {
+				end = len(in)
+			}
+			if _, err := cf.Write(in[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Rewriting blocks still in flight must leave the latest data.
+		for i := 0; i < 3; i++ {
+			if _, err := cf.Seek(int64(len(in)-200), 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cf.Write(bytes.Repeat([]byte{byte(i)}, 200)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		copy(in[len(in)-200:], bytes.Repeat([]byte{2}, 200))
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmp, key, 0)
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%+v: output does not match input", opts)
+		}
+		if err = cf.Verify(); err != nil {
+			t.Error(err)
+		}
+		cf.Close()
+	}
+	// A block that fails to be written in the background is reported by
+	// Close if not sooner.
+	tmp := path.Join(tmpdir, "fail")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{WriteBehind: 4})
+	defer cf.Close()
+	if _, err := cf.Write(in[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	cf.file.Close()
+	_, err := cf.Write(in[1000:2000])
+	if err == nil {
+		err = cf.Close()
+	}
+	if err == nil {
+		t.Error("expected an error writing to a closed file")
+	}
+}
+
+func TestCryptFileNothingPastSize(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	// Not a multiple of the 80 byte plaintext blocks, so the last block is
+	// padded with random bytes.
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i%250) + 1
+	}
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	untouched := func(what string, b []byte) {
+		for i, c := range b {
+			if c != 0 {
+				t.Errorf("%s: byte %d past what was read was set to %d", what, i, c)
+				return
+			}
+		}
+	}
+	b := make([]byte, 200)
+	if _, err := cf.Seek(960, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := cf.Read(b)
+	if n != 40 || err != nil || !bytes.Equal(b[:n], in[960:]) {
+		t.Errorf("Read gave %d %v", n, err)
+	}
+	untouched("Read", b[n:])
+	b = make([]byte, 200)
+	if n, err = cf.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end gave %d %v", n, err)
+	}
+	untouched("Read at the end", b)
+	b = make([]byte, 200)
+	if n, err = cf.ReadAt(b, 900); n != 100 || err != io.EOF || !bytes.Equal(b[:n], in[900:]) {
+		t.Errorf("ReadAt gave %d %v", n, err)
+	}
+	untouched("ReadAt", b[n:])
+	if _, err = cf.Seek(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 200)
+	if n, err = cf.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Read after Seek(0, 2) gave %d %v", n, err)
+	}
+	untouched("Read after Seek(0, 2)", b)
+	if _, err = cf.Seek(100, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = cf.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Read past the end gave %d %v", n, err)
+	}
+	if pos, _ := cf.Seek(0, 1); pos != 1100 {
+		t.Errorf("Read past the end moved the position to %d", pos)
+	}
+	if _, err = cf.Seek(930, 0); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err = cf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), in[930:]) {
+		t.Errorf("WriteTo gave %d bytes", buf.Len())
+	}
+	cf.Close()
+	os.Remove(tmp)
+	if err = cf.WriteAsEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 200)
+	if n, err = cf.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Read after WriteAsEmpty gave %d %v", n, err)
+	}
+	untouched("Read after WriteAsEmpty", b)
+	if n, err = cf.ReadAt(b, 0); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt after WriteAsEmpty gave %d %v", n, err)
+	}
+	untouched("ReadAt after WriteAsEmpty", b)
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Seek(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Write(in[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 200)
+	if n, err = cf.Read(b); n != 3 || err != nil || !bytes.Equal(b[:n], in[:3]) {
+		t.Errorf("Read after appending to an empty file gave %d %v", n, err)
+	}
+	untouched("Read after appending to an empty file", b[n:])
+}
+
+func TestCryptFileRandFailOnCreate(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	// The salt is read before the file is created; filling out the new
+	// block is next.
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Rand: &testRand{limit: saltSize}})
+	defer cf.Close()
+	if _, err := cf.Write([]byte("data")); err == nil {
+		t.Fatal("expected an error with rand failing")
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected the new file to be removed, got %v", err)
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Rand: &testRand{limit: saltSize + 80}})
+	defer cf.Close()
+	if _, err := cf.Write(make([]byte, 200)); err == nil {
+		t.Fatal("expected an error with rand failing")
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected the new file with blocks but no header to be removed, got %v", err)
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Rand: &testRand{}})
+	if _, err := cf.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Once it has a header, a failure leaves the file for what it's worth.
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Rand: &testRand{limit: 1}})
+	if _, err := cf.Seek(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Write(make([]byte, 200)); err == nil {
+		t.Fatal("expected an error with rand failing")
+	}
+	cf.Close()
+	cf = NewCryptFile(tmp, key, 0)
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "data" {
+		t.Errorf("expected the file to be left as it was, got %q", out)
+	}
+	cf.Close()
+}
+
+func TestCryptFileModes(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "default", "test")
+	cf := NewCryptFile(tmp, key, 0)
+	if err := cf.WriteAsEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for pth, mode := range map[string]os.FileMode{tmp: 0600, path.Dir(tmp): 0700} {
+		finfo, err := os.Stat(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finfo.Mode().Perm() != mode {
+			t.Errorf("%s mode %04o != %04o", pth, finfo.Mode().Perm(), mode)
+		}
+	}
+	tmp = path.Join(tmpdir, "custom", "test")
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{FileMode: 0640, DirMode: 0750})
+	if err := cf.WriteAsEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for pth, mode := range map[string]os.FileMode{tmp: 0640, path.Dir(tmp): 0750} {
+		finfo, err := os.Stat(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finfo.Mode().Perm() != mode {
+			t.Errorf("%s mode %04o != %04o", pth, finfo.Mode().Perm(), mode)
+		}
+	}
+}
+
+func TestNewCryptFileBlockSize(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, blockSize := range []int64{0, minBlockSize - aes.BlockSize, 4095, -4096} {
+		if _, err := NewCryptFileBlockSize(tmp, key, blockSize); err == nil {
+			t.Errorf("expected err with block size %d", blockSize)
+		}
+	}
+	cf, err := NewCryptFileBlockSize(tmp, key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf.Close()
+	in := "Test Message"
+	if _, err = io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in {
+		t.Errorf("output does not match input %#v != %#v", string(out), in)
+	}
+	if cf.blockSize != 4096 {
+		t.Errorf("blockSize %d != 4096", cf.blockSize)
+	}
+}
+
+func TestCryptFileReadOnly(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{ReadOnly: true})
+	defer cf.Close()
+	if _, err := io.WriteString(cf, "Test Message"); err == nil {
+		t.Errorf("expected err writing read-only")
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("read-only Write created the file; got %v", err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	in := "Test Message that spans more than a single 128-byte block so that seeking around is meaningful."
+	if _, err := io.WriteString(cf, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(tmp, 0400); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{ReadOnly: true})
+	defer cf.Close()
+	size, err := cf.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(in)) {
+		t.Errorf("Size %d != %d", size, len(in))
+	}
+	if _, err = cf.Seek(10, 0); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != in[10:] {
+		t.Errorf("output does not match input %#v != %#v", string(out), in[10:])
+	}
+	if _, err = cf.Write([]byte("x")); err != readOnlyError(tmp) {
+		t.Errorf("expected readOnlyError from Write; got %v", err)
+	}
+	if err = cf.WriteAsEmpty(); err != readOnlyError(tmp) {
+		t.Errorf("expected readOnlyError from WriteAsEmpty; got %v", err)
+	}
+	if err = cf.Rekey(key); err != readOnlyError(tmp) {
+		t.Errorf("expected readOnlyError from Rekey; got %v", err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptFileReuseAfterClose(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	first := "First round of test data, long enough to need a few 128-byte blocks, so the later rounds have something to overwrite."
+	if _, err := io.WriteString(cf, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != first {
+		t.Errorf("output does not match input %#v != %#v", string(out), first)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	second := "Second round."
+	if _, err = io.WriteString(cf, second); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf2 := NewCryptFile(tmp, key, 0)
+	defer cf2.Close()
+	out, err = ioutil.ReadAll(cf2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writing over the start of the file leaves the rest of it as it was.
+	if string(out) != second+first[len(second):] {
+		t.Errorf("output does not match input %#v != %#v", string(out), second+first[len(second):])
+	}
+	if err = cf2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Removing the file between uses should have it recreated from scratch.
+	if err = os.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	third := "Third round."
+	if _, err = io.WriteString(cf, third); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err = ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != third {
+		t.Errorf("output does not match input %#v != %#v", string(out), third)
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for name, r := range map[string]io.Reader{
+		"whole":   bytes.NewReader(in),
+		"onebyte": iotest.OneByteReader(bytes.NewReader(in)),
+		"half":    iotest.HalfReader(bytes.NewReader(in)),
+	} {
+		tmp := path.Join(tmpdir, name)
+		cf := NewCryptFile(tmp, key, 0)
+		defer cf.Close()
+		if _, err := cf.Write([]byte("prefix")); err != nil {
+			t.Fatal(err)
+		}
+		n, err := cf.ReadFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(in)) {
+			t.Errorf("%s: ReadFrom gave n %d != %d", name, n, len(in))
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmp, key, 0)
+		defer cf.Close()
+		size, err := cf.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(in)+6) {
+			t.Errorf("%s: Size %d != %d", name, size, len(in)+6)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "prefix"+string(in) {
+			t.Errorf("%s: output does not match input", name)
+		}
+	}
+	tmp := path.Join(tmpdir, "copy")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	n, err := io.Copy(cf, io.LimitReader(bytes.NewReader(in), 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 500 {
+		t.Errorf("io.Copy gave n %d != 500", n)
+	}
+	if _, err = cf.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(in[:500]) {
+		t.Errorf("output does not match input")
+	}
+}
+
+func benchmarkCopyIn(b *testing.B, f func(cf *CryptFile, r io.Reader) error) {
+	tmpdir := EmptyTestDir(b)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1<<20)
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cf := NewCryptFile(path.Join(tmpdir, "test"), key, int64(len(in)))
+		if err := f(cf, bytes.NewReader(in)); err != nil {
+			b.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			b.Fatal(err)
+		}
+		os.Remove(path.Join(tmpdir, "test"))
+	}
+}
+
+func BenchmarkCopyInWrite(b *testing.B) {
+	benchmarkCopyIn(b, func(cf *CryptFile, r io.Reader) error {
+		_, err := io.CopyBuffer(struct{ io.Writer }{cf}, struct{ io.Reader }{r}, make([]byte, 32*1024))
+		return err
+	})
+}
+
+func BenchmarkCopyInWriteEncryptWorkers(b *testing.B) {
+	benchmarkCopyIn(b, func(cf *CryptFile, r io.Reader) error {
+		cf.encryptWorkers = 4
+		_, err := io.CopyBuffer(struct{ io.Writer }{cf}, struct{ io.Reader }{r}, make([]byte, 32*1024))
+		return err
+	})
+}
+
+func BenchmarkCopyInReadFrom(b *testing.B) {
+	benchmarkCopyIn(b, func(cf *CryptFile, r io.Reader) error {
+		_, err := cf.ReadFrom(struct{ io.Reader }{r})
+		return err
+	})
+}
+
+func benchmarkCopyOut(b *testing.B, f func(cf *CryptFile, w io.Writer) error) {
+	tmpdir := EmptyTestDir(b)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1<<20)
+	cf := NewCryptFile(path.Join(tmpdir, "test"), key, int64(len(in)))
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cf.Seek(0, 0); err != nil {
+			b.Fatal(err)
+		}
+		if err := f(cf, ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyOutRead(b *testing.B) {
+	buf := make([]byte, 32*1024)
+	benchmarkCopyOut(b, func(cf *CryptFile, w io.Writer) error {
+		_, err := io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{cf}, buf)
+		return err
+	})
+}
+
+func BenchmarkCopyOutWriteTo(b *testing.B) {
+	benchmarkCopyOut(b, func(cf *CryptFile, w io.Writer) error {
+		_, err := cf.WriteTo(w)
+		return err
+	})
+}
+
+func benchmarkReadAhead(b *testing.B, readAhead bool) {
+	tmpdir := EmptyTestDir(b)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1<<20)
+	cf := NewCryptFileWithOptions(path.Join(tmpdir, "test"), key, int64(len(in)), &CryptFileOptions{ReadAhead: readAhead})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		b.Fatal(err)
+	}
+	// Hashing stands in for a reader doing something with the data, which
+	// reading ahead overlaps with decrypting the next block.
+	h := sha256.New()
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(in)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cf.Seek(0, 0); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.CopyBuffer(h, struct{ io.Reader }{cf}, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkReadAtSmall reads a few bytes at scattered offsets in large
+// blocks, where a suite that can decrypt just those bytes does less work.
+func benchmarkReadAtSmall(b *testing.B, suite CipherSuite) {
+	tmpdir := EmptyTestDir(b)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1<<20)
+	cf := NewCryptFileWithOptions(path.Join(tmpdir, "test"), key, int64(len(in)), &CryptFileOptions{Suite: suite})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		b.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cf.ReadAt(buf, int64(i*7919)%int64(len(in)-len(buf))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadAtSmallCBC(b *testing.B) {
+	benchmarkReadAtSmall(b, AES256CBCHMACSHA256)
+}
+
+func BenchmarkReadAtSmallCTR(b *testing.B) {
+	benchmarkReadAtSmall(b, AES256CTRHMACSHA256)
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	benchmarkReadAhead(b, true)
+}
+
+func BenchmarkReadNoReadAhead(b *testing.B) {
+	benchmarkReadAhead(b, false)
+}
+
+func BenchmarkCopyInWriteAligned(b *testing.B) {
+	benchmarkCopyIn(b, func(cf *CryptFile, r io.Reader) error {
+		plainBlockSize := int(cf.fallbackBlockSize - cf.fallbackSuite.overhead())
+		_, err := io.CopyBuffer(struct{ io.Writer }{cf}, struct{ io.Reader }{r}, make([]byte, plainBlockSize))
+		return err
+	})
+}
+
+func TestWriteAligned(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for _, chunk := range []int{80, 160, 50, 100, 1000} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", chunk))
+		cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{CacheBlocks: 100})
+		defer cf.Close()
+		for i := 0; i < len(in); i += chunk {
+			end := i + chunk
+			if end > len(in) {
+				end = len(in)
+			}
+			if _, err := cf.Write(in[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// With 80 byte plaintext blocks, chunks of whole blocks never need
+		// to read a block first, other than the partial one at the end.
+		if chunk%80 == 0 && cf.cache.misses > 1 {
+			t.Errorf("%d byte writes read %d blocks", chunk, cf.cache.misses)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%d byte writes: output does not match input", chunk)
+		}
+		cf.Close()
+	}
+}
+
+func TestOverwriteMiddle(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{CacheBlocks: 100})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// With 80 byte plaintext blocks, 400 to 480 is exactly block 5 and 630 to
+	// 730 covers block 8 along with parts of blocks 7 and 9.
+	for _, c := range []struct {
+		offset, length int
+		reads          int64
+	}{
+		{400, 80, 0},
+		{630, 100, 2},
+	} {
+		for i := c.offset; i < c.offset+c.length; i++ {
+			in[i] = ^in[i]
+		}
+		if _, err := cf.Seek(int64(c.offset), 0); err != nil {
+			t.Fatal(err)
+		}
+		misses := cf.cache.misses
+		if _, err := cf.Write(in[c.offset : c.offset+c.length]); err != nil {
+			t.Fatal(err)
+		}
+		if reads := cf.cache.misses - misses; reads != c.reads {
+			t.Errorf("overwriting %d bytes at %d read %d blocks instead of %d", c.length, c.offset, reads, c.reads)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size, err := cf.Size(); err != nil || size != int64(len(in)) {
+		t.Errorf("size %d != %d; %v", size, len(in), err)
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("output does not match overwritten input")
+	}
+	if err = cf.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for name, opts := range map[string]*CryptFileOptions{
+		"nocache": nil,
+		"cache":   {CacheBlocks: 4},
+	} {
+		tmp := path.Join(tmpdir, name)
+		cf := NewCryptFileWithOptions(tmp, key, 0, opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int64{0, 1, 100, 111, 112, 500, 990} {
+			out := make([]byte, 10)
+			n, err := cf.ReadAt(out, off)
+			if err != nil {
+				t.Fatalf("%s: ReadAt %d: %s", name, off, err)
+			}
+			if n != 10 || !bytes.Equal(out, in[off:off+10]) {
+				t.Errorf("%s: ReadAt %d gave %d %v", name, off, n, out[:n])
+			}
+		}
+		out := make([]byte, 20)
+		n, err := cf.ReadAt(out, 990)
+		if err != io.EOF || n != 10 || !bytes.Equal(out[:n], in[990:]) {
+			t.Errorf("%s: ReadAt past end gave %d %v", name, n, err)
+		}
+		if _, err = cf.Seek(200, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cf.Write([]byte("changed")); err != nil {
+			t.Fatal(err)
+		}
+		out = make([]byte, 7)
+		if _, err = cf.ReadAt(out, 200); err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "changed" {
+			t.Errorf("%s: ReadAt gave %#v rather than the pending write", name, string(out))
+		}
+		if _, err = cf.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cf.ReadAt(out, 200); err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "changed" {
+			t.Errorf("%s: ReadAt gave %#v rather than the flushed write", name, string(out))
+		}
+		if pos, _ := cf.Seek(0, 1); pos != 0 {
+			t.Errorf("%s: ReadAt moved the position to %d", name, pos)
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFileWithOptions(tmp, key, 0, opts)
+		defer cf.Close()
+		if _, err = cf.ReadAt(out, 200); err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "changed" {
+			t.Errorf("%s: ReadAt gave %#v after reopening", name, string(out))
+		}
+	}
+}
+
+func benchmarkReadAtHot(b *testing.B, opts *CryptFileOptions) {
+	tmpdir := EmptyTestDir(b)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf, err := NewCryptFileBlockSize(path.Join(tmpdir, "test"), key, 4096)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err = cf.Write(make([]byte, 1<<20)); err != nil {
+		b.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		b.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(cf.Path, key, 0, opts)
+	defer cf.Close()
+	out := make([]byte, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A repeated read pattern hopping between a few hot blocks.
+		if _, err = cf.ReadAt(out, int64(i%8)*10000); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	decrypts := b.N
+	if cf.cache != nil {
+		decrypts = int(cf.cache.misses)
+	}
+	b.ReportMetric(float64(decrypts)/float64(b.N), "decrypts/op")
+}
+
+func BenchmarkReadAtHot(b *testing.B) {
+	benchmarkReadAtHot(b, nil)
+}
+
+func BenchmarkReadAtHotCached(b *testing.B) {
+	benchmarkReadAtHot(b, &CryptFileOptions{CacheBlocks: 16})
+}
+
+func TestCryptFileEncryptWorkers(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 4<<20+123)
+	for i := range in {
+		in[i] = byte(i * 7)
+	}
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{EncryptWorkers: 4})
+	defer cf.Close()
+	if _, err := cf.Write(in[:1<<20]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(cf, bytes.NewReader(in[1<<20:])); err != nil {
+		t.Fatal(err)
+	}
+	// Reading back and rewriting blocks that may still be queued must see
+	// and keep the latest data.
+	out := make([]byte, 1000)
+	if _, err := cf.ReadAt(out, int64(len(in))-2000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in[len(in)-2000:len(in)-1000]) {
+		t.Error("ReadAt of queued blocks does not match input")
+	}
+	if _, err := cf.Seek(int64(len(in))-11, 0); err != nil {
+		t.Fatal(err)
+	}
+	copy(in[len(in)-11:], "overwritten")
+	if _, err := cf.Write([]byte("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Error("output does not match input")
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, start := range []int64{0, 1, 79, 80, 999, 1000} {
+		if _, err := cf.Seek(start, 0); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(in))-start {
+			t.Errorf("io.Copy from %d gave n %d != %d", start, n, int64(len(in))-start)
+		}
+		if !bytes.Equal(buf.Bytes(), in[start:]) {
+			t.Errorf("output from %d does not match input", start)
+		}
+		pos, err := cf.Seek(0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != int64(len(in)) {
+			t.Errorf("position after WriteTo %d != %d", pos, len(in))
+		}
+		if n, err := cf.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("Read after WriteTo gave %d, %v", n, err)
+		}
+	}
+	if _, err := cf.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := cf.WriteTo(&limitedWriter{w: &buf, n: 100}); err != io.ErrShortWrite {
+		t.Errorf("expected io.ErrShortWrite; got %v", err)
+	}
+}
+
+// limitedWriter accepts at most n bytes before reporting short writes.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (lw *limitedWriter) Write(b []byte) (int, error) {
+	if len(b) > lw.n {
+		b = b[:lw.n]
+	}
+	n, err := lw.w.Write(b)
+	lw.n -= n
+	return n, err
+}
+
+func TestStat(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	tmp := path.Join(tmpdir, "test")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Stat(); !os.IsNotExist(err) {
+		t.Errorf("expected IsNotExist err from Stat; got %v", err)
+	}
+	if _, err := cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	finfo, err := cf.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Size() != 1000 {
+		t.Errorf("Stat Size %d != 1000", finfo.Size())
+	}
+	if finfo.Name() != "test" {
+		t.Errorf("Stat Name %#v != %#v", finfo.Name(), "test")
+	}
+	if finfo.Mode().Perm() != 0600 {
+		t.Errorf("Stat Mode %04o != 0600", finfo.Mode().Perm())
+	}
+	osfinfo, err := os.Stat(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if osfinfo.Size() <= finfo.Size() {
+		t.Errorf("expected encrypted size %d to be larger than %d", osfinfo.Size(), finfo.Size())
+	}
+	if !osfinfo.ModTime().Equal(finfo.ModTime()) {
+		t.Errorf("Stat ModTime %s != %s", finfo.ModTime(), osfinfo.ModTime())
+	}
+}
+
+func TestName(t *testing.T) {
+	tmp := path.Join(os.TempDir(), "test")
+	var f File = NewCryptFile(tmp, nil, 0)
+	if f.Name() != tmp {
+		t.Errorf("Name %#v != %#v", f.Name(), tmp)
+	}
+	f = os.Stdin
+	if f.Name() != "/dev/stdin" {
+		t.Errorf("Name %#v != %#v", f.Name(), "/dev/stdin")
+	}
+}
+
+func TestCryptFileReadEOF(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i % 251)
+	}
+	for _, compress := range []bool{false, true} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%v", compress))
+		cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Compress: compress})
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 1)
+		for i := range in {
+			n, err := cf.Read(b)
+			if n != 1 || err != nil || b[0] != in[i] {
+				t.Fatalf("compress %v: Read of byte %d gave %d %v", compress, i, n, err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if n, err := cf.Read(b); n != 0 || err != io.EOF {
+				t.Errorf("compress %v: Read past the end gave %d %v", compress, n, err)
+			}
+		}
+		if _, err := cf.Seek(920, 0); err != nil {
+			t.Fatal(err)
+		}
+		b = make([]byte, 80)
+		if n, err := io.ReadFull(cf, b); n != 80 || err != nil || !bytes.Equal(b, in[920:]) {
+			t.Errorf("compress %v: reading exactly to the end gave %d %v", compress, n, err)
+		}
+		if n, err := cf.Read(b); n != 0 || err != io.EOF {
+			t.Errorf("compress %v: Read after reaching the end gave %d %v", compress, n, err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCryptFileLock(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Lock: true})
+	defer cf.Close()
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	for _, readOnly := range []bool{false, true} {
+		cf2 := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Lock: true, ReadOnly: readOnly})
+		_, err := cf2.Size()
+		var lockErr *LockError
+		if !errors.Is(err, ErrLocked) || !errors.As(err, &lockErr) || lockErr.Path != tmp || lockErr.Exclusive == readOnly {
+			t.Errorf("read only %v: expected a LockError while the file is being written, got %v", readOnly, err)
+		}
+		cf2.Close()
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	readers := make([]*CryptFile, 2)
+	for i := range readers {
+		readers[i] = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Lock: true, ReadOnly: true})
+		defer readers[i].Close()
+		if size, err := readers[i].Size(); size != 12 || err != nil {
+			t.Fatalf("reader %d: Size gave %d %v", i, size, err)
+		}
+	}
+	if _, err := cf.Size(); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked while the file is being read, got %v", err)
+	}
+	cf.Close()
+	unlocked := NewCryptFile(tmp, key, 0)
+	if size, err := unlocked.Size(); size != 12 || err != nil {
+		t.Errorf("without Lock, Size gave %d %v", size, err)
+	}
+	unlocked.Close()
+	for _, reader := range readers {
+		if err := reader.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size, err := cf.Size(); size != 12 || err != nil {
+		t.Errorf("after the readers closed, Size gave %d %v", size, err)
+	}
+}
+
+func TestCryptFileMmap(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	in := make([]byte, 100000)
+	for i := range in {
+		in[i] = byte(i * 3)
+	}
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{ReadOnly: true, Mmap: true})
+	defer cf.Close()
+	if _, err := cf.Size(); err != nil {
+		t.Fatal(err)
+	}
+	mmapped := runtime.GOOS == "linux" || runtime.GOOS == "darwin"
+	if mmapped && cf.mapped == nil {
+		t.Fatal("file wasn't mapped")
+	}
+	buf := make([]byte, 1000)
+	for _, off := range []int64{0, 5, 99000, 31337, 127} {
+		n, err := cf.ReadAt(buf, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], in[off:off+int64(n)]) {
+			t.Fatalf("ReadAt %d does not match input", off)
+		}
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Fatal("output does not match input")
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cf.mapped != nil {
+		t.Fatal("file still mapped after Close")
+	}
+	// Mapping a file that can be written to would leave the mapping stale.
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Mmap: true})
+	defer cf.Close()
+	if _, err = cf.Size(); err != nil {
+		t.Fatal(err)
+	}
+	if cf.mapped != nil {
+		t.Fatal("file mapped without ReadOnly")
+	}
+	// Tampering is still caught reading from the mapping.
+	cf.Close()
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, 128*3+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{ReadOnly: true, Mmap: true})
+	defer cf.Close()
+	if _, err = cf.ReadAt(buf, 0); err != KeyError {
+		t.Errorf("expected KeyError; got %v", err)
+	}
+}
+
+// benchmarkReadAtScattered reads a few kilobytes at a time at scattered
+// offsets in a file too large to fit in the block cache, were it enabled.
+func benchmarkReadAtScattered(b *testing.B, mmap bool) {
+	tmpdir := EmptyTestDir(b)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 16<<20)
+	cf := NewCryptFile(path.Join(tmpdir, "test"), key, int64(len(in)))
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		b.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		b.Fatal(err)
+	}
+	cf = NewCryptFileWithOptions(path.Join(tmpdir, "test"), key, 0, &CryptFileOptions{ReadOnly: true, Mmap: mmap})
+	defer cf.Close()
+	buf := make([]byte, 4096)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cf.ReadAt(buf, int64(i*1000003)%int64(len(in)-len(buf))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadAtScattered(b *testing.B) {
+	benchmarkReadAtScattered(b, false)
+}
+
+func BenchmarkReadAtScatteredMmap(b *testing.B) {
+	benchmarkReadAtScattered(b, true)
+}
+
+// forgeHeader rewrites the encrypted header of the ChaCha20Poly1305 file so
+// that it authenticates under newKey as well as key, as an attacker can for
+// an AEAD that doesn't commit to its key: Poly1305 is linear in each block of
+// ciphertext, so one block of the unused end of the header is solved for to
+// make the tags under the two keys agree. Under key the header decrypts as
+// before; under newKey it decrypts to noise. The plaintext header, and so its
+// authentication under key, is left as it was; see resignHeader.
+func forgeHeader(t *testing.T, pth string, key []byte, newKey []byte) {
+	cf := NewCryptFile(pth, key, 0)
+	defer cf.Close()
+	if _, err := cf.Size(); err != nil {
+		t.Fatal(err)
+	}
+	if cf.suite != ChaCha20Poly1305 {
+		t.Fatalf("can only forge ChaCha20Poly1305 headers, not %d", cf.suite)
+	}
+	header := make([]byte, cf.blockSize)
+	if _, err := cf.file.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	ad := cf.blockAD(-1)
+	enc := header[cf.headerASize:]
+	tag := enc[:chacha20poly1305.Overhead]
+	nonce := enc[chacha20poly1305.Overhead : chacha20poly1305.Overhead+chacha20poly1305.NonceSize]
+	ciphertext := enc[chacha20poly1305.Overhead+chacha20poly1305.NonceSize:]
+	// The last two whole blocks of ciphertext are past anything the header
+	// holds: one is solved for, the other varied until a solution fits.
+	free := (len(ciphertext)/16 - 1) * 16
+	if free-16 < int(header0BSize)+8+keyCommitSize {
+		t.Fatalf("header block of %d bytes too small to forge", cf.blockSize)
+	}
+	cf.Close()
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 130), big.NewInt(5))
+	two128 := new(big.Int).Lsh(big.NewInt(1), 128)
+	le := func(b []byte) *big.Int {
+		r := make([]byte, len(b))
+		for i := range b {
+			r[len(b)-1-i] = b[i]
+		}
+		return new(big.Int).SetBytes(r)
+	}
+	putLE := func(b []byte, x *big.Int) {
+		be := x.Bytes()
+		for i := range b {
+			b[i] = 0
+		}
+		for i := range be {
+			b[i] = be[len(be)-1-i]
+		}
+	}
+	// polyKey returns Poly1305's r and s for the key, from the first block
+	// of the ChaCha20 key stream.
+	polyKey := func(k []byte) (*big.Int, *big.Int) {
+		c, err := chacha20.NewUnauthenticatedCipher(k, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pk [32]byte
+		c.XORKeyStream(pk[:], pk[:])
+		r := le(pk[:16])
+		r.And(r, le([]byte{0xff, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f, 0xfc, 0xff, 0xff, 0x0f}))
+		return r, le(pk[16:])
+	}
+	r1, s1 := polyKey(key)
+	r2, s2 := polyKey(newKey)
+	// mac returns Poly1305's sum, before s is added, of the message the AEAD
+	// authenticates, with the free block taken as zeros, and the power of r
+	// the free block is multiplied by.
+	mac := func(r *big.Int) (*big.Int, int) {
+		pad := func(b []byte) []byte {
+			return append(append([]byte(nil), b...), make([]byte, (16-len(b)%16)%16)...)
+		}
+		msg := append(pad(ad), pad(ciphertext)...)
+		freeAt := len(pad(ad)) + free
+		copy(msg[freeAt:freeAt+16], make([]byte, 16))
+		lengths := make([]byte, 16)
+		binary.LittleEndian.PutUint64(lengths, uint64(len(ad)))
+		binary.LittleEndian.PutUint64(lengths[8:], uint64(len(ciphertext)))
+		msg = append(msg, lengths...)
+		h := new(big.Int)
+		for i := 0; i < len(msg); i += 16 {
+			h.Add(h, le(msg[i:i+16]))
+			h.Add(h, two128)
+			h.Mul(h, r)
+			h.Mod(h, p)
+		}
+		return h, (len(msg) - freeAt) / 16
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for tries := 0; ; tries++ {
+		if tries == 1000 {
+			t.Fatal("no forgery found")
+		}
+		rnd.Read(ciphertext[free-16 : free])
+		h1, e := mac(r1)
+		h2, _ := mac(r2)
+		// Solving h1 + x*r1^e - h2 - x*r2^e = s2 - s1 mod p for x gives
+		// sums whose tags, mod 2^128, agree if x fits the block and the
+		// sums don't wrap differently.
+		diff := new(big.Int).Sub(new(big.Int).Exp(r1, big.NewInt(int64(e)), p), new(big.Int).Exp(r2, big.NewInt(int64(e)), p))
+		diff.Mod(diff, p)
+		x := new(big.Int).Sub(s2, s1)
+		x.Sub(x, h1)
+		x.Add(x, h2)
+		x.Mul(x, new(big.Int).ModInverse(diff, p))
+		x.Mod(x, p)
+		if x.Cmp(two128) >= 0 {
+			continue
+		}
+		putLE(ciphertext[free:free+16], x)
+		h1, _ = mac(r1)
+		h1.Add(h1, new(big.Int).Mul(x, new(big.Int).Exp(r1, big.NewInt(int64(e)), p)))
+		h1.Mod(h1, p)
+		h1.Add(h1, s1)
+		h1.Mod(h1, two128)
+		putLE(tag, h1)
+		_, err1 := decryptChaCha(nil, enc, key, ad)
+		_, err2 := decryptChaCha(nil, enc, newKey, ad)
+		if err1 == nil && err2 == nil {
+			break
+		}
+	}
+	f, err := os.OpenFile(pth, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resignHeader rewrites the authentication of the plaintext header of the
+// file under the key given, as an attacker who knows that key can.
+func resignHeader(t *testing.T, pth string, key []byte) {
+	f, err := os.OpenFile(pth, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ha, err := readHeaderA(f, pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyCheck, mac := headerAuth(ha.raw, key)
+	if _, err = f.WriteAt(append(keyCheck, mac...), 20); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptFileKeyCommit(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	plausible := []byte("0123456789abcdef0123456789abcdeX")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for _, commit := range []bool{false, true} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%v", commit))
+		cf := NewCryptFileWithOptions(tmp, key, 1<<20, &CryptFileOptions{Suite: ChaCha20Poly1305, KeyCommit: commit})
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		forgeHeader(t, tmp, key, plausible)
+		// The forged header still gives the file under the key.
+		cf = NewCryptFile(tmp, key, 0)
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatalf("%v: %v", commit, err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%v: output does not match input", commit)
+		}
+		if cf.keyCommitFile != commit {
+			t.Errorf("%v: key commitment recorded %v", commit, cf.keyCommitFile)
+		}
+		cf.Close()
+		// The plaintext header's authentication, being keyed, tells the
+		// keys apart.
+		if _, err = ReadHeader(tmp, plausible); err != KeyError {
+			t.Errorf("%v: expected KeyError; got %v", commit, err)
+		}
+		if commit {
+			cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{RequireKeyCommit: true})
+			if _, err = cf.Size(); err != nil {
+				t.Errorf("%v: %v", commit, err)
+			}
+			cf.Close()
+		}
+		// But an attacker knowing both keys can authenticate it under the
+		// other, leaving the encrypted header to tell them apart.
+		resignHeader(t, tmp, plausible)
+		info, err := ReadHeader(tmp, plausible)
+		if !commit {
+			// Without the commitment, the other key is taken, giving
+			// whatever the noise says.
+			if err != nil || info.Size == int64(len(in)) {
+				t.Errorf("%v: expected the forged header to open under the other key; got %v", commit, err)
+			}
+			// Unless the reader insists on one.
+			cf = NewCryptFileWithOptions(tmp, plausible, 0, &CryptFileOptions{RequireKeyCommit: true})
+			if _, err = cf.Size(); !errors.Is(err, ErrKeyCommitment) {
+				t.Errorf("%v: expected ErrKeyCommitment when required; got %v", commit, err)
+			}
+			cf.Close()
+			continue
+		}
+		var kcErr *KeyCommitmentError
+		if !errors.As(err, &kcErr) || err == KeyError || kcErr.Path != tmp {
+			t.Errorf("%v: expected a *KeyCommitmentError; got %v", commit, err)
+		}
+	}
+	// A file created requiring a commitment gets one.
+	tmp := path.Join(tmpdir, "required")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{RequireKeyCommit: true})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Size(); err != nil || !cf.keyCommitFile {
+		t.Errorf("expected a key commitment; got %v", err)
+	}
+	cf.Close()
+	// The commitment follows the key through Rekey, and is to the file key
+	// with recipients.
+	tmp = path.Join(tmpdir, "rekey")
+	cf = NewCryptFileWithOptions(tmp, key, 1<<20, &CryptFileOptions{KeyCommit: true, BlockKeys: true})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Rekey(plausible); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddRecipient(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range [][]byte{key, plausible} {
+		cf = NewCryptFile(tmp, k, 0)
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) || !cf.keyCommitFile {
+			t.Errorf("%s: output does not match input", k)
+		}
+		cf.Close()
+	}
+}
+
+func TestCryptFileOptionFuncs(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := []byte("Hello World!")
+	tmp := path.Join(tmpdir, "blocksize")
+	cf := NewCryptFile(tmp, key, 0, WithBlockSize(4096))
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if finfo, err := os.Stat(tmp); err != nil || finfo.Size() != 4096*2 {
+		t.Errorf("expected 2 blocks of 4096 bytes, got %v %v", finfo, err)
+	}
+	cf = NewCryptFile(path.Join(tmpdir, "badblocksize"), key, 0, WithBlockSize(4095))
+	_, err := cf.Write(in)
+	var blockSize *BlockSizeError
+	if !errors.As(err, &blockSize) || blockSize.BlockSize != 4095 || blockSize.Path == "" {
+		t.Errorf("expected a BlockSizeError for 4095, got %v", err)
+	}
+	cf.Close()
+	cf = NewCryptFile(path.Join(tmpdir, "readonly"), key, 0, WithReadOnly())
+	if _, err = cf.Write(in); err == nil {
+		t.Errorf("expected err writing read-only")
+	}
+	cf.Close()
+	tmp = path.Join(tmpdir, "mode")
+	cf = NewCryptFile(tmp, key, 0, WithFileMode(0640))
+	if err = cf.WriteAsEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if finfo, err := os.Stat(tmp); err != nil || finfo.Mode().Perm() != 0640 {
+		t.Errorf("expected mode 0640, got %v %v", finfo, err)
+	}
+	var outs [2][]byte
+	for i := range outs {
+		tmp = path.Join(tmpdir, fmt.Sprintf("rand%d", i))
+		cf = NewCryptFile(tmp, key, 0, WithRandReader(&testRand{}))
+		if _, err = cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if outs[i], err = ioutil.ReadFile(tmp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(outs[0], outs[1]) {
+		t.Errorf("expected the same output from the same rand reader")
+	}
+}
+
+func TestCryptFileOpenCreate(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if err := cf.Open(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist opening a missing file, got %v", err)
+	}
+	if err := cf.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Create(); err == nil {
+		t.Errorf("expected err creating an open file")
+	}
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Create(); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected os.ErrExist creating an existing file, got %v", err)
+	}
+	cf.Close()
+	if err := cf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Open(); err != nil {
+		t.Errorf("opening an open file gave %v", err)
+	}
+	if size, err := cf.Size(); size != 12 || err != nil {
+		t.Errorf("Size gave %d %v", size, err)
+	}
+	cf.Close()
+	if err := NewCryptFile(path.Join(tmpdir, "readonly"), key, 0, WithReadOnly()).Create(); err == nil {
+		t.Errorf("expected err creating read-only")
+	}
+	if err := ioutil.WriteFile(path.Join(tmpdir, "plain"), []byte("this is not a CryptFile at all, just some text"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewCryptFile(path.Join(tmpdir, "plain"), key, 0).Open(); !errors.Is(err, ErrNotCryptFile) {
+		t.Errorf("expected ErrNotCryptFile, got %v", err)
+	}
+	cf = NewCryptFile(path.Join(tmpdir, "empty"), key, 0)
+	if err := cf.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := cf.Size(); size != 0 || err != nil {
+		t.Errorf("Size of a created but unwritten file gave %d %v", size, err)
+	}
+}
+
+func TestCryptFileOpenOrCreate(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if err := cf.OpenOrCreate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.OpenOrCreate(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := cf.Size(); size != 12 || err != nil {
+		t.Errorf("Size after opening gave %d %v", size, err)
+	}
+	cf.Close()
+	if err := ioutil.WriteFile(tmp, []byte("this is not a CryptFile at all, just some text"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.OpenOrCreate(); !errors.Is(err, ErrNotCryptFile) {
+		t.Errorf("expected ErrNotCryptFile rather than creating, got %v", err)
+	}
+	cf.Close()
+	if err := NewCryptFile(path.Join(tmpdir, "readonly"), key, 0, WithReadOnly()).OpenOrCreate(); err == nil {
+		t.Errorf("expected err creating read-only")
+	}
+}
+
+func TestIsCryptFile(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFile(tmp, key, 0)
+	if err := cf.WriteAsEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if is, err := IsCryptFile(tmp); !is || err != nil {
+		t.Errorf("IsCryptFile gave %v %v for a CryptFile", is, err)
+	}
+	for name, data := range map[string]string{
+		"wide":  "CRYPTFILE1 and whatever follows",
+		"plain": "this is not a CryptFile at all, just some text",
+		"short": "CRYPTFILE",
+		"empty": "",
+	} {
+		if err := ioutil.WriteFile(path.Join(tmpdir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if is, err := IsCryptFile(path.Join(tmpdir, name)); is != (name == "wide") || err != nil {
+			t.Errorf("IsCryptFile gave %v %v for %s", is, err, name)
+		}
+	}
+	if _, err := IsCryptFile(path.Join(tmpdir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist for a missing file, got %v", err)
+	}
+	if _, err := IsCryptFile(tmpdir); err == nil {
+		t.Errorf("expected err for a directory")
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	defer func(n int64) { wideBlockSize = n }(wideBlockSize)
+	wideBlockSize = 4096
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for _, blockSize := range []int64{4096, 8192} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%d", blockSize))
+		cf := NewCryptFile(tmp, key, 0, WithBlockSize(blockSize))
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		version := 0
+		if blockSize > wideBlockSize {
+			version = 1
+		}
+		info, err := ReadHeader(tmp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := HeaderInfo{Version: version, Suite: AES256CBCHMACSHA256, BlockSize: blockSize, PlainBlockSize: blockSize - AES256CBCHMACSHA256.overhead(), Size: -1}
+		if *info != expected {
+			t.Errorf("without the key, got %+v rather than %+v", *info, expected)
+		}
+		if info, err = ReadHeader(tmp, key); err != nil {
+			t.Fatal(err)
+		}
+		expected.Size = 1000
+		if *info != expected {
+			t.Errorf("with the key, got %+v rather than %+v", *info, expected)
+		}
+		if _, err = ReadHeader(tmp, []byte("0123456789abcdef0123456789abcdeX")); !errors.Is(err, KeyError) {
+			t.Errorf("expected KeyError with the wrong key, got %v", err)
+		}
+	}
+	tmp := path.Join(tmpdir, "compressed")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Compress: true})
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := ReadHeader(tmp, key); err != nil || info.Size != 1000 {
+		t.Errorf("compressed file gave %+v %v", info, err)
+	}
+	if _, err := ReadHeader(path.Join(tmpdir, "missing"), key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestCryptFileTellRewind(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for _, compress := range []bool{false, true} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%v", compress))
+		cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Compress: compress})
+		defer cf.Close()
+		if pos, err := cf.Tell(); pos != 0 || err != nil {
+			t.Errorf("compress %v: Tell before anything gave %d %v", compress, pos, err)
+		}
+		if _, err := cf.Write(in[:900]); err != nil {
+			t.Fatal(err)
+		}
+		if pos, err := cf.Tell(); pos != 900 || err != nil {
+			t.Errorf("compress %v: Tell after writing gave %d %v", compress, pos, err)
+		}
+		if !compress {
+			// The block being written to is still dirty; Rewind must write
+			// it out before leaving it.
+			if err := cf.Rewind(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cf.Seek(0, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := cf.Write(in[900:]); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Rewind(); err != nil {
+			t.Fatal(err)
+		}
+		if pos, err := cf.Tell(); pos != 0 || err != nil {
+			t.Errorf("compress %v: Tell after Rewind gave %d %v", compress, pos, err)
+		}
+		b := make([]byte, 130)
+		if _, err := io.ReadFull(cf, b); err != nil {
+			t.Fatal(err)
+		}
+		if pos, err := cf.Tell(); pos != 130 || err != nil {
+			t.Errorf("compress %v: Tell after reading gave %d %v", compress, pos, err)
+		}
+		if err := cf.Rewind(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("compress %v: reading after Rewind didn't give what was written", compress)
+		}
+		if pos, err := cf.Tell(); pos != 1000 || err != nil {
+			t.Errorf("compress %v: Tell at the end gave %d %v", compress, pos, err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCryptFileByteReadWrite(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	var _ io.ByteReader = (*CryptFile)(nil)
+	var _ io.ByteWriter = (*CryptFile)(nil)
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i % 251)
+	}
+	for _, compress := range []bool{false, true} {
+		tmp := path.Join(tmpdir, fmt.Sprintf("test%v", compress))
+		cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Compress: compress})
+		defer cf.Close()
+		for _, c := range in {
+			if err := cf.WriteByte(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		all, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(all, in) {
+			t.Errorf("compress %v: ReadAll didn't give what WriteByte wrote", compress)
+		}
+		if err = cf.Rewind(); err != nil {
+			t.Fatal(err)
+		}
+		var out []byte
+		for {
+			c, err := cf.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, c)
+		}
+		if !bytes.Equal(out, all) {
+			t.Errorf("compress %v: ReadByte gave %d bytes not matching ReadAll's %d", compress, len(out), len(all))
+		}
+		if _, err = cf.ReadByte(); err != io.EOF {
+			t.Errorf("compress %v: expected io.EOF again, got %v", compress, err)
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Seek(10, 0); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := cf.ReadByte(); c != in[10] || err != nil {
+		t.Errorf("ReadByte gave %d %v rather than %d", c, err, in[10])
+	}
+	if err := cf.WriteByte(0xff); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := cf.ReadByte(); c != in[12] || err != nil {
+		t.Errorf("ReadByte after WriteByte gave %d %v rather than %d", c, err, in[12])
+	}
+	in[11] = 0xff
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("WriteByte in the middle of the file didn't stick")
+	}
+	ro := NewCryptFile(tmp, key, 0, WithReadOnly())
+	defer ro.Close()
+	if _, err = ro.ReadByte(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ro.WriteByte(0); err == nil {
+		t.Errorf("expected err from WriteByte read-only")
+	}
+}
+
+func TestCryptFileRewrapKey(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	params := &Argon2Params{Time: 1, Memory: 64, Threads: 1}
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	// A file created with a phrase has a file key, BlockKeys or not, so only
+	// a file from before then, with the key from the phrase as Key gives it,
+	// has its blocks rewritten.
+	for _, kind := range []string{"phrase", "blockKeys", "legacy"} {
+		tmp := path.Join(tmpdir, kind)
+		cf := NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Old Phrase", KDF: params, BlockKeys: kind == "blockKeys"})
+		if kind == "legacy" {
+			cf = NewCryptFile(tmp, keyPhrase("Old Phrase"), 0)
+		}
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		before, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFile(tmp, nil, 0)
+		if err = cf.RewrapKey([]byte("Wrong Phrase"), []byte("New Phrase")); err != KeyError {
+			t.Errorf("%s: expected KeyError with the wrong old phrase, got %v", kind, err)
+		}
+		cf.Close()
+		if err = cf.RewrapKey([]byte("Old Phrase"), []byte("New Phrase")); err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		after, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != len(before) {
+			t.Fatalf("%s: length changed from %d to %d", kind, len(before), len(after))
+		}
+		info, err := ReadHeader(tmp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(after[:info.BlockSize], before[:info.BlockSize]) {
+			t.Errorf("%s: header unchanged", kind)
+		}
+		if unchanged := bytes.Equal(after[info.BlockSize:], before[info.BlockSize:]); unchanged != (kind != "legacy") {
+			t.Errorf("%s: blocks unchanged %v", kind, unchanged)
+		}
+		cf = NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Old Phrase"})
+		if _, err = cf.Size(); err != KeyError {
+			t.Errorf("%s: expected KeyError with the old phrase, got %v", kind, err)
+		}
+		cf.Close()
+		cf = NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "New Phrase"})
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%s: output does not match input", kind)
+		}
+		if err = cf.RewrapKey([]byte("Old Phrase"), []byte("Newer Phrase")); err != KeyError {
+			t.Errorf("%s: expected KeyError rewrapping an open file with the wrong old phrase, got %v", kind, err)
+		}
+		if err = cf.RewrapKey([]byte("New Phrase"), []byte("Newer Phrase")); err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cf = NewCryptFileWithOptions(tmp, nil, 0, &CryptFileOptions{Phrase: "Newer Phrase"})
+		if out, err = ioutil.ReadAll(cf); err != nil || !bytes.Equal(out, in) {
+			t.Errorf("%s: reading after rewrapping an open file gave %v", kind, err)
+		}
+		cf.Close()
+	}
+}
@@ -0,0 +1,130 @@
+package brimcrypt
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// CryptFS is an fs.FS, and fs.ReadDirFS, over a directory tree of CryptFiles
+// all using the same key. Files are opened read-only and present their
+// decrypted contents and sizes, so the tree can be used with things like
+// fs.WalkDir and http.FileServer.
+type CryptFS struct {
+	root string
+	key  []byte
+}
+
+var _ fs.ReadDirFS = (*CryptFS)(nil)
+
+// NewCryptFS returns a new CryptFS for the directory tree at root, using the
+// 32 byte encryption key given.
+func NewCryptFS(root string, key []byte) *CryptFS {
+	return &CryptFS{root: root, key: key}
+}
+
+// Open opens the named file, or directory, which will be an fs.ReadDirFile.
+// Files are returned as *CryptFile.
+func (cfs *CryptFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	pth := filepath.Join(cfs.root, filepath.FromSlash(name))
+	finfo, err := os.Stat(pth)
+	if err != nil {
+		return nil, cryptFSError("open", name, err)
+	}
+	if finfo.IsDir() {
+		dir, err := os.Open(pth)
+		if err != nil {
+			return nil, cryptFSError("open", name, err)
+		}
+		return &cryptDir{cfs: cfs, name: name, dir: dir, finfo: finfo}, nil
+	}
+	cf := NewCryptFileWithOptions(pth, cfs.key, 0, &CryptFileOptions{ReadOnly: true})
+	if _, err = cf.Size(); err != nil {
+		cf.Close()
+		return nil, cryptFSError("open", name, err)
+	}
+	return cf, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+// The Info of each entry reports the decrypted size of the file.
+func (cfs *CryptFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := cfs.Open(name)
+	if err != nil {
+		return nil, cryptFSError("readdir", name, err)
+	}
+	defer f.Close()
+	dir, ok := f.(*cryptDir)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := dir.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+// cryptFSError returns err as an *fs.PathError for name, rather than for the
+// full path of the underlying file.
+func cryptFSError(op string, name string, err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+type cryptDir struct {
+	cfs   *CryptFS
+	name  string
+	dir   *os.File
+	finfo os.FileInfo
+}
+
+func (d *cryptDir) Stat() (fs.FileInfo, error) {
+	return d.finfo, nil
+}
+
+func (d *cryptDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *cryptDir) Close() error {
+	return d.dir.Close()
+}
+
+func (d *cryptDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	osEntries, err := d.dir.ReadDir(n)
+	entries := make([]fs.DirEntry, len(osEntries))
+	for i, osEntry := range osEntries {
+		entries[i] = &cryptDirEntry{DirEntry: osEntry, cfs: d.cfs, name: path.Join(d.name, osEntry.Name())}
+	}
+	if err != nil && err != io.EOF {
+		err = cryptFSError("readdir", d.name, err)
+	}
+	return entries, err
+}
+
+// cryptDirEntry is an fs.DirEntry whose Info reports the decrypted size for
+// files.
+type cryptDirEntry struct {
+	fs.DirEntry
+	cfs  *CryptFS
+	name string
+}
+
+func (e *cryptDirEntry) Info() (fs.FileInfo, error) {
+	if e.IsDir() {
+		return e.DirEntry.Info()
+	}
+	f, err := e.cfs.Open(e.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
@@ -0,0 +1,74 @@
+package brimcrypt
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCryptFS(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	contents := map[string]string{
+		"a":       "Test Message A",
+		"sub/b":   "Test Message B, which is long enough to need more than a single 128-byte block of the encrypted file.",
+		"sub/c/d": "",
+	}
+	for name, content := range contents {
+		cf := NewCryptFile(path.Join(tmpdir, name), key, int64(len(content)))
+		if content == "" {
+			if err := cf.WriteAsEmpty(); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := io.WriteString(cf, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfs := NewCryptFS(tmpdir, key)
+	if err := fstest.TestFS(cfs, "a", "sub/b", "sub/c/d"); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range contents {
+		out, err := fs.ReadFile(cfs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != content {
+			t.Errorf("%s: output does not match input %#v != %#v", name, string(out), content)
+		}
+	}
+	entries, err := cfs.ReadDir("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "b" || entries[1].Name() != "c" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	finfo, err := entries[0].Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Size() != int64(len(contents["sub/b"])) {
+		t.Errorf("entry Size %d != %d", finfo.Size(), len(contents["sub/b"]))
+	}
+	if _, err = cfs.Open("missing"); !os.IsNotExist(err) {
+		t.Errorf("expected IsNotExist err; got %v", err)
+	}
+	if _, err = cfs.Open("../a"); err == nil {
+		t.Errorf("expected err with invalid path")
+	}
+	if err = ioutil.WriteFile(path.Join(tmpdir, "plain"), []byte("not a crypt file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfs.Open("plain"); err == nil {
+		t.Errorf("expected err opening a plain file")
+	}
+}
@@ -0,0 +1,172 @@
+package brimcrypt
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotCryptFile is matched by errors.Is for a *NotCryptFileError.
+	ErrNotCryptFile = errors.New("not CRYPTFILE0 data")
+	// ErrBadBlockSize is matched by errors.Is for a *BlockSizeError.
+	ErrBadBlockSize = errors.New("bad block size")
+	// ErrTruncated is matched by errors.Is for a *TruncationError.
+	ErrTruncated = errors.New("file truncated")
+	// ErrInvalidSeek is matched by errors.Is for a *SeekError.
+	ErrInvalidSeek = errors.New("invalid seek")
+	// ErrLocked is matched by errors.Is for a *LockError.
+	ErrLocked = errors.New("file locked")
+	// ErrRollback is matched by errors.Is for a *RollbackError.
+	ErrRollback = errors.New("file rolled back")
+	// ErrKeyCommitment is matched by errors.Is for a *KeyCommitmentError.
+	ErrKeyCommitment = errors.New("key commitment mismatch")
+)
+
+// NotCryptFileError indicates the file at Path doesn't start with a CryptFile
+// header.
+type NotCryptFileError struct {
+	Path string
+}
+
+func (e *NotCryptFileError) Error() string {
+	return fmt.Sprintf("%#v not CRYPTFILE0 data", e.Path)
+}
+
+func (e *NotCryptFileError) Is(target error) bool {
+	return target == ErrNotCryptFile
+}
+
+// BlockSizeError indicates an unusable BlockSize, whether recorded in the
+// header of the file at Path or given to a constructor, in which case Path may
+// be "".
+type BlockSizeError struct {
+	Path      string
+	BlockSize int64
+	msg       string
+}
+
+func (e *BlockSizeError) Error() string {
+	if e.Path == "" {
+		return e.msg
+	}
+	return fmt.Sprintf("%#v %s", e.Path, e.msg)
+}
+
+func (e *BlockSizeError) Is(target error) bool {
+	return target == ErrBadBlockSize
+}
+
+// TruncationError indicates the file at Path has fewer Blocks than the
+// Expected number recorded in its header, such as from an incomplete copy or
+// upload.
+type TruncationError struct {
+	Path     string
+	Blocks   int64
+	Expected int64
+}
+
+func (e *TruncationError) Error() string {
+	return fmt.Sprintf("%#v file truncated, has %d blocks but should have %d", e.Path, e.Blocks, e.Expected)
+}
+
+func (e *TruncationError) Is(target error) bool {
+	return target == ErrTruncated
+}
+
+// LengthError indicates the file at Path has a Length that isn't a whole
+// number of BlockSize blocks, such as from an incomplete copy or stray bytes
+// appended to it; errors.Is matches it with ErrTruncated.
+type LengthError struct {
+	Path      string
+	Length    int64
+	BlockSize int64
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("%#v length %d isn't a whole number of %d byte blocks", e.Path, e.Length, e.BlockSize)
+}
+
+func (e *LengthError) Is(target error) bool {
+	return target == ErrTruncated
+}
+
+// SeekError indicates Seek was given an invalid Whence or an Offset that
+// would move to an invalid position in the file at Path.
+type SeekError struct {
+	Path   string
+	Offset int64
+	Whence int
+	msg    string
+}
+
+func (e *SeekError) Error() string {
+	return fmt.Sprintf("%#v %s", e.Path, e.msg)
+}
+
+func (e *SeekError) Is(target error) bool {
+	return target == ErrInvalidSeek
+}
+
+// LockError indicates the file at Path couldn't be locked, with Exclusive
+// set if an exclusive lock was wanted, because another open of it holds a
+// conflicting lock.
+type LockError struct {
+	Path      string
+	Exclusive bool
+}
+
+func (e *LockError) Error() string {
+	if e.Exclusive {
+		return fmt.Sprintf("%#v is locked by another open of it", e.Path)
+	}
+	return fmt.Sprintf("%#v is locked for writing by another open of it", e.Path)
+}
+
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// RollbackError indicates the file at Path has a Version older than the
+// MinVersion wanted, such as from being replaced with an older copy of it; a
+// file that isn't versioned has a Version of 0.
+type RollbackError struct {
+	Path       string
+	Version    uint64
+	MinVersion uint64
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%#v version %d is older than %d, so may have been rolled back", e.Path, e.Version, e.MinVersion)
+}
+
+func (e *RollbackError) Is(target error) bool {
+	return target == ErrRollback
+}
+
+// KeyCommitmentError indicates the header of the file at Path authenticated
+// under the key given, but the key commitment it records is for a different
+// key, so the file has been crafted to open under more than one key.
+type KeyCommitmentError struct {
+	Path string
+}
+
+func (e *KeyCommitmentError) Error() string {
+	return fmt.Sprintf("%#v authenticated under a key it isn't committed to", e.Path)
+}
+
+func (e *KeyCommitmentError) Is(target error) bool {
+	return target == ErrKeyCommitment
+}
+
+// TreeError collects the Errors for the files that EncryptTree or
+// DecryptTree couldn't handle; the rest of the tree is still processed.
+type TreeError struct {
+	Errors []error
+}
+
+func (e *TreeError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	return fmt.Sprintf("%d errors, the first being: %s", len(e.Errors), e.Errors[0])
+}
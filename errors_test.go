@@ -0,0 +1,122 @@
+package brimcrypt
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tmp := path.Join(tmpdir, "plain")
+	if err := ioutil.WriteFile(tmp, []byte("this is not a CryptFile at all, just some text"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cf := NewCryptFile(tmp, key, 0)
+	_, err := cf.Size()
+	var notCryptFile *NotCryptFileError
+	if !errors.Is(err, ErrNotCryptFile) || !errors.As(err, &notCryptFile) || notCryptFile.Path != tmp {
+		t.Errorf("expected a NotCryptFileError for %#v, got %v", tmp, err)
+	}
+	if err.Error() != `"`+tmp+`" not CRYPTFILE0 data` {
+		t.Errorf("unexpected message %q", err)
+	}
+	cf.Close()
+	_, err = NewCryptFileBlockSize(tmp, key, 100)
+	var blockSize *BlockSizeError
+	if !errors.Is(err, ErrBadBlockSize) || !errors.As(err, &blockSize) || blockSize.BlockSize != 100 {
+		t.Errorf("expected a BlockSizeError for 100, got %v", err)
+	}
+	tmp = path.Join(tmpdir, "test")
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err = cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cf.Seek(-100, 1)
+	var seek *SeekError
+	if !errors.Is(err, ErrInvalidSeek) || !errors.As(err, &seek) || seek.Path != tmp || seek.Offset != -100 || seek.Whence != 1 {
+		t.Errorf("expected a SeekError, got %v", err)
+	}
+	if _, err = cf.Seek(0, 3); !errors.Is(err, ErrInvalidSeek) {
+		t.Errorf("expected ErrInvalidSeek, got %v", err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(tmp, 128); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cf.Size()
+	var truncation *TruncationError
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &truncation) || truncation.Blocks != 0 || truncation.Expected != 1 {
+		t.Errorf("expected a TruncationError, got %v", err)
+	}
+	cf.Close()
+	for _, length := range []int64{128 + 100, 128*2 + 1} {
+		if err = os.Truncate(tmp, length); err != nil {
+			t.Fatal(err)
+		}
+		_, err = cf.Size()
+		var lengthErr *LengthError
+		if !errors.Is(err, ErrTruncated) || !errors.As(err, &lengthErr) || lengthErr.Path != tmp || lengthErr.Length != length || lengthErr.BlockSize != 128 {
+			t.Errorf("expected a LengthError for length %d, got %v", length, err)
+		}
+		cf.Close()
+	}
+}
+
+func TestErrorsWrapped(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFileWithOptions(path.Join(tmpdir, "missing"), key, 0, &CryptFileOptions{ReadOnly: true})
+	if _, err := cf.Read(make([]byte, 1)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tmp := path.Join(tmpdir, "empty")
+	if err := ioutil.WriteFile(tmp, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	if _, err := cf.Size(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF reading the header of an empty file, got %v", err)
+	}
+	tmp = path.Join(tmpdir, "test")
+	cf = NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, 128*3+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	err = cf.Verify()
+	if !errors.Is(err, KeyError) || err == KeyError {
+		t.Errorf("expected a wrapped KeyError from Verify, got %v", err)
+	}
+	cf.Close()
+	err = cf.Rekey([]byte("0123456789abcdef0123456789abcdeX"))
+	if !errors.Is(err, KeyError) || err == KeyError {
+		t.Errorf("expected a wrapped KeyError from Rekey, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package brimcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// AES-256-GCM-SIV, from RFC 8452, is implemented here on crypto/aes as
+// nothing in the standard library or golang.org/x/crypto provides it. Each
+// nonce derives fresh message keys from the key, and the tag is computed from
+// the plaintext before being used as the initial counter, so a repeated
+// nonce gives away only whether two blocks, with the same additional data,
+// had the same plaintext. A block is laid out as the tag, then the nonce,
+// then the ciphertext, the same as ChaCha20Poly1305.
+
+const (
+	sivNonceSize = 12
+	sivTagSize   = 16
+)
+
+// polyvalElement is an element of POLYVAL's field, GF(2^128) modulo
+// x^128 + x^127 + x^126 + x^121 + 1, with the bit for x^i being bit i of the
+// 16 bytes taken as a little-endian number.
+type polyvalElement struct {
+	lo, hi uint64
+}
+
+func polyvalLoad(b []byte) polyvalElement {
+	return polyvalElement{lo: binary.LittleEndian.Uint64(b), hi: binary.LittleEndian.Uint64(b[8:])}
+}
+
+// mulX returns a times x. Like polyvalMul, it takes the same time whatever
+// the values, as they derive from the key.
+func (a polyvalElement) mulX() polyvalElement {
+	mask := -(a.hi >> 63)
+	a.hi = a.hi<<1 | a.lo>>63
+	a.lo <<= 1
+	a.hi ^= mask & 0xc200000000000000
+	a.lo ^= mask & 1
+	return a
+}
+
+// polyvalMul returns a times b.
+func polyvalMul(a, b polyvalElement) polyvalElement {
+	var r polyvalElement
+	for i := 127; i >= 0; i-- {
+		r = r.mulX()
+		var mask uint64
+		if i >= 64 {
+			mask = -(b.hi >> uint(i-64) & 1)
+		} else {
+			mask = -(b.lo >> uint(i) & 1)
+		}
+		r.lo ^= a.lo & mask
+		r.hi ^= a.hi & mask
+	}
+	return r
+}
+
+// polyvalXInv128 is x^-128, as POLYVAL's dot(a, b) is a times b times
+// x^-128.
+var polyvalXInv128 = func() polyvalElement {
+	x128 := polyvalElement{lo: 1}
+	for i := 0; i < 128; i++ {
+		x128 = x128.mulX()
+	}
+	// The inverse is x^128 to the power 2^128 - 2.
+	inv := polyvalElement{lo: 1}
+	for i := 127; i >= 0; i-- {
+		inv = polyvalMul(inv, inv)
+		if i != 0 {
+			inv = polyvalMul(inv, x128)
+		}
+	}
+	return inv
+}()
+
+// polyval returns POLYVAL(h, ...) of the additional data and plaintext, each
+// padded with zeros to the AES block size, followed by their lengths in bits.
+func polyval(h []byte, ad []byte, plain []byte) [16]byte {
+	hx := polyvalMul(polyvalLoad(h), polyvalXInv128)
+	var s polyvalElement
+	var buf [16]byte
+	absorb := func(b []byte) {
+		for len(b) > 0 {
+			if len(b) < 16 {
+				buf = [16]byte{}
+				copy(buf[:], b)
+				b = buf[:]
+			}
+			x := polyvalLoad(b)
+			s.lo ^= x.lo
+			s.hi ^= x.hi
+			s = polyvalMul(s, hx)
+			b = b[16:]
+		}
+	}
+	absorb(ad)
+	absorb(plain)
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(ad))*8)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(plain))*8)
+	absorb(buf[:])
+	var out [16]byte
+	binary.LittleEndian.PutUint64(out[:], s.lo)
+	binary.LittleEndian.PutUint64(out[8:], s.hi)
+	return out
+}
+
+// sivKeys returns the message authentication key and the cipher for the
+// message encryption key derived from key for the nonce.
+func sivKeys(key []byte, nonce []byte) ([]byte, cipher.Block, error) {
+	ciph, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	derived := make([]byte, 48)
+	var in, out [16]byte
+	copy(in[4:], nonce)
+	for i := 0; i < 6; i++ {
+		binary.LittleEndian.PutUint32(in[:], uint32(i))
+		ciph.Encrypt(out[:], in[:])
+		copy(derived[i*8:], out[:8])
+	}
+	encCiph, err := aes.NewCipher(derived[16:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return derived[:16], encCiph, nil
+}
+
+// sivTag returns the tag for the plaintext.
+func sivTag(authKey []byte, encCiph cipher.Block, nonce []byte, plain []byte, ad []byte) []byte {
+	s := polyval(authKey, ad, plain)
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	tag := make([]byte, sivTagSize)
+	encCiph.Encrypt(tag, s[:])
+	return tag
+}
+
+// sivCTR XORs src with the key stream starting from the tag into dst, which
+// may be the same slice.
+func sivCTR(encCiph cipher.Block, tag []byte, dst []byte, src []byte) {
+	var counter, stream [16]byte
+	copy(counter[:], tag)
+	counter[15] |= 0x80
+	for len(src) > 0 {
+		encCiph.Encrypt(stream[:], counter[:])
+		binary.LittleEndian.PutUint32(counter[:], binary.LittleEndian.Uint32(counter[:])+1)
+		n := len(src)
+		if n > len(stream) {
+			n = len(stream)
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ stream[i]
+		}
+		dst = dst[n:]
+		src = src[n:]
+	}
+}
+
+// decrypt4 is the AES-256-GCM-SIV counterpart of decrypt0.
+func decrypt4(block []byte, key []byte, ad []byte) ([]byte, error) {
+	return decryptSIV(nil, block, key, ad)
+}
+
+// encrypt4 is the AES-256-GCM-SIV counterpart of encrypt0.
+func encrypt4(plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	return encryptSIV(nil, rand.Reader, plainBlock, key, ad)
+}
+
+// decryptSIV is decrypt4 into dst as with CipherSuite.decryptTo; block is
+// never modified.
+func decryptSIV(dst []byte, block []byte, key []byte, ad []byte) ([]byte, error) {
+	if len(block) < sivTagSize+sivNonceSize {
+		return nil, fmt.Errorf("block must be at least %d bytes", sivTagSize+sivNonceSize)
+	}
+	tag := block[:sivTagSize]
+	nonce := block[sivTagSize : sivTagSize+sivNonceSize]
+	ciphertext := block[sivTagSize+sivNonceSize:]
+	authKey, encCiph, err := sivKeys(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	plainBlock := sized(dst, len(ciphertext))
+	sivCTR(encCiph, tag, plainBlock, ciphertext)
+	if subtle.ConstantTimeCompare(sivTag(authKey, encCiph, nonce, plainBlock, ad), tag) != 1 {
+		for i := range plainBlock {
+			plainBlock[i] = 0
+		}
+		return nil, KeyError
+	}
+	return plainBlock, nil
+}
+
+// encryptSIV is encrypt4 using dst as with CipherSuite.encryptTo.
+func encryptSIV(dst []byte, rnd io.Reader, plainBlock []byte, key []byte, ad []byte) ([]byte, error) {
+	block := sized(dst, sivTagSize+sivNonceSize+len(plainBlock))
+	nonce := block[sivTagSize : sivTagSize+sivNonceSize]
+	if _, err := io.ReadFull(rnd, nonce); err != nil {
+		return nil, err
+	}
+	authKey, encCiph, err := sivKeys(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	tag := sivTag(authKey, encCiph, nonce, plainBlock, ad)
+	copy(block, tag)
+	sivCTR(encCiph, tag, block[sivTagSize+sivNonceSize:], plainBlock)
+	return block, nil
+}
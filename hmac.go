@@ -3,18 +3,45 @@ package brimcrypt
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"hash"
 )
 
 const hmacSize = 32
 
-func newHMAC(block []byte, key []byte) []byte {
-	h := hmac.New(sha256.New, key)
+// HMAC SHA-512, for AES256CBCHMACSHA512
+const hmac512Size = 64
+
+// newHMAC returns the HMAC SHA-256 of the additional data, ad, which may be
+// nil, followed by the block.
+func newHMAC(block []byte, key []byte, ad []byte) []byte {
+	return newHMACHash(sha256.New, block, key, ad)
+}
+
+func validateHMAC(block []byte, givenHMAC []byte, key []byte, ad []byte) bool {
+	return validateHMACHash(sha256.New, block, givenHMAC, key, ad)
+}
+
+// newHMACHash is newHMAC with the hash function given.
+func newHMACHash(newHash func() hash.Hash, block []byte, key []byte, ad []byte) []byte {
+	h := hmac.New(newHash, key)
+	h.Write(ad)
 	h.Write(block)
 	return h.Sum(nil)
 }
 
-func validateHMAC(block []byte, givenHMAC []byte, key []byte) bool {
+func validateHMACHash(newHash func() hash.Hash, block []byte, givenHMAC []byte, key []byte, ad []byte) bool {
+	return hmac.Equal(givenHMAC, newHMACHash(newHash, block, key, ad))
+}
+
+// headerAuth returns the key check and authentication code stored in bytes 20
+// to 32 of a CryptFile header. The key check is only 4 bytes as it is just to
+// tell a wrong key from an altered header; the authentication code covers the
+// whole plaintext part of the header, other than where these are stored.
+func headerAuth(header []byte, key []byte) ([]byte, []byte) {
+	keyCheck := newHMAC([]byte("CRYPTFILE key check"), key, nil)[:4]
 	h := hmac.New(sha256.New, key)
-	h.Write(block)
-	return hmac.Equal(givenHMAC, h.Sum(nil))
+	h.Write(header[:20])
+	h.Write(make([]byte, 12))
+	h.Write(header[32:])
+	return keyCheck, h.Sum(nil)[:8]
 }
@@ -6,7 +6,7 @@ import (
 )
 
 func TestHMAC(t *testing.T) {
-	h := newHMAC([]byte("testing"), []byte("testing"))
+	h := newHMAC([]byte("testing"), []byte("testing"), nil)
 	if len(h) != 32 {
 		t.Errorf("HMAC wasn't 32 bytes, was %d", len(h))
 	}
@@ -14,17 +14,17 @@ func TestHMAC(t *testing.T) {
 	if fmt.Sprintf("%x", h) != exp {
 		t.Errorf("HMAC %x did not match %s", h, exp)
 	}
-	if !validateHMAC([]byte("testing"), h, []byte("testing")) {
+	if !validateHMAC([]byte("testing"), h, []byte("testing"), nil) {
 		t.Errorf("could not validate HMAC")
 	}
-	if validateHMAC([]byte("test"), h, []byte("testing")) {
+	if validateHMAC([]byte("test"), h, []byte("testing"), nil) {
 		t.Errorf("incorrect HMAC validation")
 	}
-	if validateHMAC([]byte("testing"), h, []byte("test")) {
+	if validateHMAC([]byte("testing"), h, []byte("test"), nil) {
 		t.Errorf("incorrect HMAC validation")
 	}
 	h[16] = 0
-	if validateHMAC([]byte("testing"), h, []byte("testing")) {
+	if validateHMAC([]byte("testing"), h, []byte("testing"), nil) {
 		t.Errorf("incorrect HMAC validation")
 	}
 }
@@ -0,0 +1,71 @@
+package brimcrypt
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// NewHTTPHandler returns an http.Handler serving the decrypted contents of
+// the CryptFiles in the directory tree at root, using the 32 byte encryption
+// key given, at the URL paths matching their paths under root. Range requests
+// are honored with 206 Partial Content responses, and only the blocks holding
+// the bytes asked for are read and decrypted, so seeking around large media
+// files stays cheap. Content-Length is the decrypted size. Directories are not
+// listed; use http.FileServer with a CryptFS for that.
+func NewHTTPHandler(root string, key []byte) http.Handler {
+	return &httpHandler{cfs: NewCryptFS(root, key)}
+}
+
+type httpHandler struct {
+	cfs *CryptFS
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	f, err := h.cfs.Open(name)
+	if err != nil {
+		msg, code := httpError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+	cf, ok := f.(*CryptFile)
+	if !ok {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	finfo, err := cf.Stat()
+	if err != nil {
+		msg, code := httpError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	// The SectionReader reads through ReadAt, so ServeContent's seeking for
+	// a range costs nothing and only the blocks it then reads are decrypted.
+	http.ServeContent(w, r, name, finfo.ModTime(), io.NewSectionReader(cf, 0, finfo.Size()))
+}
+
+// httpError returns the response for err, without giving away its details.
+func httpError(err error) (string, int) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "404 page not found", http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return "403 Forbidden", http.StatusForbidden
+	case errors.Is(err, fs.ErrInvalid):
+		return "400 Bad Request", http.StatusBadRequest
+	}
+	return "500 Internal Server Error", http.StatusInternalServerError
+}
@@ -0,0 +1,103 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 100000)
+	for i := range in {
+		in[i] = byte(i * 7)
+	}
+	cf := NewCryptFile(path.Join(tmpdir, "media", "movie.bin"), key, int64(len(in)))
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHTTPHandler(tmpdir, key))
+	defer srv.Close()
+	get := func(pth string, rng string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL+pth, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+	resp, body := get("/media/movie.bin", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(in)) {
+		t.Errorf("Content-Length %s != %d", resp.Header.Get("Content-Length"), len(in))
+	}
+	if !bytes.Equal(body, in) {
+		t.Error("full response does not match the plaintext")
+	}
+	for _, tt := range []struct {
+		rng        string
+		start, end int
+	}{
+		{"bytes=1000-2999", 1000, 3000},
+		{"bytes=0-0", 0, 1},
+		{"bytes=99990-", 99990, 100000},
+		{"bytes=-10", 99990, 100000},
+		{"bytes=50000-200000", 50000, 100000},
+	} {
+		resp, body = get("/media/movie.bin", tt.rng)
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("%s: status %d", tt.rng, resp.StatusCode)
+		}
+		if resp.Header.Get("Content-Length") != strconv.Itoa(tt.end-tt.start) {
+			t.Errorf("%s: Content-Length %s != %d", tt.rng, resp.Header.Get("Content-Length"), tt.end-tt.start)
+		}
+		if want := "bytes " + strconv.Itoa(tt.start) + "-" + strconv.Itoa(tt.end-1) + "/" + strconv.Itoa(len(in)); resp.Header.Get("Content-Range") != want {
+			t.Errorf("%s: Content-Range %s != %s", tt.rng, resp.Header.Get("Content-Range"), want)
+		}
+		if !bytes.Equal(body, in[tt.start:tt.end]) {
+			t.Errorf("%s: response does not match the plaintext", tt.rng)
+		}
+	}
+	if resp, _ = get("/media/movie.bin", "bytes=200000-"); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable range: status %d", resp.StatusCode)
+	}
+	if resp, _ = get("/media/missing", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file: status %d", resp.StatusCode)
+	}
+	if resp, _ = get("/media", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("directory: status %d", resp.StatusCode)
+	}
+	srv2 := httptest.NewServer(NewHTTPHandler(tmpdir, []byte("0123456789abcdef0123456789abcdeX")))
+	defer srv2.Close()
+	resp, err := http.Get(srv2.URL + "/media/movie.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("wrong key: status %d", resp.StatusCode)
+	}
+}
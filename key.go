@@ -1,14 +1,28 @@
 package brimcrypt
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -22,20 +36,67 @@ var KeyError = fmt.Errorf("invalid key")
 // Key will return a 32 byte key from a key phrase, cache, or prompting the
 // user. If any of the func args are "", that procedure will be skipped. In the
 // OS environment, x_KEY x_KEY_FILE and x_KEY_INACTIVITY are used for the key
-// phrase itself (not recommended), where to cache, and for how long.
+// phrase itself (not recommended), where to cache, and for how long; the
+// inactivity timeout is a duration such as "90s" or "500ms", or a whole number
+// of seconds. If x_KEY_KEYRING is set and there is a DefaultKeyring, the key
+// is cached there under that name instead of in x_KEY_FILE.
 func Key(phrase string, envPrefix string, prompt string, confirm string) ([]byte, error) {
+	return KeyWithOptions(phrase, envPrefix, prompt, confirm, nil)
+}
+
+// KeyOptions holds the optional settings for KeyWithOptions. The zero value
+// gives the same behavior as Key.
+type KeyOptions struct {
+	// KDF, if not nil, is used with Salt to derive the key from the phrase
+	// instead of the default single pass of SHA-256. Keys read from the cache
+	// are returned as is since they were derived before being cached.
+	KDF KDFParams
+	// Salt is the salt given to KDF.
+	Salt []byte
+	// PasswordReader, if not nil, is used to prompt for the key phrase
+	// instead of the controlling terminal, /dev/tty.
+	PasswordReader PasswordReader
+	// Stdin, if there's no PasswordReader and standard input isn't a
+	// terminal, reads the key phrase as a single line from standard input
+	// instead of prompting on /dev/tty, such as when it's piped in. There's
+	// no prompt and the confirm step is skipped.
+	Stdin bool
+	// Tries is how many times to prompt for the key phrase, and confirm it,
+	// before giving up when the two don't match or nothing was entered; 0
+	// means 1. Errors reading the input are returned right away.
+	Tries int
+}
+
+// KeyWithOptions is the same as Key but allows additional settings through
+// opts, which may be nil.
+func KeyWithOptions(phrase string, envPrefix string, prompt string, confirm string, opts *KeyOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &KeyOptions{}
+	}
 	if phrase != "" {
-		return keyPhrase(phrase), nil
+		return opts.deriveKey(phrase)
 	}
 	if envPrefix != "" {
 		if phrase = os.Getenv(envPrefix + "_KEY"); phrase != "" {
-			return keyPhrase(phrase), nil
+			return opts.deriveKey(phrase)
 		}
-		fname := os.Getenv(envPrefix + "_KEY_FILE")
-		if fname != "" {
-			if inact, err := strconv.Atoi(os.Getenv(envPrefix + "_KEY_INACTIVITY")); err == nil && inact > 0 {
-				if finfo, err := os.Stat(fname); err == nil && finfo.Size() == 32 && finfo.Mode() == 0600 && time.Now().After(finfo.ModTime()) && time.Now().Sub(finfo.ModTime()).Seconds() < float64(inact) {
+		if kr, name := keyring(envPrefix); kr != nil {
+			if inact, err := parseInactivity(os.Getenv(envPrefix + "_KEY_INACTIVITY")); err == nil && inact > 0 {
+				if key := keyringGet(kr, name, inact); key != nil {
+					return key, nil
+				}
+			} else {
+				kr.Delete(name)
+			}
+		} else if fname := os.Getenv(envPrefix + "_KEY_FILE"); fname != "" {
+			if inact, err := parseInactivity(os.Getenv(envPrefix + "_KEY_INACTIVITY")); err == nil && inact > 0 {
+				now := timeNow()
+				if finfo, err := os.Stat(fname); err == nil && finfo.Size() == 32 && finfo.Mode() == 0600 && now.After(finfo.ModTime()) && now.Sub(finfo.ModTime()) < inact {
 					if key, err := ioutil.ReadFile(fname); err == nil && len(key) == 32 {
+						// Touching the file restarts the inactivity timeout;
+						// it's never set ahead of now, which KeyWatch would
+						// take as tampering.
+						os.Chtimes(fname, now, now)
 						return key, nil
 					}
 				}
@@ -46,165 +107,658 @@ func Key(phrase string, envPrefix string, prompt string, confirm string) ([]byte
 	if prompt == "" {
 		return nil, NoKeyAndNoPromptError
 	}
-	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("no controlling terminal to ask for key phrase: %s", err)
+	pr := opts.PasswordReader
+	if pr == nil && opts.Stdin && !terminal.IsTerminal(int(stdin.Fd())) {
+		pr = NewPasswordReader(stdin, nil)
+		confirm = ""
 	}
-	var bphrase []byte
-	if _, err = fmt.Fprintf(tty, prompt); err != nil {
-		return nil, err
+	if pr == nil {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("no controlling terminal to ask for key phrase: %w", err)
+		}
+		defer tty.Close()
+		pr = &terminalPasswordReader{tty: tty}
 	}
-	if bphrase, err = terminal.ReadPassword(int(tty.Fd())); err != nil {
-		return nil, err
+	var err error
+	for try := 0; try == 0 || try < opts.Tries; try++ {
+		var bphrase []byte
+		if bphrase, err = readPhrase(pr, prompt, confirm); err == nil {
+			return opts.deriveKey(string(bphrase))
+		}
+		if err != errInputMismatch && err != errInputEmpty {
+			break
+		}
 	}
-	if _, err = fmt.Fprintf(tty, "\n"); err != nil {
+	return nil, err
+}
+
+var (
+	errInputMismatch = fmt.Errorf("input did not match")
+	errInputEmpty    = fmt.Errorf("empty input")
+)
+
+// readPhrase prompts for the key phrase and, if confirm is not "", again to
+// confirm it.
+func readPhrase(pr PasswordReader, prompt string, confirm string) ([]byte, error) {
+	bphrase, err := pr.ReadPassword(prompt)
+	if err != nil {
 		return nil, err
 	}
 	if confirm != "" {
-		if _, err = fmt.Fprintf(tty, confirm); err != nil {
+		bphrase2, err := pr.ReadPassword(confirm)
+		if err != nil {
 			return nil, err
 		}
-		var bphrase2 []byte
-		if bphrase2, err = terminal.ReadPassword(int(tty.Fd())); err != nil {
-			return nil, err
+		if !bytes.Equal(bphrase, bphrase2) {
+			return nil, errInputMismatch
 		}
-		if _, err = fmt.Fprintf(tty, "\n"); err != nil {
+	}
+	if len(bphrase) == 0 {
+		return nil, errInputEmpty
+	}
+	return bphrase, nil
+}
+
+func (opts *KeyOptions) deriveKey(phrase string) ([]byte, error) {
+	if opts.KDF == nil {
+		return keyPhrase(phrase), nil
+	}
+	return opts.KDF.deriveKey(phrase, opts.Salt)
+}
+
+// stdin is os.Stdin, replaceable by tests.
+var stdin = os.Stdin
+
+// PasswordReader prompts for and reads a key phrase; see
+// KeyOptions.PasswordReader and NewPasswordReader.
+type PasswordReader interface {
+	ReadPassword(prompt string) ([]byte, error)
+}
+
+type terminalPasswordReader struct {
+	tty *os.File
+}
+
+func (t *terminalPasswordReader) ReadPassword(prompt string) ([]byte, error) {
+	if _, err := fmt.Fprint(t.tty, prompt); err != nil {
+		return nil, err
+	}
+	bphrase, err := terminal.ReadPassword(int(t.tty.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fmt.Fprint(t.tty, "\n"); err != nil {
+		return nil, err
+	}
+	return bphrase, nil
+}
+
+type linePasswordReader struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// NewPasswordReader returns a PasswordReader that writes each prompt to w, if
+// w is not nil, and reads each key phrase as a line from r. The input is not
+// hidden, so this is meant for scripted input or custom front ends.
+func NewPasswordReader(r io.Reader, w io.Writer) PasswordReader {
+	return &linePasswordReader{r: bufio.NewReader(r), w: w}
+}
+
+func (l *linePasswordReader) ReadPassword(prompt string) ([]byte, error) {
+	if l.w != nil {
+		if _, err := fmt.Fprint(l.w, prompt); err != nil {
 			return nil, err
 		}
-		if !bytes.Equal(bphrase, bphrase2) {
-			return nil, fmt.Errorf("input did not match")
+	}
+	line, err := l.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// KeyFromFile returns the raw 32 byte key stored in the file at pth, such as
+// one supplied to an automated service, without any of the caching or
+// inactivity handling of Key. A file of any other size gives KeyError. Except
+// on Windows, the file must also not be accessible by group or others, as
+// with a mode of 0600; see KeyFromFileWithOptions to skip that check.
+func KeyFromFile(pth string) ([]byte, error) {
+	return KeyFromFileWithOptions(pth, nil)
+}
+
+// KeyFileOptions holds the optional settings for KeyFromFileWithOptions. The
+// zero value gives the same behavior as KeyFromFile.
+type KeyFileOptions struct {
+	// AnyMode skips checking the file isn't accessible by group or others.
+	AnyMode bool
+}
+
+// KeyFromFileWithOptions is the same as KeyFromFile but allows additional
+// settings through opts, which may be nil.
+func KeyFromFileWithOptions(pth string, opts *KeyFileOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &KeyFileOptions{}
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !opts.AnyMode && runtime.GOOS != "windows" && finfo.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%#v key file permissions %04o allow access by group or others", pth, finfo.Mode().Perm())
+	}
+	// Reading a byte more than a key catches files that are too long.
+	key := make([]byte, 33)
+	n, err := io.ReadFull(f, key)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if n != 32 {
+		return nil, KeyError
+	}
+	return key[:32], nil
+}
+
+// KeyFromEncoded returns the 32 byte key encoded in s, as either 64 hex
+// digits or standard base64, with or without padding; surrounding whitespace
+// is ignored. If s decodes to anything but 32 bytes, the error wraps KeyError;
+// if it isn't valid hex or base64 at all, it doesn't.
+func KeyFromEncoded(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 64 {
+		if key, err := hex.DecodeString(s); err == nil {
+			return key, nil
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		if key, err = base64.RawStdEncoding.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("key is not valid hex or base64")
 		}
 	}
-	if bphrase == nil || len(bphrase) == 0 {
-		return nil, fmt.Errorf("empty input")
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key decoded to %d bytes rather than 32: %w", len(key), KeyError)
 	}
-	return keyPhrase(string(bphrase)), nil
+	return key, nil
 }
 
-// CacheKey will cache based on the OS environment; x_KEY_FILE and
-// x_KEY_INACTIVITY are used to determine where to cache and for how long. An
-// error will be returned if caching does not occur for any reason, including
-// deliberately disabled caching. If no error is returned, the caller should
-// launch a key watcher for clearing the cache when appropriate.
+// CacheKey will cache based on the OS environment; x_KEY_FILE, or
+// x_KEY_KEYRING as with Key, and x_KEY_INACTIVITY are used to determine where
+// to cache and for how long. An error will be returned if caching does not
+// occur for any reason, including deliberately disabled caching. If no error
+// is returned, the caller should launch a key watcher for clearing the cache
+// when appropriate.
 func CacheKey(key []byte, envPrefix string) error {
 	if envPrefix == "" {
 		return fmt.Errorf("key caching disabled because no os environment prefix given")
 	}
+	kr, name := keyring(envPrefix)
 	fname := os.Getenv(envPrefix + "_KEY_FILE")
-	if fname == "" {
+	if kr == nil && fname == "" {
 		return fmt.Errorf("key caching disabled because %s is not set", envPrefix+"_KEY_FILE")
 	}
-	inact, err := strconv.Atoi(os.Getenv(envPrefix + "_KEY_INACTIVITY"))
+	inact, err := parseInactivity(os.Getenv(envPrefix + "_KEY_INACTIVITY"))
 	if err != nil {
-		return err
+		return fmt.Errorf("key caching disabled because %s could not be parsed: %w", envPrefix+"_KEY_INACTIVITY", err)
 	}
-	if inact < 1 {
-		return fmt.Errorf("key caching disabled because %s = %d", envPrefix+"_KEY_INACTIVITY", inact)
+	if inact <= 0 {
+		return fmt.Errorf("key caching disabled because %s = %s", envPrefix+"_KEY_INACTIVITY", inact)
 	}
-	tf, err := ioutil.TempFile("", "")
+	if kr != nil {
+		if err = keyringSet(kr, name, key); err != nil {
+			return fmt.Errorf("caching key in keyring: %w", err)
+		}
+		return nil
+	}
+	tname, err := writeTempFile("", key)
 	if err != nil {
-		return err
+		return fmt.Errorf("caching key: %w", err)
 	}
-	defer os.Remove(tf.Name())
-	if _, err = tf.Write(key); err != nil {
-		return err
+	defer os.Remove(tname)
+	err = renameFile(tname, fname)
+	if errors.Is(err, syscall.EXDEV) {
+		// The temp directory is on another filesystem, so the key has to be
+		// written again beside fname to be renamed into place.
+		if tname, err = writeTempFile(filepath.Dir(fname), key); err != nil {
+			return fmt.Errorf("caching key: %w", err)
+		}
+		defer os.Remove(tname)
+		err = renameFile(tname, fname)
+	}
+	if err == nil {
+		// The file time is when the key was last used, by the same clock
+		// that later decides it has expired.
+		now := timeNow()
+		err = os.Chtimes(fname, now, now)
+	}
+	if err != nil {
+		return fmt.Errorf("caching key: %w", err)
+	}
+	if err = syncDir(filepath.Dir(fname)); err != nil {
+		return fmt.Errorf("caching key: %w", err)
+	}
+	return nil
+}
+
+// parseInactivity parses an x_KEY_INACTIVITY value, which is either a
+// duration such as "90s" or "500ms", or a whole number of seconds as it was
+// originally.
+func parseInactivity(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	secs, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
 	}
-	if err = tf.Close(); err != nil {
+	return time.Duration(secs) * time.Second, nil
+}
+
+// timeNow is the clock for key cache expiry, replaceable by tests.
+var timeNow = time.Now
+
+// renameFile is os.Rename, replaceable by tests.
+var renameFile = os.Rename
+
+// writeTempFile writes b to a new temp file in dir, or the default temp
+// directory if dir is "", and syncs it to disk, returning its name.
+func writeTempFile(dir string, b []byte) (string, error) {
+	tf, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return "", err
+	}
+	if _, err = tf.Write(b); err == nil {
+		if err = tf.Sync(); err == nil {
+			err = tf.Close()
+		}
+	}
+	if err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return "", err
+	}
+	return tf.Name(), nil
+}
+
+// syncDir syncs the directory to disk so a rename within it is durable. This
+// is skipped on Windows, which can't sync directories.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
 		return err
 	}
-	return os.Rename(tf.Name(), fname)
+	err = d.Sync()
+	if err2 := d.Close(); err == nil {
+		err = err2
+	}
+	return err
 }
 
 // UncacheKey will immediately clear the cache location based on the x_KEY_FILE
-// OS environment variable.
+// and x_KEY_KEYRING OS environment variables.
 func UncacheKey(envPrefix string) {
 	if envPrefix == "" {
 		return
 	}
+	if kr, name := keyring(envPrefix); kr != nil {
+		kr.Delete(name)
+	}
 	if fname := os.Getenv(envPrefix + "_KEY_FILE"); fname != "" {
 		os.Remove(fname)
 	}
 }
 
 // KeyWatch will loop forever watching for an expired key file to remove. The
-// OS environment variables x_KEY_FILE and x_KEY_INACTIVITY indicate where the
-// key is cached and for how long. The logTimeFormat, if not "", indicates
-// verbose output of the activity.
+// OS environment variables x_KEY_FILE, or x_KEY_KEYRING as with Key, and
+// x_KEY_INACTIVITY indicate where the key is cached and for how long. The
+// logTimeFormat, if not "", indicates verbose output of the activity.
 func KeyWatch(envPrefix string, logTimeFormat string) error {
+	return KeyWatchContext(context.Background(), envPrefix, logTimeFormat)
+}
+
+// KeyWatchContext is the same as KeyWatch but returns ctx.Err() once the
+// context is done, for a clean shutdown.
+func KeyWatchContext(ctx context.Context, envPrefix string, logTimeFormat string) error {
+	return KeyWatchWithOptions(ctx, envPrefix, logTimeFormat, nil)
+}
+
+// KeyWatchLogger is where KeyWatchWithOptions sends its output; it is the
+// same as Logger.
+type KeyWatchLogger = Logger
+
+// KeyWatchOptions holds the optional settings for KeyWatchWithOptions. The
+// zero value gives the same behavior as KeyWatchContext.
+type KeyWatchOptions struct {
+	// Logger, if not nil, is given the verbose output of the activity instead
+	// of it being printed to stdout, even if logTimeFormat is "". If
+	// logTimeFormat is not "", each message still begins with the time in
+	// that format.
+	Logger KeyWatchLogger
+}
+
+// KeyWatchWithOptions is the same as KeyWatchContext but allows additional
+// settings through opts, which may be nil.
+func KeyWatchWithOptions(ctx context.Context, envPrefix string, logTimeFormat string, opts *KeyWatchOptions) error {
 	if envPrefix == "" {
 		return fmt.Errorf("no envPrefix")
 	}
+	kr, name := keyring(envPrefix)
 	fname := os.Getenv(envPrefix + "_KEY_FILE")
-	if fname == "" {
+	if kr == nil && fname == "" {
 		return fmt.Errorf("no %s_KEY_FILE set", envPrefix)
 	}
 	sinact := os.Getenv(envPrefix + "_KEY_INACTIVITY")
 	if sinact == "" {
 		return fmt.Errorf("no %s_KEY_INACTIVITY set", envPrefix)
 	}
-	inact, err := strconv.Atoi(sinact)
+	inact, err := parseInactivity(sinact)
 	if err != nil {
-		return fmt.Errorf("could not parse %s_KEY_INACTIVITY value of %#v", envPrefix, sinact)
+		return fmt.Errorf("could not parse %s_KEY_INACTIVITY value of %#v: %w", envPrefix, sinact, err)
+	}
+	if inact <= 0 {
+		return fmt.Errorf("value of %s_KEY_INACTIVITY is not positive, indicating the feature should be turned off", envPrefix)
 	}
-	if inact < 1 {
-		return fmt.Errorf("value of %s_KEY_INACTIVITY is less than 1, indicating the feature should be turned off", envPrefix)
+	var logger KeyWatchLogger
+	if opts != nil {
+		logger = opts.Logger
 	}
+	logf := keyWatchLogf(logger, logTimeFormat)
 	for {
-		sleep := time.Duration(inact) * time.Second
-		remove := false
-		finfo, err := os.Stat(fname)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				if logTimeFormat != "" {
-					fmt.Printf("%s Got error trying to check on %#v: %#v\n", time.Now().Format(logTimeFormat), fname, err)
-				}
-				remove = true
-			}
-		} else if finfo.Size() != 32 {
-			if logTimeFormat != "" {
-				fmt.Printf("%s File size of %#v was %d not 32.\n", time.Now().Format(logTimeFormat), fname, finfo.Size())
-			}
-			remove = true
-		} else if finfo.Mode() != 0600 {
-			if logTimeFormat != "" {
-				fmt.Printf("%s File permissions on %#v were %04o not 0600.\n", time.Now().Format(logTimeFormat), fname, finfo.Mode())
-			}
-			remove = true
-		} else if time.Now().Sub(finfo.ModTime()) < 60 {
-			if logTimeFormat != "" {
-				fmt.Printf("%s File time of %#v was more than 60s in the future.\n", time.Now().Format(logTimeFormat), fname)
-			}
-			remove = true
-		} else if time.Now().Sub(finfo.ModTime()).Seconds() >= float64(inact) {
-			if logTimeFormat != "" {
-				fmt.Printf("%s File time of %#v was inactive for %ds and the timeout is %ds.\n", time.Now().Format(logTimeFormat), fname, int(time.Now().Sub(finfo.ModTime()).Seconds()), inact)
-			}
-			remove = true
+		var sleep time.Duration
+		if kr != nil {
+			sleep = keyringCheck(kr, name, inact, logf)
 		} else {
-			sleep = (time.Duration(inact) * time.Second) - time.Now().Sub(finfo.ModTime())
-			if sleep/time.Second > 60 {
-				sleep = 60 * time.Second
-			}
+			sleep = keyWatchCheck(fname, inact, logf)
 		}
-		if remove {
-			err = os.Remove(fname)
-			if logTimeFormat != "" {
-				if err != nil {
-					fmt.Printf("%s Got error trying to remove %#v: %#v\n", time.Now().Format(logTimeFormat), fname, err)
-				} else {
-					fmt.Printf("%s Removed %#v.\n", time.Now().Format(logTimeFormat), fname)
-				}
-			}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
 		}
+	}
+}
+
+// keyWatchLogf returns the function KeyWatch logs through, or nil if there is
+// to be no output.
+func keyWatchLogf(logger KeyWatchLogger, logTimeFormat string) func(format string, v ...interface{}) {
+	if logger == nil && logTimeFormat == "" {
+		return nil
+	}
+	return func(format string, v ...interface{}) {
 		if logTimeFormat != "" {
-			fmt.Printf("%s Check complete; will check again in %s.\n", time.Now().Format(logTimeFormat), sleep)
+			format = "%s " + format
+			v = append([]interface{}{timeNow().Format(logTimeFormat)}, v...)
+		}
+		if logger != nil {
+			logger.Printf(format, v...)
+		} else {
+			fmt.Printf(format+"\n", v...)
 		}
-		time.Sleep(sleep)
 	}
 }
 
+// keyWatchCheck does a single check of the cached key file for KeyWatch,
+// removing it if it has expired or looks suspect, and returns how long to
+// sleep before checking again. The activity is logged through logf unless it
+// is nil.
+func keyWatchCheck(fname string, inact time.Duration, logf func(format string, v ...interface{})) time.Duration {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	now := timeNow()
+	sleep := inact
+	remove := false
+	finfo, err := os.Stat(fname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf("Got error trying to check on %#v: %#v", fname, err)
+			remove = true
+		}
+	} else if finfo.Size() != 32 {
+		logf("File size of %#v was %d not 32.", fname, finfo.Size())
+		remove = true
+	} else if finfo.Mode() != 0600 {
+		logf("File permissions on %#v were %04o not 0600.", fname, finfo.Mode())
+		remove = true
+	} else if finfo.ModTime().After(now.Add(60 * time.Second)) {
+		logf("File time of %#v was more than 60s in the future.", fname)
+		remove = true
+	} else if now.Sub(finfo.ModTime()) >= inact {
+		logf("File time of %#v was inactive for %s and the timeout is %s.", fname, now.Sub(finfo.ModTime()), inact)
+		remove = true
+	} else {
+		sleep = inact - now.Sub(finfo.ModTime())
+		if sleep/time.Second > 60 {
+			sleep = 60 * time.Second
+		}
+	}
+	if remove {
+		if err = os.Remove(fname); err != nil {
+			logf("Got error trying to remove %#v: %#v", fname, err)
+		} else {
+			logf("Removed %#v.", fname)
+		}
+	}
+	logf("Check complete; will check again in %s.", sleep)
+	return sleep
+}
+
 func keyPhrase(phrase string) []byte {
 	h := sha256.New()
 	h.Write([]byte(phrase))
 	return h.Sum(nil)
 }
+
+// KDFParams holds the settings for one of the supported passphrase key
+// derivation functions: *Argon2Params, *ScryptParams, or *PBKDF2Params. The
+// settings are recorded in the header of a CryptFile so the key can be
+// derived again on open.
+type KDFParams interface {
+	kdfID() byte
+	deriveKey(phrase string, salt []byte) ([]byte, error)
+	marshal(b []byte)
+}
+
+// Key derivation function identifiers as stored in the CryptFile header.
+const (
+	kdfNone     = 0
+	kdfArgon2id = 1
+	kdfScrypt   = 2
+	kdfPBKDF2   = 3
+)
+
+// kdfParamsSize is the header space reserved for marshaled KDFParams.
+const kdfParamsSize = 16
+
+// saltSize is the length of the random salt generated for each file.
+const saltSize = 16
+
+// maxKDFMemory is the most memory, in bytes, that the KDFParams of a
+// CryptFile may call for, as they're read from the header before the key can
+// be checked and a crafted file mustn't be able to exhaust memory.
+const maxKDFMemory = 1 << 30
+
+// maxArgon2Time is the most passes the Argon2Params of a CryptFile may call
+// for, for the same reason as maxKDFMemory.
+const maxArgon2Time = 16
+
+// maxScryptR and maxScryptP are the largest R and P the ScryptParams of a
+// CryptFile may have, again for the same reason as maxKDFMemory, which also
+// limits N, as scrypt uses 128*N*R bytes.
+const (
+	maxScryptR = 32
+	maxScryptP = 16
+)
+
+// maxPBKDF2Iterations is the most iterations the PBKDF2Params of a CryptFile
+// may call for, for the same reason as maxKDFMemory, though it's time rather
+// than memory that's at stake.
+const maxPBKDF2Iterations = 10000000
+
+func unmarshalKDFParams(id byte, b []byte) (KDFParams, error) {
+	switch id {
+	case kdfArgon2id:
+		params := &Argon2Params{
+			Time:    binary.BigEndian.Uint32(b[0:4]),
+			Memory:  binary.BigEndian.Uint32(b[4:8]),
+			Threads: b[8],
+		}
+		if params.Time < 1 || params.Threads < 1 || params.Memory < 8*uint32(params.Threads) {
+			return nil, fmt.Errorf("invalid Argon2id parameters %+v", *params)
+		}
+		if params.Time > maxArgon2Time || uint64(params.Memory)*1024 > maxKDFMemory {
+			return nil, fmt.Errorf("excessive Argon2id parameters %+v", *params)
+		}
+		return params, nil
+	case kdfScrypt:
+		params := &ScryptParams{
+			N: int(binary.BigEndian.Uint32(b[0:4])),
+			R: int(binary.BigEndian.Uint32(b[4:8])),
+			P: int(binary.BigEndian.Uint32(b[8:12])),
+		}
+		if params.N <= 1 || params.N&(params.N-1) != 0 || params.R < 1 || params.P < 1 {
+			return nil, fmt.Errorf("invalid scrypt parameters %+v", *params)
+		}
+		if params.R > maxScryptR || params.P > maxScryptP || uint64(params.N) > maxKDFMemory/128/uint64(params.R) {
+			return nil, fmt.Errorf("excessive scrypt parameters %+v", *params)
+		}
+		return params, nil
+	case kdfPBKDF2:
+		params := &PBKDF2Params{Iterations: int(binary.BigEndian.Uint32(b[0:4]))}
+		if params.Iterations < 1 {
+			return nil, fmt.Errorf("invalid PBKDF2 parameters %+v", *params)
+		}
+		if params.Iterations > maxPBKDF2Iterations {
+			return nil, fmt.Errorf("excessive PBKDF2 parameters %+v", *params)
+		}
+		return params, nil
+	}
+	return nil, fmt.Errorf("unknown key derivation function %d", id)
+}
+
+// Argon2Params are the tunable costs for KeyArgon2. See
+// golang.org/x/crypto/argon2 for guidance on choosing them.
+type Argon2Params struct {
+	// Time is the number of passes over the memory; a CryptFile allows at
+	// most 16.
+	Time uint32
+	// Memory is the amount of memory used, in KiB; a CryptFile allows at
+	// most 1 GiB.
+	Memory uint32
+	// Threads is the degree of parallelism.
+	Threads uint8
+}
+
+// DefaultArgon2Params are the Argon2id settings used when none are given;
+// they follow the recommendation of the argon2 package.
+var DefaultArgon2Params = Argon2Params{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+func (p *Argon2Params) kdfID() byte {
+	return kdfArgon2id
+}
+
+func (p *Argon2Params) deriveKey(phrase string, salt []byte) ([]byte, error) {
+	return argon2.IDKey([]byte(phrase), salt, p.Time, p.Memory, p.Threads, 32), nil
+}
+
+func (p *Argon2Params) marshal(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], p.Time)
+	binary.BigEndian.PutUint32(b[4:8], p.Memory)
+	b[8] = p.Threads
+}
+
+// KeyArgon2 returns a 32 byte key derived from the phrase and salt using
+// Argon2id. If params is nil, DefaultArgon2Params will be used. The salt
+// should be random, 16 bytes is recommended, and must be kept to derive the
+// same key again.
+func KeyArgon2(phrase string, salt []byte, params *Argon2Params) []byte {
+	if params == nil {
+		params = &DefaultArgon2Params
+	}
+	key, _ := params.deriveKey(phrase, salt)
+	return key
+}
+
+// ScryptParams are the tunable costs for KeyScrypt. See
+// golang.org/x/crypto/scrypt for guidance on choosing them.
+type ScryptParams struct {
+	// N is the CPU/memory cost and must be a power of 2 greater than 1. A
+	// CryptFile allows at most 1 GiB of memory, which is 128*N*R bytes.
+	N int
+	// R is the block size; a CryptFile allows at most 32.
+	R int
+	// P is the degree of parallelism; a CryptFile allows at most 16.
+	P int
+}
+
+// DefaultScryptParams are the scrypt settings recommended by the scrypt
+// package for interactive logins.
+var DefaultScryptParams = ScryptParams{N: 32768, R: 8, P: 1}
+
+func (p *ScryptParams) kdfID() byte {
+	return kdfScrypt
+}
+
+func (p *ScryptParams) deriveKey(phrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(phrase), salt, p.N, p.R, p.P, 32)
+}
+
+func (p *ScryptParams) marshal(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(p.N))
+	binary.BigEndian.PutUint32(b[4:8], uint32(p.R))
+	binary.BigEndian.PutUint32(b[8:12], uint32(p.P))
+}
+
+// KeyScrypt returns a 32 byte key derived from the phrase and salt using
+// scrypt with the cost parameters n, r, and p. The salt should be random, 16
+// bytes is recommended, and must be kept to derive the same key again.
+func KeyScrypt(phrase string, salt []byte, n, r, p int) ([]byte, error) {
+	return (&ScryptParams{N: n, R: r, P: p}).deriveKey(phrase, salt)
+}
+
+// PBKDF2Params are the tunable costs for KeyPBKDF2.
+type PBKDF2Params struct {
+	// Iterations is the number of rounds of HMAC SHA-256; at most
+	// 10,000,000 are allowed.
+	Iterations int
+}
+
+// DefaultPBKDF2Params are the PBKDF2 settings used when none are given.
+var DefaultPBKDF2Params = PBKDF2Params{Iterations: 600000}
+
+func (p *PBKDF2Params) kdfID() byte {
+	return kdfPBKDF2
+}
+
+func (p *PBKDF2Params) deriveKey(phrase string, salt []byte) ([]byte, error) {
+	if p.Iterations < 1 {
+		return nil, fmt.Errorf("PBKDF2 iterations %d is less than 1", p.Iterations)
+	}
+	if p.Iterations > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("PBKDF2 iterations %d is more than %d", p.Iterations, maxPBKDF2Iterations)
+	}
+	return pbkdf2.Key([]byte(phrase), salt, p.Iterations, 32, sha256.New), nil
+}
+
+func (p *PBKDF2Params) marshal(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], uint32(p.Iterations))
+}
+
+// KeyPBKDF2 returns a 32 byte key derived from the phrase and salt using
+// PBKDF2 with HMAC SHA-256 and the given number of iterations, from 1 to
+// 10,000,000. The salt should be random, 16 bytes is recommended, and must be
+// kept to derive the same key again.
+func KeyPBKDF2(phrase string, salt []byte, iter int) ([]byte, error) {
+	return (&PBKDF2Params{Iterations: iter}).deriveKey(phrase, salt)
+}
@@ -0,0 +1,631 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeyArgon2(t *testing.T) {
+	params := &Argon2Params{Time: 1, Memory: 64, Threads: 1}
+	salt := []byte("0123456789abcdef")
+	key := KeyArgon2("Test Phrase", salt, params)
+	if len(key) != 32 {
+		t.Fatalf("key wasn't 32 bytes, was %d", len(key))
+	}
+	if string(KeyArgon2("Test Phrase", salt, params)) != string(key) {
+		t.Errorf("same phrase and salt gave a different key")
+	}
+	if string(KeyArgon2("Test Phrase", []byte("fedcba9876543210"), params)) == string(key) {
+		t.Errorf("different salt gave the same key")
+	}
+	if string(KeyArgon2("Test Phrase", salt, &Argon2Params{Time: 2, Memory: 64, Threads: 1})) == string(key) {
+		t.Errorf("different params gave the same key")
+	}
+	b := make([]byte, kdfParamsSize)
+	params.marshal(b)
+	params2, err := unmarshalKDFParams(kdfArgon2id, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *params2.(*Argon2Params) != *params {
+		t.Errorf("unmarshaled params %+v != %+v", params2, params)
+	}
+	if _, err = unmarshalKDFParams(kdfArgon2id, make([]byte, kdfParamsSize)); err == nil {
+		t.Errorf("expected error with zero params")
+	}
+	// A header can't ask for more than the maximum memory or time.
+	for _, huge := range []*Argon2Params{{Time: 1, Memory: 2 << 20, Threads: 1}, {Time: 17, Memory: 64, Threads: 1}} {
+		huge.marshal(b)
+		if _, err = unmarshalKDFParams(kdfArgon2id, b); err == nil {
+			t.Errorf("expected error with params %+v", *huge)
+		}
+	}
+}
+
+func TestKeyScrypt(t *testing.T) {
+	key, err := KeyScrypt("Test Phrase", []byte("0123456789abcdef"), 16, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "c4ff41d1b8900eeb5fd759373691cd40d287925b7713c44c36ce25e258aa38a7"
+	if fmt.Sprintf("%x", key) != exp {
+		t.Errorf("KeyScrypt %x did not match %s", key, exp)
+	}
+	if _, err = KeyScrypt("Test Phrase", []byte("0123456789abcdef"), 15, 1, 1); err == nil {
+		t.Errorf("expected error with N not a power of 2")
+	}
+	params := &ScryptParams{N: 16, R: 1, P: 1}
+	b := make([]byte, kdfParamsSize)
+	params.marshal(b)
+	params2, err := unmarshalKDFParams(kdfScrypt, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *params2.(*ScryptParams) != *params {
+		t.Errorf("unmarshaled params %+v != %+v", params2, params)
+	}
+	// A header can't ask for more than the maximum memory or parallelism;
+	// 1<<20 with R 8 is the largest N at 1 GiB.
+	for _, huge := range []*ScryptParams{{N: 1 << 21, R: 8, P: 1}, {N: 16, R: 33, P: 1}, {N: 16, R: 1, P: 17}, {N: 1 << 30, R: 1 << 30, P: 1}} {
+		huge.marshal(b)
+		if _, err = unmarshalKDFParams(kdfScrypt, b); err == nil {
+			t.Errorf("expected error with params %+v", *huge)
+		}
+	}
+	(&ScryptParams{N: 1 << 20, R: 8, P: 16}).marshal(b)
+	if _, err = unmarshalKDFParams(kdfScrypt, b); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyPBKDF2(t *testing.T) {
+	key, err := KeyPBKDF2("Test Phrase", []byte("0123456789abcdef"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "8d530b3742798ea383cda6ddcad1c4a4fd9a98888a0dd3eb9dd9229a001d78b9"
+	if fmt.Sprintf("%x", key) != exp {
+		t.Errorf("KeyPBKDF2 %x did not match %s", key, exp)
+	}
+	if _, err = KeyPBKDF2("Test Phrase", []byte("0123456789abcdef"), 0); err == nil {
+		t.Errorf("expected error with 0 iterations")
+	}
+	if _, err = KeyPBKDF2("Test Phrase", []byte("0123456789abcdef"), maxPBKDF2Iterations+1); err == nil {
+		t.Errorf("expected error with %d iterations", maxPBKDF2Iterations+1)
+	}
+	params := &PBKDF2Params{Iterations: 1000}
+	b := make([]byte, kdfParamsSize)
+	params.marshal(b)
+	params2, err := unmarshalKDFParams(kdfPBKDF2, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *params2.(*PBKDF2Params) != *params {
+		t.Errorf("unmarshaled params %+v != %+v", params2, params)
+	}
+	// Those read from a header can't call for more.
+	binary.BigEndian.PutUint32(b, maxPBKDF2Iterations+1)
+	if _, err = unmarshalKDFParams(kdfPBKDF2, b); err == nil {
+		t.Errorf("expected error with %d iterations", maxPBKDF2Iterations+1)
+	}
+}
+
+func TestKeyWithOptions(t *testing.T) {
+	key, err := KeyWithOptions("Test Phrase", "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != string(keyPhrase("Test Phrase")) {
+		t.Errorf("nil options did not give the default key")
+	}
+	key, err = KeyWithOptions("Test Phrase", "", "", "", &KeyOptions{KDF: &PBKDF2Params{Iterations: 1000}, Salt: []byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "8d530b3742798ea383cda6ddcad1c4a4fd9a98888a0dd3eb9dd9229a001d78b9"
+	if fmt.Sprintf("%x", key) != exp {
+		t.Errorf("KeyWithOptions %x did not match %s", key, exp)
+	}
+}
+
+func TestKeyWatchFutureTime(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(tmpdir, "key")
+	for _, c := range []struct {
+		offset time.Duration
+		remove bool
+	}{
+		{0, false},
+		{30 * time.Second, false},
+		{time.Hour, true},
+	} {
+		if err := ioutil.WriteFile(fname, make([]byte, 32), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fname, 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(c.offset)
+		if err := os.Chtimes(fname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		keyWatchCheck(fname, 60*time.Second, nil)
+		_, err := os.Stat(fname)
+		if c.remove && !os.IsNotExist(err) {
+			t.Errorf("expected key file with mtime %s in the future to be removed; got %v", c.offset, err)
+		} else if !c.remove && err != nil {
+			t.Errorf("expected key file with mtime %s in the future to remain; got %v", c.offset, err)
+		}
+	}
+}
+
+func TestKeyPasswordReader(t *testing.T) {
+	for _, c := range []struct {
+		input   string
+		confirm string
+		err     string
+	}{
+		{"secret\n", "", ""},
+		{"secret\nsecret\n", "Again: ", ""},
+		{"secret\r\nsecret", "Again: ", ""},
+		{"secret\nsecrets\n", "Again: ", "input did not match"},
+		{"\n", "", "empty input"},
+		{"\n\n", "Again: ", "empty input"},
+		{"", "", "EOF"},
+	} {
+		var out bytes.Buffer
+		key, err := KeyWithOptions("", "", "Phrase: ", c.confirm, &KeyOptions{PasswordReader: NewPasswordReader(strings.NewReader(c.input), &out)})
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%#v: expected err %#v; got %v", c.input, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: %s", c.input, err)
+			continue
+		}
+		if string(key) != string(keyPhrase("secret")) {
+			t.Errorf("%#v: key did not match", c.input)
+		}
+		if out.String() != "Phrase: "+c.confirm {
+			t.Errorf("%#v: prompts %#v != %#v", c.input, out.String(), "Phrase: "+c.confirm)
+		}
+	}
+}
+
+func TestKeyTries(t *testing.T) {
+	for _, c := range []struct {
+		input string
+		tries int
+		err   string
+	}{
+		{"secret\nsecrets\nsecret\nsecret\n", 0, "input did not match"},
+		{"secret\nsecrets\nsecret\nsecret\n", 2, ""},
+		{"\n\nsecret\nsecret\n", 3, ""},
+		{"a\nb\nc\nd\ne\nf\nsecret\nsecret\n", 3, "input did not match"},
+		{"a\nb\n", 3, "EOF"},
+	} {
+		var out bytes.Buffer
+		key, err := KeyWithOptions("", "", "Phrase: ", "Again: ", &KeyOptions{PasswordReader: NewPasswordReader(strings.NewReader(c.input), &out), Tries: c.tries})
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%#v: expected err %#v; got %v", c.input, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: %s", c.input, err)
+			continue
+		}
+		if string(key) != string(keyPhrase("secret")) {
+			t.Errorf("%#v: key did not match", c.input)
+		}
+	}
+}
+
+func TestKeyStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer func(f *os.File) { stdin = f }(stdin)
+	stdin = r
+	if _, err = w.WriteString("secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	key, err := KeyWithOptions("", "", "Phrase: ", "Again: ", &KeyOptions{Stdin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != string(keyPhrase("secret")) {
+		t.Error("key did not match")
+	}
+	if _, err = KeyWithOptions("", "", "Phrase: ", "", &KeyOptions{Stdin: true}); err != io.EOF {
+		t.Errorf("expected io.EOF once stdin is used up, got %v", err)
+	}
+}
+
+func TestCacheKeyErrors(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	os.Setenv("BRIMCRYPT_TEST_KEY_FILE", path.Join(tmpdir, "missing", "key"))
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_FILE")
+	os.Setenv("BRIMCRYPT_TEST_KEY_INACTIVITY", "soon")
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_INACTIVITY")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := CacheKey(key, "BRIMCRYPT_TEST"); !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("expected strconv.ErrSyntax, got %v", err)
+	}
+	os.Setenv("BRIMCRYPT_TEST_KEY_INACTIVITY", "60")
+	if err := CacheKey(key, "BRIMCRYPT_TEST"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestKeyWatchContext(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	os.Setenv("BRIMCRYPT_TEST_KEY_FILE", path.Join(tmpdir, "key"))
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_FILE")
+	os.Setenv("BRIMCRYPT_TEST_KEY_INACTIVITY", "60")
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_INACTIVITY")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- KeyWatchContext(ctx, "BRIMCRYPT_TEST", "")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled; got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("KeyWatchContext did not return after the context was cancelled")
+	}
+}
+
+func TestCacheKeyCrossDevice(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(tmpdir, "key")
+	os.Setenv("BRIMCRYPT_TEST_KEY_FILE", fname)
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_FILE")
+	os.Setenv("BRIMCRYPT_TEST_KEY_INACTIVITY", "60")
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_INACTIVITY")
+	defer func(f func(string, string) error) { renameFile = f }(renameFile)
+	crossed := false
+	renameFile = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+			crossed = true
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := CacheKey(key, "BRIMCRYPT_TEST"); err != nil {
+		t.Fatal(err)
+	}
+	if !crossed {
+		t.Error("expected the first rename to be across directories")
+	}
+	cached, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, key) {
+		t.Error("cached key does not match")
+	}
+	finfo, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Mode() != 0600 {
+		t.Errorf("cached key mode %04o != 0600", finfo.Mode())
+	}
+	names, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("expected only the key file to remain; got %d files", len(names))
+	}
+}
+
+func TestKeyCacheInactivity(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(tmpdir, "key")
+	os.Setenv("BRIMCRYPT_TEST_KEY_FILE", fname)
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_FILE")
+	os.Setenv("BRIMCRYPT_TEST_KEY_INACTIVITY", "1")
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_INACTIVITY")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := CacheKey(key, "BRIMCRYPT_TEST"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for time.Since(start) < 1500*time.Millisecond {
+		time.Sleep(300 * time.Millisecond)
+		cached, err := Key("", "BRIMCRYPT_TEST", "", "")
+		if err != nil {
+			t.Fatalf("cache expired after %s despite use: %s", time.Since(start), err)
+		}
+		if !bytes.Equal(cached, key) {
+			t.Fatal("cached key does not match")
+		}
+	}
+	finfo, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.ModTime().After(time.Now()) {
+		t.Errorf("cache file mtime %s is in the future", finfo.ModTime())
+	}
+}
+
+func TestParseInactivity(t *testing.T) {
+	for _, c := range []struct {
+		input string
+		want  time.Duration
+	}{
+		{"60", 60 * time.Second},
+		{"0", 0},
+		{"-1", -time.Second},
+		{"500ms", 500 * time.Millisecond},
+		{"90s", 90 * time.Second},
+		{"2m", 2 * time.Minute},
+	} {
+		d, err := parseInactivity(c.input)
+		if err != nil {
+			t.Errorf("%#v: %s", c.input, err)
+		} else if d != c.want {
+			t.Errorf("%#v: %s != %s", c.input, d, c.want)
+		}
+	}
+	for _, input := range []string{"", "soon", "1.5"} {
+		if _, err := parseInactivity(input); err == nil {
+			t.Errorf("%#v: expected an error", input)
+		}
+	}
+}
+
+func TestKeyCacheInactivityDuration(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(tmpdir, "key")
+	os.Setenv("BRIMCRYPT_TEST_KEY_FILE", fname)
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_FILE")
+	os.Setenv("BRIMCRYPT_TEST_KEY_INACTIVITY", "200ms")
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_INACTIVITY")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := CacheKey(key, "BRIMCRYPT_TEST"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Key("", "BRIMCRYPT_TEST", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := Key("", "BRIMCRYPT_TEST", "", ""); err != NoKeyAndNoPromptError {
+		t.Errorf("expected the cache to have expired; got %v", err)
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("expected the expired key file to be removed; got %v", err)
+	}
+}
+
+type testKeyWatchLogger struct {
+	lines []string
+}
+
+func (l *testKeyWatchLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestKeyWatchLogger(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(tmpdir, "key")
+	if err := ioutil.WriteFile(fname, make([]byte, 31), 0600); err != nil {
+		t.Fatal(err)
+	}
+	logger := &testKeyWatchLogger{}
+	keyWatchCheck(fname, time.Minute, keyWatchLogf(logger, "2006"))
+	if len(logger.lines) != 3 {
+		t.Fatalf("expected 3 lines logged; got %#v", logger.lines)
+	}
+	year := time.Now().Format("2006") + " "
+	for i, want := range []string{"File size of", "Removed", "Check complete"} {
+		if !strings.HasPrefix(logger.lines[i], year+want) {
+			t.Errorf("line %d %#v doesn't start with %#v", i, logger.lines[i], year+want)
+		}
+	}
+	logger.lines = nil
+	keyWatchCheck(fname, time.Minute, keyWatchLogf(logger, ""))
+	if len(logger.lines) != 1 || !strings.HasPrefix(logger.lines[0], "Check complete") {
+		t.Errorf("expected just the check complete line without a time; got %#v", logger.lines)
+	}
+	if keyWatchLogf(nil, "") != nil {
+		t.Error("expected no logging without a logger or logTimeFormat")
+	}
+}
+
+// testClock replaces timeNow with a clock that only moves when advanced,
+// returning the function to advance it; the real clock is restored when the
+// test finishes.
+func testClock(t *testing.T) func(time.Duration) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	orig := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = orig })
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestKeyCacheClock(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	advance := testClock(t)
+	fname := path.Join(tmpdir, "key")
+	os.Setenv("BRIMCRYPT_TEST_KEY_FILE", fname)
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_FILE")
+	os.Setenv("BRIMCRYPT_TEST_KEY_INACTIVITY", "1m")
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_INACTIVITY")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := CacheKey(key, "BRIMCRYPT_TEST"); err != nil {
+		t.Fatal(err)
+	}
+	advance(10 * time.Second)
+	if sleep := keyWatchCheck(fname, time.Minute, nil); sleep != 50*time.Second {
+		t.Errorf("expected a sleep of 50s; got %s", sleep)
+	}
+	// Each use restarts the timeout, so this is well past a minute since the
+	// key was cached.
+	advance(49 * time.Second)
+	for i := 0; i < 3; i++ {
+		cached, err := Key("", "BRIMCRYPT_TEST", "", "")
+		if err != nil {
+			t.Fatalf("cache expired despite use: %s", err)
+		}
+		if !bytes.Equal(cached, key) {
+			t.Fatal("cached key does not match")
+		}
+		advance(59 * time.Second)
+	}
+	if sleep := keyWatchCheck(fname, time.Minute, nil); sleep != time.Second {
+		t.Errorf("expected a sleep of 1s; got %s", sleep)
+	}
+	if _, err := os.Stat(fname); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Second)
+	keyWatchCheck(fname, time.Minute, nil)
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("expected the expired key file to be removed; got %v", err)
+	}
+	if err := CacheKey(key, "BRIMCRYPT_TEST"); err != nil {
+		t.Fatal(err)
+	}
+	advance(time.Minute)
+	if _, err := Key("", "BRIMCRYPT_TEST", "", ""); err != NoKeyAndNoPromptError {
+		t.Errorf("expected NoKeyAndNoPromptError for an expired key; got %v", err)
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("expected the expired key file to be removed; got %v", err)
+	}
+}
+
+func TestKeyFromFile(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(tmpdir, "key")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := ioutil.WriteFile(fname, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := KeyFromFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("key from file does not match")
+	}
+	for _, size := range []int{0, 31, 33, 64} {
+		if err = ioutil.WriteFile(fname, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = KeyFromFile(fname); err != KeyError {
+			t.Errorf("expected KeyError for a %d byte file, got %v", size, err)
+		}
+	}
+	if err = ioutil.WriteFile(fname, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(fname, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = KeyFromFile(fname); err == nil {
+		t.Error("expected an error for a file readable by others")
+	}
+	if got, err = KeyFromFileWithOptions(fname, &KeyFileOptions{AnyMode: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("key from file does not match")
+	}
+	if _, err = KeyFromFile(path.Join(tmpdir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
+
+func TestKeyFromEncoded(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, s := range []string{
+		"3031323334353637383961626364656630313233343536373839616263646566",
+		"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY",
+		" MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n",
+	} {
+		got, err := KeyFromEncoded(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+		} else if !bytes.Equal(got, key) {
+			t.Errorf("%q decoded to %x", s, got)
+		}
+	}
+	for _, s := range []string{
+		"30313233343536373839616263646566",
+		"MDEyMzQ1Njc4OWFiY2RlZg==",
+		"",
+	} {
+		if _, err := KeyFromEncoded(s); !errors.Is(err, KeyError) {
+			t.Errorf("%q: expected an error wrapping KeyError, got %v", s, err)
+		}
+	}
+	for _, s := range []string{
+		"not a key!",
+		"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY==",
+	} {
+		if _, err := KeyFromEncoded(s); err == nil || errors.Is(err, KeyError) {
+			t.Errorf("%q: expected an encoding error, got %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package brimcrypt
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+// Keyring is somewhere other than the filesystem to cache keys, such as the
+// OS keyring or keychain.
+type Keyring interface {
+	// Set stores the secret under the name, replacing any already there.
+	Set(name string, secret []byte) error
+	// Get returns the secret stored under the name, or an error if there
+	// isn't one.
+	Get(name string) ([]byte, error)
+	// Delete removes the secret stored under the name, if any.
+	Delete(name string) error
+}
+
+// DefaultKeyring is the OS keyring used to cache keys when the x_KEY_KEYRING
+// OS environment variable gives the name to cache under; it is nil on
+// platforms without one, or where the tool to reach it isn't installed, in
+// which case the x_KEY_FILE cache is used instead. On macOS it is the login
+// keychain through the security command and on Linux the Secret Service
+// through the secret-tool command.
+var DefaultKeyring Keyring
+
+// keyring returns the Keyring and name to cache keys under for the envPrefix,
+// or a nil Keyring if the file cache should be used.
+func keyring(envPrefix string) (Keyring, string) {
+	if envPrefix == "" || DefaultKeyring == nil {
+		return nil, ""
+	}
+	name := os.Getenv(envPrefix + "_KEY_KEYRING")
+	if name == "" {
+		return nil, ""
+	}
+	return DefaultKeyring, name
+}
+
+// keyringSet stores the key along with the current time, which is when it was
+// last used.
+func keyringSet(kr Keyring, name string, key []byte) error {
+	secret := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(secret, uint64(timeNow().UnixNano()))
+	copy(secret[8:], key)
+	return kr.Set(name, secret)
+}
+
+// keyringGet returns the key cached under the name if it hasn't been inactive
+// for inact, restarting the timeout; otherwise it removes the entry and
+// returns nil.
+func keyringGet(kr Keyring, name string, inact time.Duration) []byte {
+	secret, err := kr.Get(name)
+	if err == nil && len(secret) == 40 {
+		now := timeNow()
+		used := time.Unix(0, int64(binary.BigEndian.Uint64(secret)))
+		if now.After(used) && now.Sub(used) < inact {
+			key := secret[8:]
+			if keyringSet(kr, name, key) == nil {
+				return key
+			}
+		}
+	}
+	kr.Delete(name)
+	return nil
+}
+
+// keyringCheck is keyWatchCheck for a key cached in a Keyring.
+func keyringCheck(kr Keyring, name string, inact time.Duration, logf func(format string, v ...interface{})) time.Duration {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+	now := timeNow()
+	sleep := inact
+	secret, err := kr.Get(name)
+	if err == nil {
+		remove := false
+		if len(secret) != 40 {
+			logf("Keyring entry %#v was %d bytes not 40.", name, len(secret))
+			remove = true
+		} else if used := time.Unix(0, int64(binary.BigEndian.Uint64(secret))); used.After(now.Add(60 * time.Second)) {
+			logf("Keyring entry %#v time was more than 60s in the future.", name)
+			remove = true
+		} else if now.Sub(used) >= inact {
+			logf("Keyring entry %#v was inactive for %s and the timeout is %s.", name, now.Sub(used), inact)
+			remove = true
+		} else {
+			sleep = inact - now.Sub(used)
+			if sleep/time.Second > 60 {
+				sleep = 60 * time.Second
+			}
+		}
+		if remove {
+			if err = kr.Delete(name); err != nil {
+				logf("Got error trying to remove keyring entry %#v: %#v", name, err)
+			} else {
+				logf("Removed keyring entry %#v.", name)
+			}
+		}
+	}
+	logf("Keyring check complete; will check again in %s.", sleep)
+	return sleep
+}
@@ -0,0 +1,43 @@
+package brimcrypt
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	if pth, err := exec.LookPath("security"); err == nil {
+		DefaultKeyring = securityKeyring(pth)
+	}
+}
+
+// securityKeyring is the login keychain reached through the security command
+// at the path given. Secrets are hex encoded and stored through security's
+// interactive mode on stdin so they never show up in a process listing.
+type securityKeyring string
+
+func (s securityKeyring) Set(name string, secret []byte) error {
+	cmd := exec.Command(string(s), "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -a brimcrypt -s %s -w %s\n", securityQuote(name), hex.EncodeToString(secret)))
+	return cmd.Run()
+}
+
+func (s securityKeyring) Get(name string) ([]byte, error) {
+	out, err := exec.Command(string(s), "find-generic-password", "-a", "brimcrypt", "-s", name, "-w").Output()
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (s securityKeyring) Delete(name string) error {
+	return exec.Command(string(s), "delete-generic-password", "-a", "brimcrypt", "-s", name).Run()
+}
+
+// securityQuote quotes s as a single argument for security's interactive
+// mode.
+func securityQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
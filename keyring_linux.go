@@ -0,0 +1,36 @@
+package brimcrypt
+
+import (
+	"encoding/hex"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	if pth, err := exec.LookPath("secret-tool"); err == nil {
+		DefaultKeyring = secretToolKeyring(pth)
+	}
+}
+
+// secretToolKeyring is the Secret Service, such as GNOME Keyring, reached
+// through the secret-tool command at the path given. Secrets are hex encoded
+// and given on stdin so they never show up in a process listing.
+type secretToolKeyring string
+
+func (s secretToolKeyring) Set(name string, secret []byte) error {
+	cmd := exec.Command(string(s), "store", "--label=brimcrypt "+name, "application", "brimcrypt", "name", name)
+	cmd.Stdin = strings.NewReader(hex.EncodeToString(secret))
+	return cmd.Run()
+}
+
+func (s secretToolKeyring) Get(name string) ([]byte, error) {
+	out, err := exec.Command(string(s), "lookup", "application", "brimcrypt", "name", name).Output()
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (s secretToolKeyring) Delete(name string) error {
+	return exec.Command(string(s), "clear", "application", "brimcrypt", "name", name).Run()
+}
@@ -0,0 +1,141 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testKeyring map[string][]byte
+
+func (k testKeyring) Set(name string, secret []byte) error {
+	k[name] = append([]byte(nil), secret...)
+	return nil
+}
+
+func (k testKeyring) Get(name string) ([]byte, error) {
+	secret, ok := k[name]
+	if !ok {
+		return nil, fmt.Errorf("%#v not found", name)
+	}
+	return append([]byte(nil), secret...), nil
+}
+
+func (k testKeyring) Delete(name string) error {
+	delete(k, name)
+	return nil
+}
+
+func TestKeyring(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(tmpdir, "key")
+	os.Setenv("BRIMCRYPT_TEST_KEY_FILE", fname)
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_FILE")
+	os.Setenv("BRIMCRYPT_TEST_KEY_KEYRING", "test")
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_KEYRING")
+	os.Setenv("BRIMCRYPT_TEST_KEY_INACTIVITY", "60")
+	defer os.Unsetenv("BRIMCRYPT_TEST_KEY_INACTIVITY")
+	defer func(kr Keyring) { DefaultKeyring = kr }(DefaultKeyring)
+	kr := testKeyring{}
+	DefaultKeyring = kr
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := CacheKey(key, "BRIMCRYPT_TEST"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("expected no key file with a keyring; got %v", err)
+	}
+	if len(kr["test"]) != 40 {
+		t.Fatalf("expected a 40 byte keyring entry; got %d bytes", len(kr["test"]))
+	}
+	cached, err := Key("", "BRIMCRYPT_TEST", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, key) {
+		t.Error("cached key does not match")
+	}
+	// An entry last used longer ago than the inactivity timeout has expired.
+	binary.BigEndian.PutUint64(kr["test"], uint64(time.Now().Add(-time.Minute).UnixNano()))
+	if _, err = Key("", "BRIMCRYPT_TEST", "", ""); err != NoKeyAndNoPromptError {
+		t.Errorf("expected the keyring entry to have expired; got %v", err)
+	}
+	if _, ok := kr["test"]; ok {
+		t.Error("expected the expired keyring entry to be removed")
+	}
+	if err = CacheKey(key, "BRIMCRYPT_TEST"); err != nil {
+		t.Fatal(err)
+	}
+	UncacheKey("BRIMCRYPT_TEST")
+	if _, ok := kr["test"]; ok {
+		t.Error("expected UncacheKey to remove the keyring entry")
+	}
+	// Without a keyring the key file is used instead.
+	DefaultKeyring = nil
+	if err = CacheKey(key, "BRIMCRYPT_TEST"); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err = ioutil.ReadFile(fname); err != nil || !bytes.Equal(cached, key) {
+		t.Errorf("expected the key file to be used without a keyring; got %v", err)
+	}
+}
+
+func TestKeyringCheck(t *testing.T) {
+	kr := testKeyring{}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := keyringSet(kr, "test", key); err != nil {
+		t.Fatal(err)
+	}
+	if sleep := keyringCheck(kr, "test", time.Minute, nil); sleep <= 0 || sleep > time.Minute {
+		t.Errorf("unexpected sleep %s", sleep)
+	}
+	if _, ok := kr["test"]; !ok {
+		t.Fatal("expected the keyring entry to remain")
+	}
+	binary.BigEndian.PutUint64(kr["test"], uint64(time.Now().Add(time.Hour).UnixNano()))
+	keyringCheck(kr, "test", time.Minute, nil)
+	if _, ok := kr["test"]; ok {
+		t.Error("expected the keyring entry with a future time to be removed")
+	}
+	if err := keyringSet(kr, "test", key); err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(kr["test"], uint64(time.Now().Add(-time.Hour).UnixNano()))
+	keyringCheck(kr, "test", time.Minute, nil)
+	if _, ok := kr["test"]; ok {
+		t.Error("expected the expired keyring entry to be removed")
+	}
+}
+
+func TestKeyringClock(t *testing.T) {
+	advance := testClock(t)
+	kr := testKeyring{}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := keyringSet(kr, "test", key); err != nil {
+		t.Fatal(err)
+	}
+	advance(20 * time.Second)
+	if sleep := keyringCheck(kr, "test", time.Minute, nil); sleep != 40*time.Second {
+		t.Errorf("expected a sleep of 40s; got %s", sleep)
+	}
+	advance(39 * time.Second)
+	if cached := keyringGet(kr, "test", time.Minute); !bytes.Equal(cached, key) {
+		t.Fatal("expected the cached key")
+	}
+	advance(time.Minute)
+	if cached := keyringGet(kr, "test", time.Minute); cached != nil {
+		t.Error("expected no key once inactive for the timeout")
+	}
+	if _, ok := kr["test"]; ok {
+		t.Error("expected the expired keyring entry to be removed")
+	}
+}
@@ -0,0 +1,37 @@
+package brimcrypt
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// From the LockFileEx documentation and winerror.h.
+const (
+	lockfileFailImmediately               = 1
+	lockfileExclusiveLock                 = 2
+	errorLockViolation      syscall.Errno = 33
+)
+
+// lockFile takes a lock with LockFileEx on the file, shared or exclusive,
+// without waiting, returning ErrLocked if another open holds a conflicting
+// lock. Windows locks are mandatory, so the lock is on the last byte of the
+// largest possible file rather than anywhere data is, which keeps it
+// advisory. The lock is released when the file is closed.
+func lockFile(f *os.File, exclusive bool) error {
+	flags := uintptr(lockfileFailImmediately)
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	ol := &syscall.Overlapped{Offset: 0xfffffffe, OffsetHigh: 0x7fffffff}
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		if err == errorLockViolation {
+			return ErrLocked
+		}
+		return err
+	}
+	return nil
+}
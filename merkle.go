@@ -0,0 +1,276 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// A file with a Merkle tree keeps a SHA-256 hash of each encrypted data
+// block, as it is on disk, as the leaves of a binary tree whose every other
+// node is the hash of its two children; a node without a sibling is carried up
+// a level as it is. The root is in the encrypted header, and the whole tree,
+// level by level from the leaves up, is written in the slots just after the
+// data blocks whenever the header is. Data blocks written past the end of the
+// file overwrite the old tree, so the leaves are loaded into memory before
+// the first block is written.
+
+// merkleHashSize is the size of each node of the tree.
+const merkleHashSize = sha256.Size
+
+// merkleLeaf returns the leaf hash of the encrypted block.
+func merkleLeaf(enc []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(enc)
+	return h.Sum(nil)
+}
+
+// merkleNode returns the hash of the node with the children given.
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleLevels returns the number of nodes in each level of a tree with the
+// leaves given, from the leaves up to the root.
+func merkleLevels(leaves int64) []int64 {
+	if leaves == 0 {
+		return nil
+	}
+	levels := []int64{leaves}
+	for n := leaves; n > 1; {
+		n = (n + 1) / 2
+		levels = append(levels, n)
+	}
+	return levels
+}
+
+// merkleBlocks returns the number of blocks the tree over the leaves takes
+// after the data blocks.
+func merkleBlocks(leaves int64, plainBlockSize int64) int64 {
+	var nodes int64
+	for _, n := range merkleLevels(leaves) {
+		nodes += n
+	}
+	perBlock := plainBlockSize / merkleHashSize
+	return (nodes + perBlock - 1) / perBlock
+}
+
+// merkleTree returns every node of the tree over the leaves, level by level
+// from the leaves up, so the root is last. With no leaves, it's just the
+// hash of nothing as the root.
+func merkleTree(leaves [][]byte) [][]byte {
+	if len(leaves) == 0 {
+		root := sha256.Sum256(nil)
+		return [][]byte{root[:]}
+	}
+	nodes := append([][]byte(nil), leaves...)
+	for level := nodes; len(level) > 1; {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		nodes = append(nodes, next...)
+		level = next
+	}
+	return nodes
+}
+
+// setMerkleLeaf records the encrypted block just written to the slot.
+func (cf *CryptFile) setMerkleLeaf(slot int64, enc []byte) {
+	for int64(len(cf.merkleLeaves)) <= slot {
+		cf.merkleLeaves = append(cf.merkleLeaves, nil)
+	}
+	cf.merkleLeaves[slot] = merkleLeaf(enc)
+	cf.merkleDirty = true
+	cf.headerDirty = true
+}
+
+// merkleNodeReader returns a function giving the tree node at the index, as
+// stored after the data blocks, decrypting each block of the tree only once.
+func (cf *CryptFile) merkleNodeReader() func(index int64) ([]byte, error) {
+	perBlock := cf.plainBlockSize / merkleHashSize
+	decs := map[int64][]byte{}
+	enc := make([]byte, cf.blockSize)
+	return func(index int64) ([]byte, error) {
+		slot := cf.blocks + index/perBlock
+		dec := decs[slot]
+		if dec == nil {
+			n, err := cf.file.ReadAt(enc, cf.blockSize+slot*cf.blockSize)
+			if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+				return nil, fmt.Errorf("%#v reading Merkle tree: %w", cf.Path, err)
+			}
+			if dec, err = cf.suite.decrypt(enc, cf.blockKey(slot), cf.blockAD(slot)); err != nil {
+				cf.countAuth(err, slot, cf.blockSize+slot*cf.blockSize)
+				return nil, fmt.Errorf("%#v Merkle tree: %w", cf.Path, err)
+			}
+			decs[slot] = dec
+		}
+		offset := index % perBlock * merkleHashSize
+		return dec[offset : offset+merkleHashSize], nil
+	}
+}
+
+// loadMerkleLeaves reads the leaves of the stored tree, checking they give
+// the root the header records.
+func (cf *CryptFile) loadMerkleLeaves() error {
+	node := cf.merkleNodeReader()
+	leaves := make([][]byte, cf.blocks)
+	for i := range leaves {
+		leaf, err := node(int64(i))
+		if err != nil {
+			return err
+		}
+		leaves[i] = append([]byte(nil), leaf...)
+	}
+	nodes := merkleTree(leaves)
+	if !bytes.Equal(nodes[len(nodes)-1], cf.merkleRoot) {
+		return fmt.Errorf("%#v Merkle tree doesn't match its root", cf.Path)
+	}
+	cf.merkleLeaves = leaves
+	return nil
+}
+
+// writeMerkle writes out the tree after the data blocks and records its root
+// for the header.
+func (cf *CryptFile) writeMerkle() error {
+	nodes := merkleTree(cf.merkleLeaves)
+	cf.merkleRoot = nodes[len(nodes)-1]
+	if len(cf.merkleLeaves) == 0 {
+		nodes = nil
+	}
+	perBlock := int(cf.plainBlockSize / merkleHashSize)
+	dec := make([]byte, cf.plainBlockSize)
+	for slot := cf.blocks; len(nodes) > 0; slot++ {
+		for i := range dec {
+			dec[i] = 0
+		}
+		for i := 0; i < perBlock && len(nodes) > 0; i++ {
+			copy(dec[i*merkleHashSize:], nodes[0])
+			nodes = nodes[1:]
+		}
+		enc, err := cf.suite.encryptTo(nil, cf.random(), dec, cf.blockKey(slot), cf.blockAD(slot))
+		if err != nil {
+			cf.fail()
+			return fmt.Errorf("%#v encrypting Merkle tree: %w", cf.Path, err)
+		}
+		n, err := cf.file.WriteAt(enc, cf.blockSize+slot*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && n != len(enc))) {
+			if err != io.EOF {
+				cf.unknownState = true
+				cf.file.Close()
+				cf.file = nil
+			}
+			return fmt.Errorf("%#v writing Merkle tree: %w", cf.Path, err)
+		}
+	}
+	cf.merkleDirty = false
+	return nil
+}
+
+// prepareFlushed opens the file and flushes any pending writes, so the header
+// and what follows the data blocks on disk are up to date, for MerkleRoot,
+// VerifyRange, and Version.
+func (cf *CryptFile) prepareFlushed() error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if err := cf.open(); err != nil {
+		return err
+	}
+	if cf.plainBlockDirty {
+		if err := cf.write(); err != nil {
+			return err
+		}
+		cf.plainBlock = nil
+	}
+	if err := cf.flushQueue(); err != nil {
+		return err
+	}
+	if cf.headerDirty {
+		if err := cf.writeHeader(); err != nil {
+			return err
+		}
+		cf.headerDirty = false
+	}
+	return nil
+}
+
+// MerkleRoot returns the root of the Merkle tree of a file created with the
+// Merkle option, which changes if any block does and so serves as a
+// fingerprint of the whole file. Any pending writes are flushed first.
+func (cf *CryptFile) MerkleRoot() ([]byte, error) {
+	if err := cf.prepareFlushed(); err != nil {
+		return nil, err
+	}
+	if !cf.merkleFile {
+		return nil, fmt.Errorf("%#v has no Merkle tree", cf.Path)
+	}
+	return append([]byte(nil), cf.merkleRoot...), nil
+}
+
+// VerifyRange checks just the blocks holding the length bytes of data at off,
+// for a file created with the Merkle option, by hashing each block as it is
+// on disk and working up the stored Merkle tree to the root recorded in the
+// header, without decrypting the blocks themselves. Only the blocks of the
+// tree on those paths are read. For a compressed file, the range is of the
+// compressed data. Any pending writes are flushed first. The error for a
+// block that fails names its block number and wraps KeyError.
+func (cf *CryptFile) VerifyRange(off, length int64) error {
+	if off < 0 || length < 0 {
+		return fmt.Errorf("%#v invalid range %d, %d", cf.Path, off, length)
+	}
+	if err := cf.prepareFlushed(); err != nil {
+		return err
+	}
+	if !cf.merkleFile {
+		return fmt.Errorf("%#v has no Merkle tree", cf.Path)
+	}
+	if length == 0 {
+		return nil
+	}
+	first := off / cf.plainBlockSize
+	last := (off + length - 1) / cf.plainBlockSize
+	if last >= cf.blocks {
+		last = cf.blocks - 1
+	}
+	levels := merkleLevels(cf.blocks)
+	node := cf.merkleNodeReader()
+	enc := make([]byte, cf.blockSize)
+	for blockNumber := first; blockNumber <= last; blockNumber++ {
+		n, err := cf.file.ReadAt(enc, cf.blockSize+blockNumber*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+			return err
+		}
+		hash := merkleLeaf(enc)
+		var start int64
+		for i, index := 0, blockNumber; i < len(levels)-1; i, index = i+1, index/2 {
+			if sibling := index ^ 1; sibling < levels[i] {
+				siblingHash, err := node(start + sibling)
+				if err != nil {
+					return err
+				}
+				if index%2 == 0 {
+					hash = merkleNode(hash, siblingHash)
+				} else {
+					hash = merkleNode(siblingHash, hash)
+				}
+			}
+			start += levels[i]
+		}
+		if !bytes.Equal(hash, cf.merkleRoot) {
+			cf.countAuth(KeyError, blockNumber, cf.blockSize+blockNumber*cf.blockSize)
+			return fmt.Errorf("%#v block %d: %w", cf.Path, blockNumber, KeyError)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCryptFileMerkle(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 3000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Merkle: true})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The header needs more room than the default block size has.
+	info, err := ReadHeader(tmp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, pbs := int64(info.BlockSize), int64(info.PlainBlockSize)
+	// The root should be that of the blocks as they are on disk.
+	raw, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leaves [][]byte
+	for i := int64(0); i < (3000+pbs-1)/pbs; i++ {
+		leaves = append(leaves, merkleLeaf(raw[bs+i*bs:bs+(i+1)*bs]))
+	}
+	nodes := merkleTree(leaves)
+	root, err := cf.MerkleRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, nodes[len(nodes)-1]) {
+		t.Errorf("root doesn't match one computed from the blocks")
+	}
+	for _, r := range [][2]int64{{0, 3000}, {500, 10}, {0, 0}, {2999, 1}, {2990, 1000}} {
+		if err = cf.VerifyRange(r[0], r[1]); err != nil {
+			t.Errorf("VerifyRange(%d, %d) gave %v", r[0], r[1], err)
+		}
+	}
+	// Writing as the file grows past the tree, then rewriting a block in
+	// the middle, both change the root and still verify.
+	if _, err = cf.Seek(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Seek(500, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	root2, err := cf.MerkleRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(root, root2) {
+		t.Errorf("root unchanged by writing")
+	}
+	if err = cf.VerifyRange(0, 6000); err != nil {
+		t.Errorf("VerifyRange after writing gave %v", err)
+	}
+	if err = cf.Verify(); err != nil {
+		t.Errorf("Verify gave %v", err)
+	}
+	if err = cf.Rekey([]byte("0123456789abcdef0123456789abcdeX")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.VerifyRange(0, 6000); err != nil {
+		t.Errorf("VerifyRange after Rekey gave %v", err)
+	}
+	cf.Close()
+	cf = NewCryptFile(tmp, []byte("0123456789abcdef0123456789abcdeX"), 0)
+	defer cf.Close()
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in = append(in, in...)
+	copy(in[500:], "changed")
+	if !bytes.Equal(out, in) {
+		t.Errorf("output does not match input")
+	}
+	cf.Close()
+	// Tampering with block 5 fails just the ranges including it.
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, bs+5*bs+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err = cf.VerifyRange(5*pbs, 1); !errors.Is(err, KeyError) || !strings.Contains(err.Error(), "block 5:") {
+		t.Errorf("expected KeyError for block 5, got %v", err)
+	}
+	if err = cf.VerifyRange(0, 3000); !errors.Is(err, KeyError) {
+		t.Errorf("expected KeyError for the first 3000 bytes, got %v", err)
+	}
+	if err = cf.VerifyRange(0, 5*pbs); err != nil {
+		t.Errorf("VerifyRange before block 5 gave %v", err)
+	}
+	if err = cf.VerifyRange(6*pbs, 6000); err != nil {
+		t.Errorf("VerifyRange after block 5 gave %v", err)
+	}
+}
+
+func TestCryptFileMerkleErrors(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFile(path.Join(tmpdir, "plain"), key, 0)
+	defer cf.Close()
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.VerifyRange(0, 12); err == nil {
+		t.Errorf("expected err without a Merkle tree")
+	}
+	if _, err := cf.MerkleRoot(); err == nil {
+		t.Errorf("expected err for the root without a Merkle tree")
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(path.Join(tmpdir, "sparse"), key, 0, &CryptFileOptions{Merkle: true, Sparse: true})
+	if _, err := cf.Write([]byte("Hello World!")); err == nil {
+		t.Errorf("expected err for sparse with a Merkle tree")
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(path.Join(tmpdir, "empty"), key, 0, &CryptFileOptions{Merkle: true})
+	if err := cf.WriteAsEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.VerifyRange(-1, 1); err == nil {
+		t.Errorf("expected err for a negative offset")
+	}
+	if err := cf.VerifyRange(0, 100); err != nil {
+		t.Errorf("VerifyRange of an empty file gave %v", err)
+	}
+	cf.Close()
+}
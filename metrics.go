@@ -0,0 +1,163 @@
+package brimcrypt
+
+import "sync/atomic"
+
+// Metrics receives counts of what a CryptFile does, such as to feed a
+// monitoring system; see CryptFileOptions.Metrics. The methods are called from
+// whichever goroutine is using the CryptFile, never from its background
+// goroutines, but one Metrics shared by CryptFiles in use by different
+// goroutines has to be safe for concurrent use, as MetricsCounters is.
+type Metrics interface {
+	// ReadBytes is called with the number of bytes of plaintext returned by
+	// each Read, ReadAt, or WriteTo.
+	ReadBytes(n int64)
+	// WroteBytes is called with the number of bytes of plaintext accepted by
+	// each Write or ReadFrom.
+	WroteBytes(n int64)
+	// EncryptedBlock is called for each data block encrypted.
+	EncryptedBlock()
+	// DecryptedBlock is called for each data block decrypted, including any
+	// read ahead but then not wanted.
+	DecryptedBlock()
+	// FailedAuth is called for each block or header that fails to
+	// authenticate, whether tampered with or given the wrong key.
+	FailedAuth()
+	// CacheHit and CacheMiss are called for each lookup in the block cache,
+	// if the CryptFile has one.
+	CacheHit()
+	CacheMiss()
+}
+
+// Logger is where a CryptFile, with CryptFileOptions.Logger, or KeyWatch sends
+// diagnostic messages; *log.Logger satisfies it. Each call is one message,
+// without a trailing newline.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf sends the message to the Logger, if any.
+func (cf *CryptFile) logf(format string, v ...interface{}) {
+	if cf.logger != nil {
+		cf.logger.Printf(format, v...)
+	}
+}
+
+// MetricsCounters is a Metrics that keeps running totals, updated atomically;
+// read them with atomic.LoadInt64 while in use.
+type MetricsCounters struct {
+	BytesRead       int64
+	BytesWritten    int64
+	BlocksEncrypted int64
+	BlocksDecrypted int64
+	AuthFailures    int64
+	CacheHits       int64
+	CacheMisses     int64
+}
+
+var _ Metrics = (*MetricsCounters)(nil)
+
+func (m *MetricsCounters) ReadBytes(n int64) {
+	atomic.AddInt64(&m.BytesRead, n)
+}
+
+func (m *MetricsCounters) WroteBytes(n int64) {
+	atomic.AddInt64(&m.BytesWritten, n)
+}
+
+func (m *MetricsCounters) EncryptedBlock() {
+	atomic.AddInt64(&m.BlocksEncrypted, 1)
+}
+
+func (m *MetricsCounters) DecryptedBlock() {
+	atomic.AddInt64(&m.BlocksDecrypted, 1)
+}
+
+func (m *MetricsCounters) FailedAuth() {
+	atomic.AddInt64(&m.AuthFailures, 1)
+}
+
+func (m *MetricsCounters) CacheHit() {
+	atomic.AddInt64(&m.CacheHits, 1)
+}
+
+func (m *MetricsCounters) CacheMiss() {
+	atomic.AddInt64(&m.CacheMisses, 1)
+}
+
+// countDecrypt passes the outcome of decrypting a data block to the Metrics,
+// if any, and a failure to authenticate on to countAuth.
+func (cf *CryptFile) countDecrypt(err error, blockNumber int64, offset int64) {
+	if cf.metrics != nil && err == nil {
+		cf.metrics.DecryptedBlock()
+	}
+	cf.countAuth(err, blockNumber, offset)
+}
+
+// countAuth tells the Metrics and the OnAuthFailure hook, if any, if the error
+// is from the block, or with blockNumber -1 the header, at offset in the file
+// failing to authenticate.
+func (cf *CryptFile) countAuth(err error, blockNumber int64, offset int64) {
+	if err != KeyError && err != HeaderError {
+		return
+	}
+	if cf.metrics != nil {
+		cf.metrics.FailedAuth()
+	}
+	if blockNumber < 0 {
+		cf.logf("%#v header at offset %d failed to authenticate", cf.Path, offset)
+	} else {
+		cf.logf("%#v block %d at offset %d failed to authenticate", cf.Path, blockNumber, offset)
+	}
+	if cf.onAuthFailure != nil {
+		cf.onAuthFailure(blockNumber, offset)
+	}
+}
+
+// Stats are the running totals for a CryptFile, from Stats, since it was
+// created or ResetStats was last called; they carry on through Close and
+// reuse.
+type Stats struct {
+	// BytesRead and BytesWritten are the plaintext bytes returned by Read,
+	// ReadAt, and WriteTo and accepted by Write and ReadFrom.
+	BytesRead    int64
+	BytesWritten int64
+	// BlockReads and BlockWrites are the encrypted blocks read from and
+	// written to the file in the course of reading and writing, not
+	// counting Verify, Rekey, and the like; comparing them to the bytes shows the cost of
+	// reading whole blocks to change part of one.
+	BlockReads  int64
+	BlockWrites int64
+	// HeaderWrites is how many times the header was written.
+	HeaderWrites int64
+	// BlockRepairs is how many blocks that failed to authenticate were
+	// rebuilt from the parity of a file with ParityShards.
+	BlockRepairs int64
+}
+
+// Stats returns the running totals of the CryptFile's I/O.
+func (cf *CryptFile) Stats() Stats {
+	return cf.stats
+}
+
+// ResetStats sets the totals returned by Stats back to zero.
+func (cf *CryptFile) ResetStats() {
+	cf.stats = Stats{}
+}
+
+// countRead adds the plaintext bytes returned by a read to the Stats and
+// Metrics.
+func (cf *CryptFile) countRead(n int64) {
+	cf.stats.BytesRead += n
+	if cf.metrics != nil && n > 0 {
+		cf.metrics.ReadBytes(n)
+	}
+}
+
+// countWrite adds the plaintext bytes accepted by a write to the Stats and
+// Metrics.
+func (cf *CryptFile) countWrite(n int64) {
+	cf.stats.BytesWritten += n
+	if cf.metrics != nil && n > 0 {
+		cf.metrics.WroteBytes(n)
+	}
+}
@@ -0,0 +1,229 @@
+package brimcrypt
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestCryptFileMetrics(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	m := &MetricsCounters{}
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{CacheBlocks: 2, Metrics: m})
+	defer cf.Close()
+	// 1000 bytes is 12 full 80 byte blocks and a partial one.
+	if _, err := cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Starting the partial block looks for it in the cache first.
+	if m.BytesWritten != 1000 || m.BlocksEncrypted != 13 || m.CacheMisses != 1 {
+		t.Errorf("after writing, got %+v", *m)
+	}
+	if _, err := io.ReadFull(cf, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if m.BytesRead != 1000 || m.BlocksDecrypted != 13 || m.CacheMisses != 14 || m.CacheHits != 0 {
+		t.Errorf("after reading, got %+v", *m)
+	}
+	b := make([]byte, 10)
+	if _, err := cf.ReadAt(b, 990); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	if m.BytesRead != 1020 || m.BlocksDecrypted != 14 || m.CacheMisses != 15 || m.CacheHits != 1 {
+		t.Errorf("after ReadAt, got %+v", *m)
+	}
+	if m.AuthFailures != 0 {
+		t.Errorf("unexpected auth failures, got %+v", *m)
+	}
+	cf.Close()
+	raw, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	if err = ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(cf); err != KeyError {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+	if m.AuthFailures != 1 {
+		t.Errorf("after reading a damaged block, got %+v", *m)
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(tmp, []byte("abcdef0123456789abcdef0123456789"), 0, &CryptFileOptions{Metrics: m})
+	if _, err = cf.Size(); err != KeyError {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+	if m.AuthFailures != 2 {
+		t.Errorf("after opening with the wrong key, got %+v", *m)
+	}
+	cf.Close()
+	os.Remove(tmp)
+}
+
+func TestCryptFileOnAuthFailure(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	var failures [][2]int64
+	opts := &CryptFileOptions{OnAuthFailure: func(blockNumber int64, offset int64) {
+		failures = append(failures, [2]int64{blockNumber, offset})
+	}}
+	cf := NewCryptFileWithOptions(tmp, key, 0, opts)
+	defer cf.Close()
+	if _, err := cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(cf); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("unexpected auth failures %v", failures)
+	}
+	cf.Close()
+	info, err := ReadHeader(tmp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := info.BlockSize + 2*info.BlockSize
+	raw[offset+info.BlockSize/2] ^= 1
+	if err = ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(cf); err != KeyError {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+	if len(failures) != 1 || failures[0] != [2]int64{2, offset} {
+		t.Errorf("expected a failure for block 2 at %d, got %v", offset, failures)
+	}
+	cf.Close()
+	failures = nil
+	cf = NewCryptFileWithOptions(tmp, []byte("abcdef0123456789abcdef0123456789"), 0, opts)
+	if _, err = cf.Size(); err != KeyError {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+	if len(failures) != 1 || failures[0] != [2]int64{-1, 0} {
+		t.Errorf("expected a failure for the header, got %v", failures)
+	}
+	cf.Close()
+}
+
+func TestCryptFileStats(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cf := NewCryptFile(path.Join(tmpdir, "test"), key, 0)
+	defer cf.Close()
+	// 1000 bytes is 12 full 80 byte blocks, written without reading them
+	// first, and a partial one written on Close.
+	if _, err := cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if st := cf.Stats(); st != (Stats{BytesWritten: 1000, BlockWrites: 12}) {
+		t.Errorf("after writing, got %+v", st)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if st := cf.Stats(); st != (Stats{BytesWritten: 1000, BlockWrites: 13, HeaderWrites: 1}) {
+		t.Errorf("after closing, got %+v", st)
+	}
+	// Changing part of a block has to read it first.
+	if _, err := cf.Seek(85, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if st := cf.Stats(); st != (Stats{BytesWritten: 1010, BlockReads: 1, BlockWrites: 14, HeaderWrites: 2}) {
+		t.Errorf("after overwriting, got %+v", st)
+	}
+	if _, err := cf.ReadAt(make([]byte, 100), 0); err != nil {
+		t.Fatal(err)
+	}
+	if st := cf.Stats(); st != (Stats{BytesRead: 100, BytesWritten: 1010, BlockReads: 3, BlockWrites: 14, HeaderWrites: 2}) {
+		t.Errorf("after ReadAt, got %+v", st)
+	}
+	cf.ResetStats()
+	if st := cf.Stats(); st != (Stats{}) {
+		t.Errorf("after ResetStats, got %+v", st)
+	}
+}
+
+func TestCryptFileLogger(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	logger := &testKeyWatchLogger{}
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{ParityShards: 1, DataShards: 4, Logger: logger})
+	defer cf.Close()
+	if _, err := cf.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.lines) != 0 {
+		t.Errorf("expected nothing logged; got %#v", logger.lines)
+	}
+	info, err := ReadHeader(tmp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := info.BlockSize + 2*info.BlockSize
+	raw[offset+info.BlockSize/2] ^= 1
+	if err = ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(cf); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	expected := []string{
+		fmt.Sprintf("%#v block 2 at offset %d failed to authenticate", tmp, offset),
+		fmt.Sprintf("%#v repaired block 2 from parity", tmp),
+	}
+	if !reflect.DeepEqual(logger.lines, expected) {
+		t.Errorf("expected %#v; got %#v", expected, logger.lines)
+	}
+	logger.lines = nil
+	cf = NewCryptFileWithOptions(tmp, []byte("abcdef0123456789abcdef0123456789"), 0, &CryptFileOptions{Logger: logger})
+	if _, err = cf.Size(); err != KeyError {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+	cf.Close()
+	expected = []string{fmt.Sprintf("%#v header at offset 0 failed to authenticate", tmp)}
+	if !reflect.DeepEqual(logger.lines, expected) {
+		t.Errorf("expected %#v; got %#v", expected, logger.lines)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package brimcrypt
+
+import "os"
+
+// mmapFile maps nothing where there's no mmap support, so reads go through
+// ReadAt.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, nil
+}
+
+// munmapFile does nothing where there's no mmap support.
+func munmapFile(b []byte) error {
+	return nil
+}
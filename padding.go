@@ -0,0 +1,74 @@
+package brimcrypt
+
+import (
+	"fmt"
+	"io"
+)
+
+// A padded file has random bytes after its data blocks, and whatever is
+// stored after them, up to a length that is a power of two or a multiple of
+// the bucket size recorded in the header, so files of similar sizes are all
+// the same size on disk. The padding is written whenever the header is, and
+// is indistinguishable from the encrypted blocks before it; the true size is
+// in the encrypted header as always.
+
+// endSlot returns the slot after the last one in use, before any padding.
+func (cf *CryptFile) endSlot() int64 {
+	if cf.sparseFile {
+		return cf.nextSlot
+	}
+	slot := cf.paritySlot()
+	if cf.parityFile {
+		slot += cf.parityGroups() * cf.shardParity
+	}
+	return slot
+}
+
+// paddedLength returns the length a file of length bytes is padded to, which
+// is a whole number of blocks.
+func (cf *CryptFile) paddedLength(length int64) int64 {
+	padded := cf.paddedBucket
+	if padded == 0 {
+		for padded = cf.blockSize; padded < length; padded *= 2 {
+		}
+	} else {
+		padded = (length + padded - 1) / padded * padded
+	}
+	return (padded + cf.blockSize - 1) / cf.blockSize * cf.blockSize
+}
+
+// writePadding pads the file out with random bytes for the header about to be
+// written.
+func (cf *CryptFile) writePadding() error {
+	finfo, err := cf.file.Stat()
+	if err != nil {
+		return fmt.Errorf("%#v %w", cf.Path, err)
+	}
+	offset := cf.blockSize + cf.endSlot()*cf.blockSize
+	if finfo.Size() > offset {
+		offset = finfo.Size()
+	}
+	length := cf.paddedLength(offset)
+	buf := make([]byte, cf.blockSize)
+	for offset < length {
+		b := buf
+		if length-offset < int64(len(b)) {
+			b = b[:length-offset]
+		}
+		if _, err = io.ReadFull(cf.random(), b); err != nil {
+			cf.fail()
+			return fmt.Errorf("%#v generating padding: %w", cf.Path, err)
+		}
+		n, err := cf.file.WriteAt(b, offset)
+		if err != nil && (err != io.EOF || (err == io.EOF && n != len(b))) {
+			if err != io.EOF {
+				cf.unknownState = true
+				cf.file.Close()
+				cf.file = nil
+			}
+			return fmt.Errorf("%#v writing padding: %w", cf.Path, err)
+		}
+		offset += int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCryptFilePadding(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 5000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	write := func(name string, size int, opts *CryptFileOptions) int64 {
+		tmp := path.Join(tmpdir, name)
+		cf := NewCryptFileWithOptions(tmp, key, 0, opts)
+		defer cf.Close()
+		if _, err := cf.Write(in[:size]); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in[:size]) {
+			t.Errorf("%s output does not match input", name)
+		}
+		if err = cf.Verify(); err != nil {
+			t.Errorf("%s Verify gave %v", name, err)
+		}
+		finfo, err := os.Stat(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return finfo.Size()
+	}
+	plain := write("plain", 1000, nil)
+	a := write("a", 1000, &CryptFileOptions{Padding: true})
+	b := write("b", 1100, &CryptFileOptions{Padding: true})
+	c := write("c", 5000, &CryptFileOptions{Padding: true})
+	if a != b {
+		t.Errorf("expected the same padded length, got %d and %d", a, b)
+	}
+	if a <= plain || a&(a-1) != 0 {
+		t.Errorf("expected a power of two over %d, got %d", plain, a)
+	}
+	if c <= a || c&(c-1) != 0 {
+		t.Errorf("expected a larger power of two than %d, got %d", a, c)
+	}
+	a = write("bucketa", 100, &CryptFileOptions{Padding: true, PaddingBucket: 4000})
+	b = write("bucketb", 2900, &CryptFileOptions{Padding: true, PaddingBucket: 4000})
+	c = write("bucketc", 5000, &CryptFileOptions{Padding: true, PaddingBucket: 4000})
+	d := write("bucketd", 1000, &CryptFileOptions{Padding: true, PaddingBucket: 4000, Merkle: true, Versioned: true})
+	if a != 4096 || b != 4096 || c != 8192 || d != 4096 {
+		t.Errorf("expected 4096, 4096, 8192, and 4096 rounded up to 256 byte blocks, got %d, %d, %d, and %d", a, b, c, d)
+	}
+	// The padding is kept up by later writes without the option, and Rekey
+	// leaves it be.
+	tmp := path.Join(tmpdir, "bucketa")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Seek(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Write(in[100:5000]); err != nil {
+		t.Fatal(err)
+	}
+	newKey := []byte("0123456789abcdef0123456789abcdeX")
+	if err := cf.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	if finfo, err := os.Stat(tmp); err != nil || finfo.Size() != 8192 {
+		t.Errorf("expected 8192 after appending, got %v %v", finfo, err)
+	}
+	cf = NewCryptFile(tmp, newKey, 0)
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("output does not match input after appending")
+	}
+	if err = cf.Verify(); err != nil {
+		t.Errorf("Verify after appending gave %v", err)
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(path.Join(tmpdir, "negative"), key, 0, &CryptFileOptions{Padding: true, PaddingBucket: -1})
+	if _, err = cf.Write(in); err == nil {
+		t.Errorf("expected err for a negative bucket")
+	}
+	cf.Close()
+}
@@ -0,0 +1,218 @@
+package brimcrypt
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// A file with parity has, for each group of shardData data blocks from the
+// first, shardParity Reed-Solomon parity blocks computed over the encrypted
+// blocks as they are on disk, with any the last group is short of taken as
+// all zeros. The parity blocks are stored group by group in the slots after
+// the data blocks and whatever else is stored after them, other than padding,
+// and are rewritten whenever the header is for each group with a block
+// written since, or for every group if the slot they start at has moved.
+// They are neither encrypted, being made only from ciphertext, nor
+// authenticated: a block rebuilt from them still has to authenticate as
+// usual, so bad parity can only fail to repair a block, never change what it
+// decrypts to. Only the data blocks are covered, not the Merkle tree, block
+// versions, or CRCs.
+
+// defaultDataShards is the number of data blocks in each group if
+// CryptFileOptions.DataShards is 0.
+const defaultDataShards = 16
+
+// maxShards is the most data and parity blocks a group may have in all.
+const maxShards = 256
+
+// paritySlot returns the slot where the parity blocks start.
+func (cf *CryptFile) paritySlot() int64 {
+	return cf.crcSlot() + cf.crcBlocks()
+}
+
+// parityGroups returns the number of groups of data blocks.
+func (cf *CryptFile) parityGroups() int64 {
+	return (cf.blocks + cf.shardData - 1) / cf.shardData
+}
+
+// parityEncoder returns the Reed-Solomon encoder for the file's groups.
+func (cf *CryptFile) parityEncoder() (reedsolomon.Encoder, error) {
+	if cf.parityEnc == nil {
+		enc, err := reedsolomon.New(int(cf.shardData), int(cf.shardParity))
+		if err != nil {
+			return nil, fmt.Errorf("%#v parity: %w", cf.Path, err)
+		}
+		cf.parityEnc = enc
+	}
+	return cf.parityEnc, nil
+}
+
+// setParityDirty records that the data block in the slot has been written, so
+// its group's parity is out of date.
+func (cf *CryptFile) setParityDirty(slot int64) {
+	if cf.parityDirty == nil {
+		cf.parityDirty = map[int64]bool{}
+	}
+	cf.parityDirty[slot/cf.shardData] = true
+	cf.headerDirty = true
+}
+
+// parityCurrent returns true if the parity on disk for the group is up to
+// date with its data blocks.
+func (cf *CryptFile) parityCurrent(group int64) bool {
+	return cf.parityAt == cf.paritySlot() && !cf.parityDirty[group]
+}
+
+// readGroup returns the data blocks of the group as they are on disk, followed
+// by its parity blocks if withParity or else by room for them. A block past
+// the last data block is all zeros, and one the file is too short to hold in
+// full is nil.
+func (cf *CryptFile) readGroup(group int64, withParity bool) ([][]byte, error) {
+	shards := make([][]byte, cf.shardData+cf.shardParity)
+	for i := range shards {
+		slot := group*cf.shardData + int64(i)
+		if int64(i) >= cf.shardData {
+			if !withParity {
+				shards[i] = make([]byte, cf.blockSize)
+				continue
+			}
+			slot = cf.paritySlot() + group*cf.shardParity + int64(i) - cf.shardData
+		} else if slot >= cf.blocks {
+			shards[i] = make([]byte, cf.blockSize)
+			continue
+		}
+		shard := make([]byte, cf.blockSize)
+		n, err := cf.file.ReadAt(shard, cf.blockSize+slot*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+			if err != io.EOF {
+				return nil, fmt.Errorf("%#v reading block %d: %w", cf.Path, slot, err)
+			}
+			shard = nil
+		}
+		shards[i] = shard
+	}
+	return shards, nil
+}
+
+// writeParity writes out the parity blocks of every group whose parity is out
+// of date, for the header about to be written.
+func (cf *CryptFile) writeParity() error {
+	enc, err := cf.parityEncoder()
+	if err != nil {
+		return err
+	}
+	start := cf.paritySlot()
+	for group := int64(0); group < cf.parityGroups(); group++ {
+		if cf.parityCurrent(group) {
+			continue
+		}
+		shards, err := cf.readGroup(group, false)
+		if err != nil {
+			return err
+		}
+		if err = enc.Encode(shards); err != nil {
+			return fmt.Errorf("%#v computing parity for group %d: %w", cf.Path, group, err)
+		}
+		for i, shard := range shards[cf.shardData:] {
+			slot := start + group*cf.shardParity + int64(i)
+			n, err := cf.file.WriteAt(shard, cf.blockSize+slot*cf.blockSize)
+			if err != nil && (err != io.EOF || (err == io.EOF && n != len(shard))) {
+				if err != io.EOF {
+					cf.unknownState = true
+					cf.file.Close()
+					cf.file = nil
+				}
+				return fmt.Errorf("%#v writing parity: %w", cf.Path, err)
+			}
+		}
+	}
+	cf.parityAt = start
+	cf.parityDirty = nil
+	return nil
+}
+
+// repairBlock rebuilds the encrypted data block in the slot, which failed to
+// authenticate, from the rest of its group and the group's parity, along with
+// any other blocks of the group that fail too, and returns it if it then
+// authenticates, or nil if it can't be repaired. Unless the file is
+// read-only, the rebuilt blocks are written back in place; they're the same
+// as were originally written, so the parity stays as it is.
+func (cf *CryptFile) repairBlock(slot int64) []byte {
+	if !cf.parityFile || slot >= cf.blocks || !cf.parityCurrent(slot/cf.shardData) {
+		return nil
+	}
+	rs, err := cf.parityEncoder()
+	if err != nil {
+		return nil
+	}
+	group := slot / cf.shardData
+	first := group * cf.shardData
+	shards, err := cf.readGroup(group, true)
+	if err != nil {
+		return nil
+	}
+	var rebuilt []int64
+	for i, shard := range shards[:cf.shardData] {
+		s := first + int64(i)
+		if s >= cf.blocks {
+			break
+		}
+		if shard == nil || s == slot || cf.suite.verify(shard, cf.blockKey(s), cf.blockAD(s)) != nil {
+			shards[i] = nil
+			rebuilt = append(rebuilt, s)
+		}
+	}
+	if int64(len(rebuilt)) > cf.shardParity {
+		cf.logf("%#v can't repair block %d: %d blocks of its group are bad", cf.Path, slot, len(rebuilt))
+		return nil
+	}
+	if err = rs.ReconstructData(shards); err != nil {
+		cf.logf("%#v can't repair block %d: %v", cf.Path, slot, err)
+		return nil
+	}
+	for _, s := range rebuilt {
+		if cf.suite.verify(shards[s-first], cf.blockKey(s), cf.blockAD(s)) != nil {
+			cf.logf("%#v can't repair block %d: block %d still fails to authenticate", cf.Path, slot, s)
+			return nil
+		}
+	}
+	for _, s := range rebuilt {
+		cf.stats.BlockRepairs++
+		cf.logf("%#v repaired block %d from parity", cf.Path, s)
+		if cf.readOnly {
+			continue
+		}
+		// Failing to write the repair back still leaves the block
+		// readable through the parity.
+		if _, err = cf.file.WriteAt(shards[s-first], cf.blockSize+s*cf.blockSize); err != nil {
+			cf.logf("%#v writing repaired block %d: %v", cf.Path, s, err)
+		}
+	}
+	return shards[slot-first]
+}
+
+// verifyParity checks the parity blocks of every group match its data blocks,
+// which are taken to have authenticated already.
+func (cf *CryptFile) verifyParity() error {
+	rs, err := cf.parityEncoder()
+	if err != nil {
+		return err
+	}
+	for group := int64(0); group < cf.parityGroups(); group++ {
+		shards, err := cf.readGroup(group, true)
+		if err != nil {
+			return err
+		}
+		for _, shard := range shards {
+			if shard == nil {
+				return fmt.Errorf("%#v parity for group %d is missing", cf.Path, group)
+			}
+		}
+		if ok, err := rs.Verify(shards); err != nil || !ok {
+			return fmt.Errorf("%#v parity for group %d doesn't match its blocks", cf.Path, group)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCryptFileParity(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	// Random data, so it doesn't shrink when compressed.
+	in := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(in)
+	// zeroBlocks zeroes the data blocks given on disk, returning the file as
+	// it was before.
+	zeroBlocks := func(tmp string, blockNumbers ...int64) []byte {
+		raw, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ReadHeader(tmp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damaged := append([]byte(nil), raw...)
+		for _, blockNumber := range blockNumbers {
+			offset := info.BlockSize + blockNumber*info.BlockSize
+			copy(damaged[offset:offset+info.BlockSize], make([]byte, info.BlockSize))
+		}
+		if err = ioutil.WriteFile(tmp, damaged, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	read := func(tmp string, readOnly bool) ([]byte, Stats, error) {
+		cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{ReadOnly: readOnly})
+		defer cf.Close()
+		out, err := ioutil.ReadAll(cf)
+		return out, cf.Stats(), err
+	}
+	for _, tt := range []struct {
+		name string
+		opts *CryptFileOptions
+	}{
+		{"plain", &CryptFileOptions{ParityShards: 2, DataShards: 4}},
+		{"default", &CryptFileOptions{ParityShards: 2}},
+		{"chacha", &CryptFileOptions{Suite: ChaCha20Poly1305, ParityShards: 2, DataShards: 4}},
+		{"everything", &CryptFileOptions{ParityShards: 2, DataShards: 4, CRC: true, Merkle: true, Versioned: true, Padding: true, BlockKeys: true, Compress: true}},
+	} {
+		tmp := path.Join(tmpdir, tt.name)
+		cf := NewCryptFileWithOptions(tmp, key, 0, tt.opts)
+		defer cf.Close()
+		if _, err := cf.Write(in); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Verify(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if cf.blocks < 5 {
+			t.Fatalf("%s: expected more blocks than %d", tt.name, cf.blocks)
+		}
+		cf.Close()
+		// A read-only read repairs the block in memory only.
+		raw := zeroBlocks(tmp, 1)
+		out, stats, err := read(tmp, true)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%s: output does not match input", tt.name)
+		}
+		if stats.BlockRepairs != 1 {
+			t.Errorf("%s: expected 1 block repair; got %d", tt.name, stats.BlockRepairs)
+		}
+		if out, stats, err = read(tmp, false); err != nil || !bytes.Equal(out, in) || stats.BlockRepairs != 1 {
+			t.Errorf("%s: read gave %v with %d block repairs", tt.name, err, stats.BlockRepairs)
+		}
+		if repaired, err := ioutil.ReadFile(tmp); err != nil || !bytes.Equal(repaired, raw) {
+			t.Errorf("%s: expected the block repaired on disk; got %v", tt.name, err)
+		}
+		// Verify repairs as well.
+		zeroBlocks(tmp, 0, 2)
+		cf = NewCryptFile(tmp, key, 0)
+		if err = cf.Verify(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if cf.Stats().BlockRepairs != 2 {
+			t.Errorf("%s: expected 2 block repairs; got %d", tt.name, cf.Stats().BlockRepairs)
+		}
+		cf.Close()
+		if repaired, err := ioutil.ReadFile(tmp); err != nil || !bytes.Equal(repaired, raw) {
+			t.Errorf("%s: expected the blocks repaired on disk; got %v", tt.name, err)
+		}
+	}
+	// Rewriting a block updates the parity of its group, which still
+	// repairs another block of the group.
+	tmp := path.Join(tmpdir, "plain")
+	cf := NewCryptFile(tmp, key, 0)
+	if _, err := cf.Size(); err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte(nil), in...)
+	copy(expected[cf.plainBlockSize:], "rewritten")
+	if _, err := cf.Seek(cf.plainBlockSize, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Write([]byte("rewritten")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zeroBlocks(tmp, 2)
+	if out, _, err := read(tmp, true); err != nil || !bytes.Equal(out, expected) {
+		t.Errorf("expected the rewritten file back; got %v", err)
+	}
+	// More bad blocks in a group than it has parity can't be repaired.
+	zeroBlocks(tmp, 0, 1, 3)
+	if _, _, err := read(tmp, true); err != KeyError {
+		t.Errorf("expected KeyError; got %v", err)
+	}
+	cf = NewCryptFile(tmp, key, 0)
+	if err := cf.Verify(); !errors.Is(err, KeyError) {
+		t.Errorf("expected KeyError from Verify; got %v", err)
+	}
+	cf.Close()
+	// Damaged parity shows up in Verify.
+	tmp = path.Join(tmpdir, "default")
+	cf = NewCryptFile(tmp, key, 0)
+	if err := cf.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	paritySlot := cf.paritySlot()
+	cf.Close()
+	zeroBlocks(tmp, paritySlot)
+	if err := cf.Verify(); err == nil {
+		t.Error("expected damaged parity to fail Verify")
+	}
+	cf.Close()
+	// Parity can't be had with a block map.
+	cf = NewCryptFileWithOptions(path.Join(tmpdir, "sparse"), key, 0, &CryptFileOptions{ParityShards: 1, Sparse: true})
+	if _, err := cf.Write(in); err == nil {
+		t.Error("expected an error for a sparse file with parity")
+	}
+	cf.Close()
+	if _, err := os.Stat(path.Join(tmpdir, "sparse")); !os.IsNotExist(err) {
+		t.Errorf("expected no sparse file; got %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package brimcrypt
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE from linux/falloc.h
+const fallocKeepSize = 1
+
+// preallocate reserves disk space for the file up to size bytes without
+// changing its length.
+func preallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+}
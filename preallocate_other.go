@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package brimcrypt
+
+import "os"
+
+// preallocate does nothing where there's no fallocate.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package brimcrypt
+
+import "io"
+
+// ProgressFunc is told how many bytes of a long operation are done out of
+// bytesTotal, which is -1 if the total isn't known up front. It's called
+// periodically by the goroutine doing the work, with bytesDone never going
+// down, and once more at the end if the operation succeeds.
+type ProgressFunc func(bytesDone, bytesTotal int64)
+
+// progressInterval is how many bytes go by between calls to a ProgressFunc;
+// tests lower it to see calls without large files.
+var progressInterval int64 = 1 << 20
+
+// progress tracks the bytes done for a ProgressFunc, which may be nil.
+type progress struct {
+	fn       ProgressFunc
+	done     int64
+	total    int64
+	reported int64
+}
+
+func newProgress(fn ProgressFunc, total int64) *progress {
+	return &progress{fn: fn, total: total}
+}
+
+// add counts n more bytes done, calling the ProgressFunc if it's been
+// progressInterval bytes since it was last called.
+func (p *progress) add(n int64) {
+	if p.fn == nil {
+		return
+	}
+	p.done += n
+	if p.done-p.reported >= progressInterval {
+		p.reported = p.done
+		p.fn(p.done, p.total)
+	}
+}
+
+// finish calls the ProgressFunc with the final count.
+func (p *progress) finish() {
+	if p.fn != nil {
+		p.reported = p.done
+		p.fn(p.done, p.total)
+	}
+}
+
+// progressReader counts the bytes read through it.
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.add(int64(n))
+	return n, err
+}
+
+// progressWriter counts the bytes written through it.
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.add(int64(n))
+	return n, err
+}
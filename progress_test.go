@@ -0,0 +1,132 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// progressRecorder returns a ProgressFunc that records its calls, and a
+// function checking they went up to the total expected.
+func progressRecorder(t *testing.T, name string) (ProgressFunc, func(total int64)) {
+	var dones []int64
+	var totals []int64
+	fn := func(bytesDone, bytesTotal int64) {
+		dones = append(dones, bytesDone)
+		totals = append(totals, bytesTotal)
+	}
+	check := func(total int64) {
+		t.Helper()
+		if len(dones) < 3 {
+			t.Fatalf("%s: %d progress calls %v", name, len(dones), dones)
+		}
+		for i := range dones {
+			if i > 0 && dones[i] < dones[i-1] {
+				t.Fatalf("%s: progress went down %v", name, dones)
+			}
+			if totals[i] != total {
+				t.Fatalf("%s: total %d != %d", name, totals[i], total)
+			}
+		}
+		if total >= 0 && dones[len(dones)-1] != total {
+			t.Fatalf("%s: progress ended at %d of %d", name, dones[len(dones)-1], total)
+		}
+		dones = nil
+		totals = nil
+	}
+	return fn, check
+}
+
+func TestProgress(t *testing.T) {
+	defer func(v int64) { progressInterval = v }(progressInterval)
+	progressInterval = 1000
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := bytes.Repeat([]byte("0123456789"), 2000)
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(tmpdir, "plain")
+	if err := ioutil.WriteFile(plain, in, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fn, check := progressRecorder(t, "EncryptFromFile")
+	a := filepath.Join(tmpdir, "a")
+	if err := EncryptFromFileWithOptions(plain, key, a, 0, &CopyOptions{Progress: fn}); err != nil {
+		t.Fatal(err)
+	}
+	check(int64(len(in)))
+	fn, check = progressRecorder(t, "CopyFile")
+	b := filepath.Join(tmpdir, "b")
+	if err := CopyFileWithOptions(a, key, b, key, 0, &CopyOptions{Progress: fn}); err != nil {
+		t.Fatal(err)
+	}
+	check(int64(len(in)))
+	fn, check = progressRecorder(t, "DecryptToFile")
+	out := filepath.Join(tmpdir, "out")
+	if err := DecryptToFileWithOptions(b, key, out, &CopyOptions{Progress: fn}); err != nil {
+		t.Fatal(err)
+	}
+	check(int64(len(in)))
+	if got, err := ioutil.ReadFile(out); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, in) {
+		t.Fatal("decrypted copy doesn't match")
+	}
+	finfo, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, check = progressRecorder(t, "Verify")
+	cf := NewCryptFileWithOptions(b, key, 0, &CryptFileOptions{Progress: fn})
+	if err = cf.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	check(finfo.Size())
+	fn, check = progressRecorder(t, "Rekey")
+	cf.progress = fn
+	if err = cf.Rekey([]byte("abcdef0123456789abcdef0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(finfo.Size())
+}
+
+func TestProgressTree(t *testing.T) {
+	defer func(v int64) { progressInterval = v }(progressInterval)
+	progressInterval = 1000
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	src := filepath.Join(tmpdir, "src")
+	var total int64
+	for i, name := range []string{"a", "sub/b", "sub/c", "empty"} {
+		data := bytes.Repeat([]byte("0123456789"), i*500)
+		total += int64(len(data))
+		pth := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The destination is inside the source, and mustn't count towards the
+	// total.
+	dst := filepath.Join(src, "dst")
+	fn, check := progressRecorder(t, "EncryptTree")
+	if err := EncryptTreeWithOptions(src, dst, key, &TreeOptions{Progress: fn}); err != nil {
+		t.Fatal(err)
+	}
+	check(total)
+	fn, check = progressRecorder(t, "DecryptTree")
+	if err := DecryptTreeWithOptions(dst, filepath.Join(tmpdir, "out"), key, &TreeOptions{Progress: fn}); err != nil {
+		t.Fatal(err)
+	}
+	check(total)
+}
@@ -0,0 +1,42 @@
+package brimcrypt
+
+import (
+	"context"
+	"io"
+)
+
+// waitLimiter waits until the CryptFile's Limiter, if any, allows n more
+// bytes, taking them no more than its burst at a time, or until ctx is done.
+func (cf *CryptFile) waitLimiter(ctx context.Context, n int) error {
+	if cf.limiter == nil {
+		return nil
+	}
+	burst := cf.limiter.Burst()
+	for n > 0 {
+		m := n
+		if burst > 0 && m > burst {
+			m = burst
+		}
+		if err := cf.limiter.WaitN(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+// cryptFileContext is the CryptFile's Read and Write with ctx, for io.Copy.
+type cryptFileContext struct {
+	cf  *CryptFile
+	ctx context.Context
+}
+
+var _ io.ReadWriter = cryptFileContext{}
+
+func (c cryptFileContext) Read(b []byte) (int, error) {
+	return c.cf.ReadContext(c.ctx, b)
+}
+
+func (c cryptFileContext) Write(b []byte) (int, error) {
+	return c.cf.WriteContext(c.ctx, b)
+}
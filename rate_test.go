@@ -0,0 +1,85 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestCryptFileLimiter(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tmp := path.Join(tmpdir, "test")
+	in := make([]byte, 5000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// After the first burst of 1000 bytes, the other 4000 take at least 0.4
+	// seconds at 10000 bytes a second, however they're read.
+	for _, tt := range []struct {
+		name string
+		read func(cf *CryptFile) ([]byte, error)
+	}{
+		{"Read", func(cf *CryptFile) ([]byte, error) {
+			return ioutil.ReadAll(struct{ io.Reader }{cf})
+		}},
+		{"ReadAt", func(cf *CryptFile) ([]byte, error) {
+			out := make([]byte, len(in))
+			_, err := cf.ReadAt(out, 0)
+			return out, err
+		}},
+		{"WriteTo", func(cf *CryptFile) ([]byte, error) {
+			var out bytes.Buffer
+			_, err := cf.WriteTo(&out)
+			return out.Bytes(), err
+		}},
+	} {
+		limiter := rate.NewLimiter(10000, 1000)
+		cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Limiter: limiter})
+		start := time.Now()
+		out, err := tt.read(cf)
+		elapsed := time.Since(start)
+		cf.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%s: output does not match input", tt.name)
+		}
+		if elapsed < 400*time.Millisecond {
+			t.Errorf("%s: expected at least 400ms; took %s", tt.name, elapsed)
+		}
+	}
+	// A slow reader can be interrupted.
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Limiter: rate.NewLimiter(100, 100)})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	var out bytes.Buffer
+	n, err := cf.WriteToContext(ctx, &out)
+	if err == nil {
+		t.Error("expected an error once cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to be interrupted; took %s", elapsed)
+	}
+	if n != int64(out.Len()) || n >= int64(len(in)) {
+		t.Errorf("expected part of the file; got %d bytes of %d", n, out.Len())
+	}
+	cf.Close()
+}
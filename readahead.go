@@ -0,0 +1,79 @@
+package brimcrypt
+
+import (
+	"fmt"
+	"io"
+)
+
+// readAheadJob is the block after the one last read being read and decrypted
+// in the background, for the ReadAhead option.
+type readAheadJob struct {
+	blockNumber int64
+	dec         []byte
+	err         error
+	done        chan struct{}
+}
+
+// startReadAhead starts reading and decrypting the block in the background,
+// unless it is past the end of the file or already to hand. Only one block is
+// read ahead at a time.
+func (cf *CryptFile) startReadAhead(blockNumber int64) {
+	if !cf.readAhead || cf.ahead != nil || blockNumber*cf.plainBlockSize >= cf.size {
+		return
+	}
+	if cf.cache != nil && cf.cache.entries[blockNumber] != nil {
+		return
+	}
+	if cf.queued(blockNumber) {
+		return
+	}
+	slot, zero, err := cf.lookupSlot(blockNumber)
+	if err != nil || zero {
+		return
+	}
+	if cf.aheadEnc == nil {
+		cf.aheadEnc = make([]byte, cf.blockSize)
+	}
+	job := &readAheadJob{blockNumber: blockNumber, done: make(chan struct{})}
+	file, suite, key, ad, enc, dec := cf.file, cf.suite, cf.blockKey(slot), cf.blockAD(slot), cf.aheadEnc, cf.newPlainBlock()
+	offset := cf.blockSize + slot*cf.blockSize
+	go func() {
+		n, err := file.ReadAt(enc, offset)
+		if err != nil && (err != io.EOF || (err == io.EOF && n != len(enc))) {
+			job.err = fmt.Errorf("reading ahead: %w", err)
+		} else {
+			job.dec, job.err = suite.decryptTo(dec, enc, key, ad)
+		}
+		close(job.done)
+	}()
+	cf.ahead = job
+}
+
+// takeReadAhead returns the block if it was read ahead without error, or nil
+// if it has to be read as usual. Whatever was read ahead is dropped either
+// way.
+func (cf *CryptFile) takeReadAhead(blockNumber int64) []byte {
+	job := cf.ahead
+	if job == nil {
+		return nil
+	}
+	cf.ahead = nil
+	<-job.done
+	if job.err == nil {
+		cf.stats.BlockReads++
+		if cf.metrics != nil {
+			cf.metrics.DecryptedBlock()
+		}
+	}
+	if job.blockNumber != blockNumber || job.err != nil {
+		return nil
+	}
+	return job.dec
+}
+
+// dropReadAhead discards whatever was read ahead, such as when the block is
+// about to change; it waits for the background read to finish so its
+// buffers can be reused.
+func (cf *CryptFile) dropReadAhead() {
+	cf.takeReadAhead(-1)
+}
@@ -0,0 +1,217 @@
+package brimcrypt
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+)
+
+// A file with recipients has the file key wrapped, that is encrypted, under
+// each recipient's key in a table in the plaintext header after the salt, and
+// any one of those keys opens the file. The rest of the header is then
+// encrypted and authenticated under a key derived from the file key, as if it
+// were block -1, rather than under any recipient's key.
+//
+// The table is an aes.BlockSize of which the first two bytes are the number
+// of entries as a uint16, followed by the entries, each the encrypted file
+// key padded out to a multiple of aes.BlockSize.
+
+// recipientsOffset returns where the recipients table starts in the header.
+func recipientsOffset(wide bool) int64 {
+	if wide {
+		return wideHeaderASize
+	}
+	return header0ASize + kdfParamsSize + saltSize
+}
+
+// recipientEntrySize returns the size of each entry of the recipients table
+// for the suite.
+func recipientEntrySize(suite CipherSuite) int64 {
+	size := fileKeySize + suite.overhead()
+	return (size + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize
+}
+
+// recipientAD returns the additional data the file key is wrapped with.
+func recipientAD(salt []byte) []byte {
+	return append([]byte("brimcrypt recipient "), salt...)
+}
+
+// readRecipients parses the recipients table of the plaintext header.
+func (ha *headerA) readRecipients(pth string) error {
+	offset := recipientsOffset(ha.wide)
+	if ha.salt == nil || ha.length < offset+aes.BlockSize {
+		return fmt.Errorf("%#v header too short for recipients", pth)
+	}
+	count := int64(binary.BigEndian.Uint16(ha.raw[offset : offset+2]))
+	entrySize := recipientEntrySize(ha.suite)
+	offset += aes.BlockSize
+	if count == 0 || offset+count*entrySize > ha.length {
+		return fmt.Errorf("%#v header has %d recipients, which don't fit", pth, count)
+	}
+	ha.recipients = make([][]byte, count)
+	for i := range ha.recipients {
+		ha.recipients[i] = ha.raw[offset : offset+fileKeySize+ha.suite.overhead()]
+		offset += entrySize
+	}
+	return nil
+}
+
+// unwrapFileKey returns the file key and the index of the recipient whose key
+// unwraps it, or KeyError if none does.
+func unwrapFileKey(suite CipherSuite, recipients [][]byte, key []byte, salt []byte) ([]byte, int, error) {
+	if len(key) != fileKeySize {
+		return nil, 0, KeyError
+	}
+	for i, entry := range recipients {
+		if fileKey, err := suite.decrypt(entry, key, recipientAD(salt)); err == nil {
+			return fileKey, i, nil
+		}
+	}
+	return nil, 0, KeyError
+}
+
+// headerKey returns the key the encrypted part of the header is under.
+func (cf *CryptFile) headerKey() []byte {
+	if cf.recipients == nil {
+		return cf.key
+	}
+	return blockKey(cf.fileKey, cf.salt, -1)
+}
+
+// wrapFileKey returns a recipients table entry for the key.
+func (cf *CryptFile) wrapFileKey(key []byte) ([]byte, error) {
+	if len(key) != fileKeySize {
+		return nil, fmt.Errorf("%#v recipient keys must be %d bytes, not %d", cf.Path, fileKeySize, len(key))
+	}
+	entry, err := cf.suite.encryptTo(nil, cf.random(), cf.fileKey, key, recipientAD(cf.salt))
+	if err != nil {
+		return nil, fmt.Errorf("%#v wrapping file key: %w", cf.Path, err)
+	}
+	return entry, nil
+}
+
+// writeRecipients fills in the recipients table of the plaintext header.
+func (cf *CryptFile) writeRecipients(header []byte) {
+	offset := recipientsOffset(cf.wideHeader)
+	binary.BigEndian.PutUint16(header[offset:offset+2], uint16(len(cf.recipients)))
+	offset += aes.BlockSize
+	for _, entry := range cf.recipients {
+		copy(header[offset:], entry)
+		offset += recipientEntrySize(cf.suite)
+	}
+}
+
+// setRecipients replaces the recipients, rewriting the header to match, as
+// long as the header block has room for them.
+func (cf *CryptFile) setRecipients(recipients [][]byte) error {
+	headerASize := recipientsOffset(cf.wideHeader) + aes.BlockSize + int64(len(recipients))*recipientEntrySize(cf.suite)
+	features := uint16(featureBlockCount | featureBlockKeys)
+	if cf.compressed {
+		features |= featureCompressed
+	}
+	if cf.sparseFile {
+		features |= featureSparse
+	}
+	if cf.merkleFile {
+		features |= featureMerkle
+	}
+	if cf.versionedFile {
+		features |= featureVersioned
+	}
+	if cf.paddedFile {
+		features |= featurePadded
+	}
+	if cf.keyCommitFile {
+		features |= featureKeyCommit
+	}
+	if cf.parityFile {
+		features |= featureParity
+	}
+	if cf.crcFile {
+		features |= featureCRC
+	}
+	if headerASize-header0ASize > 255*aes.BlockSize || cf.plainBlockSize-headerASize < headerBSize(features) {
+		return fmt.Errorf("%#v %d byte header block has no room for %d recipients", cf.Path, cf.blockSize, len(recipients))
+	}
+	cf.recipients = recipients
+	cf.headerASize = headerASize
+	if err := cf.writeHeader(); err != nil {
+		return err
+	}
+	cf.headerDirty = false
+	return nil
+}
+
+// prepareRecipients opens the file for AddRecipient and RemoveRecipient.
+func (cf *CryptFile) prepareRecipients() error {
+	if cf.unknownState {
+		return unusableError(cf.Path)
+	}
+	if cf.readOnly {
+		return readOnlyError(cf.Path)
+	}
+	if err := cf.open(); err != nil {
+		return err
+	}
+	if cf.fileKey == nil {
+		return fmt.Errorf("%#v has no file key to share; it must be created with the BlockKeys option", cf.Path)
+	}
+	return nil
+}
+
+// AddRecipient lets the 32 byte key given open the file too, along with the
+// key the CryptFile has and any other recipients already added. The file must
+// have been created with the BlockKeys option, as it's the random file key
+// that each recipient's key unwraps. Each recipient takes room in the header
+// block, so a file with small blocks may have no room for more. Adding a key
+// that can already open the file does nothing.
+func (cf *CryptFile) AddRecipient(newKEK []byte) error {
+	if err := cf.prepareRecipients(); err != nil {
+		return err
+	}
+	recipients := cf.recipients
+	if recipients == nil {
+		entry, err := cf.wrapFileKey(cf.key)
+		if err != nil {
+			return err
+		}
+		recipients = [][]byte{entry}
+	}
+	if _, _, err := unwrapFileKey(cf.suite, recipients, newKEK, cf.salt); err == nil {
+		return nil
+	}
+	entry, err := cf.wrapFileKey(newKEK)
+	if err != nil {
+		return err
+	}
+	return cf.setRecipients(append(recipients[:len(recipients):len(recipients)], entry))
+}
+
+// RemoveRecipient stops the key given from opening the file, returning an
+// error wrapping KeyError if it's not one of the file's recipients. The key
+// the CryptFile opened the file with can't be removed, nor can the last
+// recipient. A removed recipient that already had the file open, or kept a
+// copy of it, could have learned the file key, which doesn't change; only
+// re-encrypting to a new file fully revokes access to it.
+func (cf *CryptFile) RemoveRecipient(kek []byte) error {
+	if err := cf.prepareRecipients(); err != nil {
+		return err
+	}
+	_, i, err := unwrapFileKey(cf.suite, cf.recipients, kek, cf.salt)
+	if err != nil {
+		return fmt.Errorf("%#v no recipient has that key: %w", cf.Path, err)
+	}
+	if i == cf.recipient {
+		return fmt.Errorf("%#v can't remove the recipient it was opened with", cf.Path)
+	}
+	recipients := append(append([][]byte(nil), cf.recipients[:i]...), cf.recipients[i+1:]...)
+	recipient := cf.recipient
+	if i < recipient {
+		recipient--
+	}
+	if err = cf.setRecipients(recipients); err != nil {
+		return err
+	}
+	cf.recipient = recipient
+	return nil
+}
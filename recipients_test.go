@@ -0,0 +1,141 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestCryptFileRecipients(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	keyA := []byte("0123456789abcdef0123456789abcdeA")
+	keyB := []byte("0123456789abcdef0123456789abcdeB")
+	keyC := []byte("0123456789abcdef0123456789abcdeC")
+	in := make([]byte, 10000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFileWithOptions(tmp, keyA, int64(len(in)), &CryptFileOptions{BlockKeys: true})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddRecipient(keyB); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddRecipient(keyB); err != nil {
+		t.Errorf("adding the same recipient again gave %v", err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	read := func(key []byte) ([]byte, error) {
+		cf := NewCryptFile(tmp, key, 0)
+		defer cf.Close()
+		return ioutil.ReadAll(cf)
+	}
+	for _, key := range [][]byte{keyA, keyB} {
+		out, err := read(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%s: output does not match input", key)
+		}
+	}
+	if _, err := read(keyC); err != KeyError {
+		t.Errorf("expected KeyError for a key that isn't a recipient, got %v", err)
+	}
+	// Writing as B is readable by A.
+	cf = NewCryptFile(tmp, keyB, 0)
+	if _, err := cf.Seek(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Verify(); err != nil {
+		t.Errorf("Verify gave %v", err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	in = append(in, "more"...)
+	if out, err := read(keyA); err != nil || !bytes.Equal(out, in) {
+		t.Errorf("reading as A after writing as B gave %v", err)
+	}
+	// Rekeying as B leaves A alone.
+	keyB2 := []byte("0123456789abcdef0123456789abcdeb")
+	if err := cf.Rekey(keyB2); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	for _, key := range [][]byte{keyA, keyB2} {
+		if out, err := read(key); err != nil || !bytes.Equal(out, in) {
+			t.Errorf("%s: reading after rekeying B gave %v", key, err)
+		}
+	}
+	if _, err := read(keyB); err != KeyError {
+		t.Errorf("expected KeyError for B's old key, got %v", err)
+	}
+	cf = NewCryptFile(tmp, keyA, 0)
+	if err := cf.RemoveRecipient(keyC); !errors.Is(err, KeyError) {
+		t.Errorf("expected KeyError removing a key that isn't a recipient, got %v", err)
+	}
+	if err := cf.RemoveRecipient(keyA); err == nil {
+		t.Errorf("expected err removing the key the file was opened with")
+	}
+	if err := cf.RemoveRecipient(keyB2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(keyB2); err != KeyError {
+		t.Errorf("expected KeyError for a removed recipient, got %v", err)
+	}
+	if out, err := read(keyA); err != nil || !bytes.Equal(out, in) {
+		t.Errorf("reading as A after removing B gave %v", err)
+	}
+}
+
+func TestCryptFileRecipientsErrors(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	other := []byte("0123456789abcdef0123456789abcdeX")
+	cf := NewCryptFile(path.Join(tmpdir, "plain"), key, 0)
+	defer cf.Close()
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddRecipient(other); err == nil {
+		t.Errorf("expected err adding a recipient without a file key")
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(path.Join(tmpdir, "small"), key, 0, &CryptFileOptions{BlockKeys: true})
+	defer cf.Close()
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.AddRecipient(other[:16]); err == nil {
+		t.Errorf("expected err adding a 16 byte key")
+	}
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = cf.AddRecipient(append(other[:31:31], byte(i)))
+	}
+	if err == nil {
+		t.Errorf("expected err adding recipients until the header is full")
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := cf.Size(); size != 12 || err != nil {
+		t.Errorf("Size after filling the header gave %d %v", size, err)
+	}
+}
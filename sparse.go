@@ -0,0 +1,194 @@
+package brimcrypt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A sparse file keeps a block map from each block number to the slot on disk
+// holding that block, stored as block number + 1 so that 0 can mean the block
+// is all zeros and takes no slot at all. The map itself is written whenever
+// the header is, never over the map the header points to. Slots that nothing
+// used as of the last header written, such as those of an earlier map, are
+// free: a block first written takes the first free slot, and the map the
+// first run of them long enough, and otherwise fresh slots after the rest
+// are handed out in order. Slots freed since the last header written aren't
+// reused until the next, so the header on disk always describes the file.
+
+// isZero returns true if every byte of b is 0.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupSlot returns the slot holding the block, with zero set if the block
+// is all zeros and has no slot, or io.EOF if the block map doesn't reach it.
+func (cf *CryptFile) lookupSlot(blockNumber int64) (slot int64, zero bool, err error) {
+	if !cf.sparseFile {
+		return blockNumber, false, nil
+	}
+	if blockNumber >= int64(len(cf.blockMap)) {
+		return 0, false, io.EOF
+	}
+	if cf.blockMap[blockNumber] == 0 {
+		return 0, true, nil
+	}
+	return cf.blockMap[blockNumber] - 1, false, nil
+}
+
+// slotFor returns the slot to write the block to, handing out a free or fresh
+// one if the block doesn't have one yet.
+func (cf *CryptFile) slotFor(blockNumber int64) int64 {
+	if !cf.sparseFile {
+		return blockNumber
+	}
+	cf.growBlockMap(blockNumber)
+	if cf.blockMap[blockNumber] == 0 {
+		if len(cf.freeSlots) > 0 {
+			cf.blockMap[blockNumber] = cf.freeSlots[0] + 1
+			cf.freeSlots = cf.freeSlots[1:]
+		} else {
+			cf.blockMap[blockNumber] = cf.nextSlot + 1
+			cf.nextSlot++
+		}
+		cf.blockMapDirty = true
+		cf.headerDirty = true
+	}
+	return cf.blockMap[blockNumber] - 1
+}
+
+// setZero records the block as all zeros, leaving any slot it had unused.
+func (cf *CryptFile) setZero(blockNumber int64) {
+	cf.growBlockMap(blockNumber)
+	if cf.blockMap[blockNumber] != 0 {
+		cf.blockMap[blockNumber] = 0
+		cf.blockMapDirty = true
+		cf.headerDirty = true
+	}
+}
+
+// growBlockMap extends the block map to cover the block; any blocks skipped
+// over are all zeros.
+func (cf *CryptFile) growBlockMap(blockNumber int64) {
+	if blockNumber < int64(len(cf.blockMap)) {
+		return
+	}
+	cf.blockMap = append(cf.blockMap, make([]int64, blockNumber+1-int64(len(cf.blockMap)))...)
+	cf.blockMapDirty = true
+	cf.headerDirty = true
+}
+
+// blockMapBlocks returns the number of slots the block map takes.
+func (cf *CryptFile) blockMapBlocks() int64 {
+	perBlock := cf.plainBlockSize / 8
+	return (int64(len(cf.blockMap)) + perBlock - 1) / perBlock
+}
+
+// findFreeSlots records in freeSlots, in order, the slots below nextSlot that
+// neither a block nor the block map uses; it must only be called just after
+// the header is read or written, so that none is one the header on disk still
+// refers to.
+func (cf *CryptFile) findFreeSlots() {
+	used := make([]bool, cf.nextSlot)
+	for _, entry := range cf.blockMap {
+		if entry != 0 && entry-1 < cf.nextSlot {
+			used[entry-1] = true
+		}
+	}
+	for slot := cf.blockMapSlot; slot < cf.blockMapSlot+cf.blockMapBlocks() && slot < cf.nextSlot; slot++ {
+		used[slot] = true
+	}
+	cf.freeSlots = cf.freeSlots[:0]
+	for slot, u := range used {
+		if !u {
+			cf.freeSlots = append(cf.freeSlots, int64(slot))
+		}
+	}
+}
+
+// freeRun returns the first slot of the first run of count free slots, or
+// nextSlot if there is no such run.
+func (cf *CryptFile) freeRun(count int64) int64 {
+	var run int64
+	for i, slot := range cf.freeSlots {
+		if i > 0 && slot != cf.freeSlots[i-1]+1 {
+			run = 0
+		}
+		run++
+		if run == count {
+			return slot + 1 - count
+		}
+	}
+	return cf.nextSlot
+}
+
+// writeBlockMap writes the block map out to free or fresh slots, recording
+// where in blockMapSlot.
+func (cf *CryptFile) writeBlockMap() error {
+	if err := cf.flushQueue(); err != nil {
+		return err
+	}
+	cf.blockMapSlot = cf.freeRun(cf.blockMapBlocks())
+	// The slots may be taken now, until the header is written.
+	cf.freeSlots = cf.freeSlots[:0]
+	slot := cf.blockMapSlot
+	dec := make([]byte, cf.plainBlockSize)
+	for i := 0; i < len(cf.blockMap); {
+		for j := range dec {
+			dec[j] = 0
+		}
+		for j := 0; j+8 <= len(dec) && i < len(cf.blockMap); j += 8 {
+			binary.BigEndian.PutUint64(dec[j:j+8], uint64(cf.blockMap[i]))
+			i++
+		}
+		enc, err := cf.suite.encryptTo(nil, cf.random(), dec, cf.blockKey(slot), cf.blockAD(slot))
+		if err != nil {
+			cf.fail()
+			return fmt.Errorf("%#v encrypting block map: %w", cf.Path, err)
+		}
+		if err = cf.writeBlock(slot, enc); err != nil {
+			return err
+		}
+		slot++
+	}
+	if slot > cf.nextSlot {
+		cf.nextSlot = slot
+	}
+	cf.blockMapDirty = false
+	return nil
+}
+
+// readBlockMap reads the block map of entries entries from the slots starting
+// at slot.
+func (cf *CryptFile) readBlockMap(slot int64, entries int64) error {
+	perBlock := cf.plainBlockSize / 8
+	if entries < 0 || slot < 0 || slot+(entries+perBlock-1)/perBlock > cf.blocks {
+		return fmt.Errorf("%#v block map out of range", cf.Path)
+	}
+	cf.blockMap = make([]int64, entries)
+	enc := make([]byte, cf.blockSize)
+	for i := int64(0); i < entries; slot++ {
+		n, err := cf.file.ReadAt(enc, cf.blockSize+slot*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+			return fmt.Errorf("%#v reading block map: %w", cf.Path, err)
+		}
+		dec, err := cf.suite.decrypt(enc, cf.blockKey(slot), cf.blockAD(slot))
+		if err != nil {
+			cf.countAuth(err, slot, cf.blockSize+slot*cf.blockSize)
+			return err
+		}
+		for j := 0; j+8 <= len(dec) && i < entries; j += 8 {
+			cf.blockMap[i] = int64(binary.BigEndian.Uint64(dec[j : j+8]))
+			if cf.blockMap[i] < 0 || cf.blockMap[i] > cf.blocks {
+				return fmt.Errorf("%#v block map entry %d out of range", cf.Path, i)
+			}
+			i++
+		}
+	}
+	return nil
+}
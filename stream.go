@@ -0,0 +1,269 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// An encrypted stream starts with a plaintext header of the magic
+// "CRYPTSTREAM1" followed by the block size as a uint32 and a random nonce
+// for the stream. After that come the encrypted blocks, each exactly the
+// block size and authenticated along with the header and its index in the
+// stream, so a block can't be dropped, reordered, or taken from another
+// stream. Each decrypted block starts with a uint32 of how many of the
+// following bytes are data, the rest being random padding; the high bit of
+// that uint32 marks the final block, the only way a stream may end.
+const (
+	streamHeaderSize = 32
+	streamNonceSize  = 16
+	streamLengthSize = 4
+	streamFinalFlag  = 1 << 31
+	// maxStreamBlockSize is the largest block size a stream may have, so a
+	// crafted header can't make the reader allocate a huge block.
+	maxStreamBlockSize = 1 << 24
+)
+
+// streamAD returns the additional data authenticated with the block at the
+// index of the stream with the header.
+func streamAD(header []byte, index uint64) []byte {
+	ad := make([]byte, streamHeaderSize+8)
+	copy(ad, header)
+	binary.BigEndian.PutUint64(ad[streamHeaderSize:], index)
+	return ad
+}
+
+type encryptWriter struct {
+	w          io.Writer
+	key        []byte
+	blockSize  int64
+	plainBlock []byte
+	enc        []byte
+	index      int
+	header     []byte
+	blocks     uint64
+	err        error
+}
+
+// NewEncryptWriter returns an io.WriteCloser that encrypts everything written
+// to it, in blocks of the size given, to w. The block size must be a multiple
+// of the AES block size, at least 128, and at most 16 MiB; an invalid block
+// size will be reported by the first Write or Close. Close must be called to
+// write the final, padded block; it does not close w.
+func NewEncryptWriter(w io.Writer, key []byte, blockSize int64) io.WriteCloser {
+	ew := &encryptWriter{w: w, key: key, blockSize: blockSize}
+	if blockSize < minBlockSize || blockSize%aes.BlockSize != 0 || blockSize > maxStreamBlockSize {
+		ew.err = &BlockSizeError{BlockSize: blockSize, msg: fmt.Sprintf("invalid stream block size %d", blockSize)}
+		return ew
+	}
+	ew.plainBlock = make([]byte, blockSize-hmacSize-aes.BlockSize)
+	ew.index = streamLengthSize
+	return ew
+}
+
+func (ew *encryptWriter) Write(b []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n := 0
+	for len(b) > 0 {
+		// A full block is only flushed once more data arrives so that Close
+		// can still mark it as the final block.
+		if ew.index == len(ew.plainBlock) {
+			if err := ew.flush(false); err != nil {
+				return n, err
+			}
+		}
+		n2 := copy(ew.plainBlock[ew.index:], b)
+		ew.index += n2
+		n += n2
+		b = b[n2:]
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	if ew.err != nil {
+		return ew.err
+	}
+	if err := ew.flush(true); err != nil {
+		return err
+	}
+	ew.err = fmt.Errorf("encrypt writer closed")
+	return nil
+}
+
+func (ew *encryptWriter) flush(final bool) error {
+	if ew.header == nil {
+		header := make([]byte, streamHeaderSize)
+		copy(header, "CRYPTSTREAM1")
+		binary.BigEndian.PutUint32(header[12:], uint32(ew.blockSize))
+		if _, err := rand.Read(header[streamHeaderSize-streamNonceSize:]); err != nil {
+			ew.err = err
+			return err
+		}
+		if _, err := ew.w.Write(header); err != nil {
+			ew.err = err
+			return err
+		}
+		ew.header = header
+	}
+	length := uint32(ew.index - streamLengthSize)
+	if final {
+		length |= streamFinalFlag
+	}
+	binary.BigEndian.PutUint32(ew.plainBlock, length)
+	if _, err := rand.Read(ew.plainBlock[ew.index:]); err != nil {
+		ew.err = err
+		return err
+	}
+	enc, err := AES256CBCHMACSHA256.encryptTo(ew.enc, rand.Reader, ew.plainBlock, ew.key, streamAD(ew.header, ew.blocks))
+	if err != nil {
+		ew.err = err
+		return err
+	}
+	ew.enc = enc
+	if _, err = ew.w.Write(enc); err != nil {
+		ew.err = err
+		return err
+	}
+	ew.index = streamLengthSize
+	ew.blocks++
+	return nil
+}
+
+type decryptReader struct {
+	r      io.Reader
+	key    []byte
+	header []byte
+	blocks uint64
+	block  []byte
+	plain  []byte
+	final  bool
+	err    error
+}
+
+// NewDecryptReader returns an io.Reader of the plaintext of the encrypted
+// stream, as written by NewEncryptWriter, read from r. Each block is
+// authenticated before any of its plaintext is returned; the first block that
+// fails gives KeyError. A stream that ends before its final block gives
+// io.ErrUnexpectedEOF.
+func NewDecryptReader(r io.Reader, key []byte) io.Reader {
+	return &decryptReader{r: r, key: key}
+}
+
+func (dr *decryptReader) Read(b []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.final {
+			dr.err = io.EOF
+			continue
+		}
+		dr.err = dr.next()
+	}
+	n := copy(b, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) next() error {
+	if dr.block == nil {
+		header := make([]byte, streamHeaderSize)
+		if _, err := io.ReadFull(dr.r, header); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if string(header[:12]) != "CRYPTSTREAM1" {
+			return fmt.Errorf("not CRYPTSTREAM1 data")
+		}
+		blockSize := int64(binary.BigEndian.Uint32(header[12:]))
+		if blockSize < minBlockSize || blockSize%aes.BlockSize != 0 || blockSize > maxStreamBlockSize {
+			return &BlockSizeError{BlockSize: blockSize, msg: fmt.Sprintf("invalid stream block size %d", blockSize)}
+		}
+		dr.header = header
+		dr.block = make([]byte, blockSize)
+	}
+	if _, err := io.ReadFull(dr.r, dr.block); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	dec, err := decrypt0(dr.block, dr.key, streamAD(dr.header, dr.blocks))
+	if err != nil {
+		return err
+	}
+	dr.blocks++
+	length := binary.BigEndian.Uint32(dec)
+	dr.final = length&streamFinalFlag != 0
+	length &^= streamFinalFlag
+	if int(length) > len(dec)-streamLengthSize {
+		return fmt.Errorf("invalid stream block length %d", length)
+	}
+	dr.plain = dec[streamLengthSize : streamLengthSize+length]
+	return nil
+}
+
+// EncryptBytes returns plain encrypted into a self-contained byte slice, using
+// the same format as NewEncryptWriter with a block size picked for the length
+// of plain. The whole payload is held in memory, so this is meant for small
+// data such as configuration blobs; use NewEncryptWriter or a CryptFile for
+// anything large.
+func EncryptBytes(plain []byte, key []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	ew := NewEncryptWriter(&buf, key, blockSizeForSize(int64(len(plain)), AES256CBCHMACSHA256.overhead()))
+	if _, err := ew.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := ew.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecryptBytes returns the plaintext of enc as given by EncryptBytes. As with
+// EncryptBytes, the whole payload is held in memory.
+func DecryptBytes(enc []byte, key []byte) ([]byte, error) {
+	plain, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(enc), key))
+	if err != nil {
+		return nil, err
+	}
+	return plain, nil
+}
+
+type pipeWriter struct {
+	ew io.WriteCloser
+	pw *io.PipeWriter
+}
+
+// EncryptPipe returns a writer for plaintext and a reader of the encrypted
+// stream of it, as from NewEncryptWriter with the block size given, for
+// handing to something that wants an io.Reader, such as an uploader, while
+// the plaintext is still being produced. The two are joined by an io.Pipe, so
+// each Write blocks until the reader has taken the blocks it completes, and
+// the reader and writer need to be used from different goroutines. Closing
+// the writer writes the final, padded block and then gives the reader
+// io.EOF; if that or an earlier Write failed, as with an invalid block size,
+// the reader gets the error instead.
+func EncryptPipe(key []byte, blockSize int64) (io.WriteCloser, io.Reader) {
+	pr, pw := io.Pipe()
+	return &pipeWriter{ew: NewEncryptWriter(pw, key, blockSize), pw: pw}, pr
+}
+
+func (pw *pipeWriter) Write(b []byte) (int, error) {
+	return pw.ew.Write(b)
+}
+
+func (pw *pipeWriter) Close() error {
+	err := pw.ew.Close()
+	pw.pw.CloseWithError(err)
+	return err
+}
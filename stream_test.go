@@ -0,0 +1,237 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptWriter(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	var buf bytes.Buffer
+	ew := NewEncryptWriter(&buf, key, 128)
+	if _, err := ew.Write(in[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ew.Write(in[10:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ew.Write(in); err == nil {
+		t.Errorf("expected err writing after Close")
+	}
+	out := buf.Bytes()
+	if string(out[:12]) != "CRYPTSTREAM1" || binary.BigEndian.Uint32(out[12:16]) != 128 {
+		t.Fatalf("bad stream header %x", out[:streamHeaderSize])
+	}
+	header := out[:streamHeaderSize]
+	out = out[streamHeaderSize:]
+	perBlock := 128 - hmacSize - 16 - streamLengthSize
+	blocks := (len(in) + perBlock - 1) / perBlock
+	if len(out) != blocks*128 {
+		t.Fatalf("stream length %d != %d", len(out), blocks*128)
+	}
+	var plain []byte
+	for i := 0; i < blocks; i++ {
+		dec, err := decrypt0(out[i*128:(i+1)*128], key, streamAD(header, uint64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		length := binary.BigEndian.Uint32(dec)
+		if final := length&streamFinalFlag != 0; final != (i == blocks-1) {
+			t.Errorf("block %d final flag %v", i, final)
+		}
+		length &^= streamFinalFlag
+		plain = append(plain, dec[streamLengthSize:streamLengthSize+length]...)
+	}
+	if !bytes.Equal(plain, in) {
+		t.Errorf("decrypted stream does not match input")
+	}
+
+	buf.Reset()
+	ew = NewEncryptWriter(&buf, key, 128)
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != streamHeaderSize+128 {
+		t.Errorf("empty stream length %d != %d", buf.Len(), streamHeaderSize+128)
+	}
+
+	for _, blockSize := range []int64{0, 100, 129} {
+		if _, err := NewEncryptWriter(&buf, key, blockSize).Write(in); err == nil {
+			t.Errorf("expected err with block size %d", blockSize)
+		}
+	}
+}
+
+func TestDecryptReader(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 1000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for _, size := range []int{0, 1, 75, 76, 77, 152, 1000} {
+		pr, pw := io.Pipe()
+		go func() {
+			ew := NewEncryptWriter(pw, key, 128)
+			if _, err := ew.Write(in[:size]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			pw.CloseWithError(ew.Close())
+		}()
+		out, err := ioutil.ReadAll(NewDecryptReader(pr, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, in[:size]) {
+			t.Errorf("%d: output does not match input", size)
+		}
+	}
+
+	var buf bytes.Buffer
+	ew := NewEncryptWriter(&buf, key, 128)
+	if _, err := ew.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+
+	tampered := append([]byte(nil), enc...)
+	tampered[streamHeaderSize+2*128+100] ^= 1
+	out, err := ioutil.ReadAll(NewDecryptReader(bytes.NewReader(tampered), key))
+	if err != KeyError {
+		t.Errorf("expected KeyError with tampered block; got %v", err)
+	}
+	if !bytes.Equal(out, in[:2*76]) {
+		t.Errorf("expected only the %d bytes before the tampered block; got %d", 2*76, len(out))
+	}
+
+	if _, err = ioutil.ReadAll(NewDecryptReader(bytes.NewReader(enc), []byte("fedcba9876543210fedcba9876543210"))); err != KeyError {
+		t.Errorf("expected KeyError with wrong key; got %v", err)
+	}
+	if _, err = ioutil.ReadAll(NewDecryptReader(bytes.NewReader(enc[:len(enc)-128]), key)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF with missing final block; got %v", err)
+	}
+	if _, err = ioutil.ReadAll(NewDecryptReader(bytes.NewReader(enc[:len(enc)-1]), key)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF with partial final block; got %v", err)
+	}
+	if _, err = ioutil.ReadAll(NewDecryptReader(bytes.NewReader([]byte("not an encrypted stream")), key)); err == nil {
+		t.Errorf("expected err with bad header")
+	}
+
+	// Blocks are bound to their place in their own stream.
+	block := func(enc []byte, i int) []byte {
+		return enc[streamHeaderSize+i*128 : streamHeaderSize+(i+1)*128]
+	}
+	var otherBuf bytes.Buffer
+	ew = NewEncryptWriter(&otherBuf, key, 128)
+	if _, err = ew.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err = ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	other := otherBuf.Bytes()
+	dropped := append(append([]byte(nil), enc[:streamHeaderSize+2*128]...), enc[streamHeaderSize+3*128:]...)
+	reordered := append([]byte(nil), enc...)
+	copy(block(reordered, 2), block(enc, 3))
+	copy(block(reordered, 3), block(enc, 2))
+	spliced := append([]byte(nil), enc...)
+	copy(block(spliced, 2), block(other, 2))
+	for name, bad := range map[string][]byte{"dropped": dropped, "reordered": reordered, "spliced": spliced} {
+		out, err = ioutil.ReadAll(NewDecryptReader(bytes.NewReader(bad), key))
+		if err != KeyError {
+			t.Errorf("expected KeyError with %s block; got %v", name, err)
+		}
+		if !bytes.Equal(out, in[:2*76]) {
+			t.Errorf("expected only the %d bytes before the %s block; got %d", 2*76, name, len(out))
+		}
+	}
+	// A header can't ask for a huge block.
+	huge := append([]byte(nil), enc[:streamHeaderSize]...)
+	binary.BigEndian.PutUint32(huge[12:], 1<<31)
+	var bse *BlockSizeError
+	if _, err = ioutil.ReadAll(NewDecryptReader(bytes.NewReader(huge), key)); !errors.As(err, &bse) {
+		t.Errorf("expected a BlockSizeError with a huge block size; got %v", err)
+	}
+	if _, err = NewEncryptWriter(&buf, key, maxStreamBlockSize+16).Write(in); !errors.As(err, &bse) {
+		t.Errorf("expected a BlockSizeError writing with a huge block size; got %v", err)
+	}
+}
+
+func TestEncryptBytes(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, plain := range [][]byte{nil, []byte("x"), []byte(`{"config": "blob"}`), make([]byte, 100000)} {
+		enc, err := EncryptBytes(plain, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plain) > 8 && bytes.Contains(enc, plain) {
+			t.Errorf("encrypted bytes contain the plaintext")
+		}
+		dec, err := DecryptBytes(enc, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec, plain) {
+			t.Errorf("%d: decrypted bytes do not match", len(plain))
+		}
+		if _, err = DecryptBytes(enc, []byte("fedcba9876543210fedcba9876543210")); err != KeyError {
+			t.Errorf("expected KeyError with wrong key; got %v", err)
+		}
+	}
+}
+
+func TestEncryptPipe(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 10000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	w, r := EncryptPipe(key, 256)
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := io.Copy(w, bytes.NewReader(in)); err != nil {
+			errs <- err
+			return
+		}
+		errs <- w.Close()
+	}()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(NewDecryptReader(&buf, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("decrypted stream does not match input")
+	}
+
+	w, r = EncryptPipe(key, 100)
+	go func() {
+		w.Write(in)
+		w.Close()
+	}()
+	if _, err = ioutil.ReadAll(r); err == nil {
+		t.Errorf("expected an error for an invalid block size")
+	} else if _, ok := err.(*BlockSizeError); !ok {
+		t.Errorf("expected a *BlockSizeError; got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package brimcrypt
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EncryptTar writes a tar archive of the files given to a new CryptFile at
+// dstPath using the key given, so the plaintext archive never touches the
+// disk. Each file is added under its path, with any leading separators and
+// volume name removed; a directory is added as just an entry for itself,
+// without its contents, and a symbolic link as the link itself. Reading the
+// CryptFile, or decrypting it with DecryptToFile, gives a normal tar stream
+// for archive/tar. As with CopyFile, the output is written to a temporary
+// file and renamed into place once complete.
+func EncryptTar(dstPath string, key []byte, files []string) error {
+	var estimatedSize int64
+	for _, f := range files {
+		if finfo, err := os.Lstat(f); err == nil && finfo.Mode().IsRegular() {
+			estimatedSize += finfo.Size()
+		}
+	}
+	tmp, err := tempPath(dstPath)
+	if err != nil {
+		return err
+	}
+	cf := NewCryptFile(tmp, key, estimatedSize)
+	if err = writeTar(cf, files); err != nil {
+		cf.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = cf.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, dstPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeTar writes a tar archive of the files to w.
+func writeTar(w io.Writer, files []string) error {
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		if err := writeTarEntry(tw, f); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, pth string) error {
+	finfo, err := os.Lstat(pth)
+	if err != nil {
+		return err
+	}
+	var link string
+	if finfo.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(pth); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(finfo, link)
+	if err != nil {
+		return err
+	}
+	name := filepath.ToSlash(strings.TrimPrefix(filepath.Clean(pth), filepath.VolumeName(pth)))
+	name = strings.TrimLeft(name, "/")
+	if finfo.IsDir() {
+		name += "/"
+	}
+	hdr.Name = name
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !finfo.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
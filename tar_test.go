@@ -0,0 +1,78 @@
+package brimcrypt
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptTar(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	src := filepath.Join(tmpdir, "src")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{
+		"a": []byte("first file"),
+		"b": bytes.Repeat([]byte("0123456789"), 1000),
+	}
+	var files []string
+	for _, name := range []string{"a", "b"} {
+		pth := filepath.Join(src, name)
+		if err := ioutil.WriteFile(pth, contents[name], 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, pth)
+	}
+	dst := filepath.Join(tmpdir, "backup.tar.crypt")
+	if err := EncryptTar(dst, key, files); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, contents["a"]) {
+		t.Fatal("encrypted archive contains the plaintext")
+	}
+	cf := NewCryptFile(dst, key, 0)
+	defer cf.Close()
+	tr := tar.NewReader(cf)
+	for _, pth := range files {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(pth)
+		want := strings.TrimLeft(filepath.ToSlash(strings.TrimPrefix(pth, filepath.VolumeName(pth))), "/")
+		if hdr.Name != want {
+			t.Errorf("entry name %q != %q", hdr.Name, want)
+		}
+		if hdr.Size != int64(len(contents[name])) || hdr.Mode&0777 != 0600 {
+			t.Errorf("%s: entry size %d mode %o", name, hdr.Size, hdr.Mode)
+		}
+		out, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, contents[name]) {
+			t.Errorf("%s: entry does not match the file", name)
+		}
+	}
+	if _, err = tr.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF after the last entry; got %v", err)
+	}
+	if err = EncryptTar(filepath.Join(tmpdir, "bad"), key, []string{filepath.Join(src, "missing")}); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error; got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(tmpdir, "bad")); !os.IsNotExist(err) {
+		t.Errorf("expected no archive after failing; got %v", err)
+	}
+}
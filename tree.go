@@ -0,0 +1,142 @@
+package brimcrypt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TreeOptions are the options for EncryptTreeWithOptions and
+// DecryptTreeWithOptions.
+type TreeOptions struct {
+	// FailFast stops at the first file or directory that can't be handled,
+	// rather than carrying on with the rest of the tree.
+	FailFast bool
+	// Progress, if not nil, is told of the bytes of plaintext handled so far
+	// across the whole tree, out of the total of the files found by a first
+	// walk of the tree before any are handled.
+	Progress ProgressFunc
+}
+
+// EncryptTree mirrors the directory tree at srcDir under dstDir, encrypting
+// each regular file with the key given into a CryptFile of the same relative
+// path, as EncryptFromFile does. Anything else, such as symlinks, is skipped.
+// Files and directories that can't be handled are reported in a *TreeError
+// once the rest of the tree has been done. If dstDir is within srcDir, it is
+// left out of the walk.
+func EncryptTree(srcDir string, dstDir string, key []byte) error {
+	return EncryptTreeWithOptions(srcDir, dstDir, key, nil)
+}
+
+// EncryptTreeWithOptions is EncryptTree with opts, which may be nil.
+func EncryptTreeWithOptions(srcDir string, dstDir string, key []byte, opts *TreeOptions) error {
+	size := func(src string, finfo os.FileInfo) int64 {
+		return finfo.Size()
+	}
+	return walkTree(srcDir, dstDir, "encrypting", opts, size, func(src string, dst string, progress ProgressFunc) error {
+		return EncryptFromFileWithOptions(src, key, dst, 0, &CopyOptions{Progress: progress})
+	})
+}
+
+// DecryptTree is the reverse of EncryptTree, mirroring the tree of CryptFiles
+// at srcDir under dstDir as plaintext files, as DecryptToFile does. Files that
+// can't be decrypted, such as those with the wrong key or that fail
+// authentication, are reported in a *TreeError with their paths once the rest
+// of the tree has been done.
+func DecryptTree(srcDir string, dstDir string, key []byte) error {
+	return DecryptTreeWithOptions(srcDir, dstDir, key, nil)
+}
+
+// DecryptTreeWithOptions is DecryptTree with opts, which may be nil.
+func DecryptTreeWithOptions(srcDir string, dstDir string, key []byte, opts *TreeOptions) error {
+	size := func(src string, finfo os.FileInfo) int64 {
+		if info, err := ReadHeader(src, key); err == nil {
+			return info.Size
+		}
+		return 0
+	}
+	return walkTree(srcDir, dstDir, "decrypting", opts, size, func(src string, dst string, progress ProgressFunc) error {
+		return DecryptToFileWithOptions(src, key, dst, &CopyOptions{Progress: progress})
+	})
+}
+
+// walkTree calls fn for each regular file under srcDir with the matching path
+// under dstDir, recreating the directories as it goes and collecting any
+// errors into a *TreeError. With opts.Progress, the total is found first from
+// the size of each regular file, and fn is given a ProgressFunc for the file
+// that reports to opts.Progress for the whole tree; otherwise fn is given nil.
+func walkTree(srcDir string, dstDir string, verb string, opts *TreeOptions, size func(src string, finfo os.FileInfo) int64, fn func(src string, dst string, progress ProgressFunc) error) error {
+	if opts == nil {
+		opts = &TreeOptions{}
+	}
+	srcDir = filepath.Clean(srcDir)
+	dstDir = filepath.Clean(dstDir)
+	var prog *progress
+	if opts.Progress != nil {
+		var total int64
+		filepath.Walk(srcDir, func(pth string, finfo os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if pth == dstDir {
+				return filepath.SkipDir
+			}
+			if finfo.Mode().IsRegular() {
+				total += size(pth, finfo)
+			}
+			return nil
+		})
+		prog = &progress{fn: opts.Progress, total: total}
+	}
+	var errs []error
+	fail := func(pth string, err error) error {
+		err = fmt.Errorf("%s %#v: %w", verb, pth, err)
+		errs = append(errs, err)
+		if opts.FailFast {
+			return err
+		}
+		return nil
+	}
+	filepath.Walk(srcDir, func(pth string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return fail(pth, err)
+		}
+		if pth == dstDir {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(srcDir, pth)
+		if err != nil {
+			return fail(pth, err)
+		}
+		dst := filepath.Join(dstDir, rel)
+		switch {
+		case finfo.IsDir():
+			if err = os.MkdirAll(dst, 0700); err != nil {
+				if err = fail(pth, err); err == nil {
+					err = filepath.SkipDir
+				}
+				return err
+			}
+		case finfo.Mode().IsRegular():
+			var fileProgress ProgressFunc
+			var fileDone int64
+			if prog != nil {
+				fileProgress = func(bytesDone, bytesTotal int64) {
+					prog.add(bytesDone - fileDone)
+					fileDone = bytesDone
+				}
+			}
+			if err = fn(pth, dst, fileProgress); err != nil {
+				return fail(pth, err)
+			}
+		}
+		return nil
+	})
+	if len(errs) > 0 {
+		return &TreeError{Errors: errs}
+	}
+	if prog != nil {
+		prog.finish()
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptTree(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	src := filepath.Join(tmpdir, "src")
+	files := map[string][]byte{
+		"a":             []byte("first file"),
+		"empty":         {},
+		"sub/b":         bytes.Repeat([]byte("0123456789"), 1000),
+		"sub/deeper/c":  []byte("third file"),
+		"conflict/file": []byte("can't be written over a directory"),
+	}
+	for name, data := range files {
+		pth := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(src, "emptydir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(tmpdir, "dst")
+	// A non-empty directory in the way of one file should be reported without
+	// stopping the rest of the tree.
+	if err := os.MkdirAll(filepath.Join(dst, "conflict", "file", "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	err := EncryptTree(src, dst, key)
+	var terr *TreeError
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected a *TreeError, got %v", err)
+	}
+	if len(terr.Errors) != 1 {
+		t.Errorf("expected 1 error, got %v", terr.Errors)
+	}
+	delete(files, "conflict/file")
+	for name, data := range files {
+		pth := filepath.Join(dst, filepath.FromSlash(name))
+		cf := NewCryptFileWithOptions(pth, key, 0, &CryptFileOptions{ReadOnly: true})
+		out, err := ioutil.ReadAll(cf)
+		cf.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: decrypted contents do not match", name)
+		}
+	}
+	finfo, err := os.Stat(filepath.Join(dst, "empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Size() == 0 {
+		t.Error("empty file was left zero length")
+	}
+	if finfo, err = os.Stat(filepath.Join(dst, "emptydir")); err != nil || !finfo.IsDir() {
+		t.Errorf("expected emptydir to be recreated: %v", err)
+	}
+	// The destination within the source is left out of the walk.
+	if err = EncryptTree(tmpdir, filepath.Join(tmpdir, "dst2"), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(tmpdir, "dst2", "dst2")); !os.IsNotExist(err) {
+		t.Errorf("expected the destination to be skipped, got %v", err)
+	}
+}
+
+func TestDecryptTree(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	plain := filepath.Join(tmpdir, "plain")
+	files := map[string][]byte{
+		"a":            []byte("first file"),
+		"empty":        {},
+		"sub/b":        bytes.Repeat([]byte("0123456789"), 1000),
+		"sub/deeper/c": []byte("third file"),
+		"corrupt":      []byte("this one gets damaged"),
+	}
+	for name, data := range files {
+		pth := filepath.Join(plain, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crypt := filepath.Join(tmpdir, "crypt")
+	if err := EncryptTree(plain, crypt, key); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(crypt, "corrupt")
+	b, err := ioutil.ReadFile(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 1
+	if err = ioutil.WriteFile(corrupt, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmpdir, "out")
+	err = DecryptTree(crypt, out, key)
+	var terr *TreeError
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected a *TreeError, got %v", err)
+	}
+	if len(terr.Errors) != 1 || !strings.Contains(terr.Errors[0].Error(), corrupt) {
+		t.Errorf("expected 1 error naming %s, got %v", corrupt, terr.Errors)
+	}
+	for name, data := range files {
+		b, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if name == "corrupt" {
+			if !os.IsNotExist(err) {
+				t.Errorf("expected no output for the corrupted file, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: decrypted contents do not match", name)
+		}
+	}
+	if err = DecryptTreeWithOptions(crypt, filepath.Join(tmpdir, "out2"), []byte("abcdef0123456789abcdef0123456789"), &TreeOptions{FailFast: true}); !errors.As(err, &terr) {
+		t.Fatalf("expected a *TreeError, got %v", err)
+	}
+	if len(terr.Errors) != 1 || !errors.Is(terr.Errors[0], KeyError) {
+		t.Errorf("expected to stop at the first KeyError, got %v", terr.Errors)
+	}
+}
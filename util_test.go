@@ -9,7 +9,7 @@ import (
 	"testing"
 )
 
-func EmptyTestDir(t *testing.T) string {
+func EmptyTestDir(t testing.TB) string {
 	tmp, err := ioutil.TempDir("", "go-test")
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,132 @@
+package brimcrypt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A versioned file records a version number in its encrypted header that goes
+// up by one each time the header is written, and each data block is
+// authenticated along with the version the header had when the block was
+// last written, kept in a table of a uint64 per block. The table is written
+// in the slots just after the data blocks, and after any Merkle tree,
+// whenever the header is, authenticated along with the header's version. So
+// an older copy of the whole file has an older version in its header, which
+// the CryptFile can refuse, and an older copy of any one block, or of the
+// table, fails authentication against the newer header.
+
+// versionAD returns the additional data ad with the version appended.
+func versionAD(ad []byte, version uint64) []byte {
+	ad = append(ad[:len(ad):len(ad)], make([]byte, 8)...)
+	binary.BigEndian.PutUint64(ad[len(ad)-8:], version)
+	return ad
+}
+
+// versionsSlot returns the slot where the table of block versions starts.
+func (cf *CryptFile) versionsSlot() int64 {
+	slot := cf.blocks
+	if cf.merkleFile {
+		slot += merkleBlocks(cf.blocks, cf.plainBlockSize)
+	}
+	return slot
+}
+
+// setBlockVersion records that the block in the slot is about to be written,
+// and so will be authenticated along with the version of the next header.
+func (cf *CryptFile) setBlockVersion(slot int64) {
+	for int64(len(cf.blockVersions)) <= slot {
+		cf.blockVersions = append(cf.blockVersions, 0)
+	}
+	cf.blockVersions[slot] = cf.version + 1
+	cf.headerDirty = true
+}
+
+// writeVersions moves on to the next version and writes the table of block
+// versions for it, for the header about to be written.
+func (cf *CryptFile) writeVersions() error {
+	cf.version++
+	perBlock := int(cf.plainBlockSize / 8)
+	dec := make([]byte, cf.plainBlockSize)
+	versions := cf.blockVersions
+	for slot := cf.versionsSlot(); len(versions) > 0; slot++ {
+		for i := range dec {
+			dec[i] = 0
+		}
+		for i := 0; i < perBlock && len(versions) > 0; i++ {
+			binary.BigEndian.PutUint64(dec[i*8:], versions[0])
+			versions = versions[1:]
+		}
+		enc, err := cf.suite.encryptTo(nil, cf.random(), dec, cf.blockKey(slot), cf.blockAD(slot))
+		if err != nil {
+			cf.fail()
+			return fmt.Errorf("%#v encrypting block versions: %w", cf.Path, err)
+		}
+		n, err := cf.file.WriteAt(enc, cf.blockSize+slot*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && n != len(enc))) {
+			if err != io.EOF {
+				cf.unknownState = true
+				cf.file.Close()
+				cf.file = nil
+			}
+			return fmt.Errorf("%#v writing block versions: %w", cf.Path, err)
+		}
+	}
+	return nil
+}
+
+// readVersions reads the table of block versions for the header just read.
+func (cf *CryptFile) readVersions() error {
+	versions := make([]uint64, cf.blocks)
+	perBlock := cf.plainBlockSize / 8
+	enc := make([]byte, cf.blockSize)
+	for i, slot := int64(0), cf.versionsSlot(); i < cf.blocks; slot++ {
+		n, err := cf.file.ReadAt(enc, cf.blockSize+slot*cf.blockSize)
+		if err != nil && (err != io.EOF || (err == io.EOF && int64(n) != cf.blockSize)) {
+			return fmt.Errorf("%#v reading block versions: %w", cf.Path, err)
+		}
+		dec, err := cf.suite.decrypt(enc, cf.blockKey(slot), cf.blockAD(slot))
+		if err != nil {
+			cf.countAuth(err, slot, cf.blockSize+slot*cf.blockSize)
+			return fmt.Errorf("%#v block versions: %w", cf.Path, err)
+		}
+		for j := int64(0); j < perBlock && i < cf.blocks; j++ {
+			versions[i] = binary.BigEndian.Uint64(dec[j*8 : j*8+8])
+			if versions[i] > cf.version {
+				return fmt.Errorf("%#v block %d version %d is newer than the file's %d", cf.Path, i, versions[i], cf.version)
+			}
+			i++
+		}
+	}
+	cf.blockVersions = versions
+	return nil
+}
+
+// checkVersion returns a *RollbackError if the version of the file just opened
+// is older than MinVersion or than the CryptFile has seen before.
+func (cf *CryptFile) checkVersion() error {
+	min := cf.minVersion
+	if cf.seenVersion > min {
+		min = cf.seenVersion
+	}
+	if cf.version < min {
+		return &RollbackError{Path: cf.Path, Version: cf.version, MinVersion: min}
+	}
+	cf.seenVersion = cf.version
+	return nil
+}
+
+// Version returns the version of a file created with the Versioned option,
+// which goes up each time its header is written. Any pending writes are
+// flushed first, so it's the version on disk. Keeping it, and giving it as
+// the MinVersion for later opens, guards against the file being rolled back
+// to an older copy between uses of the CryptFile.
+func (cf *CryptFile) Version() (uint64, error) {
+	if err := cf.prepareFlushed(); err != nil {
+		return 0, err
+	}
+	if !cf.versionedFile {
+		return 0, fmt.Errorf("%#v has no version", cf.Path)
+	}
+	return cf.version, nil
+}
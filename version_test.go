@@ -0,0 +1,214 @@
+package brimcrypt
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCryptFileVersioned(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	in := make([]byte, 3000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	tmp := path.Join(tmpdir, "test")
+	cf := NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Versioned: true})
+	defer cf.Close()
+	if _, err := cf.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	v1, err := cf.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1 != 1 {
+		t.Errorf("expected version 1, got %d", v1)
+	}
+	info, err := ReadHeader(tmp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, pbs := info.BlockSize, info.PlainBlockSize
+	old, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Seek(pbs*5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := cf.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Errorf("version %d didn't go up from %d", v2, v1)
+	}
+	cf.Close()
+	copy(in[pbs*5:], "changed")
+	cur, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rolling back just the changed block fails authentication, even though
+	// it's the same block in the same place under the same key.
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(old[bs+5*bs:bs+6*bs], bs+5*bs); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	cf2 := NewCryptFile(tmp, key, 0)
+	defer cf2.Close()
+	if _, err = ioutil.ReadAll(cf2); !errors.Is(err, KeyError) {
+		t.Errorf("expected KeyError reading a rolled back block, got %v", err)
+	}
+	cf2.Close()
+	if err = ioutil.WriteFile(tmp, cur, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("output does not match input")
+	}
+	cf.Close()
+	// Rolling back the whole file to the older copy is refused by a
+	// CryptFile that has seen the newer version, or given it as MinVersion.
+	if err = ioutil.WriteFile(tmp, old, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(cf)
+	var rerr *RollbackError
+	if !errors.As(err, &rerr) || !errors.Is(err, ErrRollback) {
+		t.Fatalf("expected *RollbackError, got %v", err)
+	}
+	if rerr.Version != v1 || rerr.MinVersion != v2 {
+		t.Errorf("expected version %d older than %d, got %d older than %d", v1, v2, rerr.Version, rerr.MinVersion)
+	}
+	cf2 = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{MinVersion: v2})
+	if _, err = ioutil.ReadAll(cf2); !errors.Is(err, ErrRollback) {
+		t.Errorf("expected ErrRollback with MinVersion, got %v", err)
+	}
+	cf2.Close()
+	cf2 = NewCryptFile(tmp, key, 0)
+	if _, err = ioutil.ReadAll(cf2); err != nil {
+		t.Errorf("expected the older copy to open without MinVersion, got %v", err)
+	}
+	cf2.Close()
+	// The Rekey of a versioned file carries the versions over.
+	if err = ioutil.WriteFile(tmp, cur, 0600); err != nil {
+		t.Fatal(err)
+	}
+	newKey := []byte("0123456789abcdef0123456789abcdeX")
+	if err = cf.Rekey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	cf2 = NewCryptFileWithOptions(tmp, newKey, 0, &CryptFileOptions{MinVersion: v2})
+	if out, err = ioutil.ReadAll(cf2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("output after Rekey does not match input")
+	}
+	if err = cf2.Verify(); err != nil {
+		t.Errorf("Verify after Rekey gave %v", err)
+	}
+	cf2.Close()
+}
+
+func TestCryptFileVersionedOptions(t *testing.T) {
+	tmpdir := EmptyTestDir(t)
+	defer removeTestTree(tmpdir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	// A file that isn't versioned counts as version 0, so it can't stand in
+	// for a versioned one.
+	tmp := path.Join(tmpdir, "plain")
+	cf := NewCryptFile(tmp, key, 0)
+	defer cf.Close()
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	if _, err := cf.Version(); err == nil {
+		t.Errorf("expected err for the version of a file that isn't versioned")
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{MinVersion: 1})
+	if _, err := ioutil.ReadAll(cf); !errors.Is(err, ErrRollback) {
+		t.Errorf("expected ErrRollback for a file that isn't versioned, got %v", err)
+	}
+	cf.Close()
+	cf = NewCryptFileWithOptions(path.Join(tmpdir, "sparse"), key, 0, &CryptFileOptions{Versioned: true, Sparse: true})
+	if _, err := cf.Write([]byte("Hello World!")); err == nil {
+		t.Errorf("expected err for sparse and versioned")
+	}
+	cf.Close()
+	// A new file starts from MinVersion.
+	tmp = path.Join(tmpdir, "min")
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Versioned: true, MinVersion: 10})
+	if _, err := cf.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cf.Version(); v != 11 || err != nil {
+		t.Errorf("expected version 11, got %d %v", v, err)
+	}
+	cf.Close()
+	// Versioned files can have Merkle trees too, with the block versions
+	// after the tree.
+	tmp = path.Join(tmpdir, "merkle")
+	cf = NewCryptFileWithOptions(tmp, key, 0, &CryptFileOptions{Versioned: true, Merkle: true, BlockKeys: true})
+	in := make([]byte, 3000)
+	for i := range in {
+		in[i] = byte(i)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cf.Write(in[i*1000 : (i+1)*1000]); err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cf.Seek(0, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cf.VerifyRange(0, 3000); err != nil {
+		t.Errorf("VerifyRange gave %v", err)
+	}
+	if err := cf.Verify(); err != nil {
+		t.Errorf("Verify gave %v", err)
+	}
+	cf.Close()
+	cf = NewCryptFile(tmp, key, 0)
+	out, err := ioutil.ReadAll(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("output does not match input")
+	}
+	if v, err := cf.Version(); v != 3 || err != nil {
+		t.Errorf("expected version 3, got %d %v", v, err)
+	}
+	cf.Close()
+}